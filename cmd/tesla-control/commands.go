@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -49,6 +50,10 @@ type Argument struct {
 
 type Handler func(ctx context.Context, acct *account.Account, car *vehicle.Vehicle, args map[string]string) error
 
+// ConfigHandler is a Handler that also needs access to the client configuration, typically because
+// it updates locally stored keys or sessions.
+type ConfigHandler func(ctx context.Context, config *cli.Config, acct *account.Account, car *vehicle.Vehicle, args map[string]string) error
+
 type Command struct {
 	help             string
 	requiresAuth     bool // True if command requires client-to-vehicle authentication (private key)
@@ -56,6 +61,7 @@ type Command struct {
 	args             []Argument
 	optional         []Argument
 	handler          Handler
+	configHandler    ConfigHandler // Used instead of handler if set
 	domain           protocol.Domain
 }
 
@@ -132,6 +138,57 @@ func MinutesAfterMidnight(hoursAndMinutes string) (int32, error) {
 	return int32(60*hours + minutes), nil
 }
 
+const (
+	roleHelp       = "One of: owner, driver, fm (fleet manager), vehicle_monitor, charging_manager, guest"
+	formFactorHelp = "One of: nfc_card, ios_device, android_device, cloud_key"
+)
+
+var impermanentKeyArgs = []Argument{
+	{name: "PUBLIC_KEY", help: "file containing public key (or corresponding private key)"},
+	{name: "ROLE", help: roleHelp},
+	{name: "FORM_FACTOR", help: formFactorHelp},
+	{name: "DURATION", help: "Time until the key expires (e.g., 90m or 8h). Use 0 for a key that only expires when removed."},
+}
+
+// defaultPairingTimeout is how long the pair command waits for the user to approve the add-key
+// request if TIMEOUT isn't provided.
+const defaultPairingTimeout = 3 * time.Minute
+
+func addImpermanentKey(ctx context.Context, car *vehicle.Vehicle, args map[string]string, removeExisting bool) error {
+	role, formFactor, err := parseRoleAndFormFactor(args)
+	if err != nil {
+		return err
+	}
+	lifetime, err := time.ParseDuration(args["DURATION"])
+	if err != nil {
+		return fmt.Errorf("%w: invalid DURATION", ErrCommandLineArgs)
+	}
+	publicKey, err := protocol.LoadPublicKey(args["PUBLIC_KEY"])
+	if err != nil {
+		return fmt.Errorf("invalid public key: %s", err)
+	}
+	if removeExisting {
+		return car.AddImpermanentKeyAndRemoveExisting(ctx, publicKey, role, formFactor, lifetime)
+	}
+	return car.AddImpermanentKey(ctx, publicKey, role, formFactor, lifetime)
+}
+
+// parseRoleAndFormFactor parses the ROLE and FORM_FACTOR arguments of key-management commands.
+// FORM_FACTOR is optional.
+func parseRoleAndFormFactor(args map[string]string) (keys.Role, vcsec.KeyFormFactor, error) {
+	role, ok := keys.Role_value["ROLE_"+strings.ToUpper(args["ROLE"])]
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: invalid ROLE", ErrCommandLineArgs)
+	}
+	var formFactor int32
+	if name, ok := args["FORM_FACTOR"]; ok {
+		if formFactor, ok = vcsec.KeyFormFactor_value["KEY_FORM_FACTOR_"+strings.ToUpper(name)]; !ok {
+			return 0, 0, fmt.Errorf("%w: unrecognized FORM_FACTOR", ErrCommandLineArgs)
+		}
+	}
+	return keys.Role(role), vcsec.KeyFormFactor(formFactor), nil
+}
+
 // configureAndVerifyFlags verifies that c contains all the information required to execute a command.
 func configureFlags(c *cli.Config, commandName string, forceBLE bool) error {
 	info, ok := commands[commandName]
@@ -168,7 +225,7 @@ func configureFlags(c *cli.Config, commandName string, forceBLE bool) error {
 	}
 
 	// Verify all required parameters are present.
-	havePrivateKey := !(c.KeyringKeyName == "" && c.KeyFilename == "")
+	havePrivateKey := !(c.KeyringKeyName == "" && c.KeyFilename == "" && c.KeyURI == "" && c.KeyAgentSocket == "")
 	haveOAuth := !(c.KeyringTokenName == "" && c.TokenFilename == "")
 	haveVIN := c.VIN != ""
 	_, err := checkReadiness(commandName, havePrivateKey, haveOAuth, haveVIN)
@@ -205,7 +262,7 @@ func checkReadiness(commandName string, havePrivateKey, haveOAuth, haveVIN bool)
 	return info, nil
 }
 
-func execute(ctx context.Context, acct *account.Account, car *vehicle.Vehicle, args []string) error {
+func execute(ctx context.Context, config *cli.Config, acct *account.Account, car *vehicle.Vehicle, args []string) error {
 	if len(args) == 0 {
 		return errors.New("missing COMMAND")
 	}
@@ -231,7 +288,11 @@ func execute(ctx context.Context, acct *account.Account, car *vehicle.Vehicle, a
 			keywords[argInfo.name] = args[index]
 			index++
 		}
-		err = info.handler(ctx, acct, car, keywords)
+		if info.configHandler != nil {
+			err = info.configHandler(ctx, config, acct, car, keywords)
+		} else {
+			err = info.handler(ctx, acct, car, keywords)
+		}
 	}
 
 	// Print command-specific help
@@ -359,23 +420,19 @@ var commands = map[string]*Command{
 		requiresFleetAPI: false,
 		args: []Argument{
 			{name: "PUBLIC_KEY", help: "file containing public key (or corresponding private key)"},
-			{name: "ROLE", help: "One of: owner, driver, fm (fleet manager), vehicle_monitor, charging_manager"},
-			{name: "FORM_FACTOR", help: "One of: nfc_card, ios_device, android_device, cloud_key"},
+			{name: "ROLE", help: roleHelp},
+			{name: "FORM_FACTOR", help: formFactorHelp},
 		},
 		handler: func(ctx context.Context, _ *account.Account, car *vehicle.Vehicle, args map[string]string) error {
-			role, ok := keys.Role_value["ROLE_"+strings.ToUpper(args["ROLE"])]
-			if !ok {
-				return fmt.Errorf("%w: invalid ROLE", ErrCommandLineArgs)
-			}
-			formFactor, ok := vcsec.KeyFormFactor_value["KEY_FORM_FACTOR_"+strings.ToUpper(args["FORM_FACTOR"])]
-			if !ok {
-				return fmt.Errorf("%w: unrecognized FORM_FACTOR", ErrCommandLineArgs)
+			role, formFactor, err := parseRoleAndFormFactor(args)
+			if err != nil {
+				return err
 			}
 			publicKey, err := protocol.LoadPublicKey(args["PUBLIC_KEY"])
 			if err != nil {
 				return fmt.Errorf("invalid public key: %s", err)
 			}
-			return car.AddKeyWithRole(ctx, publicKey, keys.Role(role), vcsec.KeyFormFactor(formFactor))
+			return car.AddKeyWithRole(ctx, publicKey, role, formFactor)
 		},
 	},
 	"add-key-request": {
@@ -384,29 +441,80 @@ var commands = map[string]*Command{
 		requiresFleetAPI: false,
 		args: []Argument{
 			{name: "PUBLIC_KEY", help: "file containing public key (or corresponding private key)"},
-			{name: "ROLE", help: "One of: owner, driver, fm (fleet manager), vehicle_monitor, charging_manager"},
-			{name: "FORM_FACTOR", help: "One of: nfc_card, ios_device, android_device, cloud_key"},
+			{name: "ROLE", help: roleHelp},
+			{name: "FORM_FACTOR", help: formFactorHelp},
 		},
 		handler: func(ctx context.Context, _ *account.Account, car *vehicle.Vehicle, args map[string]string) error {
-			role, ok := keys.Role_value["ROLE_"+strings.ToUpper(args["ROLE"])]
-			if !ok {
-				return fmt.Errorf("%w: invalid ROLE", ErrCommandLineArgs)
-			}
-			formFactor, ok := vcsec.KeyFormFactor_value["KEY_FORM_FACTOR_"+strings.ToUpper(args["FORM_FACTOR"])]
-			if !ok {
-				return fmt.Errorf("%w: unrecognized FORM_FACTOR", ErrCommandLineArgs)
+			role, formFactor, err := parseRoleAndFormFactor(args)
+			if err != nil {
+				return err
 			}
 			publicKey, err := protocol.LoadPublicKey(args["PUBLIC_KEY"])
 			if err != nil {
 				return fmt.Errorf("invalid public key: %s", err)
 			}
-			if err := car.SendAddKeyRequestWithRole(ctx, publicKey, keys.Role(role), vcsec.KeyFormFactor(formFactor)); err != nil {
+			if err := car.SendAddKeyRequestWithRole(ctx, publicKey, role, formFactor); err != nil {
 				return err
 			}
 			fmt.Printf("Sent add-key request to %s. Confirm by tapping NFC card on center console.\n", car.VIN())
 			return nil
 		},
 	},
+	"pair": {
+		help:             "Enroll the private key (generating it if needed) with ROLE and FORM_FACTOR, waiting for NFC-card approval",
+		requiresAuth:     false,
+		requiresFleetAPI: false,
+		args: []Argument{
+			{name: "ROLE", help: roleHelp},
+		},
+		optional: []Argument{
+			{name: "FORM_FACTOR", help: formFactorHelp},
+			{name: "NAME", help: "Human-readable name to register for the key (requires OAuth token). Use \"\" to skip."},
+			{name: "TIMEOUT", help: "Time to wait for NFC-card approval (e.g., 90s or 5m). Defaults to " + defaultPairingTimeout.String() + "."},
+		},
+		configHandler: func(ctx context.Context, config *cli.Config, acct *account.Account, car *vehicle.Vehicle, args map[string]string) error {
+			role, formFactor, err := parseRoleAndFormFactor(args)
+			if err != nil {
+				return err
+			}
+			timeout := defaultPairingTimeout
+			if t, ok := args["TIMEOUT"]; ok {
+				if timeout, err = time.ParseDuration(t); err != nil || timeout <= 0 {
+					return fmt.Errorf("%w: invalid TIMEOUT", ErrCommandLineArgs)
+				}
+			}
+			// Waiting for the user to walk to the vehicle and tap their card takes much longer than
+			// -command-timeout allows for ordinary commands.
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+			defer cancel()
+			skey, created, err := config.LoadOrCreatePrivateKey()
+			if err != nil {
+				return err
+			}
+			if created {
+				fmt.Println("Generated new private key.")
+			}
+			fmt.Printf("Pairing key %s with %s.\n", protocol.KeyFingerprint(skey.PublicBytes()), car.VIN())
+			waiting := false
+			progress := func(step vehicle.PairingStep) {
+				switch step {
+				case vehicle.PairingRequestSent:
+					fmt.Println("Sent add-key request. Confirm by tapping NFC card on center console.")
+				case vehicle.PairingWaiting:
+					waiting = true
+					fmt.Print(".")
+				case vehicle.PairingKeyEnrolled:
+					if waiting {
+						fmt.Println()
+					}
+					fmt.Println("Key enrolled. Verifying...")
+				case vehicle.PairingSessionStarted:
+					fmt.Println("Vehicle accepted key.")
+				}
+			}
+			return config.PairKey(ctx, acct, car, role, formFactor, args["NAME"], progress)
+		},
+	},
 	"remove-key": {
 		help:             "Remove PUBLIC_KEY from vehicle whitelist",
 		requiresAuth:     true,
@@ -422,6 +530,132 @@ var commands = map[string]*Command{
 			return car.RemoveKey(ctx, publicKey)
 		},
 	},
+	"rotate-key": {
+		help:             "Replace the private key with a new key that has the same role, resuming from STATE_FILE if it exists",
+		requiresAuth:     true,
+		requiresFleetAPI: false,
+		args: []Argument{
+			{name: "STATE_FILE", help: "file used to record progress. Re-run with the same file to resume an interrupted rotation."},
+		},
+		optional: []Argument{
+			{name: "NAME", help: "Human-readable name to register for the new key (requires OAuth token)"},
+		},
+		domain: protocol.DomainVCSEC,
+		configHandler: func(ctx context.Context, config *cli.Config, acct *account.Account, car *vehicle.Vehicle, args map[string]string) error {
+			if err := config.RotateKey(ctx, acct, car, args["STATE_FILE"], args["NAME"]); err != nil {
+				return err
+			}
+			fmt.Printf("Rotated key for %s. New public key:\n", car.VIN())
+			skey, err := config.PrivateKey()
+			if err != nil {
+				return err
+			}
+			encoded, err := protocol.EncodePublicKey(skey.PublicBytes(), protocol.KeyFormatPEM)
+			if err != nil {
+				return err
+			}
+			_, err = os.Stdout.Write(encoded)
+			return err
+		},
+	},
+	"replace-key": {
+		help:             "Atomically replace OLD_PUBLIC_KEY with PUBLIC_KEY in vehicle whitelist",
+		requiresAuth:     true,
+		requiresFleetAPI: false,
+		args: []Argument{
+			{name: "OLD_PUBLIC_KEY", help: "file containing public key to remove (or corresponding private key)"},
+			{name: "PUBLIC_KEY", help: "file containing public key to add (or corresponding private key)"},
+			{name: "ROLE", help: roleHelp},
+			{name: "FORM_FACTOR", help: formFactorHelp},
+		},
+		handler: func(ctx context.Context, _ *account.Account, car *vehicle.Vehicle, args map[string]string) error {
+			role, formFactor, err := parseRoleAndFormFactor(args)
+			if err != nil {
+				return err
+			}
+			oldPublicKey, err := protocol.LoadPublicKey(args["OLD_PUBLIC_KEY"])
+			if err != nil {
+				return fmt.Errorf("invalid public key: %s", err)
+			}
+			publicKey, err := protocol.LoadPublicKey(args["PUBLIC_KEY"])
+			if err != nil {
+				return fmt.Errorf("invalid public key: %s", err)
+			}
+			return car.ReplaceKey(ctx, oldPublicKey, publicKey, role, formFactor)
+		},
+	},
+	"replace-key-slot": {
+		help:             "Atomically replace the key in whitelist SLOT with PUBLIC_KEY",
+		requiresAuth:     true,
+		requiresFleetAPI: false,
+		args: []Argument{
+			{name: "SLOT", help: "whitelist slot of key to remove (see list-keys)"},
+			{name: "PUBLIC_KEY", help: "file containing public key to add (or corresponding private key)"},
+			{name: "ROLE", help: roleHelp},
+			{name: "FORM_FACTOR", help: formFactorHelp},
+		},
+		handler: func(ctx context.Context, _ *account.Account, car *vehicle.Vehicle, args map[string]string) error {
+			role, formFactor, err := parseRoleAndFormFactor(args)
+			if err != nil {
+				return err
+			}
+			slot, err := strconv.ParseUint(args["SLOT"], 10, 32)
+			if err != nil {
+				return fmt.Errorf("%w: invalid SLOT", ErrCommandLineArgs)
+			}
+			publicKey, err := protocol.LoadPublicKey(args["PUBLIC_KEY"])
+			if err != nil {
+				return fmt.Errorf("invalid public key: %s", err)
+			}
+			return car.ReplaceKeyInSlot(ctx, uint32(slot), publicKey, role, formFactor)
+		},
+	},
+	"set-key-role": {
+		help:             "Change the ROLE of PUBLIC_KEY, which must already be in the vehicle whitelist",
+		requiresAuth:     true,
+		requiresFleetAPI: false,
+		args: []Argument{
+			{name: "PUBLIC_KEY", help: "file containing public key (or corresponding private key)"},
+			{name: "ROLE", help: roleHelp},
+		},
+		handler: func(ctx context.Context, _ *account.Account, car *vehicle.Vehicle, args map[string]string) error {
+			role, _, err := parseRoleAndFormFactor(args)
+			if err != nil {
+				return err
+			}
+			publicKey, err := protocol.LoadPublicKey(args["PUBLIC_KEY"])
+			if err != nil {
+				return fmt.Errorf("invalid public key: %s", err)
+			}
+			return car.UpdateKeyRole(ctx, publicKey, role)
+		},
+	},
+	"add-impermanent-key": {
+		help:             "Add PUBLIC_KEY to vehicle whitelist with ROLE and FORM_FACTOR, removing it automatically after DURATION",
+		requiresAuth:     true,
+		requiresFleetAPI: false,
+		args:             impermanentKeyArgs,
+		handler: func(ctx context.Context, _ *account.Account, car *vehicle.Vehicle, args map[string]string) error {
+			return addImpermanentKey(ctx, car, args, false)
+		},
+	},
+	"replace-impermanent-keys": {
+		help:             "Remove all impermanent keys and add PUBLIC_KEY with ROLE and FORM_FACTOR, removing it automatically after DURATION",
+		requiresAuth:     true,
+		requiresFleetAPI: false,
+		args:             impermanentKeyArgs,
+		handler: func(ctx context.Context, _ *account.Account, car *vehicle.Vehicle, args map[string]string) error {
+			return addImpermanentKey(ctx, car, args, true)
+		},
+	},
+	"remove-impermanent-keys": {
+		help:             "Remove all impermanent keys from vehicle whitelist",
+		requiresAuth:     true,
+		requiresFleetAPI: false,
+		handler: func(ctx context.Context, _ *account.Account, car *vehicle.Vehicle, _ map[string]string) error {
+			return car.RemoveAllImpermanentKeys(ctx)
+		},
+	},
 	"rename-key": {
 		help:             "Change the human-readable name of PUBLIC_KEY to NAME",
 		requiresAuth:     false,
@@ -515,6 +749,34 @@ var commands = map[string]*Command{
 			return nil
 		},
 	},
+	"key-inventory": {
+		help:             "List keys enrolled on vehicle with roles and fingerprints, marking the key in use with *",
+		requiresAuth:     false,
+		requiresFleetAPI: false,
+		optional: []Argument{
+			{name: "FORMAT", help: "One of: table (default), json"},
+		},
+		handler: func(ctx context.Context, _ *account.Account, car *vehicle.Vehicle, args map[string]string) error {
+			format := args["FORMAT"]
+			if format != "" && format != "table" && format != "json" {
+				return fmt.Errorf("%w: FORMAT must be table or json", ErrCommandLineArgs)
+			}
+			inv, err := car.KeyInventory(ctx, nil)
+			if err != nil {
+				return err
+			}
+			if format == "json" {
+				encoded, err := json.MarshalIndent(inv, "", "  ")
+				if err != nil {
+					return err
+				}
+				fmt.Println(string(encoded))
+			} else if err := inv.WriteTable(os.Stdout); err != nil {
+				return err
+			}
+			return inv.Err()
+		},
+	},
 	"honk": {
 		help:             "Honk horn",
 		requiresAuth:     true,
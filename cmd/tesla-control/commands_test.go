@@ -4,6 +4,9 @@ import (
 	"errors"
 	"strconv"
 	"testing"
+
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/keys"
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/vcsec"
 )
 
 func TestMinutesAfterMidnight(t *testing.T) {
@@ -62,3 +65,24 @@ func TestGetDays(t *testing.T) {
 		}
 	}
 }
+
+func TestParseRoleAndFormFactor(t *testing.T) {
+	role, formFactor, err := parseRoleAndFormFactor(map[string]string{"ROLE": "Driver", "FORM_FACTOR": "cloud_key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role != keys.Role_ROLE_DRIVER || formFactor != vcsec.KeyFormFactor_KEY_FORM_FACTOR_CLOUD_KEY {
+		t.Errorf("Unexpected role %s and form factor %s", role, formFactor)
+	}
+	if _, formFactor, err = parseRoleAndFormFactor(map[string]string{"ROLE": "guest"}); err != nil || formFactor != vcsec.KeyFormFactor_KEY_FORM_FACTOR_UNKNOWN {
+		t.Errorf("Expected optional FORM_FACTOR to be accepted, got %s and %v", formFactor, err)
+	}
+	for _, args := range []map[string]string{
+		{"ROLE": "chauffeur", "FORM_FACTOR": "cloud_key"},
+		{"ROLE": "owner", "FORM_FACTOR": "key_fob"},
+	} {
+		if _, _, err := parseRoleAndFormFactor(args); !errors.Is(err, ErrCommandLineArgs) {
+			t.Errorf("Expected ErrCommandLineArgs for %v but got %v", args, err)
+		}
+	}
+}
@@ -57,11 +57,11 @@ func Usage() {
 	}
 }
 
-func runCommand(acct *account.Account, car *vehicle.Vehicle, args []string, timeout time.Duration) int {
+func runCommand(config *cli.Config, acct *account.Account, car *vehicle.Vehicle, args []string, timeout time.Duration) int {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	if err := execute(ctx, acct, car, args); err != nil {
+	if err := execute(ctx, config, acct, car, args); err != nil {
 		if protocol.MayHaveSucceeded(err) {
 			writeErr("Couldn't verify success: %s", err)
 		} else if errors.Is(err, protocol.ErrNoSession) {
@@ -74,7 +74,7 @@ func runCommand(acct *account.Account, car *vehicle.Vehicle, args []string, time
 	return 0
 }
 
-func runInteractiveShell(acct *account.Account, car *vehicle.Vehicle, timeout time.Duration) int {
+func runInteractiveShell(config *cli.Config, acct *account.Account, car *vehicle.Vehicle, timeout time.Duration) int {
 	scanner := bufio.NewScanner(os.Stdin)
 	for fmt.Printf("> "); scanner.Scan(); fmt.Printf("> ") {
 		args, err := shlex.Split(scanner.Text())
@@ -88,7 +88,7 @@ func runInteractiveShell(acct *account.Account, car *vehicle.Vehicle, timeout ti
 			writeErr("Invalid command: %s", err)
 			continue
 		}
-		runCommand(acct, car, args, timeout)
+		runCommand(config, acct, car, args, timeout)
 	}
 	if err := scanner.Err(); err != nil {
 		writeErr("Error reading command: %s", err)
@@ -152,6 +152,14 @@ func main() {
 			writeErr("Missing required flag: %s", err)
 			return
 		}
+		// If an interrupted key rotation removed the old key from the vehicle, the connection
+		// must be authenticated using the new key.
+		if args[0] == "rotate-key" && len(args) > 1 {
+			if err := config.ResumeKeyRotation(args[1]); err != nil {
+				writeErr("Failed to resume key rotation: %s", err)
+				return
+			}
+		}
 	}
 
 	if err := config.LoadCredentials(); err != nil {
@@ -178,8 +186,8 @@ func main() {
 	}
 
 	if flag.NArg() > 0 {
-		status = runCommand(acct, car, flag.Args(), commandTimeout)
+		status = runCommand(config, acct, car, flag.Args(), commandTimeout)
 	} else {
-		status = runInteractiveShell(acct, car, commandTimeout)
+		status = runInteractiveShell(config, acct, car, commandTimeout)
 	}
 }
@@ -3,31 +3,65 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/teslamotors/vehicle-command/internal/log"
 	"github.com/teslamotors/vehicle-command/pkg/cli"
+	"github.com/teslamotors/vehicle-command/pkg/pkcs11"
 	"github.com/teslamotors/vehicle-command/pkg/protocol"
 	"github.com/teslamotors/vehicle-command/pkg/proxy"
 )
 
 const (
-	cacheSize   = 10000 // Number of cached vehicle sessions
-	defaultPort = 443
+	cacheSize          = 10000 // Number of cached vehicle sessions
+	defaultPort        = 443
+	policyPollInterval = 10 * time.Second
 )
 
 const (
-	EnvTLSCert = "TESLA_HTTP_PROXY_TLS_CERT"
-	EnvTLSKey  = "TESLA_HTTP_PROXY_TLS_KEY"
-	EnvHost    = "TESLA_HTTP_PROXY_HOST"
-	EnvPort    = "TESLA_HTTP_PROXY_PORT"
-	EnvTimeout = "TESLA_HTTP_PROXY_TIMEOUT"
-	EnvVerbose = "TESLA_VERBOSE"
+	EnvTLSCert     = "TESLA_HTTP_PROXY_TLS_CERT"
+	EnvTLSKey      = "TESLA_HTTP_PROXY_TLS_KEY"
+	EnvHost        = "TESLA_HTTP_PROXY_HOST"
+	EnvPort        = "TESLA_HTTP_PROXY_PORT"
+	EnvTimeout     = "TESLA_HTTP_PROXY_TIMEOUT"
+	EnvVerbose     = "TESLA_VERBOSE"
+	EnvPolicy      = "TESLA_HTTP_PROXY_POLICY"
+	EnvAuditLog    = "TESLA_HTTP_PROXY_AUDIT_LOG"
+	EnvMetrics     = "TESLA_HTTP_PROXY_METRICS_ADDR"
+	EnvJobStore    = "TESLA_HTTP_PROXY_JOB_STORE"
+	EnvWebhook     = "TESLA_HTTP_PROXY_JOB_WEBHOOK"
+	EnvIdempotency = "TESLA_HTTP_PROXY_IDEMPOTENCY_WINDOW"
+	EnvQueueDepth  = "TESLA_HTTP_PROXY_QUEUE_DEPTH"
+	EnvPriorities  = "TESLA_HTTP_PROXY_QUEUE_PRIORITIES"
+	EnvAdmin       = "TESLA_HTTP_PROXY_ADMIN_ADDR"
+	EnvUnsupported = "TESLA_HTTP_PROXY_UNSUPPORTED_VIN_EXPIRY"
+	EnvTenants     = "TESLA_HTTP_PROXY_TENANTS"
+	EnvTelemetry   = "TESLA_HTTP_PROXY_TELEMETRY_KEY_FILE"
+	EnvStepUp      = "TESLA_HTTP_PROXY_STEP_UP"
+	EnvRateLimits  = "TESLA_HTTP_PROXY_RATE_LIMITS"
+	EnvAutoWake    = "TESLA_HTTP_PROXY_AUTO_WAKE"
+	EnvWakeTimeout = "TESLA_HTTP_PROXY_WAKE_TIMEOUT"
+	EnvRoleChecks  = "TESLA_HTTP_PROXY_ROLE_CHECKS"
+	// EnvWebhookSecret is only read from the environment to keep it out of process listings.
+	EnvWebhookSecret = "TESLA_HTTP_PROXY_JOB_WEBHOOK_SECRET"
+	// EnvAdminToken is the bearer token required by the admin API. Like EnvWebhookSecret, it's
+	// only read from the environment.
+	EnvAdminToken = "TESLA_HTTP_PROXY_ADMIN_TOKEN"
+	// Secrets used by -step-up are also only read from the environment.
+	EnvApprovalSecret            = "TESLA_HTTP_PROXY_APPROVAL_SECRET"
+	EnvConfirmationWebhookSecret = "TESLA_HTTP_PROXY_CONFIRMATION_WEBHOOK_SECRET"
 )
 
 const nonLocalhostWarning = `
@@ -42,6 +76,24 @@ type HTTProxyConfig struct {
 	host         string
 	port         int
 	timeout      time.Duration
+	policyFile   string
+	policyEval   string
+	auditLog     string
+	metricsAddr  string
+	jobStore     string
+	jobWebhook   string
+	idempotency  time.Duration
+	queueDepth   int
+	priorities   string
+	rateLimits   string
+	autoWake     bool
+	roleChecks   bool
+	wakeTimeout  time.Duration
+	adminAddr    string
+	unsupported  time.Duration
+	tenantsFile  string
+	telemetryKey string
+	stepUpFile   string
 }
 
 var (
@@ -55,11 +107,30 @@ func init() {
 	flag.StringVar(&httpConfig.host, "host", "localhost", "Proxy server `hostname`")
 	flag.IntVar(&httpConfig.port, "port", defaultPort, "`Port` to listen on")
 	flag.DurationVar(&httpConfig.timeout, "timeout", proxy.DefaultTimeout, "Timeout interval when sending commands")
+	flag.StringVar(&httpConfig.policyFile, "policy", "", "Authorization policy `file` restricting which clients may send which commands to which vehicles")
+	flag.StringVar(&httpConfig.policyEval, "policy-eval", "", "Evaluate a `JSON` request (e.g., {\"subject\":\"...\",\"vin\":\"...\",\"command\":\"door_unlock\"}) against -policy and exit")
+	flag.StringVar(&httpConfig.telemetryKey, "telemetry-key-file", "", "Sign fleet telemetry configurations with the private key in `file` instead of the command-authentication key")
+	flag.StringVar(&httpConfig.tenantsFile, "tenants", "", "JSON `file` listing additional tenants, each with its own command-authentication key")
+	flag.StringVar(&httpConfig.stepUpFile, "step-up", "", "JSON `file` configuring second factors required for high-risk commands")
+	flag.StringVar(&httpConfig.auditLog, "audit-log", "", "Write hash-chained audit records to `destination` (a filename, \"stdout\", or \"syslog\")")
+	flag.StringVar(&httpConfig.jobStore, "job-store", "", "Enable asynchronous commands, storing jobs in `directory` (or \"memory\" to discard jobs on exit)")
+	flag.StringVar(&httpConfig.jobWebhook, "job-webhook", "", "POST completed asynchronous jobs to `URL`, signed with "+EnvWebhookSecret)
+	flag.DurationVar(&httpConfig.idempotency, "idempotency-window", proxy.DefaultIdempotencyWindow, "How long to remember the outcome of commands sent with an Idempotency-Key header (0 to disable)")
+	flag.IntVar(&httpConfig.queueDepth, "queue-depth", 0, "Maximum number of commands waiting for each vehicle before the proxy responds with 429 Too Many Requests (0 for no limit)")
+	flag.StringVar(&httpConfig.rateLimits, "rate-limits", "", "Comma-separated `list` of scope=count/duration limits, where scope is subject, vin, or a command category (for example, \"vin=20/m,alerts=3/m\")")
+	flag.StringVar(&httpConfig.priorities, "queue-priorities", "", "Comma-separated `list` of command=priority pairs (low, normal, or high) that override the default queue order")
+	flag.StringVar(&httpConfig.adminAddr, "admin-addr", "", "Serve the admin API over plain HTTP at `address` (e.g., localhost:9091), authenticated with "+EnvAdminToken)
+	flag.BoolVar(&httpConfig.autoWake, "auto-wake", false, "Wake sleeping vehicles and retry commands, unless the request includes \""+proxy.WakeHeader+": false\"")
+	flag.BoolVar(&httpConfig.roleChecks, "role-checks", false, "Reject commands that the role of the command-authentication key doesn't allow with 403 Forbidden, without sending them to the vehicle")
+	flag.DurationVar(&httpConfig.wakeTimeout, "wake-timeout", proxy.DefaultWakeTimeout, "Deadline for commands that may wake the vehicle, including waking, handshaking, and executing the command")
+	flag.DurationVar(&httpConfig.unsupported, "unsupported-vin-expiry", proxy.DefaultUnsupportedVINExpiry, "How long to forward commands for vehicles that don't support end-to-end authentication before trying again (0 to never retry)")
+	flag.StringVar(&httpConfig.metricsAddr, "metrics-addr", "", "Serve Prometheus metrics over plain HTTP at http://`address`/metrics (e.g., localhost:9090)")
 }
 
 func Usage() {
 	out := flag.CommandLine.Output()
 	fmt.Fprintf(out, "Usage: %s [OPTION...]\n", os.Args[0])
+	fmt.Fprintf(out, "       %s verify AUDIT_LOG_FILE...\n", os.Args[0])
 	fmt.Fprintf(out, "\nA server that exposes a REST API for sending commands to Tesla vehicles")
 	fmt.Fprintln(out, "")
 	fmt.Fprintln(out, nonLocalhostWarning)
@@ -109,23 +180,64 @@ func main() {
 		log.SetLevel(log.LevelDebug)
 	}
 
+	if flag.Arg(0) == "verify" {
+		err = verifyAuditLogs(flag.Args()[1:])
+		if err == nil {
+			os.Exit(0)
+		}
+		return
+	}
+
+	if httpConfig.policyEval != "" {
+		err = evaluatePolicy(httpConfig.policyFile, httpConfig.policyEval)
+		if err == nil {
+			os.Exit(0)
+		}
+		return
+	}
+
 	if httpConfig.host != "localhost" {
 		fmt.Fprintln(os.Stderr, nonLocalhostWarning)
 	}
 
 	var skey protocol.ECDHPrivateKey
 	skey, err = config.PrivateKey()
-	if err != nil {
+	if errors.Is(err, cli.ErrNoKeySpecified) && httpConfig.tenantsFile != "" {
+		// Every request must then be routed to a tenant.
+		err = nil
+	} else if err != nil {
 		return
 	}
 
-	if tlsPublicKey, err := protocol.LoadPublicKey(httpConfig.keyFilename); err == nil {
-		if bytes.Equal(tlsPublicKey.Bytes(), skey.PublicBytes()) {
-			fmt.Fprintln(os.Stderr, "It is unsafe to use the same private key for TLS and command authentication.")
-			fmt.Fprintln(os.Stderr, "")
-			fmt.Fprintln(os.Stderr, "Generate a new TLS key for this server.")
+	var telemetryKey protocol.ECDHPrivateKey
+	if httpConfig.telemetryKey != "" {
+		if telemetryKey, err = cli.LoadPrivateKey(httpConfig.telemetryKey); err != nil {
+			return
+		}
+	} else if _, ok := skey.(*pkcs11.Key); ok {
+		log.Warning("PKCS#11 keys can't sign fleet telemetry configurations; use -telemetry-key-file to configure fleet telemetry")
+	}
+
+	var tenants []proxy.TenantConfig
+	if httpConfig.tenantsFile != "" {
+		if tenants, err = loadTenants(httpConfig.tenantsFile); err != nil {
 			return
 		}
+	}
+
+	commandKeys := []protocol.ECDHPrivateKey{skey, telemetryKey}
+	for _, tenant := range tenants {
+		commandKeys = append(commandKeys, tenant.CommandKey, tenant.TelemetryKey)
+	}
+	if tlsPublicKey, err := protocol.LoadPublicKey(httpConfig.keyFilename); err == nil {
+		for _, key := range commandKeys {
+			if key != nil && bytes.Equal(tlsPublicKey.Bytes(), key.PublicBytes()) {
+				fmt.Fprintln(os.Stderr, "It is unsafe to use the same private key for TLS and command authentication.")
+				fmt.Fprintln(os.Stderr, "")
+				fmt.Fprintln(os.Stderr, "Generate a new TLS key for this server.")
+				return
+			}
+		}
 		log.Debug("Verified that TLS key is not the same as the command-authentication key.")
 	} else {
 		// Discarding the error here is deliberate
@@ -139,6 +251,68 @@ func main() {
 		return
 	}
 	p.Timeout = httpConfig.timeout
+	if telemetryKey != nil {
+		p.SetTelemetryKey(telemetryKey)
+	}
+	for _, tenant := range tenants {
+		if err = p.AddTenant(tenant); err != nil {
+			return
+		}
+		log.Info("Loaded tenant %s", tenant.Name)
+	}
+	if httpConfig.policyFile != "" {
+		if p.Policy, err = proxy.NewPolicyStore(httpConfig.policyFile); err != nil {
+			return
+		}
+		watchPolicy(p.Policy, p.Logger)
+		log.Info("Loaded authorization policy from %s", httpConfig.policyFile)
+	}
+	if httpConfig.auditLog != "" {
+		if p.AuditLog, err = openAuditLog(httpConfig.auditLog); err != nil {
+			return
+		}
+	}
+	if httpConfig.stepUpFile != "" {
+		if p.StepUp, err = loadStepUp(httpConfig.stepUpFile); err != nil {
+			return
+		}
+	}
+	if httpConfig.idempotency > 0 {
+		p.Idempotency = proxy.NewIdempotencyCache(httpConfig.idempotency)
+	}
+	if httpConfig.jobStore != "" {
+		if p.Jobs, err = openJobManager(httpConfig.jobStore, httpConfig.jobWebhook, p.Logger); err != nil {
+			return
+		}
+	}
+	p.UnsupportedVINExpiry = httpConfig.unsupported
+	p.AutoWake = httpConfig.autoWake
+	p.RoleChecks = httpConfig.roleChecks
+	p.WakeTimeout = httpConfig.wakeTimeout
+	p.Queue.MaxDepth = httpConfig.queueDepth
+	if httpConfig.priorities != "" {
+		if p.Queue.Priorities, err = queuePriorities(httpConfig.priorities); err != nil {
+			return
+		}
+	}
+	if httpConfig.rateLimits != "" {
+		var limits *proxy.RateLimits
+		if limits, err = proxy.ParseRateLimits(httpConfig.rateLimits); err != nil {
+			err = fmt.Errorf("invalid rate limits: %w", err)
+			return
+		}
+		p.RateLimiter = proxy.NewRateLimiter(*limits)
+		log.Info("Rate limits: %s", strings.Join(p.RateLimiter.Limits(), ", "))
+	}
+	if httpConfig.adminAddr != "" {
+		if err = serveAdmin(httpConfig.adminAddr, p); err != nil {
+			return
+		}
+	}
+	if httpConfig.metricsAddr != "" {
+		p.Metrics = proxy.NewMetrics()
+		serveMetrics(httpConfig.metricsAddr, p.Metrics)
+	}
 	addr := fmt.Sprintf("%s:%d", httpConfig.host, httpConfig.port)
 	log.Info("Listening on %s", addr)
 
@@ -150,6 +324,238 @@ func main() {
 	log.Error("Server stopped: %s", http.ListenAndServeTLS(addr, httpConfig.certFilename, httpConfig.keyFilename, p))
 }
 
+// openJobManager creates a JobManager that stores jobs in a directory or, if store is "memory",
+// in memory, and starts deleting expired jobs in the background.
+func openJobManager(store, webhookURL string, logger *slog.Logger) (*proxy.JobManager, error) {
+	var jobStore proxy.JobStore
+	if store == "memory" {
+		jobStore = proxy.NewMemoryJobStore()
+	} else {
+		var err error
+		if jobStore, err = proxy.NewFileJobStore(store); err != nil {
+			return nil, err
+		}
+	}
+	jobs, err := proxy.NewJobManager(jobStore)
+	if err != nil {
+		return nil, err
+	}
+	if webhookURL != "" {
+		secret := os.Getenv(EnvWebhookSecret)
+		if secret == "" {
+			log.Warning("%s is not set; webhook requests will not be signed", EnvWebhookSecret)
+		}
+		jobs.Webhook = &proxy.Webhook{URL: webhookURL, Secret: []byte(secret)}
+	}
+	go jobs.PurgeExpired(nil, proxy.DefaultJobPurgeInterval, logger)
+	return jobs, nil
+}
+
+// serveMetrics exposes metrics on a separate listener so that per-vehicle statistics are not
+// available to clients of the proxy.
+func serveMetrics(addr string, metrics *proxy.Metrics) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	log.Info("Serving metrics on http://%s/metrics", addr)
+	go func() {
+		log.Error("Metrics server stopped: %s", http.ListenAndServe(addr, mux))
+	}()
+}
+
+// tenantFile is the format of the file passed to -tenants.
+type tenantFile struct {
+	Tenants []struct {
+		Name             string   `json:"name"`
+		KeyFile          string   `json:"key_file"`
+		TelemetryKeyFile string   `json:"telemetry_key_file"`
+		ClientIDs        []string `json:"client_ids"`
+		Audiences        []string `json:"audiences"`
+	} `json:"tenants"`
+}
+
+// loadTenants reads tenant configurations and their private keys from filename.
+func loadTenants(filename string) ([]proxy.TenantConfig, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var file tenantFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid tenants file %s: %w", filename, err)
+	}
+	var tenants []proxy.TenantConfig
+	for _, t := range file.Tenants {
+		tenant := proxy.TenantConfig{Name: t.Name, ClientIDs: t.ClientIDs, Audiences: t.Audiences}
+		if tenant.CommandKey, err = cli.LoadPrivateKey(t.KeyFile); err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", t.Name, err)
+		}
+		if t.TelemetryKeyFile != "" {
+			if tenant.TelemetryKey, err = cli.LoadPrivateKey(t.TelemetryKeyFile); err != nil {
+				return nil, fmt.Errorf("tenant %s: %w", t.Name, err)
+			}
+		}
+		tenants = append(tenants, tenant)
+	}
+	return tenants, nil
+}
+
+// stepUpFile is the format of the file passed to -step-up.
+type stepUpFile struct {
+	Commands            []string          `json:"commands"`
+	TOTPSecrets         map[string]string `json:"totp_secrets"` // Base32-encoded, as used by authenticator apps
+	ConfirmationTTL     string            `json:"confirmation_ttl"`
+	ConfirmationWebhook string            `json:"confirmation_webhook"`
+}
+
+// loadStepUp reads a step-up configuration from filename. Secrets shared with other services are
+// read from the environment.
+func loadStepUp(filename string) (*proxy.StepUp, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var file stepUpFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid step-up file %s: %w", filename, err)
+	}
+	stepUp := &proxy.StepUp{
+		Commands:       file.Commands,
+		TOTPSecrets:    make(map[string][]byte),
+		ApprovalSecret: []byte(os.Getenv(EnvApprovalSecret)),
+	}
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	for subject, secret := range file.TOTPSecrets {
+		decoded, err := encoding.DecodeString(strings.TrimRight(strings.ToUpper(secret), "="))
+		if err != nil {
+			return nil, fmt.Errorf("invalid TOTP secret for %s: %w", subject, err)
+		}
+		stepUp.TOTPSecrets[subject] = decoded
+	}
+	if file.ConfirmationTTL != "" {
+		if stepUp.ConfirmationTTL, err = time.ParseDuration(file.ConfirmationTTL); err != nil {
+			return nil, fmt.Errorf("invalid confirmation_ttl: %w", err)
+		}
+	}
+	if file.ConfirmationWebhook != "" {
+		stepUp.ConfirmationWebhook = &proxy.Webhook{
+			URL:    file.ConfirmationWebhook,
+			Secret: []byte(os.Getenv(EnvConfirmationWebhookSecret)),
+		}
+	}
+	if len(stepUp.TOTPSecrets) == 0 && len(stepUp.ApprovalSecret) == 0 && stepUp.ConfirmationTTL == 0 {
+		log.Warning("No second factors are configured; high-risk commands will be rejected")
+	}
+	return stepUp, nil
+}
+
+// queuePriorities returns proxy.DefaultPriorities with overrides from a comma-separated list of
+// command=priority pairs.
+func queuePriorities(overrides string) (map[string]proxy.Priority, error) {
+	parsed, err := proxy.ParsePriorities(overrides)
+	if err != nil {
+		return nil, fmt.Errorf("invalid queue priorities: %w", err)
+	}
+	priorities := make(map[string]proxy.Priority)
+	for command, priority := range proxy.DefaultPriorities {
+		priorities[command] = priority
+	}
+	for command, priority := range parsed {
+		priorities[command] = priority
+	}
+	return priorities, nil
+}
+
+// serveAdmin exposes the admin API on a separate listener. The API reveals which OAuth subjects
+// are sending commands to which vehicles, so addr should not be reachable by clients of the proxy.
+func serveAdmin(addr string, p *proxy.Proxy) error {
+	token := os.Getenv(EnvAdminToken)
+	if token == "" {
+		return fmt.Errorf("-admin-addr requires %s", EnvAdminToken)
+	}
+	log.Info("Serving admin API on http://%s/", addr)
+	go func() {
+		log.Error("Admin server stopped: %s", http.ListenAndServe(addr, proxy.NewAdminHandler(p, token)))
+	}()
+	return nil
+}
+
+// openAuditLog creates an AuditLog that writes to destination, which is either "stdout", "syslog",
+// or a filename.
+func openAuditLog(destination string) (*proxy.AuditLog, error) {
+	switch destination {
+	case "stdout":
+		return proxy.NewAuditLog(proxy.NewWriterAuditSink(os.Stdout), nil), nil
+	case "syslog":
+		sink, err := proxy.NewSyslogAuditSink("tesla-http-proxy")
+		if err != nil {
+			return nil, err
+		}
+		return proxy.NewAuditLog(sink, nil), nil
+	default:
+		return proxy.OpenAuditFile(destination)
+	}
+}
+
+// verifyAuditLogs checks the hash chain of each file in filenames.
+func verifyAuditLogs(filenames []string) error {
+	if len(filenames) == 0 {
+		return fmt.Errorf("verify requires at least one audit log file")
+	}
+	for _, filename := range filenames {
+		file, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		count, err := proxy.VerifyAuditLog(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w (%d valid records)", filename, err, count)
+		}
+		fmt.Printf("%s: OK (%d records)\n", filename, count)
+	}
+	return nil
+}
+
+// evaluatePolicy prints the decision the proxy would make for the JSON-encoded
+// proxy.PolicyRequest in requestJSON.
+func evaluatePolicy(policyFile, requestJSON string) error {
+	if policyFile == "" {
+		return fmt.Errorf("-policy-eval requires -policy")
+	}
+	policy, err := proxy.LoadPolicyFile(policyFile)
+	if err != nil {
+		return err
+	}
+	var request proxy.PolicyRequest
+	if err := json.Unmarshal([]byte(requestJSON), &request); err != nil {
+		return fmt.Errorf("invalid request: %s", err)
+	}
+	decision := policy.Evaluate(&request)
+	encoded, err := json.Marshal(&decision)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(encoded))
+	return nil
+}
+
+// watchPolicy reloads the policy when the file changes or the process receives SIGHUP.
+func watchPolicy(store *proxy.PolicyStore, logger *slog.Logger) {
+	go store.Watch(nil, policyPollInterval, logger)
+	l := log.New(logger)
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			if err := store.Reload(); err != nil {
+				l.Error("Failed to reload policy; keeping previous policy: %s", err)
+			} else {
+				l.Info("Reloaded policy")
+			}
+		}
+	}()
+}
+
 // readConfig applies configuration from environment variables.
 // Values are not overwritten.
 func readFromEnvironment() error {
@@ -174,6 +580,62 @@ func readFromEnvironment() error {
 		}
 	}
 
+	if httpConfig.policyFile == "" {
+		httpConfig.policyFile = os.Getenv(EnvPolicy)
+	}
+
+	if httpConfig.auditLog == "" {
+		httpConfig.auditLog = os.Getenv(EnvAuditLog)
+	}
+
+	if httpConfig.tenantsFile == "" {
+		httpConfig.tenantsFile = os.Getenv(EnvTenants)
+	}
+
+	if httpConfig.telemetryKey == "" {
+		httpConfig.telemetryKey = os.Getenv(EnvTelemetry)
+	}
+
+	if httpConfig.stepUpFile == "" {
+		httpConfig.stepUpFile = os.Getenv(EnvStepUp)
+	}
+
+	if httpConfig.metricsAddr == "" {
+		httpConfig.metricsAddr = os.Getenv(EnvMetrics)
+	}
+
+	if httpConfig.jobStore == "" {
+		httpConfig.jobStore = os.Getenv(EnvJobStore)
+	}
+
+	if httpConfig.jobWebhook == "" {
+		httpConfig.jobWebhook = os.Getenv(EnvWebhook)
+	}
+
+	if httpConfig.priorities == "" {
+		httpConfig.priorities = os.Getenv(EnvPriorities)
+	}
+
+	if httpConfig.rateLimits == "" {
+		httpConfig.rateLimits = os.Getenv(EnvRateLimits)
+	}
+
+	if httpConfig.adminAddr == "" {
+		httpConfig.adminAddr = os.Getenv(EnvAdmin)
+	}
+
+	if !httpConfig.autoWake {
+		if autoWake, ok := os.LookupEnv(EnvAutoWake); ok {
+			httpConfig.autoWake = autoWake != "false" && autoWake != "0"
+		}
+	}
+
+	if !httpConfig.roleChecks {
+		if roleChecks, ok := os.LookupEnv(EnvRoleChecks); ok {
+			httpConfig.roleChecks = roleChecks != "false" && roleChecks != "0"
+		}
+	}
+
 	var err error
 	if httpConfig.port == defaultPort {
 		if port, ok := os.LookupEnv(EnvPort); ok {
@@ -193,5 +655,41 @@ func readFromEnvironment() error {
 		}
 	}
 
+	if httpConfig.idempotency == proxy.DefaultIdempotencyWindow {
+		if windowEnv, ok := os.LookupEnv(EnvIdempotency); ok {
+			httpConfig.idempotency, err = time.ParseDuration(windowEnv)
+			if err != nil {
+				return fmt.Errorf("invalid idempotency window: %s", windowEnv)
+			}
+		}
+	}
+
+	if httpConfig.unsupported == proxy.DefaultUnsupportedVINExpiry {
+		if expiryEnv, ok := os.LookupEnv(EnvUnsupported); ok {
+			httpConfig.unsupported, err = time.ParseDuration(expiryEnv)
+			if err != nil {
+				return fmt.Errorf("invalid unsupported VIN expiry: %s", expiryEnv)
+			}
+		}
+	}
+
+	if httpConfig.wakeTimeout == proxy.DefaultWakeTimeout {
+		if timeoutEnv, ok := os.LookupEnv(EnvWakeTimeout); ok {
+			httpConfig.wakeTimeout, err = time.ParseDuration(timeoutEnv)
+			if err != nil {
+				return fmt.Errorf("invalid wake timeout: %s", timeoutEnv)
+			}
+		}
+	}
+
+	if httpConfig.queueDepth == 0 {
+		if depthEnv, ok := os.LookupEnv(EnvQueueDepth); ok {
+			httpConfig.queueDepth, err = strconv.Atoi(depthEnv)
+			if err != nil || httpConfig.queueDepth < 0 {
+				return fmt.Errorf("invalid queue depth: %s", depthEnv)
+			}
+		}
+	}
+
 	return nil
 }
@@ -58,6 +58,10 @@ func usage() {
 }
 
 func signConfig(config *cli.Config, fleet bool) {
+	if config.KeyURI != "" {
+		fmt.Fprintln(os.Stderr, "PKCS#11 keys can't create the Schnorr signatures used by tesla-jws.")
+		os.Exit(1)
+	}
 	skey, err := config.PrivateKey()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to load private key: %s\n", err)
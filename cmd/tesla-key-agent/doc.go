@@ -0,0 +1,6 @@
+/*
+Tesla-key-agent loads a command-authentication private key once and makes it available to other
+programs, such as tesla-control and tesla-jws, over a Unix socket. See the README.md file in the
+repository root directory for instructions on using this application.
+*/
+package main
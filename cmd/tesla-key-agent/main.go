@@ -0,0 +1,149 @@
+// Utility for sharing an unlocked private key with other processes
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/teslamotors/vehicle-command/internal/log"
+	"github.com/teslamotors/vehicle-command/pkg/cli"
+	"github.com/teslamotors/vehicle-command/pkg/keyagent"
+)
+
+const usageText = `
+Loads a private key from the system keyring, a file, or a PKCS#11 token, and serves it to other
+programs over a Unix socket until interrupted. Keyring passwords and PINs are only requested once,
+when the agent starts.
+
+The program writes shell commands that set $%s to stdout. Programs that use the socket can
+connect to vehicles and create signatures with the key, but can't read it or the session keys
+derived from it.`
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "usage: %s [OPTION...]\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(w, usageText+"\n", cli.EnvTeslaKeyAgentSock)
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "OPTIONS:")
+	flag.PrintDefaults()
+}
+
+func writeErr(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, format, a...)
+	fmt.Fprintf(os.Stderr, "\n")
+}
+
+// defaultSocketPath returns a socket path in $XDG_RUNTIME_DIR, or in a new private temporary
+// directory if that isn't set. In the latter case, tempDir is the name of the directory.
+func defaultSocketPath() (path, tempDir string, err error) {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "tesla-key-agent.sock"), "", nil
+	}
+	tempDir, err = os.MkdirTemp("", "tesla-key-agent-")
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(tempDir, fmt.Sprintf("agent.%d", os.Getpid())), tempDir, nil
+}
+
+func main() {
+	var (
+		socketPath string
+		lifetime   time.Duration
+		debug      bool
+	)
+	status := 1
+	defer func() {
+		os.Exit(status)
+	}()
+
+	config, err := cli.NewConfig(cli.FlagPrivateKey)
+	if err != nil {
+		writeErr("Failed to load credential configuration: %s", err)
+		return
+	}
+	config.RegisterCommandLineFlags()
+	flag.Usage = func() { usage(flag.CommandLine.Output()) }
+	flag.StringVar(&socketPath, "socket", "", "Listen on Unix `socket`. Defaults to a file in $XDG_RUNTIME_DIR or a new temporary directory.")
+	flag.DurationVar(&lifetime, "lifetime", 0, "Exit after `duration` (for example, 8h). Defaults to running until interrupted.")
+	flag.BoolVar(&debug, "debug", false, "Enable verbose debugging messages")
+	flag.Parse()
+	if debug {
+		log.SetLevel(log.LevelDebug)
+	}
+	if flag.NArg() != 0 {
+		usage(os.Stderr)
+		return
+	}
+	if config.KeyAgentSocket != "" {
+		writeErr("The -key-agent option can't be used to start an agent")
+		return
+	}
+	config.ReadFromEnvironment()
+	// $TESLA_KEY_AGENT_SOCK may point to a previous agent, but this agent needs to load the key
+	// itself.
+	config.KeyAgentSocket = ""
+	config.DisableCache = true
+	config.CacheFilename = ""
+
+	skey, err := config.PrivateKey()
+	if err != nil {
+		writeErr("Failed to load private key: %s", err)
+		return
+	}
+
+	if socketPath == "" {
+		var tempDir string
+		if socketPath, tempDir, err = defaultSocketPath(); err != nil {
+			writeErr("Failed to create socket directory: %s", err)
+			return
+		}
+		if tempDir != "" {
+			defer os.RemoveAll(tempDir)
+		}
+	}
+	listener, err := keyagent.Listen(socketPath)
+	if err != nil {
+		writeErr("Failed to listen on %s: %s", socketPath, err)
+		return
+	}
+
+	server := keyagent.NewServer(skey)
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(listener)
+	}()
+
+	fmt.Printf("%s=%s; export %s;\n", cli.EnvTeslaKeyAgentSock, socketPath, cli.EnvTeslaKeyAgentSock)
+	log.Info("Serving public key %02x", skey.PublicBytes())
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	var expired <-chan time.Time
+	if lifetime > 0 {
+		expired = time.After(lifetime)
+	}
+
+	select {
+	case sig := <-interrupt:
+		log.Info("Received %s, exiting", sig)
+	case <-expired:
+		log.Info("Lifetime of %s expired, exiting", lifetime)
+	case err := <-done:
+		writeErr("Agent stopped: %s", err)
+		return
+	}
+	server.Close()
+	if err := <-done; !errors.Is(err, keyagent.ErrServerClosed) {
+		writeErr("Agent stopped: %s", err)
+		return
+	}
+	status = 0
+}
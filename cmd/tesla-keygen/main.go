@@ -3,19 +3,25 @@
 package main
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
+	"context"
 	"crypto/rand"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/teslamotors/vehicle-command/internal/authentication"
 	"github.com/teslamotors/vehicle-command/internal/log"
+	"github.com/teslamotors/vehicle-command/pkg/account"
 	"github.com/teslamotors/vehicle-command/pkg/cli"
 	"github.com/teslamotors/vehicle-command/pkg/protocol"
 )
@@ -30,8 +36,37 @@ Creates or deletes a private key and saves it in the system keyring, or migrates
 plaintext file into the system keyring.
 
 The program writes the public key to stdout (except when deleting a key or setting the output
-location with -output). When using the create option, the program will not overwrite an existing
-key unless invoked with -f.
+location with -output). When using the create or import options, the program will not overwrite
+an existing key unless invoked with -f.
+
+The keyring can hold several keys, distinguished by -key-name (for example, one per environment or
+vehicle group). The remaining options manage them:
+
+  list              Lists the names and public-key fingerprints of keys in the keyring.
+  import FILE       Imports a PEM, DER, hex or JWK private key from FILE ("-" for stdin).
+  public            Prints the public key, in the encoding selected by -format.
+  backup [NAME...]  Writes a passphrase-protected backup of the named keys, or of all keys, in
+                    JSON to stdout or -output.
+  restore FILE      Restores the keys in a backup file. Existing keys are skipped unless invoked
+                    with -f.
+
+Fleet API partners must host their public key at
+https://<domain>` + account.WellKnownPublicKeyPath + `.
+The following options help with this:
+
+  serve ADDRESS     Serves the public key at the well-known path on ADDRESS (e.g., :8080). Use a
+                    reverse proxy to provide HTTPS.
+  render DIR        Writes the public key to the well-known path inside DIR, for use with a static
+                    web server.
+  check URL         Fetches URL and verifies that it hosts the public key in the format Tesla
+                    expects. If URL is a domain name, the well-known path on that domain is used.
+
+When -partner-domain is provided, serve and render also print the link that vehicle owners open
+to pair the key with their vehicle.
+
+With -encrypt, keys written to -key-file by the create option, and keys printed by the export
+option, are protected with a passphrase (password-protected PKCS #8). Other programs in this
+repository read the passphrase of encrypted key files from $TESLA_KEY_PASSPHRASE, or prompt for it.
 
 The type of keyring and name of the key inside that keyring are controlled by the command-line
 options below, or through the corresponding environment variables.`
@@ -41,41 +76,180 @@ func cliUsage() {
 }
 
 func usage(w io.Writer) {
-	fmt.Fprintf(w, "usage: %s [OPTION...] create|delete|export|migrate\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(w, "usage: %s [OPTION...] create|delete|export|migrate|list|import|public|backup|restore|serve|render|check\n", filepath.Base(os.Args[0]))
 	fmt.Fprintln(w, usageText)
 	fmt.Fprintln(w, "")
 	fmt.Fprintln(w, "OPTIONS:")
 	flag.PrintDefaults()
 }
 
-func printPublicKey(skey protocol.ECDHPrivateKey, outputFile string) bool {
-	pkey := ecdsa.PublicKey{Curve: elliptic.P256()}
-	pkey.X, pkey.Y = elliptic.Unmarshal(elliptic.P256(), skey.PublicBytes())
-	if pkey.X == nil {
-		return false
+// openOutput returns outputFile, or stdout if outputFile is empty. The caller must close the
+// returned file.
+func openOutput(outputFile string) (*os.File, error) {
+	if outputFile == "" {
+		return os.Stdout, nil
 	}
-	derPublicKey, err := x509.MarshalPKIXPublicKey(&pkey)
+	return os.Create(outputFile)
+}
+
+func printPublicKey(skey protocol.ECDHPrivateKey, outputFile string, format protocol.KeyFormat) bool {
+	encoded, err := protocol.EncodePublicKey(skey.PublicBytes(), format)
 	if err != nil {
 		return false
 	}
 
 	// If outputFile is provided, write to file, else write to stdout
-	var out io.Writer = os.Stdout
-	if outputFile != "" {
-		file, err := os.Create(outputFile)
-		if err != nil {
-			writeErr("Failed to create output file: %s", err)
-			return false
+	out, err := openOutput(outputFile)
+	if err != nil {
+		writeErr("Failed to create output file: %s", err)
+		return false
+	}
+	defer out.Close()
+
+	_, err = out.Write(encoded)
+	return err == nil
+}
+
+func listKeys(config *cli.Config) error {
+	names, err := config.KeyringKeyNames()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tFINGERPRINT")
+	for _, name := range names {
+		fingerprint := "(invalid key)"
+		if skey, err := config.LoadKeyringKey(name); err == nil {
+			fingerprint = protocol.KeyFingerprint(skey.PublicBytes())
 		}
-		defer file.Close()
-		out = file
+		fmt.Fprintf(w, "%s\t%s\n", name, fingerprint)
+	}
+	return w.Flush()
+}
+
+func readInput(filename string) ([]byte, error) {
+	if filename == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(filename)
+}
+
+func importKey(config *cli.Config, filename string) (protocol.ECDHPrivateKey, error) {
+	data, err := readInput(filename)
+	if err != nil {
+		return nil, err
+	}
+	return protocol.ParsePrivateKey(data, config.KeyPassphrase)
+}
+
+func backupKeys(config *cli.Config, names []string, outputFile string) error {
+	passphrase, err := config.NewKeyPassphrase()
+	if err != nil {
+		return err
+	}
+	backup, err := config.BackupKeys(names, passphrase)
+	if err != nil {
+		return err
+	}
+	if len(backup.Keys) == 0 {
+		return errors.New("no keys found in keyring")
+	}
+	encoded, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		return err
+	}
+	out, err := openOutput(outputFile)
+	if err != nil {
+		return err
+	}
+	if _, err = out.Write(append(encoded, '\n')); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func restoreKeys(config *cli.Config, filename string, overwrite bool) error {
+	data, err := readInput(filename)
+	if err != nil {
+		return err
+	}
+	var backup cli.KeyBackup
+	if err := json.Unmarshal(data, &backup); err != nil {
+		return fmt.Errorf("invalid backup file: %w", err)
+	}
+	passphrase, err := config.KeyPassphrase()
+	if err != nil {
+		return err
+	}
+	restored, skipped, err := config.RestoreKeys(&backup, passphrase, overwrite)
+	for _, name := range restored {
+		writeErr("Restored %s", name)
 	}
+	for _, name := range skipped {
+		writeErr("Skipped %s: key already exists. Run with -f to overwrite.", name)
+	}
+	return err
+}
 
-	_ = pem.Encode(out, &pem.Block{Type: "PUBLIC KEY", Bytes: derPublicKey})
-	return true
+// hostPublicKey implements the serve, render and check commands, which help Fleet API partners
+// host their public key at the well-known location.
+func hostPublicKey(command, arg string, skey protocol.ECDHPrivateKey, domain string) error {
+	publicBytes := skey.PublicBytes()
+	switch command {
+	case "serve":
+		handler, err := account.PublicKeyHandler(publicBytes)
+		if err != nil {
+			return err
+		}
+		writeErr("Serving %s at %s%s", protocol.KeyFingerprint(publicBytes), arg, account.WellKnownPublicKeyPath)
+		if domain != "" {
+			writeErr("Pairing link: %s", account.PairingLink(domain))
+		}
+		server := &http.Server{Addr: arg, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+		return server.ListenAndServe()
+	case "render":
+		filename, err := account.WritePublicKeyDir(arg, publicBytes)
+		if err != nil {
+			return err
+		}
+		writeErr("Wrote %s", filename)
+		if domain != "" {
+			writeErr("Pairing link: %s", account.PairingLink(domain))
+		}
+		return nil
+	default:
+		url := arg
+		if !strings.Contains(url, "://") {
+			domain = url
+			url = account.WellKnownPublicKeyURL(domain)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := account.CheckHostedPublicKey(ctx, nil, url, publicBytes); err != nil {
+			return err
+		}
+		writeErr("%s hosts the expected public key.", url)
+		if domain != "" {
+			writeErr("Pairing link: %s", account.PairingLink(domain))
+		}
+		return nil
+	}
 }
 
-func printPrivateKey(skey protocol.ECDHPrivateKey) error {
+func printPrivateKey(config *cli.Config, skey protocol.ECDHPrivateKey) error {
+	if config.EncryptKeyFile {
+		passphrase, err := config.NewKeyPassphrase()
+		if err != nil {
+			return err
+		}
+		pemKey, err := protocol.EncryptPrivateKey(skey, passphrase, config.KeyEncryption)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(pemKey)
+		return err
+	}
 	native, ok := skey.(*authentication.NativeECDHKey)
 	if !ok {
 		return fmt.Errorf("private key is not exportable")
@@ -93,6 +267,9 @@ func main() {
 	var (
 		overwrite  bool
 		outputFile string
+		kdf        string
+		domain     string
+		format     string
 		skey       protocol.ECDHPrivateKey
 		err        error
 	)
@@ -105,7 +282,11 @@ func main() {
 	config.RegisterCommandLineFlags()
 	flag.Usage = cliUsage
 	flag.BoolVar(&overwrite, "f", false, "Overwrite existing key if it exists")
-	flag.StringVar(&outputFile, "output", "", "Save public key to `file`. Defaults to stdout.")
+	flag.StringVar(&outputFile, "output", "", "Save public key or backup to `file`. Defaults to stdout.")
+	flag.StringVar(&format, "format", "pem", "Public key `encoding` (pem|der|hex|jwk)")
+	flag.BoolVar(&config.EncryptKeyFile, "encrypt", false, "Protect private keys written to -key-file or exported with a passphrase. Defaults to reading the passphrase from $"+cli.EnvTeslaKeyPass+" or the terminal.")
+	flag.StringVar(&domain, "partner-domain", "", "Fleet API partner `domain` used to print the vehicle pairing link")
+	flag.StringVar(&kdf, "kdf", "scrypt", "Passphrase key-derivation `function` (scrypt|pbkdf2) used with -encrypt")
 	flag.Parse()
 
 	if config.Debug {
@@ -117,7 +298,39 @@ func main() {
 	}
 	config.ReadFromEnvironment()
 
-	if flag.NArg() != 1 {
+	switch kdf {
+	case "scrypt":
+		config.KeyEncryption = protocol.KeyEncryptionScrypt
+	case "pbkdf2":
+		config.KeyEncryption = protocol.KeyEncryptionPBKDF2
+	default:
+		writeErr("Unrecognized -kdf value %q", kdf)
+		return
+	}
+
+	publicFormat := protocol.KeyFormat(format)
+	switch publicFormat {
+	case protocol.KeyFormatPEM, protocol.KeyFormatDER, protocol.KeyFormatHex, protocol.KeyFormatJWK:
+	default:
+		writeErr("Unrecognized -format value %q", format)
+		return
+	}
+
+	switch {
+	case flag.NArg() == 0:
+		usage(os.Stderr)
+		return
+	case flag.Arg(0) == "import" || flag.Arg(0) == "restore":
+		if flag.NArg() != 2 {
+			writeErr("Must provide a filename, or - to read from stdin")
+			return
+		}
+	case flag.Arg(0) == "serve" || flag.Arg(0) == "render" || flag.Arg(0) == "check":
+		if flag.NArg() != 2 {
+			usage(os.Stderr)
+			return
+		}
+	case flag.Arg(0) != "backup" && flag.NArg() != 1:
 		usage(os.Stderr)
 		return
 	}
@@ -129,7 +342,7 @@ func main() {
 			return
 		}
 
-		skey, err = protocol.LoadPrivateKey(config.KeyFilename)
+		skey, err = config.LoadPrivateKeyFile()
 		if err != nil {
 			writeErr("Unable to read key: %s", err)
 			return
@@ -147,7 +360,7 @@ func main() {
 			// Print key and exit if it already exists
 			skey, err = config.PrivateKey()
 			if err == nil {
-				if ok := printPublicKey(skey, outputFile); !ok {
+				if ok := printPublicKey(skey, outputFile, publicFormat); !ok {
 					writeErr("Failed to parse key. The keyring may be corrupted. Run with -f to generate new key.")
 					return
 				}
@@ -163,7 +376,7 @@ func main() {
 	case "export":
 		skey, err = config.PrivateKey()
 		if err == nil {
-			err = printPrivateKey(skey)
+			err = printPrivateKey(config, skey)
 		}
 		if err != nil {
 			writeErr("Failed to export private key: %s", err)
@@ -171,6 +384,63 @@ func main() {
 			status = 0
 		}
 		return
+	case "import":
+		if !overwrite {
+			if _, err = config.PrivateKey(); err == nil {
+				writeErr("Key already exists. Run with -f to overwrite.")
+				return
+			}
+		}
+		skey, err = importKey(config, flag.Arg(1))
+		if err != nil {
+			writeErr("Failed to import key: %s", err)
+			return
+		}
+	case "public":
+		skey, err = config.PrivateKey()
+		if err != nil {
+			writeErr("Failed to load private key: %s", err)
+			return
+		}
+		if ok := printPublicKey(skey, outputFile, publicFormat); !ok {
+			writeErr("Failed to write public key.")
+			return
+		}
+		status = 0
+		return
+	case "list":
+		if err := listKeys(config); err != nil {
+			writeErr("Failed to list keys: %s", err)
+		} else {
+			status = 0
+		}
+		return
+	case "backup":
+		if err := backupKeys(config, flag.Args()[1:], outputFile); err != nil {
+			writeErr("Failed to back up keys: %s", err)
+		} else {
+			status = 0
+		}
+		return
+	case "restore":
+		if err := restoreKeys(config, flag.Arg(1), overwrite); err != nil {
+			writeErr("Failed to restore keys: %s", err)
+		} else {
+			status = 0
+		}
+		return
+	case "serve", "render", "check":
+		skey, err = config.PrivateKey()
+		if err != nil {
+			writeErr("Failed to load private key: %s", err)
+			return
+		}
+		if err := hostPublicKey(flag.Arg(0), flag.Arg(1), skey, domain); err != nil {
+			writeErr("Failed to %s public key: %s", flag.Arg(0), err)
+		} else {
+			status = 0
+		}
+		return
 	default:
 		writeErr("Unrecognized command-line argument.")
 		writeErr("")
@@ -183,7 +453,7 @@ func main() {
 		return
 	}
 
-	if ok := printPublicKey(skey, outputFile); !ok {
+	if ok := printPublicKey(skey, outputFile, publicFormat); !ok {
 		writeErr("Failed to extract public key. Run with -f to generate new key pair.")
 		return
 	}
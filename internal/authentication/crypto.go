@@ -27,6 +27,9 @@ var (
 	// ErrInvalidPrivateKey indicates the local peer tried to load an unsupported or malformed
 	// private key.
 	ErrInvalidPrivateKey = errors.New("invalid private key")
+	// ErrPassphraseRequired indicates the local peer tried to load an encrypted private key
+	// without providing a passphrase.
+	ErrPassphraseRequired = errors.New("private key is encrypted and requires a passphrase")
 )
 
 // A Session allows encrypting/decrypting/authenticating data using a shared ECDH secret.
@@ -18,6 +18,7 @@ import (
 	"math/big"
 	"os"
 
+	"github.com/teslamotors/vehicle-command/internal/pkcs8"
 	"github.com/teslamotors/vehicle-command/internal/schnorr"
 	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/signatures"
 )
@@ -74,7 +75,14 @@ func (n *NativeSession) NewHMAC(label string) hash.Hash {
 }
 
 func (n *NativeSession) SessionInfoHMAC(id, challenge, encodedInfo []byte) ([]byte, error) {
-	meta := newMetadataHash(n.NewHMAC(labelSessionInfo))
+	return SessionInfoHMAC(n, id, challenge, encodedInfo)
+}
+
+// SessionInfoHMAC returns the session info HMAC tag for encodedInfo using session.NewHMAC. It
+// allows Session implementations outside of this package, whose keys are held elsewhere, to reuse
+// the encoding of the native session implementation.
+func SessionInfoHMAC(session Session, id, challenge, encodedInfo []byte) ([]byte, error) {
+	meta := newMetadataHash(session.NewHMAC(labelSessionInfo))
 	if err := meta.Add(signatures.Tag_TAG_SIGNATURE_TYPE, []byte{byte(signatures.SignatureType_SIGNATURE_TYPE_HMAC)}); err != nil {
 		return nil, err
 	}
@@ -145,10 +153,24 @@ func NewECDHPrivateKey(rng io.Reader) (ECDHPrivateKey, error) {
 }
 
 func LoadExternalECDHKey(filename string) (ECDHPrivateKey, error) {
+	return LoadEncryptedExternalECDHKey(filename, nil)
+}
+
+// LoadEncryptedExternalECDHKey loads a PEM-encoded private key from filename. If the key is an
+// encrypted PKCS #8 key, passphrase is called to obtain the passphrase. If passphrase is nil,
+// encrypted keys result in ErrPassphraseRequired.
+func LoadEncryptedExternalECDHKey(filename string, passphrase func() ([]byte, error)) (ECDHPrivateKey, error) {
 	pemBlock, err := os.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
+	return ParseExternalECDHKey(pemBlock, passphrase)
+}
+
+// ParseExternalECDHKey parses a PEM-encoded SEC1 or PKCS #8 private key. See
+// LoadEncryptedExternalECDHKey.
+func ParseExternalECDHKey(pemBlock []byte, passphrase func() ([]byte, error)) (ECDHPrivateKey, error) {
+	var err error
 	block, _ := pem.Decode([]byte(pemBlock))
 	if block == nil {
 		return nil, fmt.Errorf("%w: expected PEM encoding", ErrInvalidPrivateKey)
@@ -156,20 +178,37 @@ func LoadExternalECDHKey(filename string) (ECDHPrivateKey, error) {
 
 	var ecdsaPrivateKey *ecdsa.PrivateKey
 
-	if block.Type == "EC PRIVATE KEY" {
+	switch block.Type {
+	case "EC PRIVATE KEY":
 		ecdsaPrivateKey, err = x509.ParseECPrivateKey(block.Bytes)
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "ENCRYPTED PRIVATE KEY":
+		if passphrase == nil {
+			return nil, ErrPassphraseRequired
+		}
+		secret, err := passphrase()
 		if err != nil {
 			return nil, err
 		}
-		var ok bool
-		if ecdsaPrivateKey, ok = privateKey.(*ecdsa.PrivateKey); !ok {
-			return nil, fmt.Errorf("%w: only elliptic curve keys supported", ErrInvalidPrivateKey)
+		der, err := pkcs8.Decrypt(block.Bytes, secret)
+		if err != nil {
+			return nil, err
 		}
+		// A wrong passphrase occasionally produces valid padding, so a parsing failure is most
+		// likely caused by the passphrase too.
+		if ecdsaPrivateKey, err = parsePKCS8(der); err != nil {
+			if errors.Is(err, ErrInvalidPrivateKey) {
+				return nil, err
+			}
+			return nil, pkcs8.ErrIncorrectPassphrase
+		}
+	default:
+		ecdsaPrivateKey, err = parsePKCS8(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	if ecdsaPrivateKey.Curve != elliptic.P256() {
@@ -178,6 +217,35 @@ func LoadExternalECDHKey(filename string) (ECDHPrivateKey, error) {
 	return &NativeECDHKey{ecdsaPrivateKey}, nil
 }
 
+func parsePKCS8(der []byte) (*ecdsa.PrivateKey, error) {
+	privateKey, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	ecdsaPrivateKey, ok := privateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: only elliptic curve keys supported", ErrInvalidPrivateKey)
+	}
+	return ecdsaPrivateKey, nil
+}
+
+// EncryptPrivateKey returns the PEM encoding of skey as an encrypted PKCS #8 private key.
+func EncryptPrivateKey(skey ECDHPrivateKey, passphrase []byte, kdf pkcs8.KDF) ([]byte, error) {
+	nativeKey, ok := skey.(*NativeECDHKey)
+	if !ok {
+		return nil, fmt.Errorf("key is not exportable")
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(nativeKey.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := pkcs8.Encrypt(der, passphrase, kdf)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: encrypted}), nil
+}
+
 func UnmarshalECDHPrivateKey(privateScalar []byte) ECDHPrivateKey {
 	if len(privateScalar) != 32 {
 		return nil
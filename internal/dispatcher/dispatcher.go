@@ -3,8 +3,10 @@ package dispatcher
 import (
 	"context"
 	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"log/slog"
 	"sync"
 	"time"
 
@@ -12,6 +14,7 @@ import (
 	"github.com/teslamotors/vehicle-command/internal/log"
 	"github.com/teslamotors/vehicle-command/pkg/connector"
 	"github.com/teslamotors/vehicle-command/pkg/protocol"
+	"github.com/teslamotors/vehicle-command/pkg/trace"
 
 	"google.golang.org/protobuf/proto"
 
@@ -37,6 +40,8 @@ type Dispatcher struct {
 
 	handlerLock sync.Mutex
 	handlers    map[receiverKey]*receiver
+
+	log *log.Logger
 }
 
 // New creates a Dispatcher from a Connector.
@@ -49,6 +54,7 @@ func New(conn connector.Connector, privateKey authentication.ECDHPrivateKey) (*D
 		handlers:   make(map[receiverKey]*receiver),
 		privateKey: privateKey,
 		done:       make(chan bool),
+		log:        log.New(nil).With(log.KeyVIN, conn.VIN()),
 	}
 	if _, err := rand.Read(dispatcher.address); err != nil {
 		return nil, err
@@ -56,6 +62,17 @@ func New(conn connector.Connector, privateKey authentication.ECDHPrivateKey) (*D
 	return &dispatcher, nil
 }
 
+// SetLogger directs log messages to logger. If logger is nil, messages are written to the global
+// logger. Must be called before d.Start.
+func (d *Dispatcher) SetLogger(logger *slog.Logger) {
+	d.log = log.New(logger).With(log.KeyVIN, d.conn.VIN())
+}
+
+// requestLog returns a Logger that tags messages with a request UUID.
+func (d *Dispatcher) requestLog(uuid []byte) *log.Logger {
+	return d.log.With(log.KeyRequestUUID, fmt.Sprintf("%02x", uuid))
+}
+
 func (d *Dispatcher) SetMaxLatency(latency time.Duration) {
 	if latency > 0 {
 		d.latencyLock.Lock()
@@ -70,8 +87,15 @@ func (d *Dispatcher) RetryInterval() time.Duration {
 }
 
 // StartSession sends a blocking request start an authenticated session with a universal.Domain.
-func (d *Dispatcher) StartSession(ctx context.Context, domain universal.Domain) error {
-	var err error
+func (d *Dispatcher) StartSession(ctx context.Context, domain universal.Domain) (err error) {
+	ctx, span := trace.Start(ctx, "Dispatcher.StartSession")
+	span.SetAttribute(trace.AttrVIN, d.conn.VIN())
+	span.SetAttribute(trace.AttrDomain, domain.String())
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
 	var sessionReady bool
 	d.sessionLock.Lock()
 	s, ok := d.sessions[domain]
@@ -79,15 +103,18 @@ func (d *Dispatcher) StartSession(ctx context.Context, domain universal.Domain)
 		d.sessions[domain], err = newSession(d.privateKey, d.conn.VIN())
 		s = d.sessions[domain]
 	} else if s != nil && s.ctx != nil {
-		log.Info("Session for %s loaded from cache", domain)
+		d.log.With(log.KeyDomain, domain.String()).Info("Session for %s loaded from cache", domain)
 		sessionReady = true
 	}
 	d.sessionLock.Unlock()
+	span.SetAttribute(trace.AttrSessionCached, sessionReady)
 	if err != nil || sessionReady {
 		return err
 	}
-	for {
-		if retry, err := d.tryStartSession(ctx, s, domain); !retry {
+	for retries := 0; ; retries++ {
+		span.SetAttribute(trace.AttrRetryCount, retries)
+		var retry bool
+		if retry, err = d.tryStartSession(ctx, s, domain); !retry {
 			return err
 		}
 	}
@@ -187,7 +214,7 @@ func (d *Dispatcher) checkForSessionUpdate(message *universal.RoutableMessage, h
 	}
 
 	if d.privateKey == nil {
-		log.Warning("[%02x] Discarding session info because client does not have a private key", message.GetRequestUuid())
+		d.requestLog(message.GetRequestUuid()).Warning("Discarding session info because client does not have a private key")
 		return
 	}
 
@@ -196,13 +223,13 @@ func (d *Dispatcher) checkForSessionUpdate(message *universal.RoutableMessage, h
 	d.latencyLock.Unlock()
 
 	if handler.expired(maxLatency) {
-		log.Warning("[%02x] Discarding session info because it was received more than %s after request", message.GetRequestUuid(), maxLatency)
+		d.requestLog(message.GetRequestUuid()).Warning("Discarding session info because it was received more than %s after request", maxLatency)
 		return
 	}
 
 	tag := message.GetSignatureData().GetSessionInfoTag().GetTag()
 	if tag == nil {
-		log.Warning("[%02x] Discarding unauthenticated session info", message.GetRequestUuid())
+		d.requestLog(message.GetRequestUuid()).Warning("Discarding unauthenticated session info")
 		return
 	}
 	var err error
@@ -212,15 +239,15 @@ func (d *Dispatcher) checkForSessionUpdate(message *universal.RoutableMessage, h
 
 	session, ok := d.sessions[domain]
 	if !ok {
-		log.Error("[%02x] Dropping session from unregistered domain %s", message.GetRequestUuid(), domain)
+		d.requestLog(message.GetRequestUuid()).Error("Dropping session from unregistered domain %s", domain)
 		return
 	}
 
 	if err = session.processHello(message.GetRequestUuid(), sessionInfo, tag); err != nil {
-		log.Warning("[%02x] Session info error: %s", message.GetRequestUuid(), err)
+		d.requestLog(message.GetRequestUuid()).Warning("Session info error: %s", err)
 		return
 	}
-	log.Info("[%02x] Updated session info for %s", message.GetRequestUuid(), domain)
+	d.requestLog(message.GetRequestUuid()).Info("Updated session info for %s", domain)
 }
 
 func (d *Dispatcher) decrypt(message *universal.RoutableMessage, handler *receiver) error {
@@ -246,14 +273,14 @@ func (d *Dispatcher) process(message *universal.RoutableMessage) {
 	var key receiverKey
 
 	if message.GetFromDestination() == nil {
-		log.Warning("[xxx] Dropping message with missing source")
+		d.log.Warning("Dropping message with missing source")
 		return
 	}
 	key.domain = message.GetFromDestination().GetDomain()
 
 	requestUUID := message.GetRequestUuid()
 	if len(requestUUID) != uuidLength && len(requestUUID) != 0 {
-		log.Warning("[xxx] Dropping message with invalid request UUID length")
+		d.log.Warning("Dropping message with invalid request UUID length")
 		return
 	}
 	if key.domain != universal.Domain_DOMAIN_VEHICLE_SECURITY {
@@ -262,24 +289,24 @@ func (d *Dispatcher) process(message *universal.RoutableMessage) {
 
 	destination := message.GetToDestination()
 	if destination == nil {
-		log.Warning("[%02x] Dropping message with missing destination", message.GetRequestUuid())
+		d.requestLog(message.GetRequestUuid()).Warning("Dropping message with missing destination")
 		return
 	}
 
-	switch d := destination.SubDestination.(type) {
+	switch dest := destination.SubDestination.(type) {
 	case *universal.Destination_Domain:
-		log.Debug("[%02x] Dropping message to %s", message.GetRequestUuid(), d.Domain)
+		d.requestLog(message.GetRequestUuid()).Debug("Dropping message to %s", dest.Domain)
 		return
 	case *universal.Destination_RoutingAddress:
 		// Continue
 	default:
-		log.Debug("[%02x] Dropping message with unrecognized destination type", message.GetRequestUuid())
+		d.requestLog(message.GetRequestUuid()).Debug("Dropping message with unrecognized destination type")
 		return
 	}
 
 	addr := destination.GetRoutingAddress()
 	if len(addr) != addressLength {
-		log.Warning("[%02x] Dropping message with invalid address length", message.GetRequestUuid())
+		d.requestLog(message.GetRequestUuid()).Warning("Dropping message with invalid address length")
 		return
 	}
 	copy(key.address[:], addr)
@@ -288,7 +315,7 @@ func (d *Dispatcher) process(message *universal.RoutableMessage) {
 	handler, ok := d.handlers[key]
 	d.handlerLock.Unlock()
 	if !ok {
-		log.Warning("[%02x] Dropping message without registered handler %s", requestUUID, key.String())
+		d.requestLog(requestUUID).Warning("Dropping message without registered handler %s", key.String())
 		return
 	}
 
@@ -300,17 +327,17 @@ func (d *Dispatcher) process(message *universal.RoutableMessage) {
 
 	// Decryption is a no-op for plaintext messages
 	if err := d.decrypt(message, handler); err == protocol.ErrReplayedResponse {
-		log.Info("[%02x] Dropping duplicate vehicle response", requestUUID)
+		d.requestLog(requestUUID).Info("Dropping duplicate vehicle response")
 		return
 	} else if err != nil {
-		log.Warning("[%02x] Error decrypting vehicle response: %s", requestUUID, err)
+		d.requestLog(requestUUID).Warning("Error decrypting vehicle response: %s", err)
 		return
 	}
 
 	select {
 	case handler.ch <- message:
 	default:
-		log.Error("[%02x] Dropping response to command because response handler queue is full", requestUUID)
+		d.requestLog(requestUUID).Error("Dropping response to command because response handler queue is full")
 	}
 }
 
@@ -329,7 +356,7 @@ func (d *Dispatcher) Start(ctx context.Context) error {
 
 // Listen for incoming commands and dispatch them to registered receivers.
 func (d *Dispatcher) listen(ready chan<- struct{}) {
-	log.Info("Starting dispatcher service...")
+	d.log.Info("Starting dispatcher service...")
 	d.doneLock.Lock()
 	if d.terminate == nil {
 		d.terminate = make(chan struct{})
@@ -352,7 +379,7 @@ func (d *Dispatcher) listen(ready chan<- struct{}) {
 			}
 			message := new(universal.RoutableMessage)
 			if err := proto.Unmarshal(messageBytes, message); err != nil {
-				log.Warning("Dropping unparseable message: %s", err)
+				d.log.Warning("Dropping unparseable message: %s", err)
 				continue
 			}
 			d.process(message)
@@ -376,7 +403,15 @@ func (d *Dispatcher) Stop() {
 }
 
 // Send a message to a vehicle.
-func (d *Dispatcher) Send(ctx context.Context, message *universal.RoutableMessage, auth connector.AuthMethod) (protocol.Receiver, error) {
+func (d *Dispatcher) Send(ctx context.Context, message *universal.RoutableMessage, auth connector.AuthMethod) (recv protocol.Receiver, err error) {
+	ctx, span := trace.Start(ctx, "Dispatcher.Send")
+	span.SetAttribute(trace.AttrVIN, d.conn.VIN())
+	span.SetAttribute(trace.AttrDomain, message.GetToDestination().GetDomain().String())
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
 	d.doneLock.Lock()
 	listening := d.terminate != nil
 	d.doneLock.Unlock()
@@ -408,6 +443,7 @@ func (d *Dispatcher) Send(ctx context.Context, message *universal.RoutableMessag
 
 	copy(key.address[:], addr)
 	message.Uuid = uuid
+	span.SetAttribute(trace.AttrRequestUUID, hex.EncodeToString(uuid))
 	message.FromDestination = &universal.Destination{
 		SubDestination: &universal.Destination_RoutingAddress{RoutingAddress: addr},
 	}
@@ -422,7 +458,7 @@ func (d *Dispatcher) Send(ctx context.Context, message *universal.RoutableMessag
 		}
 		d.sessionLock.Unlock()
 		if !ok {
-			log.Warning("No session available for %s", message.GetToDestination().GetDomain())
+			d.log.With(log.KeyDomain, key.domain.String()).Warning("No session available for %s", key.domain)
 			return nil, protocol.ErrNoSession
 		}
 		if err := session.authorize(ctx, message, auth); err != nil {
@@ -441,16 +477,17 @@ func (d *Dispatcher) Send(ctx context.Context, message *universal.RoutableMessag
 		}
 	}()
 
-	for {
+	for retries := 0; ; retries++ {
+		span.SetAttribute(trace.AttrRetryCount, retries)
 		err = d.conn.Send(ctx, encodedMessage)
 		if err == nil {
 			return resp, nil
 		}
 		if !protocol.ShouldRetry(err) {
-			log.Warning("[%02x] Terminal transmission error: %s", message.GetUuid(), err)
+			d.requestLog(message.GetUuid()).Warning("Terminal transmission error: %s", err)
 			return nil, err
 		}
-		log.Debug("[%02x] Retrying transmission after error: %s", message.GetUuid(), err)
+		d.requestLog(message.GetUuid()).Debug("Retrying transmission after error: %s", err)
 		select {
 		case <-ctx.Done():
 			return nil, &protocol.CommandError{Err: ctx.Err(), PossibleSuccess: false, PossibleTemporary: true}
@@ -480,7 +517,7 @@ func SessionInfoRequest(domain universal.Domain, publicBytes []byte) *universal.
 // RequestSessionInfo sends a handshake request and returns a protocol.Receiver for receiving the
 // response.
 func (d *Dispatcher) RequestSessionInfo(ctx context.Context, domain universal.Domain) (protocol.Receiver, error) {
-	log.Info("Requesting session info from %s", domain)
+	d.log.With(log.KeyDomain, domain.String()).Info("Requesting session info from %s", domain)
 	if d.privateKey == nil {
 		return nil, protocol.ErrRequiresKey
 	}
@@ -5,12 +5,14 @@ import (
 	"context"
 	"crypto/rand"
 	"errors"
+	"fmt"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/teslamotors/vehicle-command/pkg/connector"
 	"github.com/teslamotors/vehicle-command/pkg/protocol"
+	"github.com/teslamotors/vehicle-command/pkg/trace"
 
 	"google.golang.org/protobuf/proto"
 
@@ -719,6 +721,59 @@ func TestRetrySend(t *testing.T) {
 	}
 }
 
+func TestSendTrace(t *testing.T) {
+	exporter := trace.NewInMemoryExporter()
+	trace.SetExporter(exporter)
+	defer trace.SetExporter(nil)
+
+	dispatcher, conn := getTestSetup(t)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ctx, parent := trace.Start(ctx, "test")
+
+	const errCount = 2
+	for i := 0; i < errCount; i++ {
+		conn.EnqueueSendError(&protocol.CommandError{Err: errTimeout, PossibleSuccess: false, PossibleTemporary: true})
+	}
+	conn.EnqueueSendError(&protocol.RoutableMessageError{Code: universal.MessageFault_E_MESSAGEFAULT_ERROR_REMOTE_ACCESS_DISABLED})
+
+	req := testCommand()
+	if rsp, err := dispatcher.Send(ctx, req, connector.AuthMethodNone); err == nil {
+		rsp.Close()
+		t.Fatal("Expected error")
+	}
+
+	var span *trace.SpanData
+	for _, s := range exporter.Spans() {
+		if s.Name == "Dispatcher.Send" && s.Parent == parent.SpanContext() {
+			span = &s
+			break
+		}
+	}
+	if span == nil {
+		t.Fatal("Dispatcher.Send span not exported")
+	}
+	if span.SpanContext.TraceID != parent.SpanContext().TraceID {
+		t.Error("Span not part of parent trace")
+	}
+	expected := map[string]interface{}{
+		trace.AttrDomain:      testDomain.String(),
+		trace.AttrRetryCount:  errCount,
+		trace.AttrRequestUUID: fmt.Sprintf("%x", req.GetUuid()),
+		trace.AttrFaultCode:   universal.MessageFault_E_MESSAGEFAULT_ERROR_REMOTE_ACCESS_DISABLED.String(),
+	}
+	for key, value := range expected {
+		if span.Attributes[key] != value {
+			t.Errorf("Expected %s=%v, got %v", key, value, span.Attributes[key])
+		}
+	}
+	if span.Err == nil {
+		t.Error("Expected span to record error")
+	}
+}
+
 func TestSendTimeout(t *testing.T) {
 	dispatcher, conn := getTestSetup(t)
 	defer conn.Close()
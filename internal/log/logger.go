@@ -1,11 +1,18 @@
 // Package log provides a global logger with configurable logging level. The intended use is for
 // development builds.
+//
+// Components that allow clients to inject a *slog.Logger wrap it in a [Logger], which provides the
+// same printf-style methods as the package-level functions and redacts secrets before records
+// reach the client's handler.
 
 package log
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
 	"os"
+	"strings"
 	"sync"
 	"time"
 )
@@ -20,6 +27,14 @@ const (
 	LevelDebug                // Logs detailed IO
 )
 
+// Structured field names attached to log records.
+const (
+	KeyVIN         = "vin"
+	KeyDomain      = "domain"
+	KeyRequestUUID = "request_uuid"
+	KeyComponent   = "component"
+)
+
 var globalLogLevel Level
 var logMutex sync.Mutex
 
@@ -42,23 +57,140 @@ func logLevel() Level {
 	return globalLogLevel
 }
 
-func log(level Level, format string, a ...interface{}) {
-	if level <= logLevel() {
-		msg := fmt.Sprintf("%s %s ", time.Now().Format(time.RFC3339), labels[level])
-		msg += fmt.Sprintf(format, a...)
-		fmt.Fprintln(os.Stderr, msg)
+var slogLevels = map[Level]slog.Level{
+	LevelDebug:   slog.LevelDebug,
+	LevelInfo:    slog.LevelInfo,
+	LevelWarning: slog.LevelWarn,
+	LevelError:   slog.LevelError,
+}
+
+func fromSlogLevel(level slog.Level) Level {
+	switch {
+	case level >= slog.LevelError:
+		return LevelError
+	case level >= slog.LevelWarn:
+		return LevelWarning
+	case level >= slog.LevelInfo:
+		return LevelInfo
+	default:
+		return LevelDebug
+	}
+}
+
+// legacyHandler is a slog.Handler that writes to stderr in this package's original format,
+// filtering by the level set with SetLevel. Structured fields are appended as key=value pairs.
+type legacyHandler struct {
+	prefix string
+	attrs  []slog.Attr
+}
+
+func (h *legacyHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return fromSlogLevel(level) <= logLevel()
+}
+
+func (h *legacyHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %s", time.Now().Format(time.RFC3339), labels[fromSlogLevel(r.Level)], r.Message)
+	writeAttr := func(a slog.Attr) bool {
+		fmt.Fprintf(&b, " %s%s=%v", h.prefix, a.Key, a.Value)
+		return true
+	}
+	for _, a := range h.attrs {
+		writeAttr(a)
+	}
+	r.Attrs(writeAttr)
+	fmt.Fprintln(os.Stderr, b.String())
+	return nil
+}
+
+func (h *legacyHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	child := &legacyHandler{prefix: h.prefix}
+	child.attrs = append(child.attrs, h.attrs...)
+	for _, a := range attrs {
+		a.Key = h.prefix + a.Key
+		child.attrs = append(child.attrs, a)
+	}
+	return child
+}
+
+func (h *legacyHandler) WithGroup(name string) slog.Handler {
+	return &legacyHandler{prefix: h.prefix + name + ".", attrs: h.attrs}
+}
+
+// Logger writes printf-style log messages to a slog.Handler. A nil *Logger writes to the global
+// logger.
+type Logger struct {
+	logger *slog.Logger
+}
+
+var defaultLogger = &Logger{logger: slog.New(NewRedactingHandler(&legacyHandler{}))}
+
+// New returns a Logger that writes to l, redacting secrets. If l is nil, the Logger writes to
+// stderr using the level set by SetLevel.
+func New(l *slog.Logger) *Logger {
+	if l == nil {
+		return defaultLogger
+	}
+	return &Logger{logger: slog.New(NewRedactingHandler(l.Handler()))}
+}
+
+// With returns a Logger that includes the given key-value pairs in each record.
+func (l *Logger) With(args ...interface{}) *Logger {
+	if l == nil {
+		l = defaultLogger
+	}
+	return &Logger{logger: l.logger.With(args...)}
+}
+
+func (l *Logger) log(level Level, format string, a ...interface{}) {
+	if l == nil {
+		l = defaultLogger
+	}
+	ctx := context.Background()
+	if !l.logger.Enabled(ctx, slogLevels[level]) {
+		return
+	}
+	l.logger.Log(ctx, slogLevels[level], fmt.Sprintf(format, a...))
+}
+
+func (l *Logger) Debug(format string, a ...interface{}) {
+	l.log(LevelDebug, format, a...)
+}
+func (l *Logger) Info(format string, a ...interface{}) {
+	l.log(LevelInfo, format, a...)
+}
+func (l *Logger) Warning(format string, a ...interface{}) {
+	l.log(LevelWarning, format, a...)
+}
+func (l *Logger) Error(format string, a ...interface{}) {
+	l.log(LevelError, format, a...)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx that carries l. Functions that don't belong to an object with
+// its own Logger use FromContext to find one.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the Logger stored in ctx by NewContext, or the global logger.
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(contextKey{}).(*Logger); ok {
+		return l
 	}
+	return defaultLogger
 }
 
 func Debug(format string, a ...interface{}) {
-	log(LevelDebug, format, a...)
+	defaultLogger.Debug(format, a...)
 }
 func Info(format string, a ...interface{}) {
-	log(LevelInfo, format, a...)
+	defaultLogger.Info(format, a...)
 }
 func Warning(format string, a ...interface{}) {
-	log(LevelWarning, format, a...)
+	defaultLogger.Warning(format, a...)
 }
 func Error(format string, a ...interface{}) {
-	log(LevelError, format, a...)
+	defaultLogger.Error(format, a...)
 }
@@ -0,0 +1,92 @@
+package log
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are substrings of field names whose values are never logged.
+var sensitiveKeys = []string{"token", "password", "pin", "secret", "authorization"}
+
+var (
+	bearerRE = regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+`)
+	// Matches JSON string or number values of sensitive fields, such as {"pin": "1234"}.
+	jsonFieldRE = regexp.MustCompile(`(?i)("[a-z_]*(?:token|password|pin|secret)[a-z_]*"\s*:\s*)("(?:[^"\\]|\\.)*"|[0-9]+)`)
+)
+
+// Redact removes OAuth tokens and sensitive JSON fields (such as PINs) from s.
+func Redact(s string) string {
+	s = bearerRE.ReplaceAllString(s, "${1}"+redacted)
+	return jsonFieldRE.ReplaceAllString(s, `${1}"`+redacted+`"`)
+}
+
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	if isSensitiveKey(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Redact(a.Value.String()))
+	case slog.KindGroup:
+		group := a.Value.Group()
+		attrs := make([]slog.Attr, len(group))
+		for i, member := range group {
+			attrs[i] = redactAttr(member)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(attrs...)}
+	}
+	return a
+}
+
+// redactingHandler removes secrets from log records before passing them to another handler.
+type redactingHandler struct {
+	next slog.Handler
+}
+
+// NewRedactingHandler returns a slog.Handler that redacts tokens, PINs, and other secrets from
+// messages and fields before passing records to next.
+func NewRedactingHandler(next slog.Handler) slog.Handler {
+	if h, ok := next.(*redactingHandler); ok {
+		return h
+	}
+	return &redactingHandler{next: next}
+}
+
+func (h *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	clean := slog.NewRecord(r.Time, r.Level, Redact(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		clean.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.next.Handle(ctx, clean)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clean := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		clean[i] = redactAttr(a)
+	}
+	return &redactingHandler{next: h.next.WithAttrs(clean)}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{next: h.next.WithGroup(name)}
+}
@@ -0,0 +1,288 @@
+// Package pkcs8 encrypts and decrypts PKCS #8 private keys using password-based encryption (PBES2,
+// RFC 8018) with AES-CBC and either scrypt (RFC 7914) or PBKDF2 key derivation. These are the
+// formats written by "openssl pkcs8 -topk8 -v2 aes-256-cbc [-scrypt]".
+package pkcs8
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	// ErrIncorrectPassphrase indicates an encrypted private key could not be decrypted, most likely
+	// because the passphrase is wrong.
+	ErrIncorrectPassphrase = errors.New("incorrect passphrase or corrupted private key")
+
+	// ErrUnsupportedEncryption indicates an encrypted private key uses an encryption scheme or
+	// parameters that aren't supported.
+	ErrUnsupportedEncryption = errors.New("unsupported private key encryption")
+)
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt         = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// KDF selects the key-derivation function used by Encrypt.
+type KDF int
+
+const (
+	// KDFScrypt derives keys using scrypt. It's the default because it's memory-hard, which makes
+	// brute-force attacks on stolen key files expensive.
+	KDFScrypt KDF = iota
+	// KDFPBKDF2 derives keys using PBKDF2 with HMAC-SHA256. Use it if key files must be readable by
+	// tools or FIPS-validated modules that don't support scrypt.
+	KDFPBKDF2
+)
+
+// Parameters used by Encrypt. The scrypt parameters match OpenSSL's defaults, which allows OpenSSL
+// to read the files without raising its memory limit. The PBKDF2 iteration count follows current
+// OWASP guidance for HMAC-SHA256.
+const (
+	scryptN          = 1 << 14
+	scryptR          = 8
+	scryptP          = 1
+	pbkdf2Iterations = 600000
+	saltLength       = 16
+)
+
+// Limits on parameters accepted by Decrypt, which prevent a malformed file from causing excessive
+// memory use or CPU time.
+const (
+	maxScryptN          = 1 << 20
+	maxScryptRP         = 1 << 8
+	maxPBKDF2Iterations = 10000000
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+type scryptParams struct {
+	Salt                     []byte
+	CostParameter            int
+	BlockSize                int
+	ParallelizationParameter int
+	KeyLength                int `asn1:"optional"`
+}
+
+// algorithm returns an AlgorithmIdentifier with DER-encoded params.
+func algorithm(oid asn1.ObjectIdentifier, params any) (pkix.AlgorithmIdentifier, error) {
+	encoded, err := asn1.Marshal(params)
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, err
+	}
+	return pkix.AlgorithmIdentifier{Algorithm: oid, Parameters: asn1.RawValue{FullBytes: encoded}}, nil
+}
+
+// unmarshal parses the DER encoding of val from data, rejecting trailing data.
+func unmarshal(data []byte, val any) error {
+	rest, err := asn1.Unmarshal(data, val)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrUnsupportedEncryption, err)
+	}
+	if len(rest) != 0 {
+		return fmt.Errorf("%w: trailing data", ErrUnsupportedEncryption)
+	}
+	return nil
+}
+
+// Encrypt encrypts der, a DER-encoded PKCS #8 PrivateKeyInfo, using passphrase. It returns a
+// DER-encoded EncryptedPrivateKeyInfo, which is usually stored in an "ENCRYPTED PRIVATE KEY" PEM
+// block. The data is encrypted using AES-256-CBC and a key derived using kdf.
+func Encrypt(der, passphrase []byte, kdf KDF) ([]byte, error) {
+	salt := make([]byte, saltLength)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	const keyLength = 32
+	var key []byte
+	var kdfAlgorithm pkix.AlgorithmIdentifier
+	var err error
+	switch kdf {
+	case KDFScrypt:
+		if key, err = scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, keyLength); err != nil {
+			return nil, err
+		}
+		kdfAlgorithm, err = algorithm(oidScrypt, scryptParams{
+			Salt:                     salt,
+			CostParameter:            scryptN,
+			BlockSize:                scryptR,
+			ParallelizationParameter: scryptP,
+		})
+	case KDFPBKDF2:
+		key = pbkdf2.Key(passphrase, salt, pbkdf2Iterations, keyLength, sha256.New)
+		kdfAlgorithm, err = algorithm(oidPBKDF2, pbkdf2Params{
+			Salt:           salt,
+			IterationCount: pbkdf2Iterations,
+			PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+		})
+	default:
+		return nil, fmt.Errorf("%w: unknown KDF %d", ErrUnsupportedEncryption, kdf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	encryptionScheme, err := algorithm(oidAES256CBC, iv)
+	if err != nil {
+		return nil, err
+	}
+	pbes2, err := algorithm(oidPBES2, pbes2Params{KeyDerivationFunc: kdfAlgorithm, EncryptionScheme: encryptionScheme})
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(der)%aes.BlockSize
+	ciphertext := append(bytes.Clone(der), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, ciphertext)
+
+	return asn1.Marshal(encryptedPrivateKeyInfo{Algorithm: pbes2, EncryptedData: ciphertext})
+}
+
+// Decrypt decrypts der, a DER-encoded EncryptedPrivateKeyInfo, using passphrase and returns the
+// DER-encoded PKCS #8 PrivateKeyInfo. It returns ErrIncorrectPassphrase if the decrypted data isn't
+// correctly padded, which usually means the passphrase is wrong. Callers should check the result
+// parses as a private key.
+func Decrypt(der, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if err := unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("%w: only PBES2 is supported", ErrUnsupportedEncryption)
+	}
+	var params pbes2Params
+	if err := unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+
+	var keyLength int
+	switch scheme := params.EncryptionScheme.Algorithm; {
+	case scheme.Equal(oidAES128CBC):
+		keyLength = 16
+	case scheme.Equal(oidAES192CBC):
+		keyLength = 24
+	case scheme.Equal(oidAES256CBC):
+		keyLength = 32
+	default:
+		return nil, fmt.Errorf("%w: cipher %s", ErrUnsupportedEncryption, scheme)
+	}
+	var iv []byte
+	if err := unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("%w: invalid IV", ErrUnsupportedEncryption)
+	}
+
+	key, err := deriveKey(params.KeyDerivationFunc, passphrase, keyLength)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := info.EncryptedData
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, ErrIncorrectPassphrase
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, ErrIncorrectPassphrase
+	}
+	for _, b := range plaintext[len(plaintext)-padding:] {
+		if int(b) != padding {
+			return nil, ErrIncorrectPassphrase
+		}
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+// deriveKey derives a keyLength-byte key from passphrase using kdf.
+func deriveKey(kdf pkix.AlgorithmIdentifier, passphrase []byte, keyLength int) ([]byte, error) {
+	switch {
+	case kdf.Algorithm.Equal(oidScrypt):
+		var params scryptParams
+		if err := unmarshal(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, err
+		}
+		if params.KeyLength != 0 && params.KeyLength != keyLength {
+			return nil, fmt.Errorf("%w: key length doesn't match cipher", ErrUnsupportedEncryption)
+		}
+		if params.CostParameter > maxScryptN || params.BlockSize*params.ParallelizationParameter > maxScryptRP {
+			return nil, fmt.Errorf("%w: scrypt parameters too large", ErrUnsupportedEncryption)
+		}
+		key, err := scrypt.Key(passphrase, params.Salt, params.CostParameter, params.BlockSize, params.ParallelizationParameter, keyLength)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncryption, err)
+		}
+		return key, nil
+	case kdf.Algorithm.Equal(oidPBKDF2):
+		var params pbkdf2Params
+		if err := unmarshal(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, err
+		}
+		if params.KeyLength != 0 && params.KeyLength != keyLength {
+			return nil, fmt.Errorf("%w: key length doesn't match cipher", ErrUnsupportedEncryption)
+		}
+		if params.IterationCount <= 0 || params.IterationCount > maxPBKDF2Iterations {
+			return nil, fmt.Errorf("%w: invalid PBKDF2 iteration count", ErrUnsupportedEncryption)
+		}
+		var prf func() hash.Hash
+		switch {
+		case len(params.PRF.Algorithm) == 0, params.PRF.Algorithm.Equal(oidHMACWithSHA1):
+			prf = sha1.New
+		case params.PRF.Algorithm.Equal(oidHMACWithSHA256):
+			prf = sha256.New
+		default:
+			return nil, fmt.Errorf("%w: PBKDF2 PRF %s", ErrUnsupportedEncryption, params.PRF.Algorithm)
+		}
+		return pbkdf2.Key(passphrase, params.Salt, params.IterationCount, keyLength, prf), nil
+	default:
+		return nil, fmt.Errorf("%w: KDF %s", ErrUnsupportedEncryption, kdf.Algorithm)
+	}
+}
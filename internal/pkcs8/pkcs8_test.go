@@ -0,0 +1,69 @@
+package pkcs8
+
+import (
+	"bytes"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"testing"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	plaintext := []byte("not really a private key")
+	for _, kdf := range []KDF{KDFScrypt, KDFPBKDF2} {
+		der, err := Encrypt(plaintext, []byte("hunter2"), kdf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := Decrypt(der, []byte("hunter2"))
+		if err != nil {
+			t.Fatalf("KDF %d: %s", kdf, err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("KDF %d: decrypted %q", kdf, decrypted)
+		}
+		// A wrong passphrase produces valid padding with probability of roughly 1/256, in which
+		// case callers detect the error when parsing the key.
+		if decrypted, err := Decrypt(der, []byte("hunter3")); err == nil && bytes.Equal(decrypted, plaintext) {
+			t.Errorf("KDF %d: decrypted using wrong passphrase", kdf)
+		}
+	}
+}
+
+func TestDecryptUnsupported(t *testing.T) {
+	kdf, err := algorithm(oidScrypt, scryptParams{
+		Salt:                     []byte("salt"),
+		CostParameter:            1 << 30,
+		BlockSize:                8,
+		ParallelizationParameter: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheme, err := algorithm(oidAES256CBC, make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pbes2, err := algorithm(oidPBES2, pbes2Params{KeyDerivationFunc: kdf, EncryptionScheme: scheme})
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := asn1.Marshal(encryptedPrivateKeyInfo{Algorithm: pbes2, EncryptedData: make([]byte, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decrypt(der, []byte("hunter2")); !errors.Is(err, ErrUnsupportedEncryption) {
+		t.Errorf("Expected ErrUnsupportedEncryption but got %v", err)
+	}
+
+	legacy, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 3}},
+		EncryptedData: make([]byte, 32),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decrypt(legacy, []byte("hunter2")); !errors.Is(err, ErrUnsupportedEncryption) {
+		t.Errorf("Expected ErrUnsupportedEncryption for PBES1 but got %v", err)
+	}
+}
@@ -71,11 +71,13 @@ type Account struct {
 	client     http.Client
 }
 
-// We don't parse JWTs beyond what's required to extract the API server domain name
-type oauthPayload struct {
+// Claims contains the OAuth token claims used to route requests. We don't parse JWTs beyond
+// what's required to extract the API server domain name and identify the client.
+type Claims struct {
 	Audiences []string `json:"aud"`
 	OUCode    string   `json:"ou_code"`
 	Subject   string   `json:"sub"`
+	ClientID  string   `json:"client_id"`
 }
 
 var domainRegEx = regexp.MustCompile(`^[A-Za-z0-9-.]+$`) // We're mostly interested in stopping paths; the http package handles the rest.
@@ -83,7 +85,7 @@ var remappedDomains = map[string]string{}                // For use during devel
 
 const defaultDomain = "fleet-api.prd.na.vn.cloud.tesla.com"
 
-func (p *oauthPayload) domain() string {
+func (p *Claims) domain() string {
 	if len(remappedDomains) > 0 {
 		for _, a := range p.Audiences {
 			if d, ok := remappedDomains[a]; ok {
@@ -114,9 +116,9 @@ func (p *oauthPayload) domain() string {
 	return domain
 }
 
-// New returns an [Account] that can be used to fetch a [vehicle.Vehicle].
-// Optional userAgent can be passed in - otherwise it will be generated from code
-func New(oauthToken, userAgent string) (*Account, error) {
+// ParseClaims extracts the claims from an OAuth token. It does not verify the token's signature;
+// Fleet API does.
+func ParseClaims(oauthToken string) (*Claims, error) {
 	parts := strings.Split(oauthToken, ".")
 	if len(parts) != 3 {
 		return nil, fmt.Errorf("client provided malformed OAuth token")
@@ -125,10 +127,20 @@ func New(oauthToken, userAgent string) (*Account, error) {
 	if err != nil {
 		return nil, fmt.Errorf("client provided malformed OAuth token: %s (%s)", err, parts[1])
 	}
-	var payload oauthPayload
-	if err := json.Unmarshal(payloadJSON, &payload); err != nil {
+	var claims Claims
+	if err := json.Unmarshal(payloadJSON, &claims); err != nil {
 		return nil, fmt.Errorf("client provided malformed OAuth token: %s", err)
 	}
+	return &claims, nil
+}
+
+// New returns an [Account] that can be used to fetch a [vehicle.Vehicle].
+// Optional userAgent can be passed in - otherwise it will be generated from code
+func New(oauthToken, userAgent string) (*Account, error) {
+	payload, err := ParseClaims(oauthToken)
+	if err != nil {
+		return nil, err
+	}
 
 	domain := payload.domain()
 	if domain == "" {
@@ -212,6 +224,44 @@ func (a *Account) SendVehicleFleetAPICommand(ctx context.Context, vin, endpoint
 	return a.sendFleetAPICommand(ctx, endpoint, command)
 }
 
+// vehiclesPerPage is the page size requested by Vehicles.
+const vehiclesPerPage = 100
+
+// VehicleSummary describes a vehicle in the list returned by Fleet API's api/1/vehicles endpoint.
+type VehicleSummary struct {
+	// ID is the identifier used by Fleet API endpoints that predate VIN-based paths.
+	ID          int64  `json:"id"`
+	IDString    string `json:"id_s"`
+	VehicleID   int64  `json:"vehicle_id"`
+	VIN         string `json:"vin"`
+	DisplayName string `json:"display_name"`
+	State       string `json:"state"`
+}
+
+// Vehicles returns the vehicles on the account, fetching every page of results.
+func (a *Account) Vehicles(ctx context.Context) ([]VehicleSummary, error) {
+	var vehicles []VehicleSummary
+	for page := 1; ; page++ {
+		body, err := a.Get(ctx, fmt.Sprintf("api/1/vehicles?page=%d&per_page=%d", page, vehiclesPerPage))
+		if err != nil {
+			return nil, err
+		}
+		var rsp struct {
+			Response   []VehicleSummary `json:"response"`
+			Pagination struct {
+				Next *int `json:"next"`
+			} `json:"pagination"`
+		}
+		if err := json.Unmarshal(body, &rsp); err != nil {
+			return nil, fmt.Errorf("error parsing vehicle list: %w", err)
+		}
+		vehicles = append(vehicles, rsp.Response...)
+		if rsp.Pagination.Next == nil || len(rsp.Response) == 0 {
+			return vehicles, nil
+		}
+	}
+}
+
 // UpdateKey sends metadata about a public key to Tesla's servers.
 //
 // Vehicles query this information when displaying the list of paired mobile devices and NFC cards
@@ -1,9 +1,13 @@
 package account
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -46,7 +50,7 @@ func TestNewAccount(t *testing.T) {
 
 // TestDomainDefault tests the default domain extraction.
 func TestDomainDefault(t *testing.T) {
-	payload := &oauthPayload{
+	payload := &Claims{
 		Audiences: []string{"https://auth.tesla.com/nts"},
 	}
 
@@ -61,7 +65,7 @@ func TestDomainDefault(t *testing.T) {
 
 // TestDomainExtraction tests the extraction of the correct domain based on OUCode.
 func TestDomainExtraction(t *testing.T) {
-	payload := &oauthPayload{
+	payload := &Claims{
 		Audiences: []string{
 			"https://auth.tesla.com/nts",
 			"https://fleet-api.prd.na.vn.cloud.tesla.com",
@@ -82,7 +86,37 @@ func TestDomainExtraction(t *testing.T) {
 }
 
 // makeTestJWT creates a JWT string with the given payload.
-func makeTestJWT(payload *oauthPayload) string {
+func makeTestJWT(payload *Claims) string {
 	jwtBody, _ := json.Marshal(payload)
 	return fmt.Sprintf("x.%s.y", b64Encode(string(jwtBody)))
 }
+
+func TestVehicles(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/1/vehicles" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch req.URL.Query().Get("page") {
+		case "1":
+			fmt.Fprint(w, `{"response":[{"id":100,"id_s":"100","vin":"5YJ3E1EA1KF000001"}],"pagination":{"current":1,"next":2}}`)
+		case "2":
+			fmt.Fprint(w, `{"response":[{"id":200,"id_s":"200","vin":"5YJ3E1EA1KF000002"}],"pagination":{"current":2,"next":null}}`)
+		default:
+			t.Errorf("Unexpected page %s", req.URL.Query().Get("page"))
+		}
+	}))
+	defer server.Close()
+
+	acct := &Account{
+		Host:   strings.TrimPrefix(server.URL, "https://"),
+		client: *server.Client(),
+	}
+	vehicles, err := acct.Vehicles(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vehicles) != 2 || vehicles[0].ID != 100 || vehicles[1].VIN != "5YJ3E1EA1KF000002" {
+		t.Errorf("Unexpected vehicles: %+v", vehicles)
+	}
+}
@@ -0,0 +1,161 @@
+package account
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/teslamotors/vehicle-command/pkg/protocol"
+)
+
+// WellKnownPublicKeyPath is the path at which Fleet API partners must host their public key, as a
+// PEM-encoded PKIX P-256 public key. See [PublicKeyPEM].
+const WellKnownPublicKeyPath = "/.well-known/appspecific/com.tesla.3p.public-key.pem"
+
+// maxPublicKeyFileSize limits how much of a hosted public key file is read by CheckHostedPublicKey.
+const maxPublicKeyFileSize = 16 * 1024
+
+var (
+	// ErrInvalidHostedKey indicates a hosted public key file isn't in the format Tesla expects.
+	ErrInvalidHostedKey = errors.New("hosted file is not a PEM-encoded P-256 public key")
+
+	// ErrPublicKeyMismatch indicates a hosted public key doesn't match the local key.
+	ErrPublicKeyMismatch = errors.New("hosted public key does not match local key")
+)
+
+// PairingLink returns the link that vehicle owners open in the Tesla mobile app to add the public key
+// registered for domain to their vehicle.
+func PairingLink(domain string) string {
+	return "https://tesla.com/_ak/" + domain
+}
+
+// WellKnownPublicKeyURL returns the URL at which domain must host its public key.
+func WellKnownPublicKeyURL(domain string) string {
+	return "https://" + domain + WellKnownPublicKeyPath
+}
+
+// PublicKeyPEM returns the contents of the file that must be hosted at [WellKnownPublicKeyPath].
+// It returns [protocol.ErrInvalidPublicKey] if publicBytes isn't an uncompressed P-256 public key.
+func PublicKeyPEM(publicBytes []byte) ([]byte, error) {
+	return protocol.EncodePublicKey(publicBytes, protocol.KeyFormatPEM)
+}
+
+// PublicKeyHandler returns an http.Handler that serves publicBytes at [WellKnownPublicKeyPath] and
+// responds to all other paths with 404 Not Found.
+func PublicKeyHandler(publicBytes []byte) (http.Handler, error) {
+	encoded, err := PublicKeyPEM(publicBytes)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(WellKnownPublicKeyPath, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		_, _ = w.Write(encoded)
+	})
+	return mux, nil
+}
+
+// WritePublicKeyDir writes publicBytes to [WellKnownPublicKeyPath] inside dir, creating
+// subdirectories as needed, so that dir can be served by a static web server. It returns the name
+// of the file it wrote.
+func WritePublicKeyDir(dir string, publicBytes []byte) (string, error) {
+	encoded, err := PublicKeyPEM(publicBytes)
+	if err != nil {
+		return "", err
+	}
+	filename := filepath.Join(dir, filepath.FromSlash(WellKnownPublicKeyPath))
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return "", err
+	}
+	return filename, os.WriteFile(filename, encoded, 0644)
+}
+
+// parseHostedPublicKey returns the uncompressed public key in a hosted public key file.
+func parseHostedPublicKey(data []byte) ([]byte, error) {
+	block, rest := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%w: expected a PEM block of type PUBLIC KEY", ErrInvalidHostedKey)
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return nil, fmt.Errorf("%w: unexpected data after public key", ErrInvalidHostedKey)
+	}
+	pkey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidHostedKey, err)
+	}
+	var publicKey *ecdh.PublicKey
+	switch pkey := pkey.(type) {
+	case *ecdsa.PublicKey:
+		if pkey.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("%w: key is not on curve P-256", ErrInvalidHostedKey)
+		}
+		publicKey, err = pkey.ECDH()
+	case *ecdh.PublicKey:
+		if pkey.Curve() != ecdh.P256() {
+			return nil, fmt.Errorf("%w: key is not on curve P-256", ErrInvalidHostedKey)
+		}
+		publicKey = pkey
+	default:
+		return nil, fmt.Errorf("%w: key is not an elliptic curve key", ErrInvalidHostedKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidHostedKey, err)
+	}
+	return publicKey.Bytes(), nil
+}
+
+// CheckHostedPublicKey fetches the public key file at url and verifies that it contains
+// publicBytes in the format Tesla expects. If client is nil, http.DefaultClient is used.
+//
+// It returns an error wrapping [ErrInvalidHostedKey] if the file can't be parsed, or
+// [ErrPublicKeyMismatch] if it contains a different key.
+func CheckHostedPublicKey(ctx context.Context, client *http.Client, url string, publicBytes []byte) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("couldn't fetch %s: %s", url, rsp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(rsp.Body, maxPublicKeyFileSize))
+	if err != nil {
+		return err
+	}
+	hosted, err := parseHostedPublicKey(data)
+	if err != nil {
+		// Web servers commonly respond to unknown paths with an index page instead of a 404.
+		if strings.HasPrefix(rsp.Header.Get("Content-Type"), "text/html") {
+			return fmt.Errorf("%w: server returned an HTML page", ErrInvalidHostedKey)
+		}
+		return err
+	}
+	if !bytes.Equal(hosted, publicBytes) {
+		return fmt.Errorf("%w: found %s, expected %s", ErrPublicKeyMismatch,
+			protocol.KeyFingerprint(hosted), protocol.KeyFingerprint(publicBytes))
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"io"
 	"os"
+	"sort"
 	"sync"
 	"time"
 
@@ -111,3 +112,33 @@ func (c *SessionCache) GetEntry(vin string) ([]dispatcher.CacheEntry, bool) {
 	session, ok := c.Vehicles[vin]
 	return session, ok
 }
+
+// VINs returns the VINs that have cached sessions, in sorted order.
+func (c *SessionCache) VINs() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	vins := make([]string, 0, len(c.Vehicles))
+	for vin := range c.Vehicles {
+		vins = append(vins, vin)
+	}
+	sort.Strings(vins)
+	return vins
+}
+
+// Delete removes the sessions associated with vin. Subsequent connections to the vehicle perform
+// a new handshake.
+func (c *SessionCache) Delete(vin string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.Vehicles, vin)
+}
+
+// Clear removes all sessions from the SessionCache.
+func (c *SessionCache) Clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.Vehicles = make(map[string][]dispatcher.CacheEntry)
+}
@@ -97,3 +97,17 @@ func TestEviction(t *testing.T) {
 	_ = c.Update("1", generateTestSessions(1))
 	verifyCache(t, c, []int{4, 5, 6, 7, 8})
 }
+
+func TestDeleteAndClear(t *testing.T) {
+	c := generateTestCache(t, 3)
+	if vins := c.VINs(); len(vins) != 3 || vins[0] != "0" || vins[2] != "2" {
+		t.Errorf("unexpected VINs: %v", vins)
+	}
+	c.Delete("1")
+	verifyCache(t, c, []int{0, 2})
+	c.Clear()
+	verifyCache(t, c, nil)
+	if _, ok := c.GetEntry("0"); ok {
+		t.Error("cleared cache returned entry")
+	}
+}
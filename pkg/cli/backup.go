@@ -0,0 +1,110 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/teslamotors/vehicle-command/pkg/protocol"
+)
+
+// KeyBackupVersion is the version of the KeyBackup format written by [Config.BackupKeys].
+const KeyBackupVersion = 1
+
+var (
+	// ErrUnsupportedBackup indicates a KeyBackup was written by a newer version of this package.
+	ErrUnsupportedBackup = errors.New("unsupported key backup version")
+
+	// ErrFingerprintMismatch indicates a key in a KeyBackup doesn't match its recorded fingerprint.
+	ErrFingerprintMismatch = errors.New("key backup is corrupted: fingerprint mismatch")
+)
+
+// KeyBackup holds encrypted copies of private keys from the system keyring. It's serialized as
+// JSON. Names and fingerprints are stored in plaintext so that backups can be inspected without
+// the passphrase.
+type KeyBackup struct {
+	Version int         `json:"version"`
+	Created time.Time   `json:"created"`
+	Keys    []BackupKey `json:"keys"`
+}
+
+// BackupKey is a private key in a KeyBackup.
+type BackupKey struct {
+	Name        string `json:"name"`
+	Fingerprint string `json:"fingerprint"`
+	// PrivateKey is a password-protected PKCS #8 PEM block, which can also be decrypted using
+	// OpenSSL.
+	PrivateKey string `json:"private_key"`
+}
+
+// BackupKeys encrypts the named private keys in the system keyring using passphrase. If names is
+// empty, all keys are included.
+func (c *Config) BackupKeys(names []string, passphrase []byte) (*KeyBackup, error) {
+	kr, err := c.openKeyring()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		if names, err = c.KeyringKeyNames(); err != nil {
+			return nil, err
+		}
+	}
+	backup := &KeyBackup{Version: KeyBackupVersion, Created: time.Now().UTC()}
+	for _, name := range names {
+		skey, err := loadKeyringKey(kr, name)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", name, err)
+		}
+		encrypted, err := protocol.EncryptPrivateKey(skey, passphrase, c.KeyEncryption)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", name, err)
+		}
+		backup.Keys = append(backup.Keys, BackupKey{
+			Name:        name,
+			Fingerprint: protocol.KeyFingerprint(skey.PublicBytes()),
+			PrivateKey:  string(encrypted),
+		})
+	}
+	return backup, nil
+}
+
+// RestoreKeys decrypts the keys in backup using passphrase and writes them to the system keyring.
+// Existing keys with the same name are only replaced if overwrite is true. RestoreKeys returns the
+// names of the keys it wrote and skipped.
+//
+// All keys are decrypted and checked before any are written.
+func (c *Config) RestoreKeys(backup *KeyBackup, passphrase []byte, overwrite bool) (restored, skipped []string, err error) {
+	if backup.Version != KeyBackupVersion {
+		return nil, nil, fmt.Errorf("%w: %d", ErrUnsupportedBackup, backup.Version)
+	}
+	getPassphrase := func() ([]byte, error) { return passphrase, nil }
+	keys := make([]protocol.ECDHPrivateKey, len(backup.Keys))
+	for i, entry := range backup.Keys {
+		skey, err := protocol.ParsePrivateKey([]byte(entry.PrivateKey), getPassphrase)
+		if err != nil {
+			return nil, nil, fmt.Errorf("key %s: %w", entry.Name, err)
+		}
+		if protocol.KeyFingerprint(skey.PublicBytes()) != entry.Fingerprint {
+			return nil, nil, fmt.Errorf("key %s: %w", entry.Name, ErrFingerprintMismatch)
+		}
+		keys[i] = skey
+	}
+
+	kr, err := c.openKeyring()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, entry := range backup.Keys {
+		if !overwrite {
+			if _, err := kr.Get(keyringKeyService + "." + entry.Name); err == nil {
+				skipped = append(skipped, entry.Name)
+				continue
+			}
+		}
+		if err := saveKeyringKey(kr, entry.Name, keys[i]); err != nil {
+			return restored, skipped, fmt.Errorf("key %s: %w", entry.Name, err)
+		}
+		restored = append(restored, entry.Name)
+	}
+	return restored, skipped, nil
+}
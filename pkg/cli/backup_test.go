@@ -0,0 +1,104 @@
+package cli_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/teslamotors/vehicle-command/internal/authentication"
+	"github.com/teslamotors/vehicle-command/pkg/cli"
+	"github.com/teslamotors/vehicle-command/pkg/protocol"
+)
+
+// newFileKeyringConfig returns a Config that uses a file-backed keyring in a temporary directory.
+func newFileKeyringConfig(t *testing.T) *cli.Config {
+	config, err := cli.NewConfig(cli.FlagPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.BackendType.Set("file"); err != nil {
+		t.Skipf("File keyring unavailable: %s", err)
+	}
+	config.Backend.FileDir = t.TempDir()
+	t.Setenv(cli.EnvTeslaKeyringPass, "keyring password")
+	config.ReadFromEnvironment()
+	return config
+}
+
+func TestBackupKeys(t *testing.T) {
+	source := newFileKeyringConfig(t)
+	keys := make(map[string]protocol.ECDHPrivateKey)
+	for _, name := range []string{"staging", "production"} {
+		skey, err := authentication.NewECDHPrivateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		source.KeyringKeyName = name
+		if err := source.SavePrivateKey(skey); err != nil {
+			t.Fatal(err)
+		}
+		keys[name] = skey
+	}
+	names, err := source.KeyringKeyNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"production", "staging"}) {
+		t.Errorf("Unexpected key names: %v", names)
+	}
+
+	backup, err := source.BackupKeys(nil, []byte("backup passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := json.Marshal(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded cli.KeyBackup
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range decoded.Keys {
+		if entry.Fingerprint != protocol.KeyFingerprint(keys[entry.Name].PublicBytes()) {
+			t.Errorf("Wrong fingerprint for %s", entry.Name)
+		}
+	}
+
+	destination := newFileKeyringConfig(t)
+	if _, _, err := destination.RestoreKeys(&decoded, []byte("wrong"), false); !errors.Is(err, protocol.ErrIncorrectPassphrase) {
+		t.Errorf("Expected ErrIncorrectPassphrase but got %v", err)
+	}
+	restored, skipped, err := destination.RestoreKeys(&decoded, []byte("backup passphrase"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != 2 || len(skipped) != 0 {
+		t.Errorf("Expected to restore 2 keys, restored %v and skipped %v", restored, skipped)
+	}
+	for name, skey := range keys {
+		loaded, err := destination.LoadKeyringKey(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(loaded.PublicBytes(), skey.PublicBytes()) {
+			t.Errorf("Restored wrong key for %s", name)
+		}
+	}
+
+	restored, skipped, err = destination.RestoreKeys(&decoded, []byte("backup passphrase"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != 0 || len(skipped) != 2 {
+		t.Errorf("Expected to skip existing keys, restored %v and skipped %v", restored, skipped)
+	}
+
+	decoded.Keys[0].Fingerprint = decoded.Keys[1].Fingerprint
+	if _, _, err := destination.RestoreKeys(&decoded, []byte("backup passphrase"), true); !errors.Is(err, cli.ErrFingerprintMismatch) {
+		t.Errorf("Expected ErrFingerprintMismatch but got %v", err)
+	}
+}
@@ -62,6 +62,8 @@ import (
 	"github.com/teslamotors/vehicle-command/pkg/account"
 	"github.com/teslamotors/vehicle-command/pkg/cache"
 	"github.com/teslamotors/vehicle-command/pkg/connector/ble"
+	"github.com/teslamotors/vehicle-command/pkg/keyagent"
+	"github.com/teslamotors/vehicle-command/pkg/pkcs11"
 	"github.com/teslamotors/vehicle-command/pkg/protocol"
 	"github.com/teslamotors/vehicle-command/pkg/vehicle"
 
@@ -107,6 +109,9 @@ func (d *DomainList) String() string {
 const (
 	EnvTeslaKeyName      = "TESLA_KEY_NAME"
 	EnvTeslaKeyFile      = "TESLA_KEY_FILE"
+	EnvTeslaKeyURI       = "TESLA_KEY_URI"
+	EnvTeslaKeyAgentSock = "TESLA_KEY_AGENT_SOCK"
+	EnvTeslaKeyPass      = "TESLA_KEY_PASSPHRASE"
 	EnvTeslaTokenName    = "TESLA_TOKEN_NAME"
 	EnvTeslaTokenFile    = "TESLA_TOKEN_FILE"
 	EnvTeslaVIN          = "TESLA_VIN"
@@ -136,6 +141,8 @@ var (
 	ErrNoKeySpecified        = errors.New("private key location not provided")
 	ErrNoAvailableTransports = errors.New("no available transports (configuration must permit BLE and/or OAuth)")
 	ErrKeyNotFound           = keyring.ErrKeyNotFound
+	ErrEmptyPassphrase       = errors.New("passphrase must not be empty")
+	ErrPassphraseMismatch    = errors.New("passphrases do not match")
 )
 
 // Config fields determine how a client authenticates to vehicles and/or Tesla's backend.
@@ -147,6 +154,8 @@ type Config struct {
 	BtAdapterID      string // ID of Bluetooth adapter to use (Linux only)
 	TokenFilename    string
 	KeyFilename      string
+	KeyURI           string // PKCS#11 URI of a private key stored in a hardware token
+	KeyAgentSocket   string // Unix socket of a tesla-key-agent holding the private key
 	CacheFilename    string
 	DisableCache     bool
 	Backend          keyring.Config
@@ -157,7 +166,13 @@ type Config struct {
 	// connection latency and avoid waking up the infotainment system unnecessarily.
 	Domains DomainList
 
+	// EncryptKeyFile causes SavePrivateKey to protect KeyFilename with a passphrase, using
+	// KeyEncryption to derive the encryption key.
+	EncryptKeyFile bool
+	KeyEncryption  protocol.KeyEncryption
+
 	password   *string
+	keyPass    *string
 	sessions   *cache.SessionCache
 	acct       *account.Account
 	skey       protocol.ECDHPrivateKey
@@ -192,6 +207,8 @@ func (c *Config) RegisterCommandLineFlags() {
 		flag.BoolVar(&c.DisableCache, "disable-session-cache", false, "Disable the session info cache.")
 		flag.StringVar(&c.KeyringKeyName, "key-name", "", "System keyring `name` for private key. Defaults to $TESLA_KEY_NAME.")
 		flag.StringVar(&c.KeyFilename, "key-file", "", "A `file` containing private key. Defaults to $TESLA_KEY_FILE.")
+		flag.StringVar(&c.KeyURI, "key-uri", "", "PKCS#11 `URI` of a private key stored in a hardware token. Defaults to $TESLA_KEY_URI.")
+		flag.StringVar(&c.KeyAgentSocket, "key-agent", "", "Unix `socket` of a tesla-key-agent holding the private key. Defaults to $TESLA_KEY_AGENT_SOCK.")
 		flag.Var(&c.Domains, "domain", "Domains to connect to (can be repeated; omit for all)")
 	}
 	if c.Flags.isSet(FlagOAuth) {
@@ -250,12 +267,25 @@ func (c *Config) ReadFromEnvironment() {
 			}
 			log.Debug("Set session cache file to '%s'", c.CacheFilename)
 		}
-		if c.KeyringKeyName == "" && c.KeyFilename == "" {
+		if !c.keyLocationSet() {
 			c.KeyringKeyName = os.Getenv(EnvTeslaKeyName)
 			log.Debug("Set key name to '%s'", c.KeyringKeyName)
 
 			c.KeyFilename = os.Getenv(EnvTeslaKeyFile)
 			log.Debug("Set key file to '%s'", c.KeyFilename)
+
+			c.KeyURI = os.Getenv(EnvTeslaKeyURI)
+			log.Debug("Set key URI to '%s'", pkcs11.RedactURI(c.KeyURI))
+
+			c.KeyAgentSocket = os.Getenv(EnvTeslaKeyAgentSock)
+			log.Debug("Set key agent socket to '%s'", c.KeyAgentSocket)
+		}
+		if c.keyPass == nil {
+			passphrase := os.Getenv(EnvTeslaKeyPass)
+			c.keyPass = &passphrase
+			if len(passphrase) > 0 {
+				log.Debug("Set key file passphrase to %s", strings.Repeat("*", len("hunter2")))
+			}
 		}
 	}
 	if c.Flags.isSet(FlagOAuth) {
@@ -317,11 +347,18 @@ func (c *Config) PrivateKey() (skey protocol.ECDHPrivateKey, err error) {
 		log.Debug("Skipping private key loading because FlagPrivateKey is not set")
 		return nil, ErrNoKeySpecified
 	}
-	if c.KeyFilename == "" && c.KeyringKeyName == "" {
+	if !c.keyLocationSet() {
 		return nil, ErrNoKeySpecified
 	}
-	if c.KeyFilename != "" {
-		skey, err = protocol.LoadPrivateKey(c.KeyFilename)
+	if c.KeyAgentSocket != "" {
+		var client *keyagent.Client
+		if client, err = keyagent.Dial(c.KeyAgentSocket); err == nil {
+			skey = client
+		}
+	} else if c.KeyURI != "" {
+		skey, err = LoadPrivateKey(c.KeyURI)
+	} else if c.KeyFilename != "" {
+		skey, err = c.LoadPrivateKeyFile()
 	}
 	if skey == nil && c.KeyringKeyName != "" {
 		skey, err = c.LoadKeyFromKeyring()
@@ -333,6 +370,17 @@ func (c *Config) PrivateKey() (skey protocol.ECDHPrivateKey, err error) {
 	return skey, err
 }
 
+// LoadPrivateKeyFile loads the private key in c.KeyFilename. If the file is encrypted, the
+// passphrase is read from $TESLA_KEY_PASSPHRASE or requested interactively.
+func (c *Config) LoadPrivateKeyFile() (protocol.ECDHPrivateKey, error) {
+	return protocol.LoadEncryptedPrivateKey(c.KeyFilename, c.KeyPassphrase)
+}
+
+// keyLocationSet returns true if c specifies where to load a private key from.
+func (c *Config) keyLocationSet() bool {
+	return c.KeyringKeyName != "" || c.KeyFilename != "" || c.KeyURI != "" || c.KeyAgentSocket != ""
+}
+
 // Connect to vehicle and/or account.
 //
 // If c.TokenFilename is set, the returned account will not be nil and the vehicle will use a
@@ -435,13 +483,34 @@ func (c *Config) Account() (*account.Account, error) {
 	return account.New(token, "")
 }
 
+// LoadPrivateKey loads a private key from location, which is either a PKCS#11 URI or the name of
+// a file accepted by [protocol.LoadPrivateKey].
+func LoadPrivateKey(location string) (protocol.ECDHPrivateKey, error) {
+	if pkcs11.IsURI(location) {
+		key, err := pkcs11.Open(location)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	return protocol.LoadPrivateKey(location)
+}
+
 // SavePrivateKey writes skey to the system keyring or file, depending on what options are
-// configured. The method prefers the keyring if both options are available.
+// configured. The method prefers the keyring if both options are available. Files are encrypted
+// with a passphrase if c.EncryptKeyFile is set.
 func (c *Config) SavePrivateKey(skey protocol.ECDHPrivateKey) error {
 	if c.KeyringKeyName != "" {
 		return c.saveKeyToKeyring(skey)
 	}
 	if c.KeyFilename != "" {
+		if c.EncryptKeyFile {
+			passphrase, err := c.NewKeyPassphrase()
+			if err != nil {
+				return err
+			}
+			return protocol.SaveEncryptedPrivateKey(skey, c.KeyFilename, passphrase, c.KeyEncryption)
+		}
 		return protocol.SavePrivateKey(skey, c.KeyFilename)
 	}
 	return ErrNoKeySpecified
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
+	"strings"
 
 	"github.com/teslamotors/vehicle-command/internal/authentication"
 	"github.com/teslamotors/vehicle-command/pkg/protocol"
@@ -51,7 +53,16 @@ func (c *Config) getPassword(prompt string) (string, error) {
 	if c.password != nil && *c.password != "" {
 		return *c.password, nil
 	}
+	password, err := readPassword(prompt)
+	if err != nil {
+		return "", err
+	}
+	c.password = &password
+	return password, nil
+}
 
+// readPassword prompts the user for a password without echoing it to the terminal.
+func readPassword(prompt string) (string, error) {
 	var w io.Writer
 	fd := int(os.Stdout.Fd())
 	if !term.IsTerminal(fd) {
@@ -70,9 +81,49 @@ func (c *Config) getPassword(prompt string) (string, error) {
 		return "", err
 	}
 	fmt.Fprintln(w)
-	password := string(b)
-	c.password = &password
-	return password, nil
+	return string(b), nil
+}
+
+// KeyPassphrase returns the passphrase of an encrypted private key, prompting the user if it
+// wasn't provided through $TESLA_KEY_PASSPHRASE.
+func (c *Config) KeyPassphrase() ([]byte, error) {
+	if c.keyPass != nil && *c.keyPass != "" {
+		return []byte(*c.keyPass), nil
+	}
+	prompt := "Private key passphrase"
+	if c.KeyFilename != "" {
+		prompt = fmt.Sprintf("Passphrase for %s", c.KeyFilename)
+	}
+	passphrase, err := readPassword(prompt)
+	if err != nil {
+		return nil, err
+	}
+	c.keyPass = &passphrase
+	return []byte(passphrase), nil
+}
+
+// NewKeyPassphrase returns the passphrase to encrypt a private key with. If the passphrase wasn't
+// provided through $TESLA_KEY_PASSPHRASE, the user is asked to enter it twice.
+func (c *Config) NewKeyPassphrase() ([]byte, error) {
+	if c.keyPass != nil && *c.keyPass != "" {
+		return []byte(*c.keyPass), nil
+	}
+	passphrase, err := readPassword("New private key passphrase")
+	if err != nil {
+		return nil, err
+	}
+	if passphrase == "" {
+		return nil, ErrEmptyPassphrase
+	}
+	confirmation, err := readPassword("Confirm passphrase")
+	if err != nil {
+		return nil, err
+	}
+	if passphrase != confirmation {
+		return nil, ErrPassphraseMismatch
+	}
+	c.keyPass = &passphrase
+	return []byte(passphrase), nil
 }
 
 func (c *Config) openKeyring() (keyring.Keyring, error) {
@@ -118,11 +169,20 @@ func (c *Config) SaveTokenToKeyring(token string) error {
 //
 // The provided name is an arbitrary string that identifies the key.
 func (c *Config) LoadKeyFromKeyring() (protocol.ECDHPrivateKey, error) {
+	return c.LoadKeyringKey(c.KeyringKeyName)
+}
+
+// LoadKeyringKey reads the private key with the given name from the system keyring.
+func (c *Config) LoadKeyringKey(name string) (protocol.ECDHPrivateKey, error) {
 	kr, err := c.openKeyring()
 	if err != nil {
 		return nil, err
 	}
-	item, err := kr.Get(keyringKeyService + "." + c.KeyringKeyName)
+	return loadKeyringKey(kr, name)
+}
+
+func loadKeyringKey(kr keyring.Keyring, name string) (protocol.ECDHPrivateKey, error) {
+	item, err := kr.Get(keyringKeyService + "." + name)
 	if err != nil {
 		return nil, fmt.Errorf("could not load key: %s", err)
 	}
@@ -138,17 +198,40 @@ func (c *Config) fullKeyName() string {
 	return keyringKeyService + "." + c.KeyringKeyName
 }
 
-// SaveKeyToKeyring writes a private key to the system keyring.
-func (c *Config) saveKeyToKeyring(key protocol.ECDHPrivateKey) error {
-	nativeKey, ok := key.(*authentication.NativeECDHKey)
-	if !ok {
-		return fmt.Errorf("key is not exportable")
+// KeyringKeyNames returns the names of the private keys in the system keyring, in sorted order.
+func (c *Config) KeyringKeyNames() ([]string, error) {
+	kr, err := c.openKeyring()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := kr.Keys()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, key := range keys {
+		if name, ok := strings.CutPrefix(key, keyringKeyService+"."); ok {
+			names = append(names, name)
+		}
 	}
+	sort.Strings(names)
+	return names, nil
+}
 
+// SaveKeyToKeyring writes a private key to the system keyring.
+func (c *Config) saveKeyToKeyring(key protocol.ECDHPrivateKey) error {
 	kr, err := c.openKeyring()
 	if err != nil {
 		return err
 	}
+	return saveKeyringKey(kr, c.KeyringKeyName, key)
+}
+
+func saveKeyringKey(kr keyring.Keyring, name string, key protocol.ECDHPrivateKey) error {
+	nativeKey, ok := key.(*authentication.NativeECDHKey)
+	if !ok {
+		return fmt.Errorf("key is not exportable")
+	}
 
 	scalar := make([]byte, 32)
 	if (nativeKey.D.BitLen()+7)/8 != len(scalar) {
@@ -156,7 +239,7 @@ func (c *Config) saveKeyToKeyring(key protocol.ECDHPrivateKey) error {
 	}
 
 	if err := kr.Set(keyring.Item{
-		Key:  c.fullKeyName(),
+		Key:  keyringKeyService + "." + name,
 		Data: nativeKey.D.FillBytes(scalar),
 	}); err != nil {
 		return fmt.Errorf("failed to enroll key in keyring: %s", err)
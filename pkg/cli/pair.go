@@ -0,0 +1,103 @@
+package cli
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/teslamotors/vehicle-command/internal/authentication"
+	"github.com/teslamotors/vehicle-command/pkg/account"
+	"github.com/teslamotors/vehicle-command/pkg/protocol"
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/keys"
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/vcsec"
+	"github.com/teslamotors/vehicle-command/pkg/vehicle"
+)
+
+// LoadOrCreatePrivateKey returns the configured private key. If the key is configured to be stored
+// in the system keyring or a key file that doesn't exist yet, a new key is generated and saved
+// there, and created is true.
+func (c *Config) LoadOrCreatePrivateKey() (skey protocol.ECDHPrivateKey, created bool, err error) {
+	if !c.keyLocationSet() {
+		return nil, false, ErrNoKeySpecified
+	}
+	if c.KeyAgentSocket == "" && c.KeyURI == "" {
+		exists, err := c.privateKeyExists()
+		if err != nil {
+			return nil, false, err
+		}
+		if !exists {
+			if skey, err = authentication.NewECDHPrivateKey(rand.Reader); err != nil {
+				return nil, false, err
+			}
+			if err := c.SavePrivateKey(skey); err != nil {
+				return nil, false, fmt.Errorf("couldn't save new key: %w", err)
+			}
+			created = true
+		}
+	}
+	// Load the key through PrivateKey so that it's cached along with the session cache.
+	c.Flags |= FlagPrivateKey
+	if skey, err = c.PrivateKey(); err != nil {
+		return nil, false, err
+	}
+	return skey, created, nil
+}
+
+// privateKeyExists returns true if there's a private key in the configured key file or keyring
+// entry.
+func (c *Config) privateKeyExists() (bool, error) {
+	if c.KeyFilename != "" {
+		_, err := os.Stat(c.KeyFilename)
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return false, err
+		}
+	}
+	if c.KeyringKeyName != "" {
+		names, err := c.KeyringKeyNames()
+		if err != nil {
+			return false, err
+		}
+		return slices.Contains(names, c.KeyringKeyName), nil
+	}
+	return false, nil
+}
+
+// PairKey enrolls the configured private key with car using an add-key request that the user
+// approves with their NFC card, generating a new key first if necessary (see
+// [Config.LoadOrCreatePrivateKey]). See [vehicle.Vehicle.PairKey] for details.
+//
+// If name is not empty, the key is registered with Tesla's servers under name so that it's labeled
+// in the vehicle UI. This requires an OAuth token; if acct is nil, c is used to log in.
+func (c *Config) PairKey(ctx context.Context, acct *account.Account, car *vehicle.Vehicle, role keys.Role, formFactor vcsec.KeyFormFactor, name string, progress func(vehicle.PairingStep)) error {
+	skey, _, err := c.LoadOrCreatePrivateKey()
+	if err != nil {
+		return err
+	}
+	if err := car.PairKey(ctx, skey, role, formFactor, progress); err != nil {
+		return err
+	}
+	c.UpdateCachedSessions(car)
+	if name == "" {
+		return nil
+	}
+	if acct == nil {
+		if acct, err = c.Account(); err != nil {
+			return fmt.Errorf("key was paired, but couldn't log in to register its name: %w", err)
+		}
+	}
+	publicKey, err := ecdh.P256().NewPublicKey(skey.PublicBytes())
+	if err != nil {
+		return err
+	}
+	if err := acct.UpdateKey(ctx, publicKey, name); err != nil {
+		return fmt.Errorf("key was paired, but couldn't update key metadata: %w", err)
+	}
+	return nil
+}
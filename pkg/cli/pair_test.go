@@ -0,0 +1,61 @@
+package cli_test
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/teslamotors/vehicle-command/pkg/cli"
+	"github.com/teslamotors/vehicle-command/pkg/protocol"
+)
+
+func TestLoadOrCreatePrivateKey(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	newConfig := func() *cli.Config {
+		config, err := cli.NewConfig(cli.FlagBLE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.KeyFilename = keyFile
+		return config
+	}
+
+	skey, created, err := newConfig().LoadOrCreatePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created {
+		t.Error("Expected new key to be created")
+	}
+	saved, err := protocol.LoadPrivateKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(saved.PublicBytes(), skey.PublicBytes()) {
+		t.Error("Saved key doesn't match returned key")
+	}
+
+	config := newConfig()
+	loaded, created, err := config.LoadOrCreatePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created {
+		t.Error("Expected existing key to be loaded")
+	}
+	if !bytes.Equal(loaded.PublicBytes(), skey.PublicBytes()) {
+		t.Error("Loaded key doesn't match saved key")
+	}
+	if cached, err := config.PrivateKey(); err != nil || cached != loaded {
+		t.Errorf("Expected key to be cached (err = %v)", err)
+	}
+
+	config, err = cli.NewConfig(cli.FlagBLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := config.LoadOrCreatePrivateKey(); !errors.Is(err, cli.ErrNoKeySpecified) {
+		t.Errorf("Expected ErrNoKeySpecified but got %v", err)
+	}
+}
@@ -0,0 +1,225 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/teslamotors/vehicle-command/internal/authentication"
+	"github.com/teslamotors/vehicle-command/pkg/account"
+	"github.com/teslamotors/vehicle-command/pkg/protocol"
+	"github.com/teslamotors/vehicle-command/pkg/vehicle"
+)
+
+// ErrRotationUnsupported indicates the configured private key can't be rotated because it isn't
+// stored in the system keyring or a key file.
+var ErrRotationUnsupported = errors.New("key rotation requires a private key stored in the system keyring or a key file")
+
+// stagedKeySuffix is appended to the keyring name or filename of the configured private key to
+// obtain the location of the new key during a rotation.
+const stagedKeySuffix = ".next"
+
+// RotateKey replaces the configured private key with a new one, both in the vehicle's whitelist
+// and in local storage. The new key is given the same role as the old key. See
+// [vehicle.Vehicle.RotateKey] for details.
+//
+// Progress is recorded in stateFile, which is removed once the rotation is complete. If stateFile
+// already exists, RotateKey resumes the rotation it describes. The new key is kept alongside the
+// old one (with a ".next" suffix added to the keyring name or filename) until it replaces the old
+// key at the end of the rotation.
+//
+// If acct is not nil and name is not empty, the new key is registered with Tesla's servers under
+// name so that it's labeled in the vehicle UI.
+func (c *Config) RotateKey(ctx context.Context, acct *account.Account, car *vehicle.Vehicle, stateFile, name string) error {
+	rotation, err := readKeyRotation(stateFile)
+	if err != nil {
+		return err
+	}
+	var newKey protocol.ECDHPrivateKey
+	staged := true
+	if rotation == nil {
+		if err := c.checkRotationSupported(); err != nil {
+			return err
+		}
+		oldKey, err := c.PrivateKey()
+		if err != nil {
+			return err
+		}
+		if newKey, err = authentication.NewECDHPrivateKey(rand.Reader); err != nil {
+			return err
+		}
+		if err := c.saveStagedKey(newKey); err != nil {
+			return fmt.Errorf("couldn't save new key: %w", err)
+		}
+		rotation = vehicle.NewKeyRotation(car.VIN(), oldKey.PublicBytes(), newKey)
+		if err := writeKeyRotation(stateFile, rotation); err != nil {
+			return err
+		}
+	} else if newKey, staged, err = c.rotationKey(rotation); err != nil {
+		return err
+	}
+
+	checkpoint := func(r *vehicle.KeyRotation) error {
+		return writeKeyRotation(stateFile, r)
+	}
+	if err := car.RotateKey(ctx, rotation, newKey, checkpoint); err != nil {
+		return err
+	}
+
+	if staged {
+		if err := c.commitStagedKey(newKey); err != nil {
+			return fmt.Errorf("couldn't replace old key: %w", err)
+		}
+	}
+	c.skey = newKey
+	c.UpdateCachedSessions(car)
+	if acct != nil && name != "" {
+		publicKey, err := ecdh.P256().NewPublicKey(newKey.PublicBytes())
+		if err != nil {
+			return err
+		}
+		if err := acct.UpdateKey(ctx, publicKey, name); err != nil {
+			return fmt.Errorf("couldn't update key metadata: %w", err)
+		}
+	}
+	return os.Remove(stateFile)
+}
+
+// ResumeKeyRotation configures c to use the new key from an interrupted rotation recorded in
+// stateFile, if the new key has already been added to the vehicle. This allows the rotation to be
+// resumed even if the old key has already been removed. ResumeKeyRotation does nothing if
+// stateFile doesn't exist.
+func (c *Config) ResumeKeyRotation(stateFile string) error {
+	rotation, err := readKeyRotation(stateFile)
+	if err != nil || rotation == nil || rotation.Step < vehicle.RotationKeyAdded {
+		return err
+	}
+	newKey, _, err := c.rotationKey(rotation)
+	if err != nil {
+		return err
+	}
+	// Load the configured key first, which also loads the session cache.
+	if _, err := c.PrivateKey(); err != nil {
+		return err
+	}
+	c.skey = newKey
+	return nil
+}
+
+func (c *Config) checkRotationSupported() error {
+	if c.KeyAgentSocket != "" || c.KeyURI != "" || (c.KeyringKeyName == "" && c.KeyFilename == "") {
+		return ErrRotationUnsupported
+	}
+	return nil
+}
+
+// rotationKey loads the new key of rotation. The key is normally loaded from the staging location,
+// but if it has already been moved to the primary location, staged is false.
+func (c *Config) rotationKey(rotation *vehicle.KeyRotation) (skey protocol.ECDHPrivateKey, staged bool, err error) {
+	if err := c.checkRotationSupported(); err != nil {
+		return nil, false, err
+	}
+	if skey, err = c.loadStagedKey(); err == nil {
+		staged = true
+	} else if c.KeyringKeyName != "" {
+		skey, err = c.LoadKeyFromKeyring()
+	} else {
+		skey, err = c.LoadPrivateKeyFile()
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("couldn't load new key: %w", err)
+	}
+	if !bytes.Equal(skey.PublicBytes(), rotation.NewPublicKey) {
+		return nil, false, fmt.Errorf("%w: new private key not found", vehicle.ErrRotationMismatch)
+	}
+	return skey, staged, nil
+}
+
+func (c *Config) saveStagedKey(skey protocol.ECDHPrivateKey) error {
+	if c.KeyringKeyName != "" {
+		kr, err := c.openKeyring()
+		if err != nil {
+			return err
+		}
+		return saveKeyringKey(kr, c.KeyringKeyName+stagedKeySuffix, skey)
+	}
+	// Protect the new key file the same way as the existing one.
+	current, err := os.ReadFile(c.KeyFilename)
+	if err != nil {
+		return err
+	}
+	if c.EncryptKeyFile || bytes.Contains(current, []byte("ENCRYPTED PRIVATE KEY")) {
+		passphrase, err := c.KeyPassphrase()
+		if err != nil {
+			return err
+		}
+		return protocol.SaveEncryptedPrivateKey(skey, c.KeyFilename+stagedKeySuffix, passphrase, c.KeyEncryption)
+	}
+	return protocol.SavePrivateKey(skey, c.KeyFilename+stagedKeySuffix)
+}
+
+func (c *Config) loadStagedKey() (protocol.ECDHPrivateKey, error) {
+	if c.KeyringKeyName != "" {
+		return c.LoadKeyringKey(c.KeyringKeyName + stagedKeySuffix)
+	}
+	return protocol.LoadEncryptedPrivateKey(c.KeyFilename+stagedKeySuffix, c.KeyPassphrase)
+}
+
+// commitStagedKey replaces the configured private key with skey, which must have been saved using
+// saveStagedKey.
+func (c *Config) commitStagedKey(skey protocol.ECDHPrivateKey) error {
+	if c.KeyringKeyName != "" {
+		kr, err := c.openKeyring()
+		if err != nil {
+			return err
+		}
+		if err := saveKeyringKey(kr, c.KeyringKeyName, skey); err != nil {
+			return err
+		}
+		return kr.Remove(keyringKeyService + "." + c.KeyringKeyName + stagedKeySuffix)
+	}
+	return os.Rename(c.KeyFilename+stagedKeySuffix, c.KeyFilename)
+}
+
+// readKeyRotation returns the KeyRotation saved in filename, or nil if the file doesn't exist.
+func readKeyRotation(filename string) (*vehicle.KeyRotation, error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rotation vehicle.KeyRotation
+	if err := json.Unmarshal(data, &rotation); err != nil {
+		return nil, fmt.Errorf("invalid key rotation state file %s: %w", filename, err)
+	}
+	return &rotation, nil
+}
+
+// writeKeyRotation atomically replaces filename with rotation.
+func writeKeyRotation(filename string, rotation *vehicle.KeyRotation) error {
+	data, err := json.MarshalIndent(rotation, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
@@ -0,0 +1,102 @@
+package cli_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/teslamotors/vehicle-command/internal/authentication"
+	"github.com/teslamotors/vehicle-command/pkg/cli"
+	"github.com/teslamotors/vehicle-command/pkg/protocol"
+	"github.com/teslamotors/vehicle-command/pkg/vehicle"
+)
+
+func TestResumeKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key.pem")
+	stateFile := filepath.Join(dir, "rotation.json")
+
+	oldKey, err := authentication.NewECDHPrivateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := authentication.NewECDHPrivateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.SavePrivateKey(oldKey, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.SavePrivateKey(newKey, keyFile+".next"); err != nil {
+		t.Fatal(err)
+	}
+
+	newConfig := func() *cli.Config {
+		config, err := cli.NewConfig(cli.FlagPrivateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.KeyFilename = keyFile
+		return config
+	}
+	writeState := func(rotation *vehicle.KeyRotation) {
+		encoded, err := json.Marshal(rotation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(stateFile, encoded, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkKey := func(config *cli.Config, expected protocol.ECDHPrivateKey) {
+		t.Helper()
+		skey, err := config.PrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(skey.PublicBytes(), expected.PublicBytes()) {
+			t.Error("Config uses wrong key")
+		}
+	}
+
+	// No rotation in progress
+	config := newConfig()
+	if err := config.ResumeKeyRotation(stateFile); err != nil {
+		t.Fatal(err)
+	}
+	checkKey(config, oldKey)
+
+	// The old key is still valid until the new key has been added.
+	rotation := vehicle.NewKeyRotation("5YJ3E1EA0JF000000", oldKey.PublicBytes(), newKey)
+	writeState(rotation)
+	config = newConfig()
+	if err := config.ResumeKeyRotation(stateFile); err != nil {
+		t.Fatal(err)
+	}
+	checkKey(config, oldKey)
+
+	rotation.Step = vehicle.RotationOldKeyRemoved
+	writeState(rotation)
+	config = newConfig()
+	if err := config.ResumeKeyRotation(stateFile); err != nil {
+		t.Fatal(err)
+	}
+	checkKey(config, newKey)
+
+	// Rotation state that doesn't match the staged key
+	rotation.NewPublicKey = oldKey.PublicBytes()
+	writeState(rotation)
+	if err := newConfig().ResumeKeyRotation(stateFile); !errors.Is(err, vehicle.ErrRotationMismatch) {
+		t.Errorf("Expected ErrRotationMismatch but got %v", err)
+	}
+
+	config = newConfig()
+	config.KeyURI = "pkcs11:object=test"
+	if err := config.ResumeKeyRotation(stateFile); !errors.Is(err, cli.ErrRotationUnsupported) {
+		t.Errorf("Expected ErrRotationUnsupported but got %v", err)
+	}
+}
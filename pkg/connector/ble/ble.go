@@ -7,6 +7,7 @@ import (
 	"crypto/sha1"
 	"errors"
 	"fmt"
+	"log/slog"
 	"sync"
 	"time"
 
@@ -14,6 +15,7 @@ import (
 	"github.com/teslamotors/vehicle-command/internal/log"
 	"github.com/teslamotors/vehicle-command/pkg/connector"
 	"github.com/teslamotors/vehicle-command/pkg/protocol"
+	"github.com/teslamotors/vehicle-command/pkg/trace"
 )
 
 const (
@@ -50,6 +52,13 @@ type Connection struct {
 	client      ble.Client
 	lastRx      time.Time
 	lock        sync.Mutex
+	log         *log.Logger
+}
+
+// SetLogger directs log messages to logger. If logger is nil, messages are written to the global
+// logger. Must be called before sending messages.
+func (c *Connection) SetLogger(logger *slog.Logger) {
+	c.log = log.New(logger).With(log.KeyVIN, c.vin)
 }
 
 func (c *Connection) PreferredAuthMethod() connector.AuthMethod {
@@ -73,7 +82,7 @@ func (c *Connection) flush() bool {
 		}
 		if len(c.inputBuffer) >= 2+msgLength {
 			buffer := c.inputBuffer[2 : 2+msgLength]
-			log.Debug("RX: %02x", buffer)
+			c.log.Debug("RX: %02x", buffer)
 			c.inputBuffer = c.inputBuffer[2+msgLength:]
 			select {
 			case c.inbox <- buffer:
@@ -105,12 +114,21 @@ func (c *Connection) rx(p []byte) {
 	}
 }
 
-func (c *Connection) Send(_ context.Context, buffer []byte) error {
+func (c *Connection) Send(ctx context.Context, buffer []byte) (err error) {
+	_, span := trace.Start(ctx, "ble.Connection.Send")
+	span.SetAttribute(trace.AttrVIN, c.vin)
+	blocks := 0
+	defer func() {
+		span.SetAttribute(trace.AttrBLEBlocks, blocks)
+		span.RecordError(err)
+		span.End()
+	}()
+
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
 	var out []byte
-	log.Debug("TX: %02x", buffer)
+	c.log.Debug("TX: %02x", buffer)
 	out = append(out, uint8(len(buffer)>>8), uint8(len(buffer)))
 	out = append(out, buffer...)
 	blockLength := c.blockLength
@@ -121,6 +139,7 @@ func (c *Connection) Send(_ context.Context, buffer []byte) error {
 		if err := c.client.WriteCharacteristic(c.txChar, out[:blockLength], false); err != nil {
 			return err
 		}
+		blocks++
 		out = out[blockLength:]
 	}
 	return nil
@@ -266,7 +285,7 @@ func NewConnectionFromScanResult(ctx context.Context, vin string, target *ScanRe
 		if !retry || IsAdapterError(err) {
 			return nil, err
 		}
-		log.Warning("BLE connection attempt failed: %s", err)
+		log.FromContext(ctx).With(log.KeyVIN, vin).Warning("BLE connection attempt failed: %s", err)
 		if err := ctx.Err(); err != nil {
 			if lastError != nil {
 				return nil, lastError
@@ -287,6 +306,7 @@ func tryToConnect(ctx context.Context, vin string, target *ScanResult) (*Connect
 	}
 
 	localName := VehicleLocalName(vin)
+	logger := log.FromContext(ctx).With(log.KeyVIN, vin)
 
 	if target == nil {
 		target, err = scanVehicleBeacon(ctx, localName)
@@ -303,14 +323,14 @@ func tryToConnect(ctx context.Context, vin string, target *ScanResult) (*Connect
 		return nil, false, ErrMaxConnectionsExceeded
 	}
 
-	log.Debug("Dialing to %s (%s)...", target.Address, localName)
+	logger.Debug("Dialing to %s (%s)...", target.Address, localName)
 
 	client, err := device.Dial(ctx, ble.NewAddr(target.Address))
 	if err != nil {
 		return nil, true, fmt.Errorf("ble: failed to dial for %s (%s): %s", vin, localName, err)
 	}
 
-	log.Debug("Discovering services %s...", client.Addr())
+	logger.Debug("Discovering services %s...", client.Addr())
 	services, err := client.DiscoverServices([]ble.UUID{vehicleServiceUUID})
 	if err != nil {
 		return nil, true, fmt.Errorf("ble: failed to enumerate device services: %s", err)
@@ -328,6 +348,7 @@ func tryToConnect(ctx context.Context, vin string, target *ScanResult) (*Connect
 		vin:    vin,
 		client: client,
 		inbox:  make(chan []byte, 5),
+		log:    logger,
 	}
 	for _, characteristic := range characteristics {
 		if characteristic.UUID.Equal(toVehicleUUID) {
@@ -348,13 +369,13 @@ func tryToConnect(ctx context.Context, vin string, target *ScanResult) (*Connect
 
 	txMtu, err := client.ExchangeMTU(maxBLEMTUSize)
 	if err != nil {
-		log.Warning("ble: failed to exchange MTU: %s", err)
+		logger.Warning("ble: failed to exchange MTU: %s", err)
 		conn.blockLength = ble.DefaultMTU - 3 // Fallback to default MTU size
 	} else {
 		conn.blockLength = min(txMtu, maxBLEMessageSize) - 3 // 3 bytes for header
-		log.Debug("MTU size: %d", txMtu)
+		logger.Debug("MTU size: %d", txMtu)
 	}
 
-	log.Info("Connected to vehicle BLE")
+	logger.Info("Connected to vehicle BLE")
 	return &conn, false, nil
 }
@@ -2,7 +2,10 @@ package connector
 
 import (
 	"context"
+	"log/slog"
 	"time"
+
+	"github.com/teslamotors/vehicle-command/internal/log"
 )
 
 // AuthMethod enumerates the different mechanisms vehicles use to authenticate clients.
@@ -70,3 +73,13 @@ type FleetAPIConnector interface {
 	SendFleetAPICommand(ctx context.Context, endpoint string, command interface{}) ([]byte, error)
 	Wakeup(ctx context.Context) error
 }
+
+// NewLoggerContext returns a copy of ctx that directs log messages to logger. Connectors use the
+// logger for functions that aren't associated with an existing connection, such as establishing a
+// BLE connection or sending a Fleet API request, and for connections created using ctx. Use the
+// SetLogger method of an existing connection to change its logger.
+//
+// Log records are tagged with structured fields (such as the VIN) and secrets are redacted.
+func NewLoggerContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return log.NewContext(ctx, log.New(logger))
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"regexp"
 	"strings"
@@ -16,6 +17,7 @@ import (
 	"github.com/teslamotors/vehicle-command/internal/log"
 	"github.com/teslamotors/vehicle-command/pkg/connector"
 	"github.com/teslamotors/vehicle-command/pkg/protocol"
+	"github.com/teslamotors/vehicle-command/pkg/trace"
 )
 
 // MaxLatency is the default maximum latency permitted when updating the vehicle clock estimate.
@@ -90,7 +92,7 @@ func SendFleetAPICommand(ctx context.Context, client *http.Client, userAgent, au
 			return nil, err
 		}
 	}
-	log.Debug("Sending request to %s: %s", url, body)
+	log.FromContext(ctx).Debug("Sending request to %s: %s", url, body)
 	request, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
 	if err != nil {
 		return nil, &protocol.CommandError{Err: err, PossibleSuccess: false, PossibleTemporary: true}
@@ -100,6 +102,7 @@ func SendFleetAPICommand(ctx context.Context, client *http.Client, userAgent, au
 	request.Header.Set("Content-type", "application/json")
 	request.Header.Set("Authorization", authHeader)
 	request.Header.Set("Accept", "*/*")
+	trace.Inject(ctx, request.Header)
 
 	result, err := client.Do(request)
 	if err != nil {
@@ -119,7 +122,7 @@ func SendFleetAPICommand(ctx context.Context, client *http.Client, userAgent, au
 		return nil, protocol.NewError("response exceeds maximum length", true, true)
 	}
 
-	log.Debug("Server returned %d: %s: %s", result.StatusCode, http.StatusText(result.StatusCode), body)
+	log.FromContext(ctx).Debug("Server returned %d: %s: %s", result.StatusCode, http.StatusText(result.StatusCode), body)
 	switch result.StatusCode {
 	case http.StatusOK:
 		return body, nil
@@ -143,13 +146,13 @@ func ValidTeslaDomainSuffix(domain string) bool {
 // response body is not necessarily nil if the error is set.
 func (c *Connection) SendFleetAPICommand(ctx context.Context, endpoint string, command interface{}) ([]byte, error) {
 	url := fmt.Sprintf("https://%s/%s", c.serverURL, endpoint)
-	rsp, err := SendFleetAPICommand(ctx, c.client, c.UserAgent, c.authHeader, url, command)
+	rsp, err := SendFleetAPICommand(log.NewContext(ctx, c.log), c.client, c.UserAgent, c.authHeader, url, command)
 	if err != nil {
 		var httpErr *HTTPError
 		if errors.As(err, &httpErr) && httpErr.Code == http.StatusMisdirectedRequest {
 			matches := baseDomainRE.FindStringSubmatch(httpErr.Message)
 			if len(matches) == 2 && ValidTeslaDomainSuffix(matches[1]) {
-				log.Debug("Received HTTP Status 421. Updating server URL.")
+				c.log.Debug("Received HTTP Status 421. Updating server URL.")
 				c.serverURL = matches[1]
 			}
 		}
@@ -168,6 +171,8 @@ type Connection struct {
 
 	lock     sync.Mutex
 	lastPoke time.Time
+
+	log *log.Logger
 }
 
 // NewConnection creates a Connection.
@@ -179,10 +184,17 @@ func NewConnection(vin string, authHeader, serverURL, userAgent string) *Connect
 		serverURL:  serverURL,
 		authHeader: authHeader,
 		inbox:      make(chan []byte, connector.BufferSize),
+		log:        log.New(nil).With(log.KeyVIN, vin),
 	}
 	return &conn
 }
 
+// SetLogger directs log messages to logger. If logger is nil, messages are written to the global
+// logger. Must be called before sending messages.
+func (c *Connection) SetLogger(logger *slog.Logger) {
+	c.log = log.New(logger).With(log.KeyVIN, c.vin)
+}
+
 func (c *Connection) PreferredAuthMethod() connector.AuthMethod {
 	return connector.AuthMethodHMAC
 }
@@ -246,7 +258,18 @@ func (c *Connection) Wakeup(ctx context.Context) error {
 	}
 }
 
-func (c *Connection) Send(ctx context.Context, buffer []byte) error {
+func (c *Connection) Send(ctx context.Context, buffer []byte) (err error) {
+	ctx, span := trace.Start(ctx, "inet.Connection.Send")
+	span.SetAttribute(trace.AttrVIN, c.vin)
+	defer func() {
+		var httpErr *HTTPError
+		if errors.As(err, &httpErr) {
+			span.SetAttribute(trace.AttrHTTPStatus, httpErr.Code)
+		}
+		span.RecordError(err)
+		span.End()
+	}()
+
 	type cmd struct {
 		Payload []byte `json:"routable_message"`
 	}
@@ -263,7 +286,7 @@ func (c *Connection) Send(ctx context.Context, buffer []byte) error {
 
 	var rsp jsonResponse
 	if err := json.Unmarshal(body, &rsp); err != nil {
-		log.Debug("Invalid server response (%d bytes): %s", len(body), body)
+		c.log.Debug("Invalid server response (%d bytes): %s", len(body), body)
 		return &protocol.CommandError{Err: fmt.Errorf("unable to parse server response: %w", err), PossibleSuccess: true, PossibleTemporary: false}
 	}
 	c.lock.Lock()
@@ -0,0 +1,236 @@
+package keyagent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"net"
+	"sync"
+
+	"github.com/teslamotors/vehicle-command/internal/log"
+	"github.com/teslamotors/vehicle-command/pkg/protocol"
+)
+
+// Client is a private key held by a key agent. It implements [protocol.ECDHPrivateKey] and is safe
+// for concurrent use.
+type Client struct {
+	path        string
+	publicBytes []byte
+
+	lock   sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Dial connects to the agent listening on the Unix socket at path and fetches its public key.
+func Dial(path string) (*Client, error) {
+	c := &Client{path: path}
+	rsp, err := c.call(&request{Op: opPublicKey})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.publicBytes = rsp.Data
+	return c, nil
+}
+
+// connect opens a connection to the agent if one isn't already open. The caller must hold c.lock.
+func (c *Client) connect() error {
+	if c.conn != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("unix", c.path, dialTimeout)
+	if err != nil {
+		return fmt.Errorf("could not connect to key agent: %w", err)
+	}
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+	return nil
+}
+
+// disconnect closes the connection to the agent. The caller must hold c.lock.
+func (c *Client) disconnect() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+		c.reader = nil
+	}
+}
+
+// roundTrip sends req and reads the response. The caller must hold c.lock.
+func (c *Client) roundTrip(req *request) (*response, error) {
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	if err := json.NewEncoder(c.conn).Encode(req); err != nil {
+		c.disconnect()
+		return nil, err
+	}
+	line, err := c.reader.ReadBytes('\n')
+	if err != nil {
+		c.disconnect()
+		return nil, err
+	}
+	var rsp response
+	if err := json.Unmarshal(line, &rsp); err != nil {
+		c.disconnect()
+		return nil, fmt.Errorf("invalid response from key agent: %w", err)
+	}
+	return &rsp, nil
+}
+
+// call sends req to the agent and returns the response. If the connection fails, for example
+// because the agent restarted, call reconnects once. After reconnecting, it checks that the agent
+// still holds the same private key.
+func (c *Client) call(req *request) (*response, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	reconnected := c.conn == nil
+	rsp, err := c.roundTrip(req)
+	if err != nil && !reconnected {
+		reconnected = true
+		rsp, err = c.roundTrip(req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if reconnected && c.publicBytes != nil {
+		keyRsp, err := c.roundTrip(&request{Op: opPublicKey})
+		if err != nil {
+			return nil, err
+		}
+		if err := keyRsp.err(); err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(keyRsp.Data, c.publicBytes) {
+			c.disconnect()
+			return nil, ErrPublicKeyChanged
+		}
+	}
+	if err := rsp.err(); err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
+// Exchange derives a session with the owner of remotePublicBytes. The agent performs the ECDH
+// operation and keeps the session keys; the returned session asks the agent to use them.
+func (c *Client) Exchange(remotePublicBytes []byte) (protocol.Session, error) {
+	if _, err := c.call(&request{Op: opExchange, Peer: remotePublicBytes}); err != nil {
+		return nil, err
+	}
+	return &session{client: c, peer: bytes.Clone(remotePublicBytes)}, nil
+}
+
+// PublicBytes returns the agent's public key in uncompressed format.
+func (c *Client) PublicBytes() []byte {
+	return bytes.Clone(c.publicBytes)
+}
+
+// SchnorrSignature asks the agent to sign message.
+func (c *Client) SchnorrSignature(message []byte) ([]byte, error) {
+	rsp, err := c.call(&request{Op: opSign, Data: message})
+	if err != nil {
+		return nil, err
+	}
+	return rsp.Data, nil
+}
+
+// Close closes the connection to the agent. The agent keeps running, and later calls to c open a
+// new connection.
+func (c *Client) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.disconnect()
+	return nil
+}
+
+// session is a protocol.Session whose keys are held by the agent.
+type session struct {
+	client *Client
+	peer   []byte
+}
+
+func (s *session) LocalPublicBytes() []byte {
+	return s.client.PublicBytes()
+}
+
+func (s *session) Encrypt(plaintext, associatedData []byte) (nonce, ciphertext, tag []byte, err error) {
+	rsp, err := s.client.call(&request{Op: opEncrypt, Peer: s.peer, Data: plaintext, AssociatedData: associatedData})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return rsp.Nonce, rsp.Data, rsp.Tag, nil
+}
+
+func (s *session) Decrypt(nonce, ciphertext, associatedData, tag []byte) ([]byte, error) {
+	rsp, err := s.client.call(&request{
+		Op:             opDecrypt,
+		Peer:           s.peer,
+		Nonce:          nonce,
+		Data:           ciphertext,
+		AssociatedData: associatedData,
+		Tag:            tag,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rsp.Data, nil
+}
+
+func (s *session) SessionInfoHMAC(id, challenge, encodedInfo []byte) ([]byte, error) {
+	rsp, err := s.client.call(&request{Op: opSessionInfoHMAC, Peer: s.peer, ID: id, Challenge: challenge, Data: encodedInfo})
+	if err != nil {
+		return nil, err
+	}
+	return rsp.Data, nil
+}
+
+func (s *session) NewHMAC(label string) hash.Hash {
+	return &agentHMAC{session: s, label: label}
+}
+
+// agentHMAC buffers the data written to it and asks the agent to compute the HMAC when Sum is
+// called.
+type agentHMAC struct {
+	session *session
+	label   string
+	data    bytes.Buffer
+}
+
+func (h *agentHMAC) Write(p []byte) (int, error) {
+	return h.data.Write(p)
+}
+
+// Sum appends the HMAC of the data written so far to b. If the agent can't compute it, Sum appends
+// random bytes instead, since hash.Hash can't return errors. A random tag won't be accepted by a
+// vehicle or match a tag received from one.
+func (h *agentHMAC) Sum(b []byte) []byte {
+	rsp, err := h.session.client.call(&request{Op: opHMAC, Peer: h.session.peer, Label: h.label, Data: h.data.Bytes()})
+	if err == nil && len(rsp.Data) != sha256.Size {
+		err = fmt.Errorf("key agent returned %d-byte HMAC", len(rsp.Data))
+	}
+	if err != nil {
+		log.Error("Key agent HMAC failed: %s", err)
+		mac := make([]byte, sha256.Size)
+		_, _ = rand.Read(mac)
+		return append(b, mac...)
+	}
+	return append(b, rsp.Data...)
+}
+
+func (h *agentHMAC) Reset() {
+	h.data.Reset()
+}
+
+func (h *agentHMAC) Size() int {
+	return sha256.Size
+}
+
+func (h *agentHMAC) BlockSize() int {
+	return sha256.BlockSize
+}
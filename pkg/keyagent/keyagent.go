@@ -0,0 +1,115 @@
+/*
+Package keyagent shares a command-authentication private key between processes over a Unix socket,
+in the spirit of ssh-agent.
+
+A [Server], usually run by the tesla-key-agent command, loads a private key once (for example,
+after prompting for a keyring password or PKCS#11 PIN) and answers requests on a socket that's only
+accessible to the current user. Clients use [Dial] to obtain a [Client], which implements
+[protocol.ECDHPrivateKey] and can be used anywhere a private key is expected.
+
+The private key never leaves the agent, and neither do the session keys derived from it. When a
+client connects to a vehicle, the agent performs the ECDH exchange and keeps the resulting session.
+The client sends the messages it exchanges with the vehicle to the agent, which encrypts, decrypts,
+and authenticates them. A compromised client can use the agent's sessions while it has access to
+the socket, but can't exfiltrate the private key or session keys.
+
+Requests and responses are JSON objects, one per line.
+*/
+package keyagent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/teslamotors/vehicle-command/internal/authentication"
+)
+
+// Operations supported by the agent. Session operations identify the session by the vehicle's
+// public key.
+const (
+	opPublicKey       = "public_key"
+	opExchange        = "exchange"
+	opEncrypt         = "encrypt"
+	opDecrypt         = "decrypt"
+	opHMAC            = "hmac"
+	opSessionInfoHMAC = "session_info_hmac"
+	opSign            = "sign"
+)
+
+// Error codes included in responses, which the client translates back into errors.
+const (
+	codeInvalidPublicKey = "invalid_public_key"
+	codeNotSupported     = "not_supported"
+)
+
+// dialTimeout limits how long a client waits to connect to the agent.
+const dialTimeout = 5 * time.Second
+
+var (
+	// ErrNotSupported indicates the agent's private key can't perform a requested operation. For
+	// example, keys stored in a PKCS#11 token can't create Schnorr signatures.
+	ErrNotSupported = errors.New("operation not supported by the agent's private key")
+
+	// ErrAgentRunning indicates Listen found another agent already serving the socket.
+	ErrAgentRunning = errors.New("key agent is already listening on socket")
+
+	// ErrPublicKeyChanged indicates a client reconnected to an agent that holds a different
+	// private key.
+	ErrPublicKeyChanged = errors.New("key agent's public key changed")
+)
+
+type request struct {
+	Op   string `json:"op"`
+	Data []byte `json:"data,omitempty"`
+	// Peer is the public key of the vehicle whose session is used by session operations.
+	Peer           []byte `json:"peer,omitempty"`
+	Label          string `json:"label,omitempty"`
+	Nonce          []byte `json:"nonce,omitempty"`
+	AssociatedData []byte `json:"associated_data,omitempty"`
+	Tag            []byte `json:"tag,omitempty"`
+	ID             []byte `json:"id,omitempty"`
+	Challenge      []byte `json:"challenge,omitempty"`
+}
+
+type response struct {
+	Data  []byte `json:"data,omitempty"`
+	Nonce []byte `json:"nonce,omitempty"`
+	Tag   []byte `json:"tag,omitempty"`
+	Error string `json:"error,omitempty"`
+	Code  string `json:"code,omitempty"`
+}
+
+// err returns the error described by r, if any.
+func (r *response) err() error {
+	switch {
+	case r.Error == "":
+		return nil
+	case r.Code == codeInvalidPublicKey:
+		return authentication.ErrInvalidPublicKey
+	case r.Code == codeNotSupported:
+		return fmt.Errorf("%w: %s", ErrNotSupported, r.Error)
+	default:
+		return fmt.Errorf("key agent: %s", r.Error)
+	}
+}
+
+// Listen creates a Unix socket at path that only the current user can connect to. It removes a
+// stale socket left behind by an agent that exited uncleanly, but returns ErrAgentRunning if
+// another agent is still using path.
+//
+// Make sure other users can't write to the directory containing path.
+func Listen(path string) (net.Listener, error) {
+	if _, err := os.Lstat(path); err == nil {
+		if conn, err := net.DialTimeout("unix", path, dialTimeout); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%w %s", ErrAgentRunning, path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return listenPrivate(path)
+}
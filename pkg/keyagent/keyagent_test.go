@@ -0,0 +1,227 @@
+package keyagent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/teslamotors/vehicle-command/internal/authentication"
+	"github.com/teslamotors/vehicle-command/internal/schnorr"
+	"github.com/teslamotors/vehicle-command/pkg/pkcs11"
+	"github.com/teslamotors/vehicle-command/pkg/protocol"
+)
+
+var _ protocol.ECDHPrivateKey = (*Client)(nil)
+
+// socketPath returns a short socket path in a new temporary directory. Unix socket paths are
+// limited to around 100 bytes, which t.TempDir() can exceed.
+func socketPath(t *testing.T) string {
+	dir, err := os.MkdirTemp("", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "sock")
+}
+
+func newKey(t *testing.T) protocol.ECDHPrivateKey {
+	key, err := authentication.NewECDHPrivateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// startServer serves key at path and returns a function that stops the server.
+func startServer(t *testing.T, key protocol.ECDHPrivateKey, path string) func() {
+	listener, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(key)
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(listener)
+	}()
+	return func() {
+		server.Close()
+		if err := <-done; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Unexpected error from Serve: %s", err)
+		}
+	}
+}
+
+// noSchnorrKey is a key that can't create Schnorr signatures, like a PKCS#11 key.
+type noSchnorrKey struct {
+	protocol.ECDHPrivateKey
+}
+
+func (noSchnorrKey) SchnorrSignature([]byte) ([]byte, error) {
+	return nil, pkcs11.ErrSchnorrNotSupported
+}
+
+func TestAgent(t *testing.T) {
+	path := socketPath(t)
+	key := newKey(t)
+	stop := startServer(t, key, path)
+	defer stop()
+
+	client, err := Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if !bytes.Equal(client.PublicBytes(), key.PublicBytes()) {
+		t.Fatal("Client public key doesn't match agent's key")
+	}
+
+	vehicleKey := newKey(t)
+	local, err := client.Exchange(vehicleKey.PublicBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := vehicleKey.Exchange(client.PublicBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, ciphertext, tag, err := local.Encrypt([]byte("honk"), []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := remote.Decrypt(nonce, ciphertext, []byte("metadata"), tag)
+	if err != nil {
+		t.Fatalf("Vehicle could not decrypt message from agent key: %s", err)
+	}
+	if string(plaintext) != "honk" {
+		t.Errorf("Unexpected plaintext: %q", plaintext)
+	}
+	nonce, ciphertext, tag, err = remote.Encrypt([]byte("ok"), []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err = local.Decrypt(nonce, ciphertext, []byte("metadata"), tag); err != nil || string(plaintext) != "ok" {
+		t.Errorf("Couldn't decrypt message from vehicle: %q, %v", plaintext, err)
+	}
+	if _, err = local.Decrypt(nonce, ciphertext, []byte("tampered"), tag); err == nil {
+		t.Error("Expected error decrypting message with wrong associated data")
+	}
+
+	localHMAC, remoteHMAC := local.NewHMAC("label"), remote.NewHMAC("label")
+	localHMAC.Write([]byte("message"))
+	remoteHMAC.Write([]byte("message"))
+	if !bytes.Equal(localHMAC.Sum(nil), remoteHMAC.Sum(nil)) {
+		t.Error("HMAC computed by agent doesn't match vehicle's")
+	}
+	localTag, err := local.SessionInfoHMAC([]byte("vin"), []byte("challenge"), []byte("info"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteTag, err := remote.SessionInfoHMAC([]byte("vin"), []byte("challenge"), []byte("info"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(localTag, remoteTag) {
+		t.Error("Session info HMAC computed by agent doesn't match vehicle's")
+	}
+
+	signature, err := client.SchnorrSignature([]byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := schnorr.Verify(key.PublicBytes(), []byte("payload"), signature); err != nil {
+		t.Errorf("Invalid signature from agent: %s", err)
+	}
+
+	if _, err := client.Exchange([]byte{0x04, 0x01}); !errors.Is(err, authentication.ErrInvalidPublicKey) {
+		t.Errorf("Expected ErrInvalidPublicKey but got %v", err)
+	}
+}
+
+func TestAgentNotSupported(t *testing.T) {
+	path := socketPath(t)
+	stop := startServer(t, noSchnorrKey{newKey(t)}, path)
+	defer stop()
+
+	client, err := Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.SchnorrSignature([]byte("payload")); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Expected ErrNotSupported but got %v", err)
+	}
+}
+
+func TestListenPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows doesn't use file modes for sockets")
+	}
+	path := socketPath(t)
+	listener, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("Expected socket mode 0600, got %#o", mode)
+	}
+}
+
+func TestAgentRestart(t *testing.T) {
+	path := socketPath(t)
+	key := newKey(t)
+	stop := startServer(t, key, path)
+
+	client, err := Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, err := Listen(path); !errors.Is(err, ErrAgentRunning) {
+		t.Errorf("Expected ErrAgentRunning but got %v", err)
+	}
+
+	// The client reconnects if the agent restarts with the same key...
+	stop()
+	stop = startServer(t, key, path)
+	if _, err := client.SchnorrSignature([]byte("payload")); err != nil {
+		t.Errorf("Client didn't reconnect: %s", err)
+	}
+
+	// ...but not if the agent's key changes.
+	stop()
+	stop = startServer(t, newKey(t), path)
+	defer stop()
+	if _, err := client.SchnorrSignature([]byte("payload")); !errors.Is(err, ErrPublicKeyChanged) {
+		t.Errorf("Expected ErrPublicKeyChanged but got %v", err)
+	}
+}
+
+func TestAgentInvalidRequest(t *testing.T) {
+	path := socketPath(t)
+	stop := startServer(t, newKey(t), path)
+	defer stop()
+
+	client, err := Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	rsp, err := client.roundTrip(&request{Op: "export_private_key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.err() == nil || rsp.Data != nil {
+		t.Errorf("Expected error response to unknown operation, got %+v", rsp)
+	}
+}
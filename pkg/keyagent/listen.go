@@ -0,0 +1,17 @@
+//go:build !windows
+
+package keyagent
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenPrivate creates a Unix socket at path with permissions 0600. The socket is created with a
+// restrictive umask, so that there's no window during which other users can connect to it. The
+// umask is process-wide, so listenPrivate should be called before other goroutines create files.
+func listenPrivate(path string) (net.Listener, error) {
+	mask := syscall.Umask(0177)
+	defer syscall.Umask(mask)
+	return net.Listen("unix", path)
+}
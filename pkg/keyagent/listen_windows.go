@@ -0,0 +1,9 @@
+package keyagent
+
+import "net"
+
+// listenPrivate creates a Unix socket at path. Windows doesn't use file modes for access control,
+// so the socket is protected by the permissions of the directory containing it.
+func listenPrivate(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
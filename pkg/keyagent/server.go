@@ -0,0 +1,209 @@
+package keyagent
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/teslamotors/vehicle-command/internal/authentication"
+	"github.com/teslamotors/vehicle-command/internal/log"
+	"github.com/teslamotors/vehicle-command/pkg/pkcs11"
+	"github.com/teslamotors/vehicle-command/pkg/protocol"
+)
+
+// ErrServerClosed is returned by [Server.Serve] after [Server.Close] is called.
+var ErrServerClosed = errors.New("key agent closed")
+
+// maxRequestSize limits the size of a request line. Requests contain a public key, a JWS payload
+// to sign, or a message exchanged with a vehicle, all of which are much smaller.
+const maxRequestSize = 1 << 20
+
+// maxSessions limits the number of vehicle sessions a Server keeps. Sessions are cheap to
+// recreate, so the cache is cleared when it fills up.
+const maxSessions = 1024
+
+// Server answers requests from clients using a private key.
+type Server struct {
+	key protocol.ECDHPrivateKey
+
+	lock      sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+
+	sessionsLock sync.Mutex
+	sessions     map[string]protocol.Session
+}
+
+// NewServer returns a Server that uses key to answer requests.
+func NewServer(key protocol.ECDHPrivateKey) *Server {
+	return &Server{
+		key:       key,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+		sessions:  make(map[string]protocol.Session),
+	}
+}
+
+// session returns the session with the vehicle whose public key is peer, performing an ECDH
+// exchange if needed.
+func (s *Server) session(peer []byte) (protocol.Session, error) {
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+	if session, ok := s.sessions[string(peer)]; ok {
+		return session, nil
+	}
+	session, err := s.key.Exchange(peer)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.sessions) >= maxSessions {
+		clear(s.sessions)
+	}
+	s.sessions[string(peer)] = session
+	return session, nil
+}
+
+// Serve accepts connections from listener and handles them until s is closed, in which case it
+// returns ErrServerClosed.
+func (s *Server) Serve(listener net.Listener) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners[listener] = struct{}{}
+	s.lock.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.lock.Lock()
+			closed := s.closed
+			delete(s.listeners, listener)
+			s.lock.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go s.handle(conn)
+	}
+}
+
+// track registers conn so that Close can interrupt it. It returns false if s is closed.
+func (s *Server) track(conn net.Conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+// Close stops all listeners, closes open connections, and waits for in-progress requests to
+// finish.
+func (s *Server) Close() error {
+	s.lock.Lock()
+	s.closed = true
+	for listener := range s.listeners {
+		listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		s.wg.Done()
+	}()
+	log.Debug("Key agent client connected")
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), maxRequestSize)
+	encoder := json.NewEncoder(conn)
+	for scanner.Scan() {
+		var req request
+		var rsp *response
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			rsp = &response{Error: fmt.Sprintf("invalid request: %s", err)}
+		} else {
+			rsp = s.answer(&req)
+		}
+		if err := encoder.Encode(rsp); err != nil {
+			log.Debug("Key agent failed to write response: %s", err)
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Debug("Key agent connection closed: %s", err)
+	}
+}
+
+// answer performs the operation requested by req.
+func (s *Server) answer(req *request) *response {
+	log.Debug("Key agent request: %s", req.Op)
+	var rsp response
+	var err error
+	switch req.Op {
+	case opPublicKey:
+		rsp.Data = s.key.PublicBytes()
+	case opSign:
+		rsp.Data, err = s.key.SchnorrSignature(req.Data)
+	case opExchange, opEncrypt, opDecrypt, opHMAC, opSessionInfoHMAC:
+		err = s.answerSession(req, &rsp)
+	default:
+		return &response{Error: fmt.Sprintf("unknown operation %q", req.Op)}
+	}
+	switch {
+	case err == nil:
+		return &rsp
+	case errors.Is(err, authentication.ErrInvalidPublicKey):
+		return &response{Error: err.Error(), Code: codeInvalidPublicKey}
+	case errors.Is(err, pkcs11.ErrSchnorrNotSupported), errors.Is(err, pkcs11.ErrNotSupported), errors.Is(err, ErrNotSupported):
+		return &response{Error: err.Error(), Code: codeNotSupported}
+	default:
+		log.Warning("Key agent %s request failed: %s", req.Op, err)
+		return &response{Error: err.Error()}
+	}
+}
+
+// answerSession performs a session operation. Only the results of the operation are returned to
+// the client; session keys stay in the agent.
+func (s *Server) answerSession(req *request, rsp *response) error {
+	session, err := s.session(req.Peer)
+	if err != nil {
+		return err
+	}
+	switch req.Op {
+	case opEncrypt:
+		rsp.Nonce, rsp.Data, rsp.Tag, err = session.Encrypt(req.Data, req.AssociatedData)
+	case opDecrypt:
+		rsp.Data, err = session.Decrypt(req.Nonce, req.Data, req.AssociatedData, req.Tag)
+	case opHMAC:
+		mac := session.NewHMAC(req.Label)
+		mac.Write(req.Data)
+		rsp.Data = mac.Sum(nil)
+	case opSessionInfoHMAC:
+		rsp.Data, err = session.SessionInfoHMAC(req.ID, req.Challenge, req.Data)
+	}
+	return err
+}
@@ -0,0 +1,29 @@
+// Package pkcs11 implements a command-authentication private key that is stored in a PKCS#11
+// token, such as a hardware security module (HSM).
+//
+// A [Key] performs the ECDH exchange with each vehicle inside the token using the
+// CKM_ECDH1_DERIVE mechanism, so the long-term private key never leaves the token. The session key
+// is derived from the shared secret in the token using CKM_SHA1_KEY_DERIVATION, and both are
+// sensitive, non-extractable session objects. Messages are encrypted and decrypted in the token
+// using CKM_AES_GCM. The token must support all three mechanisms and CKM_SHA256_HMAC.
+//
+// A Key does not meet every TEE requirement described in [protocol.Session]:
+//
+//   - The HMAC-SHA256 subkeys used to authenticate commands and session info are computed in the
+//     token with CKM_SHA256_HMAC, but are returned to the host, which computes the HMACs. A
+//     compromised host can exfiltrate subkeys for vehicles the key has been used with.
+//   - Encryption nonces are generated by the host, unless the token replaces them with its own.
+//
+// A compromised host cannot obtain the private key, the shared secrets, or the AES session keys.
+//
+// PKCS#11 also has no mechanism for the Schnorr/P256 signatures used by Tesla's JWS format.
+// Operations that require those signatures, such as signing fleet telemetry configurations or
+// running tesla-jws, need a different key.
+//
+// Keys are identified using PKCS#11 URIs (RFC 7512), for example:
+//
+//	pkcs11:token=tesla;object=fleet-key?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-source=file:/run/secrets/pin
+//
+// The implementation uses cgo. Binaries built with CGO_ENABLED=0 return [ErrNotSupported] from
+// [Open].
+package pkcs11
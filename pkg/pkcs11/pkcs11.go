@@ -0,0 +1,265 @@
+//go:build cgo
+
+package pkcs11
+
+import (
+	"crypto/ecdh"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"sync"
+
+	cryptoki "github.com/miekg/pkcs11"
+
+	"github.com/teslamotors/vehicle-command/internal/authentication"
+	"github.com/teslamotors/vehicle-command/pkg/protocol"
+)
+
+// sharedSecretLength is the length of the x-coordinate of a P-256 point.
+const sharedSecretLength = 32
+
+// Key is a command-authentication private key stored in a PKCS#11 token. It implements
+// protocol.ECDHPrivateKey, but can't create Schnorr signatures (see the package documentation). A
+// Key is safe for concurrent use.
+type Key struct {
+	lock        sync.Mutex
+	modulePath  string
+	ctx         *cryptoki.Ctx
+	session     cryptoki.SessionHandle
+	handle      cryptoki.ObjectHandle
+	publicBytes []byte
+	closed      bool
+}
+
+// module is a loaded PKCS#11 library. PKCS#11 libraries can only be initialized once per process,
+// so keys loaded from the same library share a module.
+type module struct {
+	ctx  *cryptoki.Ctx
+	refs int
+}
+
+var (
+	modulesLock sync.Mutex
+	modules     = make(map[string]*module)
+)
+
+// loadModule returns the initialized PKCS#11 library at path. Each call must be followed by a call
+// to releaseModule.
+func loadModule(path string) (*cryptoki.Ctx, error) {
+	modulesLock.Lock()
+	defer modulesLock.Unlock()
+	if m, ok := modules[path]; ok {
+		m.refs++
+		return m.ctx, nil
+	}
+	ctx := cryptoki.New(path)
+	if ctx == nil {
+		return nil, fmt.Errorf("could not load PKCS#11 module %s", path)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("could not initialize PKCS#11 module: %w", err)
+	}
+	modules[path] = &module{ctx: ctx, refs: 1}
+	return ctx, nil
+}
+
+func releaseModule(path string) error {
+	modulesLock.Lock()
+	defer modulesLock.Unlock()
+	m, ok := modules[path]
+	if !ok {
+		return nil
+	}
+	if m.refs--; m.refs > 0 {
+		return nil
+	}
+	delete(modules, path)
+	err := m.ctx.Finalize()
+	m.ctx.Destroy()
+	return err
+}
+
+// Open loads the PKCS#11 module named in uri, logs in to the token, and finds the private key
+// and its corresponding public key. Close the Key when it's no longer needed.
+func Open(uri string) (*Key, error) {
+	parsed, err := ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	ctx, err := loadModule(parsed.ModulePath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := openKey(ctx, parsed)
+	if err != nil {
+		_ = releaseModule(parsed.ModulePath)
+		return nil, err
+	}
+	key.modulePath = parsed.ModulePath
+	return key, nil
+}
+
+func openKey(ctx *cryptoki.Ctx, uri *URI) (*Key, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return nil, err
+	}
+	for _, slot := range slots {
+		if uri.SlotID != nil && *uri.SlotID != slot {
+			continue
+		}
+		if uri.Token != "" {
+			info, err := ctx.GetTokenInfo(slot)
+			if err != nil || info.Label != uri.Token {
+				continue
+			}
+		}
+		key, err := openKeyInSlot(ctx, slot, uri)
+		if errors.Is(err, ErrKeyNotFound) {
+			continue
+		}
+		return key, err
+	}
+	return nil, ErrKeyNotFound
+}
+
+func openKeyInSlot(ctx *cryptoki.Ctx, slot uint, uri *URI) (*Key, error) {
+	session, err := ctx.OpenSession(slot, cryptoki.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, err
+	}
+	key := &Key{ctx: ctx, session: session}
+	if err = ctx.Login(session, cryptoki.CKU_USER, uri.PIN); err != nil && !errors.Is(err, cryptoki.Error(cryptoki.CKR_USER_ALREADY_LOGGED_IN)) {
+		_ = ctx.CloseSession(session)
+		return nil, fmt.Errorf("could not log in to PKCS#11 token: %w", err)
+	}
+	if key.handle, err = key.findObject(cryptoki.CKO_PRIVATE_KEY, uri); err == nil {
+		key.publicBytes, err = key.loadPublicBytes(uri)
+	}
+	if err != nil {
+		_ = ctx.CloseSession(session)
+		return nil, err
+	}
+	return key, nil
+}
+
+// findObject returns the only object of the given class that matches uri.
+func (k *Key) findObject(class uint, uri *URI) (cryptoki.ObjectHandle, error) {
+	template := []*cryptoki.Attribute{
+		cryptoki.NewAttribute(cryptoki.CKA_CLASS, class),
+		cryptoki.NewAttribute(cryptoki.CKA_KEY_TYPE, cryptoki.CKK_EC),
+	}
+	if uri.Object != "" {
+		template = append(template, cryptoki.NewAttribute(cryptoki.CKA_LABEL, uri.Object))
+	}
+	if uri.ID != nil {
+		template = append(template, cryptoki.NewAttribute(cryptoki.CKA_ID, uri.ID))
+	}
+	if err := k.ctx.FindObjectsInit(k.session, template); err != nil {
+		return 0, err
+	}
+	objects, _, err := k.ctx.FindObjects(k.session, 2)
+	if finalErr := k.ctx.FindObjectsFinal(k.session); err == nil {
+		err = finalErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	switch len(objects) {
+	case 0:
+		return 0, ErrKeyNotFound
+	case 1:
+		return objects[0], nil
+	default:
+		return 0, fmt.Errorf("PKCS#11 URI matches more than one key")
+	}
+}
+
+// loadPublicBytes returns the uncompressed public key that corresponds to k.
+func (k *Key) loadPublicBytes(uri *URI) ([]byte, error) {
+	handle, err := k.findObject(cryptoki.CKO_PUBLIC_KEY, uri)
+	if errors.Is(err, ErrKeyNotFound) {
+		// Some tokens expose the public point on the private key object.
+		handle, err = k.handle, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	attributes, err := k.ctx.GetAttributeValue(k.session, handle, []*cryptoki.Attribute{
+		cryptoki.NewAttribute(cryptoki.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read public key from PKCS#11 token: %w", err)
+	}
+	point := attributes[0].Value
+	// CKA_EC_POINT is usually a DER-encoded OCTET STRING, but some tokens return the raw point.
+	var raw []byte
+	if rest, err := asn1.Unmarshal(point, &raw); err == nil && len(rest) == 0 {
+		point = raw
+	}
+	if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+		return nil, fmt.Errorf("%w: PKCS#11 key is not a NIST P-256 key", authentication.ErrInvalidPrivateKey)
+	}
+	return point, nil
+}
+
+// Exchange derives a session with the owner of remotePublicBytes. The ECDH shared secret and the
+// session key derived from it are created in the token as sensitive, non-extractable objects, and
+// the session encrypts and decrypts messages in the token. See the package documentation for the
+// parts of the session that run on the host.
+func (k *Key) Exchange(remotePublicBytes []byte) (protocol.Session, error) {
+	if _, err := ecdh.P256().NewPublicKey(remotePublicBytes); err != nil {
+		return nil, authentication.ErrInvalidPublicKey
+	}
+	mechanism := cryptoki.NewMechanism(cryptoki.CKM_ECDH1_DERIVE, cryptoki.NewECDH1DeriveParams(cryptoki.CKD_NULL, nil, remotePublicBytes))
+	template := []*cryptoki.Attribute{
+		cryptoki.NewAttribute(cryptoki.CKA_CLASS, cryptoki.CKO_SECRET_KEY),
+		cryptoki.NewAttribute(cryptoki.CKA_KEY_TYPE, cryptoki.CKK_GENERIC_SECRET),
+		cryptoki.NewAttribute(cryptoki.CKA_VALUE_LEN, sharedSecretLength),
+		cryptoki.NewAttribute(cryptoki.CKA_TOKEN, false),
+		cryptoki.NewAttribute(cryptoki.CKA_SENSITIVE, true),
+		cryptoki.NewAttribute(cryptoki.CKA_EXTRACTABLE, false),
+		cryptoki.NewAttribute(cryptoki.CKA_DERIVE, true),
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.closed {
+		return nil, ErrKeyClosed
+	}
+	sharedSecret, err := k.ctx.DeriveKey(k.session, []*cryptoki.Mechanism{mechanism}, k.handle, template)
+	if err != nil {
+		return nil, fmt.Errorf("PKCS#11 ECDH derivation failed: %w", err)
+	}
+	defer func() {
+		_ = k.ctx.DestroyObject(k.session, sharedSecret)
+	}()
+	return k.deriveSession(sharedSecret)
+}
+
+// PublicBytes returns the uncompressed public key.
+func (k *Key) PublicBytes() []byte {
+	return append([]byte(nil), k.publicBytes...)
+}
+
+// SchnorrSignature returns ErrSchnorrNotSupported. The method is required by
+// protocol.ECDHPrivateKey, but PKCS#11 has no mechanism for Tesla's Schnorr signatures.
+func (k *Key) SchnorrSignature(message []byte) ([]byte, error) {
+	return nil, ErrSchnorrNotSupported
+}
+
+// Close logs out of the token and, if no other keys are using it, unloads the PKCS#11 module.
+func (k *Key) Close() error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.closed {
+		return nil
+	}
+	k.closed = true
+	err := k.ctx.CloseSession(k.session)
+	if releaseErr := releaseModule(k.modulePath); err == nil {
+		err = releaseErr
+	}
+	return err
+}
@@ -0,0 +1,31 @@
+//go:build !cgo
+
+package pkcs11
+
+import "github.com/teslamotors/vehicle-command/pkg/protocol"
+
+// Key is a command-authentication private key stored in a PKCS#11 token. It's unavailable in
+// binaries built without cgo.
+type Key struct{}
+
+// Open returns ErrNotSupported because the binary was built without cgo.
+func Open(uri string) (*Key, error) {
+	return nil, ErrNotSupported
+}
+
+func (k *Key) Exchange(remotePublicBytes []byte) (protocol.Session, error) {
+	return nil, ErrNotSupported
+}
+
+func (k *Key) PublicBytes() []byte {
+	return nil
+}
+
+func (k *Key) SchnorrSignature(message []byte) ([]byte, error) {
+	return nil, ErrSchnorrNotSupported
+}
+
+// Close does nothing.
+func (k *Key) Close() error {
+	return nil
+}
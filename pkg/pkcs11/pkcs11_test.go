@@ -0,0 +1,231 @@
+//go:build cgo
+
+package pkcs11
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	cryptoki "github.com/miekg/pkcs11"
+
+	"github.com/teslamotors/vehicle-command/internal/authentication"
+	"github.com/teslamotors/vehicle-command/pkg/protocol"
+)
+
+var _ protocol.ECDHPrivateKey = (*Key)(nil)
+
+// EnvSoftHSMModule overrides the location of the SoftHSM library used by tests.
+const EnvSoftHSMModule = "SOFTHSM2_MODULE"
+
+const (
+	testTokenLabel = "vehicle-command-test"
+	testKeyLabel   = "fleet-key"
+	testPIN        = "1234"
+)
+
+// softHSMModule returns the path of the SoftHSM library, or skips the test if it isn't installed.
+func softHSMModule(t *testing.T) string {
+	candidates := []string{
+		os.Getenv(EnvSoftHSMModule),
+		"/usr/lib/softhsm/libsofthsm2.so",
+		"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+		"/usr/lib64/pkcs11/libsofthsm2.so",
+		"/usr/local/lib/softhsm/libsofthsm2.so",
+		"/opt/homebrew/lib/softhsm/libsofthsm2.so",
+	}
+	for _, path := range candidates {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	t.Skipf("SoftHSM not found; set %s to run PKCS#11 tests", EnvSoftHSMModule)
+	return ""
+}
+
+// initSoftHSM creates a SoftHSM token in a temporary directory containing a P-256 key pair.
+func initSoftHSM(t *testing.T, modulePath string) {
+	dir := t.TempDir()
+	tokens := filepath.Join(dir, "tokens")
+	if err := os.Mkdir(tokens, 0700); err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "softhsm2.conf")
+	if err := os.WriteFile(config, []byte(fmt.Sprintf("directories.tokendir = %s\nobjectstore.backend = file\n", tokens)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOFTHSM2_CONF", config)
+
+	ctx := cryptoki.New(modulePath)
+	if ctx == nil {
+		t.Fatalf("Could not load %s", modulePath)
+	}
+	defer ctx.Destroy()
+	if err := ctx.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Finalize()
+
+	slots, err := ctx.GetSlotList(false)
+	if err != nil || len(slots) == 0 {
+		t.Fatalf("No SoftHSM slots available: %v", err)
+	}
+	if err := ctx.InitToken(slots[0], "so-pin", testTokenLabel); err != nil {
+		t.Fatal(err)
+	}
+	// SoftHSM moves initialized tokens to a new slot.
+	if slots, err = ctx.GetSlotList(true); err != nil {
+		t.Fatal(err)
+	}
+	var slot uint
+	for _, s := range slots {
+		if info, err := ctx.GetTokenInfo(s); err == nil && info.Label == testTokenLabel {
+			slot = s
+		}
+	}
+	session, err := ctx.OpenSession(slot, cryptoki.CKF_SERIAL_SESSION|cryptoki.CKF_RW_SESSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.CloseSession(session)
+	if err := ctx.Login(session, cryptoki.CKU_SO, "so-pin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.InitPIN(session, testPIN); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.Logout(session); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.Login(session, cryptoki.CKU_USER, testPIN); err != nil {
+		t.Fatal(err)
+	}
+	// DER encoding of the prime256v1 OID.
+	p256OID := []byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}
+	_, _, err = ctx.GenerateKeyPair(session,
+		[]*cryptoki.Mechanism{cryptoki.NewMechanism(cryptoki.CKM_EC_KEY_PAIR_GEN, nil)},
+		[]*cryptoki.Attribute{
+			cryptoki.NewAttribute(cryptoki.CKA_TOKEN, true),
+			cryptoki.NewAttribute(cryptoki.CKA_LABEL, testKeyLabel),
+			cryptoki.NewAttribute(cryptoki.CKA_EC_PARAMS, p256OID),
+		},
+		[]*cryptoki.Attribute{
+			cryptoki.NewAttribute(cryptoki.CKA_TOKEN, true),
+			cryptoki.NewAttribute(cryptoki.CKA_LABEL, testKeyLabel),
+			cryptoki.NewAttribute(cryptoki.CKA_PRIVATE, true),
+			cryptoki.NewAttribute(cryptoki.CKA_SENSITIVE, true),
+			cryptoki.NewAttribute(cryptoki.CKA_EXTRACTABLE, false),
+			cryptoki.NewAttribute(cryptoki.CKA_DERIVE, true),
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSoftHSMKey(t *testing.T) {
+	modulePath := softHSMModule(t)
+	initSoftHSM(t, modulePath)
+
+	uri := fmt.Sprintf("pkcs11:token=%s;object=%s?module-path=%s&pin-value=%s", testTokenLabel, testKeyLabel, modulePath, testPIN)
+	key, err := Open(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key.Close()
+
+	// A second key from the same module shares the initialized library.
+	other, err := Open(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key.PublicBytes(), other.PublicBytes()) {
+		t.Error("Keys opened with the same URI have different public keys")
+	}
+	if err := other.Close(); err != nil {
+		t.Error(err)
+	}
+
+	vehicleKey, err := authentication.NewECDHPrivateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := key.Exchange(vehicleKey.PublicBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := vehicleKey.Exchange(key.PublicBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, ciphertext, tag, err := local.Encrypt([]byte("honk"), []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := remote.Decrypt(nonce, ciphertext, []byte("metadata"), tag)
+	if err != nil {
+		t.Fatalf("Vehicle could not decrypt message from PKCS#11 key: %s", err)
+	}
+	if string(plaintext) != "honk" {
+		t.Errorf("Unexpected plaintext %q", plaintext)
+	}
+
+	nonce, ciphertext, tag, err = remote.Encrypt([]byte("ok"), []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err = local.Decrypt(nonce, ciphertext, []byte("metadata"), tag); err != nil || string(plaintext) != "ok" {
+		t.Errorf("PKCS#11 key could not decrypt message from vehicle: %q, %v", plaintext, err)
+	}
+	tag[0] ^= 1
+	if _, err := local.Decrypt(nonce, ciphertext, []byte("metadata"), tag); err == nil {
+		t.Error("Expected error for modified tag")
+	}
+
+	// HMAC subkeys derived in the token match the vehicle's.
+	localMAC := local.NewHMAC("authenticated command")
+	remoteMAC := remote.NewHMAC("authenticated command")
+	localMAC.Write([]byte("command"))
+	remoteMAC.Write([]byte("command"))
+	if !bytes.Equal(localMAC.Sum(nil), remoteMAC.Sum(nil)) {
+		t.Error("HMAC doesn't match vehicle's")
+	}
+	localInfo, err := local.SessionInfoHMAC([]byte("id"), []byte("challenge"), []byte("info"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteInfo, err := remote.SessionInfoHMAC([]byte("id"), []byte("challenge"), []byte("info"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(localInfo, remoteInfo) {
+		t.Error("Session info HMAC doesn't match vehicle's")
+	}
+
+	if _, err := key.Exchange([]byte{4, 1, 2, 3}); err == nil {
+		t.Error("Expected error for invalid public key")
+	}
+	if _, err := key.SchnorrSignature([]byte("message")); !errors.Is(err, ErrSchnorrNotSupported) {
+		t.Errorf("Expected ErrSchnorrNotSupported, got %v", err)
+	}
+
+	if _, err := Open(fmt.Sprintf("pkcs11:object=missing?module-path=%s&pin-value=%s", modulePath, testPIN)); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	if err := key.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := local.Encrypt([]byte("honk"), nil); !errors.Is(err, ErrKeyClosed) {
+		t.Errorf("Expected ErrKeyClosed, got %v", err)
+	}
+	if _, err := key.Exchange(vehicleKey.PublicBytes()); !errors.Is(err, ErrKeyClosed) {
+		t.Errorf("Expected ErrKeyClosed, got %v", err)
+	}
+}
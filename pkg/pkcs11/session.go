@@ -0,0 +1,189 @@
+//go:build cgo
+
+package pkcs11
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"runtime"
+	"sync"
+
+	cryptoki "github.com/miekg/pkcs11"
+
+	"github.com/teslamotors/vehicle-command/internal/authentication"
+	"github.com/teslamotors/vehicle-command/internal/log"
+)
+
+const (
+	gcmNonceLength = 12
+	gcmTagLength   = 16
+)
+
+// session is a protocol.Session whose session key is a non-extractable object in the token. The
+// object handles are destroyed when the session is garbage collected or the Key is closed.
+type session struct {
+	key *Key
+	// aesKey and macKey have the same value: the session key used by the vehicle. Tokens only
+	// accept generic secrets for HMAC mechanisms, so the key is derived twice.
+	aesKey cryptoki.ObjectHandle
+	macKey cryptoki.ObjectHandle
+
+	lock    sync.Mutex
+	subkeys map[string][]byte
+}
+
+// deriveSession derives the vehicle's session key from the ECDH shared secret object in the token.
+// Vehicles use the first 16 bytes of the SHA-1 digest of the shared secret, which the token
+// computes with CKM_SHA1_KEY_DERIVATION.
+func (k *Key) deriveSession(sharedSecret cryptoki.ObjectHandle) (*session, error) {
+	mechanism := []*cryptoki.Mechanism{cryptoki.NewMechanism(cryptoki.CKM_SHA1_KEY_DERIVATION, nil)}
+	aesKey, err := k.ctx.DeriveKey(k.session, mechanism, sharedSecret, sessionKeyTemplate(cryptoki.CKK_AES,
+		cryptoki.NewAttribute(cryptoki.CKA_ENCRYPT, true),
+		cryptoki.NewAttribute(cryptoki.CKA_DECRYPT, true),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("PKCS#11 session key derivation failed: %w", err)
+	}
+	macKey, err := k.ctx.DeriveKey(k.session, mechanism, sharedSecret, sessionKeyTemplate(cryptoki.CKK_GENERIC_SECRET,
+		cryptoki.NewAttribute(cryptoki.CKA_SIGN, true),
+	))
+	if err != nil {
+		_ = k.ctx.DestroyObject(k.session, aesKey)
+		return nil, fmt.Errorf("PKCS#11 session key derivation failed: %w", err)
+	}
+	s := &session{key: k, aesKey: aesKey, macKey: macKey, subkeys: make(map[string][]byte)}
+	runtime.SetFinalizer(s, (*session).destroy)
+	return s, nil
+}
+
+func sessionKeyTemplate(keyType uint, usage ...*cryptoki.Attribute) []*cryptoki.Attribute {
+	return append([]*cryptoki.Attribute{
+		cryptoki.NewAttribute(cryptoki.CKA_CLASS, cryptoki.CKO_SECRET_KEY),
+		cryptoki.NewAttribute(cryptoki.CKA_KEY_TYPE, keyType),
+		cryptoki.NewAttribute(cryptoki.CKA_VALUE_LEN, authentication.SharedKeySizeBytes),
+		cryptoki.NewAttribute(cryptoki.CKA_TOKEN, false),
+		cryptoki.NewAttribute(cryptoki.CKA_SENSITIVE, true),
+		cryptoki.NewAttribute(cryptoki.CKA_EXTRACTABLE, false),
+	}, usage...)
+}
+
+// destroy removes the session key objects from the token.
+func (s *session) destroy() {
+	s.key.lock.Lock()
+	defer s.key.lock.Unlock()
+	if s.key.closed {
+		// Closing the PKCS#11 session destroyed the objects, and the handles may have been reused.
+		return
+	}
+	_ = s.key.ctx.DestroyObject(s.key.session, s.aesKey)
+	_ = s.key.ctx.DestroyObject(s.key.session, s.macKey)
+}
+
+func (s *session) LocalPublicBytes() []byte {
+	return s.key.PublicBytes()
+}
+
+// Encrypt encrypts plaintext in the token using CKM_AES_GCM. Some tokens replace the nonce
+// provided by the host with their own, so the nonce is read back after encryption.
+func (s *session) Encrypt(plaintext, associatedData []byte) (nonce, ciphertext, tag []byte, err error) {
+	nonce = make([]byte, gcmNonceLength)
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, nil, nil, err
+	}
+	params := cryptoki.NewGCMParams(nonce, associatedData, gcmTagLength*8)
+	defer params.Free()
+
+	k := s.key
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.closed {
+		return nil, nil, nil, ErrKeyClosed
+	}
+	if err = k.ctx.EncryptInit(k.session, []*cryptoki.Mechanism{cryptoki.NewMechanism(cryptoki.CKM_AES_GCM, params)}, s.aesKey); err != nil {
+		return nil, nil, nil, fmt.Errorf("PKCS#11 encryption failed: %w", err)
+	}
+	sealed, err := k.ctx.Encrypt(k.session, plaintext)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("PKCS#11 encryption failed: %w", err)
+	}
+	if len(sealed) != len(plaintext)+gcmTagLength {
+		return nil, nil, nil, fmt.Errorf("PKCS#11 token returned %d bytes for %d-byte plaintext", len(sealed), len(plaintext))
+	}
+	if iv := params.IV(); len(iv) == gcmNonceLength {
+		nonce = iv
+	}
+	return nonce, sealed[:len(plaintext)], sealed[len(plaintext):], nil
+}
+
+// Decrypt authenticates and decrypts ciphertext in the token using CKM_AES_GCM.
+func (s *session) Decrypt(nonce, ciphertext, associatedData, tag []byte) ([]byte, error) {
+	params := cryptoki.NewGCMParams(nonce, associatedData, len(tag)*8)
+	defer params.Free()
+	sealed := make([]byte, 0, len(ciphertext)+len(tag))
+	sealed = append(sealed, ciphertext...)
+	sealed = append(sealed, tag...)
+
+	k := s.key
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.closed {
+		return nil, ErrKeyClosed
+	}
+	if err := k.ctx.DecryptInit(k.session, []*cryptoki.Mechanism{cryptoki.NewMechanism(cryptoki.CKM_AES_GCM, params)}, s.aesKey); err != nil {
+		return nil, fmt.Errorf("PKCS#11 decryption failed: %w", err)
+	}
+	plaintext, err := k.ctx.Decrypt(k.session, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("PKCS#11 decryption failed: %w", err)
+	}
+	return plaintext, nil
+}
+
+// subkey returns HMAC-SHA256(session key, label), computed in the token with CKM_SHA256_HMAC.
+// Subkeys are cached, since a session only uses a few labels.
+func (s *session) subkey(label string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if subkey, ok := s.subkeys[label]; ok {
+		return subkey, nil
+	}
+
+	k := s.key
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.closed {
+		return nil, ErrKeyClosed
+	}
+	if err := k.ctx.SignInit(k.session, []*cryptoki.Mechanism{cryptoki.NewMechanism(cryptoki.CKM_SHA256_HMAC, nil)}, s.macKey); err != nil {
+		return nil, fmt.Errorf("PKCS#11 HMAC failed: %w", err)
+	}
+	subkey, err := k.ctx.Sign(k.session, []byte(label))
+	if err != nil {
+		return nil, fmt.Errorf("PKCS#11 HMAC failed: %w", err)
+	}
+	if len(subkey) != sha256.Size {
+		return nil, fmt.Errorf("PKCS#11 token returned %d-byte HMAC", len(subkey))
+	}
+	s.subkeys[label] = subkey
+	return subkey, nil
+}
+
+// NewHMAC returns an HMAC keyed with the subkey for label. If the token can't compute the subkey,
+// the HMAC uses a random key instead, since NewHMAC can't return errors. Its tags won't be accepted
+// by a vehicle or match a tag received from one.
+func (s *session) NewHMAC(label string) hash.Hash {
+	subkey, err := s.subkey(label)
+	if err != nil {
+		log.Error("Could not derive HMAC key in PKCS#11 token: %s", err)
+		subkey = make([]byte, sha256.Size)
+		_, _ = rand.Read(subkey)
+	}
+	return hmac.New(sha256.New, subkey)
+}
+
+func (s *session) SessionInfoHMAC(id, challenge, encodedInfo []byte) ([]byte, error) {
+	return authentication.SessionInfoHMAC(s, id, challenge, encodedInfo)
+}
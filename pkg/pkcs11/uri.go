@@ -0,0 +1,155 @@
+package pkcs11
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// URIScheme is the prefix of PKCS#11 URIs.
+const URIScheme = "pkcs11:"
+
+// EnvPIN is used as the token PIN if a URI doesn't contain a pin-value or pin-source attribute.
+const EnvPIN = "TESLA_PKCS11_PIN"
+
+var (
+	// ErrInvalidURI indicates a string isn't a supported PKCS#11 URI.
+	ErrInvalidURI = errors.New("invalid PKCS#11 URI")
+
+	// ErrNotSupported indicates the binary was built without PKCS#11 support.
+	ErrNotSupported = errors.New("PKCS#11 support requires a binary built with cgo")
+
+	// ErrSchnorrNotSupported indicates a Key was asked to produce a Schnorr signature, which
+	// PKCS#11 tokens cannot do.
+	ErrSchnorrNotSupported = errors.New("PKCS#11 keys cannot create Schnorr signatures")
+
+	// ErrKeyNotFound indicates no private key in the token matches a URI.
+	ErrKeyNotFound = errors.New("no matching private key found in PKCS#11 token")
+
+	// ErrKeyClosed indicates a Key, or a session derived from it, was used after the Key was
+	// closed.
+	ErrKeyClosed = errors.New("PKCS#11 key is closed")
+)
+
+// URI identifies a private key in a PKCS#11 token. See RFC 7512.
+type URI struct {
+	// ModulePath is the file name of the PKCS#11 library (the module-path query attribute).
+	ModulePath string
+	// Token is the label of the token (the token path attribute). If empty, the first token
+	// containing a matching key is used.
+	Token string
+	// SlotID selects a token by slot (the slot-id path attribute), if not nil.
+	SlotID *uint
+	// Object is the label of the key (the object path attribute).
+	Object string
+	// ID is the CKA_ID of the key (the id path attribute).
+	ID []byte
+	// PIN is the user PIN, read from the pin-value or pin-source query attribute, or from
+	// EnvPIN.
+	PIN string
+}
+
+// IsURI returns true if s has the PKCS#11 URI scheme.
+func IsURI(s string) bool {
+	return strings.HasPrefix(s, URIScheme)
+}
+
+// RedactURI returns s with the value of its pin-value attribute, if any, replaced so that the URI
+// can be logged.
+func RedactURI(s string) string {
+	path, query, ok := strings.Cut(s, "?")
+	if !ok {
+		return s
+	}
+	attributes := strings.Split(query, "&")
+	for i, attribute := range attributes {
+		if name, _, _ := strings.Cut(attribute, "="); name == "pin-value" {
+			attributes[i] = "pin-value=REDACTED"
+		}
+	}
+	return path + "?" + strings.Join(attributes, "&")
+}
+
+// ParseURI parses a PKCS#11 URI. The module-path query attribute is required, and either object
+// or id must identify the key. The pin-source attribute may be a file name or a file: URI.
+func ParseURI(s string) (*URI, error) {
+	rest, ok := strings.CutPrefix(s, URIScheme)
+	if !ok {
+		return nil, fmt.Errorf("%w: missing %q prefix", ErrInvalidURI, URIScheme)
+	}
+	path, query, _ := strings.Cut(rest, "?")
+
+	var uri URI
+	for _, attribute := range strings.Split(path, ";") {
+		if attribute == "" {
+			continue
+		}
+		name, encoded, ok := strings.Cut(attribute, "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: expected name=value, got %q", ErrInvalidURI, attribute)
+		}
+		value, err := url.PathUnescape(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidURI, err)
+		}
+		switch name {
+		case "token":
+			uri.Token = value
+		case "object":
+			uri.Object = value
+		case "id":
+			uri.ID = []byte(value)
+		case "slot-id":
+			slot, err := strconv.ParseUint(value, 10, 0)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid slot-id %q", ErrInvalidURI, value)
+			}
+			slotID := uint(slot)
+			uri.SlotID = &slotID
+		case "type":
+			if value != "private" {
+				return nil, fmt.Errorf("%w: object type must be private", ErrInvalidURI)
+			}
+		default:
+			// RFC 7512 permits attributes that don't affect key selection, such as
+			// manufacturer.
+		}
+	}
+
+	for _, attribute := range strings.Split(query, "&") {
+		if attribute == "" {
+			continue
+		}
+		name, encoded, _ := strings.Cut(attribute, "=")
+		value, err := url.QueryUnescape(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidURI, err)
+		}
+		switch name {
+		case "module-path":
+			uri.ModulePath = value
+		case "pin-value":
+			uri.PIN = value
+		case "pin-source":
+			pin, err := os.ReadFile(strings.TrimPrefix(value, "file:"))
+			if err != nil {
+				return nil, fmt.Errorf("could not read PKCS#11 PIN: %w", err)
+			}
+			uri.PIN = strings.TrimRight(string(pin), "\r\n")
+		}
+	}
+
+	if uri.ModulePath == "" {
+		return nil, fmt.Errorf("%w: module-path is required", ErrInvalidURI)
+	}
+	if uri.Object == "" && uri.ID == nil {
+		return nil, fmt.Errorf("%w: object or id is required", ErrInvalidURI)
+	}
+	if uri.PIN == "" {
+		uri.PIN = os.Getenv(EnvPIN)
+	}
+	return &uri, nil
+}
@@ -0,0 +1,73 @@
+package pkcs11
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseURI(t *testing.T) {
+	pinFile := filepath.Join(t.TempDir(), "pin")
+	if err := os.WriteFile(pinFile, []byte("5678\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	uri, err := ParseURI("pkcs11:token=my%20token;object=fleet-key;id=%01%02;slot-id=3;type=private?module-path=/usr/lib/libsofthsm2.so&pin-value=1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.Token != "my token" || uri.Object != "fleet-key" || !bytes.Equal(uri.ID, []byte{1, 2}) {
+		t.Errorf("Unexpected key selection: %+v", uri)
+	}
+	if uri.SlotID == nil || *uri.SlotID != 3 {
+		t.Errorf("Expected slot 3, got %v", uri.SlotID)
+	}
+	if uri.ModulePath != "/usr/lib/libsofthsm2.so" || uri.PIN != "1234" {
+		t.Errorf("Unexpected module or PIN: %+v", uri)
+	}
+
+	uri, err = ParseURI("pkcs11:object=fleet-key?module-path=/usr/lib/libsofthsm2.so&pin-source=file:" + pinFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.PIN != "5678" {
+		t.Errorf("Expected PIN from file, got %q", uri.PIN)
+	}
+
+	t.Setenv(EnvPIN, "9999")
+	if uri, err = ParseURI("pkcs11:object=fleet-key?module-path=/usr/lib/libsofthsm2.so"); err != nil {
+		t.Fatal(err)
+	} else if uri.PIN != "9999" {
+		t.Errorf("Expected PIN from environment, got %q", uri.PIN)
+	}
+
+	for _, invalid := range []string{
+		"/path/to/key.pem",
+		"pkcs11:object=fleet-key",
+		"pkcs11:token=tesla?module-path=/usr/lib/libsofthsm2.so",
+		"pkcs11:object=fleet-key;type=public?module-path=/usr/lib/libsofthsm2.so",
+		"pkcs11:object=fleet-key;slot-id=x?module-path=/usr/lib/libsofthsm2.so",
+	} {
+		if _, err := ParseURI(invalid); !errors.Is(err, ErrInvalidURI) {
+			t.Errorf("Expected ErrInvalidURI for %s, got %v", invalid, err)
+		}
+	}
+}
+
+func TestRedactURI(t *testing.T) {
+	tests := []struct {
+		uri, expected string
+	}{
+		{"pkcs11:object=fleet-key", "pkcs11:object=fleet-key"},
+		{"pkcs11:object=fleet-key?module-path=/lib/p11.so&pin-value=1234", "pkcs11:object=fleet-key?module-path=/lib/p11.so&pin-value=REDACTED"},
+		{"pkcs11:object=fleet-key?pin-value=1234&pin-value=5678", "pkcs11:object=fleet-key?pin-value=REDACTED&pin-value=REDACTED"},
+		{"pkcs11:object=fleet-key?pin-source=/run/pin", "pkcs11:object=fleet-key?pin-source=/run/pin"},
+	}
+	for _, test := range tests {
+		if redacted := RedactURI(test.uri); redacted != test.expected {
+			t.Errorf("Expected %s but got %s", test.expected, redacted)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"google.golang.org/protobuf/proto"
 
 	"github.com/teslamotors/vehicle-command/internal/authentication"
+	"github.com/teslamotors/vehicle-command/internal/pkcs8"
 	verror "github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/errors"
 	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/signatures"
 	universal "github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/universalmessage"
@@ -56,6 +57,12 @@ var (
 	// the same response counter. This could be benign, as the network may have reattempted
 	// transmission.
 	ErrReplayedResponse = errors.New("received vehicle response with duplicate counter")
+	// ErrPassphraseRequired indicates a client tried to load an encrypted private key without a
+	// passphrase.
+	ErrPassphraseRequired = authentication.ErrPassphraseRequired
+	// ErrIncorrectPassphrase indicates an encrypted private key could not be decrypted, usually
+	// because the passphrase is wrong.
+	ErrIncorrectPassphrase = pkcs8.ErrIncorrectPassphrase
 )
 
 type CommandError struct {
@@ -226,6 +233,25 @@ func (v *RoutableMessageError) Error() string {
 	return fmt.Sprintf("unrecognized error code %d", v.Code)
 }
 
+// VehicleFault returns the name and numeric value of the fault code reported by the vehicle, if err
+// wraps a RoutableMessageError, KeychainError, or NominalVCSECError.
+func VehicleFault(err error) (name string, code int32, ok bool) {
+	var messageErr *RoutableMessageError
+	if errors.As(err, &messageErr) {
+		return messageErr.Code.String(), int32(messageErr.Code), true
+	}
+	var keychainErr *KeychainError
+	if errors.As(err, &keychainErr) {
+		return keychainErr.Code.String(), int32(keychainErr.Code), true
+	}
+	var vcsecErr *NominalVCSECError
+	if errors.As(err, &vcsecErr) {
+		generic := vcsecErr.Details.GetGenericError()
+		return generic.String(), int32(generic), true
+	}
+	return "", 0, false
+}
+
 // GetError translates a universal.RoutableMessage into an appropriate Error,
 // returning nil if the universal.RoutableMessage did not contain an error.
 func GetError(u *universal.RoutableMessage) error {
@@ -11,6 +11,7 @@ import (
 	"os"
 
 	"github.com/teslamotors/vehicle-command/internal/authentication"
+	"github.com/teslamotors/vehicle-command/internal/pkcs8"
 )
 
 // Expose some interfaces from the otherwise internal package
@@ -57,11 +58,49 @@ type ECDHPrivateKey authentication.ECDHPrivateKey
 // keys.
 type Session = authentication.Session
 
-// LoadPrivateKey loads a P256 EC private key from a file.
+// LoadPrivateKey loads a P256 EC private key from a file. Encrypted private keys result in
+// ErrPassphraseRequired; use LoadEncryptedPrivateKey to load them.
 func LoadPrivateKey(filename string) (ECDHPrivateKey, error) {
 	return authentication.LoadExternalECDHKey(filename)
 }
 
+// LoadEncryptedPrivateKey loads a P256 EC private key from a file that may contain a
+// password-protected PKCS #8 key ("BEGIN ENCRYPTED PRIVATE KEY"). The passphrase function is only
+// called if the key is encrypted. Keys encrypted using PBES2 with scrypt or PBKDF2 key derivation
+// and AES-CBC are supported.
+//
+// An incorrect passphrase results in ErrIncorrectPassphrase.
+func LoadEncryptedPrivateKey(filename string, passphrase func() ([]byte, error)) (ECDHPrivateKey, error) {
+	return authentication.LoadEncryptedExternalECDHKey(filename, passphrase)
+}
+
+// KeyEncryption selects how encrypted private keys derive an encryption key from a passphrase.
+type KeyEncryption int
+
+const (
+	// KeyEncryptionScrypt uses scrypt, which is resistant to brute-force attacks using specialized
+	// hardware.
+	KeyEncryptionScrypt KeyEncryption = KeyEncryption(pkcs8.KDFScrypt)
+	// KeyEncryptionPBKDF2 uses PBKDF2 with HMAC-SHA256, which is more widely supported than scrypt.
+	KeyEncryptionPBKDF2 KeyEncryption = KeyEncryption(pkcs8.KDFPBKDF2)
+)
+
+// EncryptPrivateKey returns skey as a PEM-encoded, password-protected PKCS #8 private key. The key
+// is encrypted using AES-256-CBC, and can be read by LoadEncryptedPrivateKey and OpenSSL.
+func EncryptPrivateKey(skey ECDHPrivateKey, passphrase []byte, method KeyEncryption) ([]byte, error) {
+	return authentication.EncryptPrivateKey(skey, passphrase, pkcs8.KDF(method))
+}
+
+// SaveEncryptedPrivateKey writes skey to filename as a password-protected PKCS #8 private key. See
+// EncryptPrivateKey.
+func SaveEncryptedPrivateKey(skey ECDHPrivateKey, filename string, passphrase []byte, method KeyEncryption) error {
+	pemKey, err := EncryptPrivateKey(skey, passphrase, method)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, pemKey, 0600)
+}
+
 func SavePrivateKey(skey ECDHPrivateKey, filename string) error {
 	nativeKey, ok := skey.(*authentication.NativeECDHKey)
 	if !ok {
@@ -1,12 +1,27 @@
 package protocol
 
 import (
+	"bytes"
 	"crypto/ecdh"
+	"crypto/rand"
 	"errors"
 	"io/fs"
+	"path/filepath"
 	"testing"
+
+	"github.com/teslamotors/vehicle-command/internal/authentication"
 )
 
+// testPassphrase is the passphrase of the encrypted test keys.
+const testPassphrase = "tesla123"
+
+func passphrase(value string, called *bool) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		*called = true
+		return []byte(value), nil
+	}
+}
+
 func TestLoadPublicKey(t *testing.T) {
 	expected, err := ecdh.P256().NewPublicKey([]byte{
 		0x04, 0x2a, 0x01, 0xe3, 0x08, 0x84, 0x64, 0xb5, 0xe9, 0xf7, 0x2d, 0x68,
@@ -27,6 +42,7 @@ func TestLoadPublicKey(t *testing.T) {
 	tests := []testData{
 		{"test/encrypted-pkcs8-invalid.pem", false},
 		{"test/encrypted-pkcs8.pem", false},
+		{"test/encrypted-pkcs8-scrypt.pem", false},
 		{"test/not-on-curve.pem", false},
 		{"test/p521.pem", false},
 		{"test/pkcs8-invalid.pem", false},
@@ -59,3 +75,61 @@ func TestLoadPublicKey(t *testing.T) {
 		}
 	}
 }
+
+func TestLoadEncryptedPrivateKey(t *testing.T) {
+	expected, err := LoadPublicKey("test/public.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, filename := range []string{"test/encrypted-pkcs8.pem", "test/encrypted-pkcs8-scrypt.pem"} {
+		var called bool
+		skey, err := LoadEncryptedPrivateKey(filename, passphrase(testPassphrase, &called))
+		if err != nil {
+			t.Errorf("Failed to load %s: %s", filename, err)
+			continue
+		}
+		if !bytes.Equal(skey.PublicBytes(), expected.Bytes()) {
+			t.Errorf("File %s did not contain the expected private key", filename)
+		}
+		if _, err := LoadEncryptedPrivateKey(filename, passphrase("wrong", &called)); !errors.Is(err, ErrIncorrectPassphrase) {
+			t.Errorf("Expected ErrIncorrectPassphrase for %s but got %v", filename, err)
+		}
+		if _, err := LoadPrivateKey(filename); !errors.Is(err, ErrPassphraseRequired) {
+			t.Errorf("Expected ErrPassphraseRequired for %s but got %v", filename, err)
+		}
+	}
+
+	var called bool
+	if _, err := LoadEncryptedPrivateKey("test/encrypted-pkcs8-invalid.pem", passphrase(testPassphrase, &called)); err == nil {
+		t.Error("Expected invalid encrypted key to fail to load")
+	}
+
+	called = false
+	if _, err := LoadEncryptedPrivateKey("test/pkcs8.pem", passphrase(testPassphrase, &called)); err != nil {
+		t.Fatal(err)
+	}
+	if called {
+		t.Error("Passphrase requested for unencrypted key")
+	}
+}
+
+func TestSaveEncryptedPrivateKey(t *testing.T) {
+	skey, err := authentication.NewECDHPrivateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []KeyEncryption{KeyEncryptionScrypt, KeyEncryptionPBKDF2} {
+		filename := filepath.Join(t.TempDir(), "key.pem")
+		if err := SaveEncryptedPrivateKey(skey, filename, []byte("hunter2"), method); err != nil {
+			t.Fatal(err)
+		}
+		var called bool
+		loaded, err := LoadEncryptedPrivateKey(filename, passphrase("hunter2", &called))
+		if err != nil {
+			t.Fatalf("Failed to load key encrypted with method %d: %s", method, err)
+		}
+		if !bytes.Equal(loaded.PublicBytes(), skey.PublicBytes()) {
+			t.Errorf("Loaded wrong key for method %d", method)
+		}
+	}
+}
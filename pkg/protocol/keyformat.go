@@ -0,0 +1,165 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/teslamotors/vehicle-command/internal/authentication"
+)
+
+// KeyFormat identifies an encoding of a key.
+type KeyFormat string
+
+const (
+	KeyFormatPEM KeyFormat = "pem" // PEM-encoded PKIX public key, or SEC1/PKCS #8 private key
+	KeyFormatDER KeyFormat = "der" // Binary version of KeyFormatPEM
+	KeyFormatHex KeyFormat = "hex" // Hex-encoded uncompressed curve point, or private scalar
+	KeyFormatJWK KeyFormat = "jwk" // JSON Web Key (RFC 7517)
+)
+
+// ErrUnknownKeyFormat indicates a key couldn't be parsed in any supported format.
+var ErrUnknownKeyFormat = errors.New("unrecognized key format")
+
+// p256CoordinateSize is the size of a P-256 coordinate or private scalar.
+const p256CoordinateSize = 32
+
+// jsonWebKey is a P-256 JSON Web Key. D is only present in private keys.
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+	D       string `json:"d,omitempty"`
+}
+
+// KeyFingerprint returns a short, printable identifier of an uncompressed P-256 public key. The
+// fingerprint is the unpadded base64 encoding of the key's SHA-256 digest, prefixed with
+// "SHA256:".
+func KeyFingerprint(publicBytes []byte) string {
+	digest := sha256.Sum256(publicBytes)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(digest[:])
+}
+
+// EncodePublicKey encodes an uncompressed P-256 public key in the given format.
+func EncodePublicKey(publicBytes []byte, format KeyFormat) ([]byte, error) {
+	pkey, err := ecdh.P256().NewPublicKey(publicBytes)
+	if err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+	switch format {
+	case KeyFormatPEM, KeyFormatDER:
+		der, err := x509.MarshalPKIXPublicKey(pkey)
+		if err != nil {
+			return nil, err
+		}
+		if format == KeyFormatDER {
+			return der, nil
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+	case KeyFormatHex:
+		return []byte(hex.EncodeToString(publicBytes) + "\n"), nil
+	case KeyFormatJWK:
+		jwk := jsonWebKey{
+			KeyType: "EC",
+			Curve:   "P-256",
+			X:       base64.RawURLEncoding.EncodeToString(publicBytes[1 : 1+p256CoordinateSize]),
+			Y:       base64.RawURLEncoding.EncodeToString(publicBytes[1+p256CoordinateSize:]),
+		}
+		encoded, err := json.Marshal(jwk)
+		if err != nil {
+			return nil, err
+		}
+		return append(encoded, '\n'), nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKeyFormat, format)
+	}
+}
+
+// ParsePrivateKey parses a P-256 private key in any of the following formats:
+//   - SEC1 or PKCS #8 PEM ("BEGIN EC PRIVATE KEY" or "BEGIN PRIVATE KEY")
+//   - Password-protected PKCS #8 PEM ("BEGIN ENCRYPTED PRIVATE KEY"), in which case passphrase is
+//     called to obtain the passphrase
+//   - SEC1 or PKCS #8 DER
+//   - Hex-encoded 32-byte private scalar
+//   - JSON Web Key containing the private "d" parameter
+func ParsePrivateKey(data []byte, passphrase func() ([]byte, error)) (ECDHPrivateKey, error) {
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("-----BEGIN")):
+		return authentication.ParseExternalECDHKey(trimmed, passphrase)
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		return parsePrivateJWK(trimmed)
+	case len(trimmed) == 2*p256CoordinateSize:
+		scalar, err := hex.DecodeString(string(trimmed))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownKeyFormat, err)
+		}
+		return unmarshalScalar(scalar)
+	}
+	if ecdsaKey, err := x509.ParseECPrivateKey(data); err == nil {
+		return nativeKey(ecdsaKey)
+	}
+	if privateKey, err := x509.ParsePKCS8PrivateKey(data); err == nil {
+		ecdsaKey, ok := privateKey.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%w: only elliptic curve keys supported", authentication.ErrInvalidPrivateKey)
+		}
+		return nativeKey(ecdsaKey)
+	}
+	return nil, ErrUnknownKeyFormat
+}
+
+func nativeKey(ecdsaKey *ecdsa.PrivateKey) (ECDHPrivateKey, error) {
+	if ecdsaKey.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("%w: only NIST-P256 keys supported", authentication.ErrInvalidPrivateKey)
+	}
+	return &authentication.NativeECDHKey{PrivateKey: ecdsaKey}, nil
+}
+
+func unmarshalScalar(scalar []byte) (ECDHPrivateKey, error) {
+	if skey := UnmarshalECDHPrivateKey(scalar); skey != nil {
+		return skey, nil
+	}
+	return nil, authentication.ErrInvalidPrivateKey
+}
+
+func parsePrivateJWK(data []byte) (ECDHPrivateKey, error) {
+	var jwk jsonWebKey
+	if err := json.Unmarshal(data, &jwk); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKeyFormat, err)
+	}
+	if jwk.KeyType != "EC" || jwk.Curve != "P-256" {
+		return nil, fmt.Errorf("%w: only EC P-256 JSON Web Keys supported", authentication.ErrInvalidPrivateKey)
+	}
+	if jwk.D == "" {
+		return nil, fmt.Errorf("%w: JSON Web Key doesn't contain a private key", authentication.ErrInvalidPrivateKey)
+	}
+	scalar, err := base64.RawURLEncoding.DecodeString(jwk.D)
+	if err != nil || len(scalar) != p256CoordinateSize {
+		return nil, fmt.Errorf("%w: invalid JSON Web Key \"d\" parameter", authentication.ErrInvalidPrivateKey)
+	}
+	skey, err := unmarshalScalar(scalar)
+	if err != nil {
+		return nil, err
+	}
+	// Reject keys with inconsistent public parameters, which indicate the key is corrupted.
+	if jwk.X != "" || jwk.Y != "" {
+		publicBytes := skey.PublicBytes()
+		x := base64.RawURLEncoding.EncodeToString(publicBytes[1 : 1+p256CoordinateSize])
+		y := base64.RawURLEncoding.EncodeToString(publicBytes[1+p256CoordinateSize:])
+		if jwk.X != x || jwk.Y != y {
+			return nil, fmt.Errorf("%w: JSON Web Key public parameters don't match private key", authentication.ErrInvalidPrivateKey)
+		}
+	}
+	return skey, nil
+}
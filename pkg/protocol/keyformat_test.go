@@ -0,0 +1,154 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/teslamotors/vehicle-command/internal/authentication"
+)
+
+func TestParsePrivateKey(t *testing.T) {
+	reference, err := LoadPrivateKey(filepath.Join("test", "private.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	native := reference.(*authentication.NativeECDHKey)
+	scalar := make([]byte, p256CoordinateSize)
+	native.D.FillBytes(scalar)
+
+	sec1, err := x509.MarshalECPrivateKey(native.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(native.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicBytes := reference.PublicBytes()
+	jwk, err := json.Marshal(jsonWebKey{
+		KeyType: "EC",
+		Curve:   "P-256",
+		X:       base64.RawURLEncoding.EncodeToString(publicBytes[1 : 1+p256CoordinateSize]),
+		Y:       base64.RawURLEncoding.EncodeToString(publicBytes[1+p256CoordinateSize:]),
+		D:       base64.RawURLEncoding.EncodeToString(scalar),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := os.ReadFile(filepath.Join("test", "encrypted-pkcs8.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs := map[string][]byte{
+		"sec1-pem":  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1}),
+		"pkcs8-pem": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}),
+		"sec1-der":  sec1,
+		"pkcs8-der": pkcs8,
+		"hex":       []byte(hex.EncodeToString(scalar) + "\n"),
+		"jwk":       jwk,
+	}
+	for name, data := range inputs {
+		skey, err := ParsePrivateKey(data, nil)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if !bytes.Equal(skey.PublicBytes(), publicBytes) {
+			t.Errorf("%s: parsed wrong key", name)
+		}
+	}
+
+	var called bool
+	skey, err := ParsePrivateKey(encrypted, passphrase(testPassphrase, &called))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !called {
+		t.Error("Passphrase wasn't requested")
+	}
+	if !bytes.Equal(skey.PublicBytes(), publicBytes) {
+		t.Error("Parsed wrong encrypted key")
+	}
+
+	if _, err := ParsePrivateKey([]byte("not a key"), nil); !errors.Is(err, ErrUnknownKeyFormat) {
+		t.Errorf("Expected ErrUnknownKeyFormat but got %v", err)
+	}
+	var corrupted jsonWebKey
+	if err := json.Unmarshal(jwk, &corrupted); err != nil {
+		t.Fatal(err)
+	}
+	corrupted.X = corrupted.Y
+	corruptedJWK, err := json.Marshal(corrupted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParsePrivateKey(corruptedJWK, nil); !errors.Is(err, authentication.ErrInvalidPrivateKey) {
+		t.Errorf("Expected ErrInvalidPrivateKey for inconsistent JWK but got %v", err)
+	}
+}
+
+func TestEncodePublicKey(t *testing.T) {
+	reference, err := LoadPublicKey(filepath.Join("test", "public.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicBytes := reference.Bytes()
+
+	encoded, err := EncodePublicKey(publicBytes, KeyFormatPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := os.ReadFile(filepath.Join("test", "public.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bytes.TrimSpace(encoded), bytes.TrimSpace(expected)) {
+		t.Errorf("Unexpected PEM encoding:\n%s", encoded)
+	}
+
+	encoded, err = EncodePublicKey(publicBytes, KeyFormatHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, err := hex.DecodeString(string(bytes.TrimSpace(encoded))); err != nil || !bytes.Equal(decoded, publicBytes) {
+		t.Errorf("Unexpected hex encoding: %s", encoded)
+	}
+
+	encoded, err = EncodePublicKey(publicBytes, KeyFormatJWK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jwk jsonWebKey
+	if err := json.Unmarshal(encoded, &jwk); err != nil {
+		t.Fatal(err)
+	}
+	if jwk.KeyType != "EC" || jwk.Curve != "P-256" || jwk.D != "" {
+		t.Errorf("Unexpected JWK: %s", encoded)
+	}
+
+	if _, err := EncodePublicKey(publicBytes, "base32"); !errors.Is(err, ErrUnknownKeyFormat) {
+		t.Errorf("Expected ErrUnknownKeyFormat but got %v", err)
+	}
+	if _, err := EncodePublicKey(publicBytes[1:], KeyFormatPEM); !errors.Is(err, ErrInvalidPublicKey) {
+		t.Errorf("Expected ErrInvalidPublicKey but got %v", err)
+	}
+}
+
+func TestKeyFingerprint(t *testing.T) {
+	reference, err := LoadPublicKey(filepath.Join("test", "public.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expected = "SHA256:xzZTYjcqUGb8bSzGgUV+P9vNDiCVj2pYXmlgQXIDFsc"
+	if fingerprint := KeyFingerprint(reference.Bytes()); fingerprint != expected {
+		t.Errorf("Expected %s but got %s", expected, fingerprint)
+	}
+}
@@ -0,0 +1,367 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/teslamotors/vehicle-command/pkg/protocol"
+	universal "github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/universalmessage"
+)
+
+// DefaultFleetAPIHost is the Fleet API server used by clients whose OAuth tokens don't specify a
+// region.
+const DefaultFleetAPIHost = "fleet-api.prd.na.vn.cloud.tesla.com"
+
+const readinessTimeout = 5 * time.Second
+
+// readinessPeer is the P-256 base point in uncompressed form. Readiness checks perform an ECDH
+// exchange with it, since keys held by a PKCS#11 token or key agent return cached public keys even
+// when the token or agent is unavailable.
+var readinessPeer = []byte{
+	0x04,
+	0x6b, 0x17, 0xd1, 0xf2, 0xe1, 0x2c, 0x42, 0x47, 0xf8, 0xbc, 0xe6, 0xe5, 0x63, 0xa4, 0x40, 0xf2,
+	0x77, 0x03, 0x7d, 0x81, 0x2d, 0xeb, 0x33, 0xa0, 0xf4, 0xa1, 0x39, 0x45, 0xd8, 0x98, 0xc2, 0x96,
+	0x4f, 0xe3, 0x42, 0xe2, 0xfe, 0x1a, 0x7f, 0x9b, 0x8e, 0xe7, 0xeb, 0x4a, 0x7c, 0x0f, 0x9e, 0x16,
+	0x2b, 0xce, 0x33, 0x57, 0x6b, 0x31, 0x5e, 0xce, 0xcb, 0xb6, 0x40, 0x68, 0x37, 0xbf, 0x51, 0xf5,
+}
+
+var (
+	// ErrAdminUnauthorized indicates a request to the admin API did not include the admin token.
+	ErrAdminUnauthorized = errors.New("missing or invalid admin token")
+
+	// ErrNoCommandKey indicates the proxy was created without a command-authentication key.
+	ErrNoCommandKey = errors.New("command-authentication private key is not loaded")
+)
+
+// CachedSession describes a session with one of a vehicle's domains.
+type CachedSession struct {
+	Domain    string    `json:"domain"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// VehicleSessions lists the cached sessions for a vehicle.
+type VehicleSessions struct {
+	VIN string `json:"vin"`
+	// Tenant is empty for sessions that use the key passed to New.
+	Tenant   string          `json:"tenant,omitempty"`
+	Sessions []CachedSession `json:"sessions"`
+}
+
+// UnsupportedVIN describes a vehicle that the proxy believes doesn't support end-to-end
+// authentication. Commands for these vehicles are forwarded to Fleet API's REST API.
+type UnsupportedVIN struct {
+	VIN      string    `json:"vin"`
+	MarkedAt time.Time `json:"marked_at"`
+	// ExpiresAt is omitted if p.UnsupportedVINExpiry is zero.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// ReadinessCheck is the result of one of the checks performed by [Proxy.CheckReadiness].
+type ReadinessCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// CachedSessions returns the vehicles with cached sessions. Each tenant has its own sessions.
+func (p *Proxy) CachedSessions() []VehicleSessions {
+	var vehicles []VehicleSessions
+	for _, t := range p.allTenants() {
+		for _, vin := range t.sessions.VINs() {
+			entries, ok := t.sessions.GetEntry(vin)
+			if !ok {
+				continue
+			}
+			v := VehicleSessions{VIN: vin, Tenant: t.Name}
+			for _, entry := range entries {
+				v.Sessions = append(v.Sessions, CachedSession{
+					Domain:    universal.Domain(entry.Domain).String(),
+					CreatedAt: entry.CreatedAt,
+				})
+			}
+			vehicles = append(vehicles, v)
+		}
+	}
+	return vehicles
+}
+
+// FlushSessions removes every tenant's cached sessions for vin, or for all vehicles if vin is
+// empty. The proxy performs a new handshake the next time it sends a command to an affected
+// vehicle. FlushSessions returns the number of cache entries removed.
+func (p *Proxy) FlushSessions(vin string) int {
+	var count int
+	for _, t := range p.allTenants() {
+		if vin == "" {
+			count += len(t.sessions.VINs())
+			t.sessions.Clear()
+		} else if _, ok := t.sessions.GetEntry(vin); ok {
+			count++
+			t.sessions.Delete(vin)
+		}
+	}
+	return count
+}
+
+// UnsupportedVINs returns the vehicles the proxy currently forwards to Fleet API's REST API.
+func (p *Proxy) UnsupportedVINs() []UnsupportedVIN {
+	var vins []UnsupportedVIN
+	p.unsupported.Range(func(key, value any) bool {
+		markedAt := value.(time.Time)
+		if p.unsupportedVINExpired(markedAt) {
+			return true
+		}
+		v := UnsupportedVIN{VIN: key.(string), MarkedAt: markedAt}
+		if p.UnsupportedVINExpiry > 0 {
+			expiresAt := markedAt.Add(p.UnsupportedVINExpiry)
+			v.ExpiresAt = &expiresAt
+		}
+		vins = append(vins, v)
+		return true
+	})
+	sort.Slice(vins, func(i, j int) bool { return vins[i].VIN < vins[j].VIN })
+	return vins
+}
+
+// ClearUnsupportedVINs causes the proxy to retry end-to-end authentication with vin, or with all
+// vehicles if vin is empty. It returns the number of VINs removed from the list.
+func (p *Proxy) ClearUnsupportedVINs(vin string) int {
+	var count int
+	p.unsupported.Range(func(key, value any) bool {
+		if vin == "" || key.(string) == vin {
+			if p.clearUnsupportedVIN(key.(string), value) {
+				count++
+			}
+		}
+		return true
+	})
+	return count
+}
+
+// SubjectHosts returns the Fleet API server assigned to each OAuth subject. The proxy learns these
+// assignments when Fleet API redirects a request to a different region.
+func (p *Proxy) SubjectHosts() map[string]string {
+	hosts := make(map[string]string)
+	p.domainForSubject.Range(func(key, value any) bool {
+		hosts[key.(string)] = value.(string)
+		return true
+	})
+	return hosts
+}
+
+// CheckReadiness confirms that the proxy has at least one command-authentication key, that each key
+// can perform an ECDH key exchange, and that the proxy can reach each of hosts and every Fleet API
+// server in [Proxy.SubjectHosts]. A server is reachable if it responds to an HTTPS request with any
+// status code. If client is nil, http.DefaultClient is used.
+func (p *Proxy) CheckReadiness(ctx context.Context, client *http.Client, hosts ...string) (checks []ReadinessCheck, ready bool) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	ready = true
+	addCheck := func(name string, err error) {
+		check := ReadinessCheck{Name: name, OK: err == nil}
+		if err != nil {
+			check.Error = err.Error()
+			ready = false
+		}
+		checks = append(checks, check)
+	}
+
+	if p.defaultTenant.CommandKey == nil && len(p.tenants) == 0 {
+		addCheck("command_key", ErrNoCommandKey)
+	}
+	for _, t := range p.allTenants() {
+		if t.CommandKey == nil {
+			continue
+		}
+		name := "command_key"
+		if t.Name != "" {
+			name += ":" + t.Name
+		}
+		addCheck(name, checkKey(ctx, t.CommandKey))
+	}
+
+	hosts = append([]string(nil), hosts...)
+	seen := make(map[string]bool)
+	for _, host := range hosts {
+		seen[host] = true
+	}
+	for _, host := range p.SubjectHosts() {
+		if !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	for _, host := range hosts {
+		addCheck("fleet_api:"+host, checkHostReachable(ctx, client, host))
+	}
+	return checks, ready
+}
+
+// checkKey performs a key exchange with k, which fails if k is stored in a PKCS#11 token or key
+// agent that is no longer available.
+func checkKey(ctx context.Context, k protocol.ECDHPrivateKey) error {
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		_, err := k.Exchange(readinessPeer)
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			return fmt.Errorf("key exchange failed: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("key exchange failed: %w", ctx.Err())
+	}
+}
+
+func checkHostReachable(ctx context.Context, client *http.Client, host string) error {
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+host+"/", nil)
+	if err != nil {
+		return err
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	return rsp.Body.Close()
+}
+
+// AdminHandler serves an HTTP API for inspecting and resetting a Proxy's internal state. Requests
+// must include an "Authorization: Bearer <token>" header containing the token passed to
+// NewAdminHandler.
+//
+// Endpoints:
+//
+//	GET    /sessions[?vin=VIN]     List cached sessions.
+//	DELETE /sessions[?vin=VIN]     Flush cached sessions.
+//	GET    /unsupported            List vehicles that don't support end-to-end authentication.
+//	DELETE /unsupported[?vin=VIN]  Retry end-to-end authentication with vehicles.
+//	GET    /subjects               List the Fleet API server assigned to each OAuth subject.
+//	GET    /queue[?vin=VIN]        List queued commands.
+//	GET    /ready                  Check that the proxy's keys work and it can reach Fleet API.
+//
+// Responses include VINs and OAuth subjects, so the handler should not be reachable by proxy
+// clients.
+type AdminHandler struct {
+	// FleetAPIHosts are checked by /ready, in addition to hosts assigned to OAuth subjects. If
+	// nil, DefaultFleetAPIHost is checked.
+	FleetAPIHosts []string
+
+	// Client is used to contact Fleet API during readiness checks. If nil, http.DefaultClient is
+	// used.
+	Client *http.Client
+
+	proxy *Proxy
+	token string
+	mux   *http.ServeMux
+}
+
+// NewAdminHandler returns an AdminHandler for p that accepts requests authorized with token.
+func NewAdminHandler(p *Proxy, token string) *AdminHandler {
+	h := &AdminHandler{proxy: p, token: token, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/sessions", h.handleSessions)
+	h.mux.HandleFunc("/unsupported", h.handleUnsupported)
+	h.mux.HandleFunc("/subjects", h.handleSubjects)
+	h.mux.HandleFunc("/ready", h.handleReady)
+	h.mux.HandleFunc("/queue", func(w http.ResponseWriter, req *http.Request) {
+		h.proxy.Queue.ServeHTTP(w, req)
+	})
+	return h
+}
+
+func (h *AdminHandler) authorized(req *http.Request) bool {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return ok && h.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !h.authorized(req) {
+		writeJSONError(w, h.proxy.logger(), http.StatusUnauthorized, ErrAdminUnauthorized)
+		return
+	}
+	h.proxy.logger().Info("Admin request: %s %s", req.Method, req.URL.String())
+	h.mux.ServeHTTP(w, req)
+}
+
+func writeAdminResponse(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"response": response})
+}
+
+type removedCount struct {
+	Removed int `json:"removed"`
+}
+
+func (h *AdminHandler) handleSessions(w http.ResponseWriter, req *http.Request) {
+	vin := req.URL.Query().Get("vin")
+	switch req.Method {
+	case http.MethodGet:
+		vehicles := []VehicleSessions{}
+		for _, v := range h.proxy.CachedSessions() {
+			if vin == "" || v.VIN == vin {
+				vehicles = append(vehicles, v)
+			}
+		}
+		writeAdminResponse(w, http.StatusOK, vehicles)
+	case http.MethodDelete:
+		count := h.proxy.FlushSessions(vin)
+		writeAdminResponse(w, http.StatusOK, removedCount{Removed: count})
+	default:
+		writeJSONError(w, h.proxy.logger(), http.StatusMethodNotAllowed, nil)
+	}
+}
+
+func (h *AdminHandler) handleUnsupported(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		vins := h.proxy.UnsupportedVINs()
+		if vins == nil {
+			vins = []UnsupportedVIN{}
+		}
+		writeAdminResponse(w, http.StatusOK, vins)
+	case http.MethodDelete:
+		count := h.proxy.ClearUnsupportedVINs(req.URL.Query().Get("vin"))
+		writeAdminResponse(w, http.StatusOK, removedCount{Removed: count})
+	default:
+		writeJSONError(w, h.proxy.logger(), http.StatusMethodNotAllowed, nil)
+	}
+}
+
+func (h *AdminHandler) handleSubjects(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeJSONError(w, h.proxy.logger(), http.StatusMethodNotAllowed, nil)
+		return
+	}
+	writeAdminResponse(w, http.StatusOK, h.proxy.SubjectHosts())
+}
+
+func (h *AdminHandler) handleReady(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeJSONError(w, h.proxy.logger(), http.StatusMethodNotAllowed, nil)
+		return
+	}
+	hosts := h.FleetAPIHosts
+	if hosts == nil {
+		hosts = []string{DefaultFleetAPIHost}
+	}
+	checks, ready := h.proxy.CheckReadiness(req.Context(), h.Client, hosts...)
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeAdminResponse(w, status, checks)
+}
@@ -0,0 +1,172 @@
+package proxy_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/teslamotors/vehicle-command/pkg/protocol"
+	"github.com/teslamotors/vehicle-command/pkg/proxy"
+)
+
+const testAdminToken = "admin-secret"
+
+func adminRequest(t *testing.T, h http.Handler, method, path string, response interface{}) int {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	rsp := httptest.NewRecorder()
+	h.ServeHTTP(rsp, req)
+	if response != nil {
+		reply := struct {
+			Response interface{} `json:"response"`
+		}{Response: response}
+		if err := json.Unmarshal(rsp.Body.Bytes(), &reply); err != nil {
+			t.Fatalf("Invalid response to %s %s: %s", method, path, err)
+		}
+	}
+	return rsp.Code
+}
+
+func TestAdminAuthentication(t *testing.T) {
+	p, err := proxy.New(context.Background(), newTestKey(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"", testAdminToken} {
+		h := proxy.NewAdminHandler(p, token)
+		for _, auth := range []string{"", "Bearer wrong", "Bearer "} {
+			req := httptest.NewRequest(http.MethodGet, "/subjects", nil)
+			req.Header.Set("Authorization", auth)
+			rsp := httptest.NewRecorder()
+			h.ServeHTTP(rsp, req)
+			if rsp.Code != http.StatusUnauthorized {
+				t.Errorf("Expected status %d with token %q and header %q, got %d", http.StatusUnauthorized, token, auth, rsp.Code)
+			}
+		}
+	}
+	var hosts map[string]string
+	if code := adminRequest(t, proxy.NewAdminHandler(p, testAdminToken), http.MethodGet, "/subjects", &hosts); code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, code)
+	}
+}
+
+func TestAdminUnsupportedVINs(t *testing.T) {
+	p, err := proxy.New(context.Background(), newTestKey(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := proxy.NewAdminHandler(p, testAdminToken)
+	p.MarkUnsupportedVIN(testVIN)
+	p.MarkUnsupportedVIN(otherTestVIN)
+
+	var vins []proxy.UnsupportedVIN
+	adminRequest(t, h, http.MethodGet, "/unsupported", &vins)
+	if len(vins) != 2 || vins[0].ExpiresAt == nil || !vins[0].ExpiresAt.Equal(vins[0].MarkedAt.Add(proxy.DefaultUnsupportedVINExpiry)) {
+		t.Fatalf("Unexpected unsupported VINs: %+v", vins)
+	}
+
+	var removed struct {
+		Removed int `json:"removed"`
+	}
+	adminRequest(t, h, http.MethodDelete, "/unsupported?vin="+url.QueryEscape(testVIN), &removed)
+	if removed.Removed != 1 {
+		t.Errorf("Expected one VIN removed, got %d", removed.Removed)
+	}
+	if vins := p.UnsupportedVINs(); len(vins) != 1 || vins[0].VIN != otherTestVIN {
+		t.Errorf("Unexpected unsupported VINs after delete: %+v", vins)
+	}
+
+	p.UnsupportedVINExpiry = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if vins := p.UnsupportedVINs(); len(vins) != 0 {
+		t.Errorf("Expected unsupported VINs to expire, got %+v", vins)
+	}
+}
+
+func TestAdminSessions(t *testing.T) {
+	p, err := proxy.New(context.Background(), newTestKey(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := proxy.NewAdminHandler(p, testAdminToken)
+	var vehicles []proxy.VehicleSessions
+	if code := adminRequest(t, h, http.MethodGet, "/sessions", &vehicles); code != http.StatusOK || len(vehicles) != 0 {
+		t.Errorf("Unexpected response: %d %+v", code, vehicles)
+	}
+	if code := adminRequest(t, h, http.MethodDelete, "/sessions?vin="+testVIN, nil); code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, code)
+	}
+	if code := adminRequest(t, h, http.MethodPost, "/sessions", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status %d, got %d", http.StatusMethodNotAllowed, code)
+	}
+}
+
+func TestAdminReadiness(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := proxy.New(context.Background(), nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := proxy.NewAdminHandler(p, testAdminToken)
+	h.Client = server.Client()
+	h.FleetAPIHosts = []string{serverURL.Host}
+
+	var checks []proxy.ReadinessCheck
+	if code := adminRequest(t, h, http.MethodGet, "/ready", &checks); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d without a command key, got %d", http.StatusServiceUnavailable, code)
+	}
+	if len(checks) != 2 || checks[0].Name != "command_key" || checks[0].OK || !checks[1].OK {
+		t.Errorf("Unexpected readiness checks: %+v", checks)
+	}
+
+	server.Close()
+	checks, ready := p.CheckReadiness(context.Background(), h.Client, serverURL.Host)
+	if ready || len(checks) != 2 || checks[1].OK || checks[1].Error == "" {
+		t.Errorf("Expected unreachable host to fail readiness check: %+v", checks)
+	}
+}
+
+// unavailableKey simulates a key in a PKCS#11 token or key agent that has stopped responding.
+type unavailableKey struct {
+	protocol.ECDHPrivateKey
+}
+
+func (unavailableKey) Exchange([]byte) (protocol.Session, error) {
+	return nil, errors.New("token removed")
+}
+
+func TestAdminReadinessKeyExchange(t *testing.T) {
+	key := newTestKey(t)
+	p, err := proxy.New(context.Background(), key, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddTenant(proxy.TenantConfig{Name: "partner-a", CommandKey: unavailableKey{key}}); err != nil {
+		t.Fatal(err)
+	}
+	checks, ready := p.CheckReadiness(context.Background(), nil)
+	if ready || len(checks) != 2 {
+		t.Fatalf("Expected unavailable key to fail readiness check: %+v", checks)
+	}
+	if checks[0].Name != "command_key" || !checks[0].OK {
+		t.Errorf("Expected default key to pass readiness check: %+v", checks[0])
+	}
+	if checks[1].Name != "command_key:partner-a" || checks[1].OK || !strings.Contains(checks[1].Error, "token removed") {
+		t.Errorf("Expected tenant key to fail readiness check: %+v", checks[1])
+	}
+}
@@ -0,0 +1,304 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teslamotors/vehicle-command/pkg/connector/inet"
+	"github.com/teslamotors/vehicle-command/pkg/protocol"
+	"github.com/teslamotors/vehicle-command/pkg/vehicle"
+)
+
+// Transports recorded in an AuditRecord.
+const (
+	TransportSignedCommand = "signed_command" // End-to-end authenticated command sent by the proxy
+	TransportREST          = "rest"           // Request forwarded to Fleet API
+)
+
+// Outcomes recorded in an AuditRecord.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	OutcomeDenied  = "denied"
+	// OutcomeStepUpRequired indicates a command was not sent because it requires a second factor.
+	OutcomeStepUpRequired = "step_up_required"
+	// OutcomeRateLimited indicates a command was not sent because the client exceeded a rate
+	// limit.
+	OutcomeRateLimited = "rate_limited"
+)
+
+const redacted = "[REDACTED]"
+
+// sensitiveParameters are redacted from audit records. Parameter names are matched by substring.
+var sensitiveParameters = []string{"password", "pin", "token", "secret"}
+
+var (
+	// ErrAuditChainBroken indicates an audit log was modified after it was written.
+	ErrAuditChainBroken = errors.New("audit log hash chain is broken")
+)
+
+// AuditRecord describes a request handled by the proxy.
+//
+// Records are hash-chained: each record's Hash covers its contents and the Hash of the previous
+// record, so that editing or deleting a record invalidates every record that follows it.
+type AuditRecord struct {
+	Sequence         uint64                 `json:"seq"`
+	Time             time.Time              `json:"time"`
+	Subject          string                 `json:"subject,omitempty"`
+	Tenant           string                 `json:"tenant,omitempty"`
+	ClientIP         string                 `json:"client_ip,omitempty"`
+	Method           string                 `json:"method"`
+	Path             string                 `json:"path"`
+	VIN              string                 `json:"vin,omitempty"`
+	Command          string                 `json:"command,omitempty"`
+	Parameters       map[string]interface{} `json:"parameters,omitempty"`
+	Transport        string                 `json:"transport"`
+	Outcome          string                 `json:"outcome"`
+	Status           int                    `json:"status"`
+	Error            string                 `json:"error,omitempty"`
+	MayHaveSucceeded bool                   `json:"may_have_succeeded"`
+	StepUp           string                 `json:"step_up,omitempty"`
+	PrevHash         string                 `json:"prev_hash"`
+	Hash             string                 `json:"hash"`
+}
+
+func (r *AuditRecord) computeHash() (string, error) {
+	unhashed := *r
+	unhashed.Hash = ""
+	encoded, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(encoded)
+	return hex.EncodeToString(digest[:]), nil
+}
+
+// AuditSink stores serialized audit records. Each call to Write receives one JSON-encoded record
+// without a trailing newline.
+type AuditSink interface {
+	Write(record []byte) error
+}
+
+type writerSink struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewWriterAuditSink returns an AuditSink that writes newline-delimited JSON records to w.
+func NewWriterAuditSink(w io.Writer) AuditSink {
+	return &writerSink{w: w}
+}
+
+func (s *writerSink) Write(record []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, err := s.w.Write(append(record, '\n'))
+	return err
+}
+
+// AuditLog writes hash-chained AuditRecords to an AuditSink.
+type AuditLog struct {
+	sink AuditSink
+
+	lock     sync.Mutex
+	sequence uint64
+	prevHash string
+}
+
+// NewAuditLog creates an AuditLog that writes to sink. If last is not nil, the new records
+// continue the chain that ends with last.
+func NewAuditLog(sink AuditSink, last *AuditRecord) *AuditLog {
+	a := &AuditLog{sink: sink}
+	if last != nil {
+		a.sequence = last.Sequence
+		a.prevHash = last.Hash
+	}
+	return a
+}
+
+// OpenAuditFile creates an AuditLog that appends to filename, continuing the hash chain of any
+// records already in the file.
+func OpenAuditFile(filename string) (*AuditLog, error) {
+	var last *AuditRecord
+	if existing, err := os.Open(filename); err == nil {
+		_, last, err = verifyAuditLog(existing)
+		existing.Close()
+		if err != nil {
+			return nil, fmt.Errorf("refusing to append to %s: %w", filename, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewAuditLog(NewWriterAuditSink(file), last), nil
+}
+
+// Record adds r to the chain and writes it to the sink. The method sets r.Sequence, r.PrevHash,
+// and r.Hash.
+func (a *AuditLog) Record(r *AuditRecord) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	r.Sequence = a.sequence + 1
+	r.PrevHash = a.prevHash
+	hash, err := r.computeHash()
+	if err != nil {
+		return err
+	}
+	r.Hash = hash
+	encoded, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if err := a.sink.Write(encoded); err != nil {
+		return err
+	}
+	a.sequence = r.Sequence
+	a.prevHash = r.Hash
+	return nil
+}
+
+// VerifyAuditLog checks the hash chain of newline-delimited JSON records read from r. It returns
+// the number of valid records. If the chain is broken, the returned error identifies the first
+// invalid record.
+func VerifyAuditLog(r io.Reader) (int, error) {
+	count, _, err := verifyAuditLog(r)
+	return count, err
+}
+
+func verifyAuditLog(r io.Reader) (int, *AuditRecord, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), MaxResponseLength)
+	var last *AuditRecord
+	count := 0
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		var record AuditRecord
+		if err := json.Unmarshal(text, &record); err != nil {
+			return count, last, fmt.Errorf("%w: line %d is not a valid record: %s", ErrAuditChainBroken, line, err)
+		}
+		if last != nil {
+			if record.PrevHash != last.Hash || record.Sequence != last.Sequence+1 {
+				return count, last, fmt.Errorf("%w: line %d does not follow record %d", ErrAuditChainBroken, line, last.Sequence)
+			}
+		}
+		hash, err := record.computeHash()
+		if err != nil {
+			return count, last, err
+		}
+		if hash != record.Hash {
+			return count, last, fmt.Errorf("%w: line %d (record %d) was modified", ErrAuditChainBroken, line, record.Sequence)
+		}
+		last = &record
+		count++
+	}
+	return count, last, scanner.Err()
+}
+
+// sanitizeParameters returns a copy of params with sensitive values redacted.
+func sanitizeParameters(params RequestParameters) map[string]interface{} {
+	if len(params) == 0 {
+		return nil
+	}
+	sanitized := make(map[string]interface{}, len(params))
+	for key, value := range params {
+		lower := strings.ToLower(key)
+		for _, sensitive := range sensitiveParameters {
+			if strings.Contains(lower, sensitive) {
+				value = redacted
+				break
+			}
+		}
+		sanitized[key] = value
+	}
+	return sanitized
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func newAuditRecord(req *http.Request) *AuditRecord {
+	record := &AuditRecord{
+		Time:      time.Now().UTC(),
+		Method:    req.Method,
+		Path:      req.URL.Path,
+		Transport: TransportREST,
+	}
+	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		record.ClientIP = clientIP
+	}
+	return record
+}
+
+// finish fills in the outcome of a request.
+func (r *AuditRecord) finish(status int, err error) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	r.Status = status
+	var permissionErr *vehicle.PermissionError
+	switch {
+	case errors.Is(err, ErrPolicyDenied), errors.Is(err, ErrStepUpFailed), errors.As(err, &permissionErr):
+		r.Outcome = OutcomeDenied
+	case errors.Is(err, ErrStepUpRequired):
+		r.Outcome = OutcomeStepUpRequired
+	case errors.Is(err, ErrRateLimited):
+		r.Outcome = OutcomeRateLimited
+	case err != nil || status >= http.StatusBadRequest:
+		r.Outcome = OutcomeFailure
+	default:
+		r.Outcome = OutcomeSuccess
+	}
+	if err != nil {
+		r.Error = err.Error()
+		r.MayHaveSucceeded = protocol.MayHaveSucceeded(err)
+	} else if status >= http.StatusInternalServerError {
+		// Fleet API returned an error for a forwarded request.
+		httpErr := inet.HTTPError{Code: status}
+		r.MayHaveSucceeded = httpErr.MayHaveSucceeded()
+	}
+}
+
+// writeAuditRecord writes record to p.AuditLog, if auditing is enabled.
+func (p *Proxy) writeAuditRecord(record *AuditRecord) {
+	if p.AuditLog == nil {
+		return
+	}
+	if err := p.AuditLog.Record(record); err != nil {
+		p.logger().Error("Failed to write audit record: %s", err)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+
+package proxy
+
+import (
+	"log/syslog"
+)
+
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+// NewSyslogAuditSink returns an AuditSink that writes records to the local syslog daemon.
+func NewSyslogAuditSink(tag string) (AuditSink, error) {
+	writer, err := syslog.New(syslog.LOG_NOTICE|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{writer: writer}, nil
+}
+
+func (s *syslogSink) Write(record []byte) error {
+	return s.writer.Notice(string(record))
+}
@@ -0,0 +1,10 @@
+package proxy
+
+import (
+	"errors"
+)
+
+// NewSyslogAuditSink is not supported on Windows.
+func NewSyslogAuditSink(_ string) (AuditSink, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
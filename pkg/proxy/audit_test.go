@@ -0,0 +1,138 @@
+package proxy_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/teslamotors/vehicle-command/pkg/proxy"
+)
+
+// testToken returns an unsigned OAuth token for subject. The proxy does not verify token
+// signatures, so it's sufficient for requests that are rejected before reaching Fleet API.
+func testToken(subject string) string {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"sub": subject,
+		"aud": []string{"https://fleet-api.prd.na.vn.cloud.tesla.com"},
+	})
+	return "header." + base64.RawStdEncoding.EncodeToString(payload) + ".signature"
+}
+
+func readAuditRecords(t *testing.T, data []byte) []proxy.AuditRecord {
+	t.Helper()
+	var records []proxy.AuditRecord
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var record proxy.AuditRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatalf("Invalid audit record %s: %s", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestAuditLogChain(t *testing.T) {
+	var buffer bytes.Buffer
+	auditLog := proxy.NewAuditLog(proxy.NewWriterAuditSink(&buffer), nil)
+	for _, command := range []string{"door_lock", "honk_horn", "flash_lights"} {
+		record := proxy.AuditRecord{VIN: testVIN, Command: command, Outcome: proxy.OutcomeSuccess}
+		if err := auditLog.Record(&record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	original := buffer.Bytes()
+
+	count, err := proxy.VerifyAuditLog(bytes.NewReader(original))
+	if err != nil || count != 3 {
+		t.Fatalf("Expected 3 valid records, got %d: %s", count, err)
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(original), []byte("\n"))
+
+	edited := bytes.Replace(original, []byte("honk_horn"), []byte("door_lock"), 1)
+	if _, err := proxy.VerifyAuditLog(bytes.NewReader(edited)); !errors.Is(err, proxy.ErrAuditChainBroken) {
+		t.Errorf("Expected edited log to fail verification, got %v", err)
+	}
+
+	deleted := bytes.Join([][]byte{lines[0], lines[2]}, []byte("\n"))
+	if count, err := proxy.VerifyAuditLog(bytes.NewReader(deleted)); !errors.Is(err, proxy.ErrAuditChainBroken) || count != 1 {
+		t.Errorf("Expected log with deleted record to fail verification after 1 record, got %d, %v", count, err)
+	}
+}
+
+func TestOpenAuditFileContinuesChain(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	for i := 0; i < 2; i++ {
+		auditLog, err := proxy.OpenAuditFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := auditLog.Record(&proxy.AuditRecord{Command: "honk_horn"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, err := proxy.VerifyAuditLog(bytes.NewReader(data)); err != nil || count != 2 {
+		t.Fatalf("Expected 2 valid records, got %d: %s", count, err)
+	}
+
+	if err := os.WriteFile(filename, bytes.Replace(data, []byte("honk_horn"), []byte("door_lock"), 1), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := proxy.OpenAuditFile(filename); !errors.Is(err, proxy.ErrAuditChainBroken) {
+		t.Errorf("Expected error when appending to tampered file, got %v", err)
+	}
+}
+
+func TestProxyWritesAuditRecords(t *testing.T) {
+	var buffer bytes.Buffer
+	p, err := proxy.New(context.Background(), newTestKey(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.AuditLog = proxy.NewAuditLog(proxy.NewWriterAuditSink(&buffer), nil)
+	p.Policy = newTestPolicyStore(t, `{"rules": [{"effect": "deny", "commands": ["set_valet_mode"]}]}`)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/1/vehicles/"+testVIN+"/command/set_valet_mode", strings.NewReader(`{"on": true, "password": "1234"}`))
+	req.Header.Set("Authorization", "Bearer "+testToken("subject-1"))
+	rsp := httptest.NewRecorder()
+	p.ServeHTTP(rsp, req)
+	if rsp.Code != http.StatusForbidden {
+		t.Fatalf("Expected status %d, got %d", http.StatusForbidden, rsp.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/1/vehicles/"+testVIN+"/command/honk_horn", nil)
+	p.ServeHTTP(httptest.NewRecorder(), req)
+
+	records := readAuditRecords(t, buffer.Bytes())
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 audit records, got %d", len(records))
+	}
+	denied := records[0]
+	if denied.Subject != "subject-1" || denied.VIN != testVIN || denied.Command != "set_valet_mode" {
+		t.Errorf("Unexpected record %+v", denied)
+	}
+	if denied.Outcome != proxy.OutcomeDenied || denied.Status != http.StatusForbidden || denied.ClientIP == "" {
+		t.Errorf("Unexpected outcome in record %+v", denied)
+	}
+	if denied.Parameters["password"] != "[REDACTED]" || denied.Parameters["on"] != true {
+		t.Errorf("Parameters not sanitized: %+v", denied.Parameters)
+	}
+	if records[1].Outcome != proxy.OutcomeFailure || records[1].Error == "" {
+		t.Errorf("Expected missing token to be recorded as failure: %+v", records[1])
+	}
+	if _, err := proxy.VerifyAuditLog(&buffer); err != nil {
+		t.Error(err)
+	}
+}
@@ -22,6 +22,8 @@ var (
 	// ErrCommandUseRESTAPI indicates vehicle/command is not supported by the protocol
 	ErrCommandUseRESTAPI = errors.New("command requires using the REST API")
 
+	errInvalidCommand = &inet.HTTPError{Code: http.StatusBadRequest, Message: "{\"response\":null,\"error\":\"invalid_command\",\"error_description\":\"\"}"}
+
 	seatPositions = []vehicle.SeatPosition{
 		vehicle.SeatFrontLeft,
 		vehicle.SeatFrontRight,
@@ -57,6 +59,12 @@ var (
 // RequestParameters allows simple type check
 type RequestParameters map[string]interface{}
 
+// isKnownCommand returns true if ExtractCommandAction recognizes command.
+func isKnownCommand(command string) bool {
+	_, err := ExtractCommandAction(context.Background(), command, nil)
+	return err != errInvalidCommand
+}
+
 // ExtractCommandAction use command to define which action should be executed.
 func ExtractCommandAction(ctx context.Context, command string, params RequestParameters) (func(*vehicle.Vehicle) error, error) {
 	switch command {
@@ -559,7 +567,7 @@ func ExtractCommandAction(ctx context.Context, command string, params RequestPar
 			return nil, errors.New("command must be 'vent' or 'close'")
 		}
 	default:
-		return nil, &inet.HTTPError{Code: http.StatusBadRequest, Message: "{\"response\":null,\"error\":\"invalid_command\",\"error_description\":\"\"}"}
+		return nil, errInvalidCommand
 	}
 }
 
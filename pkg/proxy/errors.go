@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/teslamotors/vehicle-command/pkg/connector/inet"
+	"github.com/teslamotors/vehicle-command/pkg/protocol"
+	"github.com/teslamotors/vehicle-command/pkg/vehicle"
+)
+
+// ErrorCode is a stable, machine-readable identifier for the cause of a failed request.
+type ErrorCode string
+
+const (
+	CodeInvalidRequest       ErrorCode = "invalid_request"
+	CodeForbidden            ErrorCode = "forbidden"
+	CodePolicyDenied         ErrorCode = "policy_denied"
+	CodeNotFound             ErrorCode = "not_found"
+	CodeMethodNotAllowed     ErrorCode = "method_not_allowed"
+	CodeIdempotencyKeyReused ErrorCode = "idempotency_key_reused"
+	CodeStepUpRequired       ErrorCode = "step_up_required"
+	CodeStepUpFailed         ErrorCode = "step_up_failed"
+	CodeRateLimited          ErrorCode = "rate_limited"
+	CodeTimeout              ErrorCode = "timeout"
+	CodeUnavailable          ErrorCode = "unavailable"
+	CodeInternal             ErrorCode = "internal_error"
+
+	CodeVehicleOffline       ErrorCode = "vehicle_offline"        // The vehicle is asleep or not connected
+	CodeVehicleBusy          ErrorCode = "vehicle_busy"           // The vehicle is busy or finishing waking up
+	CodeVehicleFault         ErrorCode = "vehicle_fault"          // The vehicle rejected the message at the protocol layer
+	CodeVehicleRejected      ErrorCode = "vehicle_rejected"       // The vehicle authenticated the command but couldn't execute it
+	CodeKeychainError        ErrorCode = "keychain_error"         // The vehicle couldn't modify its list of authorized keys
+	CodeKeyNotPaired         ErrorCode = "key_not_paired"         // The proxy's public key isn't enrolled on the vehicle
+	CodeKeyUnavailable       ErrorCode = "key_unavailable"        // The proxy doesn't have a command-authentication private key
+	CodeNoSession            ErrorCode = "no_session"             // An authenticated session could not be established
+	CodeProtocolNotSupported ErrorCode = "protocol_not_supported" // The vehicle doesn't support end-to-end authentication
+	CodeFleetAPIError        ErrorCode = "fleet_api_error"        // Fleet API returned an error
+	CodeRoleNotPermitted     ErrorCode = "role_not_permitted"     // The proxy's key role doesn't allow the command
+)
+
+// Suggested delays before retrying temporary failures.
+const (
+	retryAfterBusy    = 1
+	retryAfterDefault = 5
+	// Waking a vehicle typically takes 10-30 seconds.
+	retryAfterOffline = 15
+)
+
+// ErrorDetails describes a failed request. It's included in error responses as the
+// "error_details" field, alongside the Fleet API-compatible "error" field.
+type ErrorDetails struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	// MayHaveSucceeded is true if the vehicle may have executed the command despite the error.
+	// Clients should check vehicle state before retrying non-idempotent commands.
+	MayHaveSucceeded bool `json:"may_have_succeeded"`
+	// Temporary is true if retrying the request may succeed without user intervention.
+	Temporary bool `json:"temporary"`
+	// RetryAfter is the suggested delay, in seconds, before retrying a temporary failure.
+	RetryAfter int `json:"retry_after,omitempty"`
+	// VehicleFault and VehicleFaultCode contain the name and numeric value of the fault reported
+	// by the vehicle, if any.
+	VehicleFault     string `json:"vehicle_fault,omitempty"`
+	VehicleFaultCode int32  `json:"vehicle_fault_code,omitempty"`
+	// UpstreamStatus is the HTTP status code returned by Fleet API, if any.
+	UpstreamStatus int `json:"upstream_status,omitempty"`
+}
+
+// codeForStatus returns the ErrorCode for a response with no more specific cause.
+func codeForStatus(status int) ErrorCode {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return CodeInvalidRequest
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return CodeTimeout
+	case http.StatusBadGateway:
+		return CodeFleetAPIError
+	case http.StatusServiceUnavailable:
+		return CodeUnavailable
+	}
+	return CodeInternal
+}
+
+// sentinelCodes maps errors to codes. The first match wins.
+var sentinelCodes = []struct {
+	err  error
+	code ErrorCode
+}{
+	{ErrPolicyDenied, CodePolicyDenied},
+	{ErrIdempotencyKeyReused, CodeIdempotencyKeyReused},
+	{ErrStepUpRequired, CodeStepUpRequired},
+	{ErrStepUpFailed, CodeStepUpFailed},
+	{ErrJobNotFound, CodeNotFound},
+	{ErrQueueFull, CodeRateLimited},
+	{ErrRateLimited, CodeRateLimited},
+	{inet.ErrVehicleNotAwake, CodeVehicleOffline},
+	{protocol.ErrBusy, CodeVehicleBusy},
+	{protocol.ErrKeyNotPaired, CodeKeyNotPaired},
+	{protocol.ErrRequiresKey, CodeKeyUnavailable},
+	{protocol.ErrNoSession, CodeNoSession},
+	{protocol.ErrProtocolNotSupported, CodeProtocolNotSupported},
+	{context.DeadlineExceeded, CodeTimeout},
+}
+
+// describeError classifies err, which caused a response with the given HTTP status.
+func describeError(status int, err error) *ErrorDetails {
+	details := &ErrorDetails{Code: codeForStatus(status)}
+	if err == nil {
+		details.Message = http.StatusText(status)
+		details.Temporary = status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+	} else {
+		details.Message = err.Error()
+		var commandErr protocol.Error
+		if errors.As(err, &commandErr) {
+			details.MayHaveSucceeded = commandErr.MayHaveSucceeded()
+			details.Temporary = commandErr.Temporary()
+		}
+	}
+
+	var httpErr *inet.HTTPError
+	var messageErr *protocol.RoutableMessageError
+	var keychainErr *protocol.KeychainError
+	var permissionErr *vehicle.PermissionError
+	switch {
+	case err == nil:
+	case errors.As(err, &permissionErr):
+		details.Code = CodeRoleNotPermitted
+	case errors.As(err, &httpErr):
+		details.Code = CodeFleetAPIError
+		details.UpstreamStatus = httpErr.Code
+	case errors.As(err, &messageErr):
+		details.Code = CodeVehicleFault
+	case errors.As(err, &keychainErr):
+		details.Code = CodeKeychainError
+	case protocol.IsNominalError(err):
+		// Parameter validation errors are also reported as NominalErrors, but with a 4xx status.
+		if status == http.StatusOK {
+			details.Code = CodeVehicleRejected
+		}
+	default:
+		for _, sentinel := range sentinelCodes {
+			if errors.Is(err, sentinel.err) {
+				details.Code = sentinel.code
+				break
+			}
+		}
+	}
+	switch details.Code {
+	case CodeTimeout, CodeRateLimited, CodeVehicleOffline:
+		details.Temporary = true
+	}
+
+	if fault, code, ok := protocol.VehicleFault(err); ok {
+		details.VehicleFault = fault
+		details.VehicleFaultCode = code
+	}
+
+	var rateErr *RateLimitError
+	if details.Temporary {
+		switch {
+		case errors.As(err, &rateErr):
+			details.RetryAfter = rateErr.retryAfterSeconds()
+		case details.Code == CodeVehicleBusy:
+			details.RetryAfter = retryAfterBusy
+		case details.Code == CodeVehicleOffline:
+			details.RetryAfter = retryAfterOffline
+		default:
+			details.RetryAfter = retryAfterDefault
+		}
+	}
+	return details
+}
+
+// setRetryAfter adds a Retry-After header to a response if details suggests a delay.
+func setRetryAfter(w http.ResponseWriter, details *ErrorDetails) {
+	if details.RetryAfter > 0 && w.Header().Get("Retry-After") == "" {
+		w.Header().Set("Retry-After", strconv.Itoa(details.RetryAfter))
+	}
+}
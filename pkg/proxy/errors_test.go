@@ -0,0 +1,97 @@
+package proxy_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/teslamotors/vehicle-command/pkg/connector/inet"
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/keys"
+	"github.com/teslamotors/vehicle-command/pkg/proxy"
+	"github.com/teslamotors/vehicle-command/pkg/vehicle"
+)
+
+func TestErrorDetails(t *testing.T) {
+	p, err := proxy.New(context.Background(), newTestKey(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Policy = newTestPolicyStore(t, `{"default": "allow", "rules": [{"effect": "deny", "commands": ["door_unlock"]}]}`)
+	var logs bytes.Buffer
+	p.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+
+	tests := []struct {
+		name    string
+		method  string
+		command string
+		body    string
+		token   bool
+		status  int
+		code    proxy.ErrorCode
+	}{
+		{"missing token", http.MethodPost, "honk_horn", "", false, http.StatusForbidden, proxy.CodeForbidden},
+		{"policy", http.MethodPost, "door_unlock", "", true, http.StatusForbidden, proxy.CodePolicyDenied},
+		{"bad parameter", http.MethodPost, "set_charge_limit", `{"percent": "lots"}`, true, http.StatusBadRequest, proxy.CodeInvalidRequest},
+		{"method", http.MethodGet, "honk_horn", "", true, http.StatusMethodNotAllowed, proxy.CodeMethodNotAllowed},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "/api/1/vehicles/"+testVIN+"/command/"+test.command, strings.NewReader(test.body))
+		if test.token {
+			req.Header.Set("Authorization", "Bearer "+testToken("subject-1"))
+		}
+		rsp := httptest.NewRecorder()
+		p.ServeHTTP(rsp, req)
+		if rsp.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, rsp.Code)
+			continue
+		}
+		var reply proxy.Response
+		if err := json.Unmarshal(rsp.Body.Bytes(), &reply); err != nil {
+			t.Errorf("%s: invalid response body: %s", test.name, err)
+			continue
+		}
+		if reply.Details == nil {
+			t.Errorf("%s: missing error_details in %s", test.name, rsp.Body.String())
+			continue
+		}
+		if reply.Details.Code != test.code {
+			t.Errorf("%s: expected code %s, got %s", test.name, test.code, reply.Details.Code)
+		}
+		if reply.Details.Message == "" {
+			t.Errorf("%s: missing message", test.name)
+		}
+		if reply.Details.Temporary || reply.Details.MayHaveSucceeded || rsp.Header().Get("Retry-After") != "" {
+			t.Errorf("%s: expected permanent error, got %+v", test.name, reply.Details)
+		}
+	}
+	if !strings.Contains(logs.String(), "Returning error Forbidden") {
+		t.Errorf("Expected errors to be logged to Proxy.Logger, got:\n%s", logs.String())
+	}
+}
+
+func TestPermissionErrorDetails(t *testing.T) {
+	err := fmt.Errorf("command failed: %w", &vehicle.PermissionError{Role: keys.Role_ROLE_VEHICLE_MONITOR, Permission: vehicle.PermissionCharging})
+	details := proxy.DescribeError(http.StatusForbidden, err)
+	if details.Code != proxy.CodeRoleNotPermitted {
+		t.Errorf("Expected code %s, got %s", proxy.CodeRoleNotPermitted, details.Code)
+	}
+	if details.Temporary || details.MayHaveSucceeded {
+		t.Errorf("Expected permanent error, got %+v", details)
+	}
+}
+
+func TestVehicleOfflineErrorDetails(t *testing.T) {
+	details := proxy.DescribeError(http.StatusRequestTimeout, inet.ErrVehicleNotAwake)
+	if details.Code != proxy.CodeVehicleOffline {
+		t.Errorf("Expected code %s, got %s", proxy.CodeVehicleOffline, details.Code)
+	}
+	if !details.Temporary || details.RetryAfter == 0 {
+		t.Errorf("Expected temporary error with retry delay, got %+v", details)
+	}
+}
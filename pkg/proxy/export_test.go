@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"context"
+	"time"
+)
+
+// MarkUnsupportedVIN lets tests simulate a vehicle that doesn't support end-to-end authentication.
+func (p *Proxy) MarkUnsupportedVIN(vin string) {
+	p.markUnsupportedVIN(vin)
+}
+
+// SetClock lets tests control the time used to refill rate-limit buckets.
+func (r *RateLimiter) SetClock(now func() time.Time) {
+	r.now = now
+}
+
+// SetSubjectHost lets tests direct a subject's requests to a fake Fleet API server.
+func (p *Proxy) SetSubjectHost(subject, host string) {
+	p.updateDomainForSubject(subject, host)
+}
+
+// DescribeError lets tests check how errors are classified without a vehicle.
+func DescribeError(status int, err error) *ErrorDetails {
+	return describeError(status, err)
+}
+
+// Enqueue lets tests acquire a vehicle's queue the way commands do.
+func (p *Proxy) Enqueue(ctx context.Context, vin, subject, command string) (func(), error) {
+	return p.enqueue(ctx, vin, subject, command)
+}
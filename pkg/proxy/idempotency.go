@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// IdempotencyKeyHeader contains a client-generated value that identifies retries of the same
+	// command.
+	IdempotencyKeyHeader = "Idempotency-Key"
+
+	// IdempotentReplayedHeader is set to "true" on responses that were returned from the
+	// idempotency cache instead of executing the command.
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+
+	// DefaultIdempotencyWindow is how long the proxy remembers the outcome of a command.
+	DefaultIdempotencyWindow = time.Hour
+
+	maxIdempotencyKeyLength = 255
+)
+
+var (
+	// ErrIdempotencyKeyReused indicates a client sent the same idempotency key with a different
+	// command or parameters.
+	ErrIdempotencyKeyReused = errors.New("idempotency key was already used for a different request")
+
+	// ErrInvalidIdempotencyKey indicates the Idempotency-Key header is too long.
+	ErrInvalidIdempotencyKey = errors.New("idempotency key is too long")
+)
+
+type idempotencyKey struct {
+	subject string
+	vin     string
+	key     string
+}
+
+type idempotencyEntry struct {
+	fingerprint [sha256.Size]byte
+	done        chan struct{}
+
+	// The following fields are set before done is closed.
+	cached   bool
+	expires  time.Time
+	response *bufferedResponse
+	err      error
+}
+
+// IdempotencyCache remembers the outcome of commands sent with an Idempotency-Key header, so that
+// retries return the original result instead of executing the command again.
+//
+// Keys are scoped to an OAuth subject and VIN. If a duplicate request arrives while the original
+// is in progress, it waits for and then returns the original's result. Only outcomes in which the
+// command succeeded or may have succeeded are cached; if a command definitely wasn't executed, a
+// retry executes it.
+type IdempotencyCache struct {
+	window time.Duration
+
+	lock    sync.Mutex
+	entries map[idempotencyKey]*idempotencyEntry
+}
+
+// NewIdempotencyCache returns an IdempotencyCache that remembers outcomes for window.
+func NewIdempotencyCache(window time.Duration) *IdempotencyCache {
+	return &IdempotencyCache{
+		window:  window,
+		entries: make(map[idempotencyKey]*idempotencyEntry),
+	}
+}
+
+// begin returns the entry for key. If leader is true, the caller must execute the command and
+// then call finish.
+func (c *IdempotencyCache) begin(key idempotencyKey, fingerprint [sha256.Size]byte) (entry *idempotencyEntry, leader bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	for k, e := range c.entries {
+		select {
+		case <-e.done:
+			if !e.cached || now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		default:
+		}
+	}
+	if entry, ok := c.entries[key]; ok {
+		return entry, false
+	}
+	entry = &idempotencyEntry{fingerprint: fingerprint, done: make(chan struct{})}
+	c.entries[key] = entry
+	return entry, true
+}
+
+func (c *IdempotencyCache) finish(key idempotencyKey, entry *idempotencyEntry, rsp *bufferedResponse, err error, cache bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry.response = rsp
+	entry.err = err
+	entry.cached = cache
+	entry.expires = time.Now().Add(c.window)
+	if !cache {
+		delete(c.entries, key)
+	}
+	close(entry.done)
+}
+
+func writeBufferedResponse(w http.ResponseWriter, rsp *bufferedResponse, replayed bool) {
+	for name, values := range rsp.header {
+		w.Header()[name] = values
+	}
+	if replayed {
+		w.Header().Set(IdempotentReplayedHeader, "true")
+	}
+	status := rsp.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	_, _ = w.Write(rsp.body.Bytes())
+}
+
+// runIdempotent executes run at most once per idempotency key within p.Idempotency's window. The
+// record is used to decide whether the outcome should be cached.
+func (p *Proxy) runIdempotent(w http.ResponseWriter, req *http.Request, record *AuditRecord, key string,
+	run func(http.ResponseWriter, *http.Request) error) error {
+	if len(key) > maxIdempotencyKeyLength {
+		writeJSONError(w, p.logger(), http.StatusBadRequest, ErrInvalidIdempotencyKey)
+		return ErrInvalidIdempotencyKey
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, MaxResponseLength))
+	if err != nil {
+		writeJSONError(w, p.logger(), http.StatusBadRequest, err)
+		return err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	fingerprint := sha256.Sum256(append([]byte(req.URL.Path+"\x00"), body...))
+	cacheKey := idempotencyKey{subject: record.Subject, vin: record.VIN, key: key}
+
+	for {
+		entry, leader := p.Idempotency.begin(cacheKey, fingerprint)
+		if leader {
+			rsp := &bufferedResponse{}
+			err := run(rsp, req)
+			outcome := *record
+			outcome.finish(rsp.status, err)
+			p.Idempotency.finish(cacheKey, entry, rsp, err, outcome.Outcome == OutcomeSuccess || outcome.MayHaveSucceeded)
+			writeBufferedResponse(w, rsp, false)
+			return err
+		}
+		if entry.fingerprint != fingerprint {
+			writeJSONError(w, p.logger(), http.StatusUnprocessableEntity, ErrIdempotencyKeyReused)
+			return ErrIdempotencyKeyReused
+		}
+		select {
+		case <-entry.done:
+		case <-req.Context().Done():
+			return req.Context().Err()
+		}
+		if !entry.cached {
+			// The original attempt definitely failed, so it's safe to try again.
+			continue
+		}
+		p.logger().Info("Replaying result of %s for idempotency key %q", record.Command, key)
+		writeBufferedResponse(w, entry.response, true)
+		return entry.err
+	}
+}
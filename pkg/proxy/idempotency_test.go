@@ -0,0 +1,64 @@
+package proxy_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/teslamotors/vehicle-command/pkg/proxy"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	p, err := proxy.New(context.Background(), newTestKey(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Idempotency = proxy.NewIdempotencyCache(time.Minute)
+	if p.Jobs, err = proxy.NewJobManager(proxy.NewMemoryJobStore()); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(key, body string, async bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/1/vehicles/"+testVIN+"/command/set_charge_limit", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+testToken("subject-1"))
+		req.Header.Set(proxy.IdempotencyKeyHeader, key)
+		if async {
+			req.Header.Set("Prefer", proxy.PreferAsync)
+		}
+		rsp := httptest.NewRecorder()
+		p.ServeHTTP(rsp, req)
+		return rsp
+	}
+
+	// Accepted jobs are cached, so a retry returns the same job instead of creating a new one.
+	first := send("key-1", `{"percent": "lots"}`, true)
+	if first.Code != http.StatusAccepted {
+		t.Fatalf("Expected status %d, got %d", http.StatusAccepted, first.Code)
+	}
+	retry := send("key-1", `{"percent": "lots"}`, true)
+	if retry.Code != http.StatusAccepted || retry.Header().Get(proxy.IdempotentReplayedHeader) != "true" {
+		t.Errorf("Expected replayed response, got %d %v", retry.Code, retry.Header())
+	}
+	if retry.Header().Get("Location") != first.Header().Get("Location") || retry.Body.String() != first.Body.String() {
+		t.Errorf("Replayed response differs from original")
+	}
+
+	if rsp := send("key-1", `{"percent": 80}`, true); rsp.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status %d when reusing key, got %d", http.StatusUnprocessableEntity, rsp.Code)
+	}
+
+	// Commands that definitely weren't executed are not cached.
+	for i := 0; i < 2; i++ {
+		rsp := send("key-2", `{"percent": "lots"}`, false)
+		if rsp.Code != http.StatusBadRequest || rsp.Header().Get(proxy.IdempotentReplayedHeader) != "" {
+			t.Errorf("Expected fresh %d response, got %d %v", http.StatusBadRequest, rsp.Code, rsp.Header())
+		}
+	}
+
+	if rsp := send(strings.Repeat("k", 256), `{}`, false); rsp.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for long key, got %d", http.StatusBadRequest, rsp.Code)
+	}
+}
@@ -0,0 +1,617 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teslamotors/vehicle-command/internal/log"
+)
+
+// JobState describes the progress of an asynchronous command.
+type JobState string
+
+const (
+	JobQueued      JobState = "queued"      // Waiting for earlier commands to the same vehicle
+	JobWaking      JobState = "waking"      // Connecting to the vehicle
+	JobHandshaking JobState = "handshaking" // Establishing an authenticated session
+	JobSent        JobState = "sent"        // Command sent; waiting for the vehicle's response
+	JobSucceeded   JobState = "succeeded"
+	JobFailed      JobState = "failed"    // The command was not executed
+	JobAmbiguous   JobState = "ambiguous" // The command failed, but may have been executed
+)
+
+// Terminal returns true if s is a final state.
+func (s JobState) Terminal() bool {
+	return s == JobSucceeded || s == JobFailed || s == JobAmbiguous
+}
+
+const (
+	// PreferAsync is the value of the Prefer header that requests asynchronous execution.
+	PreferAsync = "respond-async"
+
+	// JobsPath is the URL path prefix for polling asynchronous commands.
+	JobsPath = "/jobs/"
+
+	// WebhookSignatureHeader contains the signature of webhook requests. See
+	// VerifyWebhookSignature.
+	WebhookSignatureHeader = "X-Tesla-Proxy-Signature"
+
+	// DefaultJobRetention is how long completed jobs remain available for polling.
+	DefaultJobRetention = 24 * time.Hour
+
+	// DefaultJobPurgeInterval is how often applications should call PurgeExpired.
+	DefaultJobPurgeInterval = 10 * time.Minute
+
+	webhookAttempts = 3
+)
+
+var (
+	// ErrJobNotFound indicates a job ID does not exist, has expired, or belongs to a different
+	// client.
+	ErrJobNotFound = errors.New("job not found")
+
+	// ErrInvalidWebhookSignature indicates a webhook request was not signed with the expected key.
+	ErrInvalidWebhookSignature = errors.New("invalid webhook signature")
+
+	errProxyRestarted = errors.New("proxy restarted before command completed")
+
+	jobIDRE = regexp.MustCompile(`^[0-9a-f]{32}$`)
+)
+
+// Job is an asynchronous command.
+type Job struct {
+	ID      string    `json:"id"`
+	Subject string    `json:"-"`
+	VIN     string    `json:"vin"`
+	Command string    `json:"command"`
+	State   JobState  `json:"state"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+	// Status and Response contain the HTTP status code and body the proxy would have returned if
+	// the command had been sent synchronously. They are only set once the job is complete.
+	Status   int             `json:"status,omitempty"`
+	Response json.RawMessage `json:"response,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// storedJob includes fields omitted from client responses.
+type storedJob struct {
+	Job
+	Subject string `json:"subject"`
+}
+
+func (j *Job) marshalStorage() ([]byte, error) {
+	return json.Marshal(&storedJob{Job: *j, Subject: j.Subject})
+}
+
+func (j *Job) unmarshalStorage(data []byte) error {
+	var stored storedJob
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	*j = stored.Job
+	j.Subject = stored.Subject
+	return nil
+}
+
+// JobStore persists jobs. Implementations must be safe for concurrent use.
+type JobStore interface {
+	// Save creates or replaces job.
+	Save(job *Job) error
+	// Load returns the job with the given ID, or ErrJobNotFound.
+	Load(id string) (*Job, error)
+	// List returns all stored jobs.
+	List() ([]*Job, error)
+	// Delete removes the job with the given ID. Deleting a nonexistent job is not an error.
+	Delete(id string) error
+}
+
+type memoryJobStore struct {
+	lock sync.Mutex
+	jobs map[string]Job
+}
+
+// NewMemoryJobStore returns a JobStore that does not persist jobs across restarts.
+func NewMemoryJobStore() JobStore {
+	return &memoryJobStore{jobs: make(map[string]Job)}
+}
+
+func (m *memoryJobStore) Save(job *Job) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.jobs[job.ID] = *job
+	return nil
+}
+
+func (m *memoryJobStore) Load(id string) (*Job, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return &job, nil
+}
+
+func (m *memoryJobStore) List() ([]*Job, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	jobs := make([]*Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		job := job
+		jobs = append(jobs, &job)
+	}
+	return jobs, nil
+}
+
+func (m *memoryJobStore) Delete(id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.jobs, id)
+	return nil
+}
+
+type fileJobStore struct {
+	dir string
+}
+
+// NewFileJobStore returns a JobStore that saves each job as a JSON file in dir, creating dir if
+// necessary.
+func NewFileJobStore(dir string) (JobStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileJobStore{dir: dir}, nil
+}
+
+func (f *fileJobStore) filename(id string) string {
+	return filepath.Join(f.dir, id+".json")
+}
+
+func (f *fileJobStore) Save(job *Job) error {
+	data, err := job.marshalStorage()
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file and rename it so that readers never see a partial job.
+	tmp, err := os.CreateTemp(f.dir, ".job-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.filename(job.ID))
+}
+
+func (f *fileJobStore) Load(id string) (*Job, error) {
+	if !jobIDRE.MatchString(id) {
+		return nil, ErrJobNotFound
+	}
+	data, err := os.ReadFile(f.filename(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrJobNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var job Job
+	if err := job.unmarshalStorage(data); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (f *fileJobStore) List() ([]*Job, error) {
+	filenames, err := filepath.Glob(filepath.Join(f.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*Job
+	for _, filename := range filenames {
+		job, err := f.Load(strings.TrimSuffix(filepath.Base(filename), ".json"))
+		if errors.Is(err, ErrJobNotFound) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+func (f *fileJobStore) Delete(id string) error {
+	if !jobIDRE.MatchString(id) {
+		return nil
+	}
+	err := os.Remove(f.filename(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Webhook describes an HTTP endpoint that receives notifications, such as completed jobs.
+//
+// The proxy POSTs the JSON-encoded notification (for example, a Job) to URL. If Secret is not
+// empty, requests include a WebhookSignatureHeader that the receiver should check using
+// VerifyWebhookSignature.
+type Webhook struct {
+	URL    string
+	Secret []byte
+	Client *http.Client // If nil, http.DefaultClient is used
+}
+
+func signWebhook(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature checks the WebhookSignatureHeader value of a webhook request with the
+// given body. The header has the form "t=<unix timestamp>,v1=<hex HMAC-SHA256>", where the HMAC
+// covers the timestamp, a period, and the body. Signatures older than maxAge are rejected to
+// prevent replay.
+func VerifyWebhookSignature(secret []byte, header string, body []byte, maxAge time.Duration) error {
+	timestamp, signature := parseSignatureHeader(header)
+	if timestamp == 0 || signature == nil {
+		return ErrInvalidWebhookSignature
+	}
+	if age := time.Since(time.Unix(timestamp, 0)); age > maxAge || age < -maxAge {
+		return fmt.Errorf("%w: timestamp outside allowed window", ErrInvalidWebhookSignature)
+	}
+	expected, _ := hex.DecodeString(signWebhook(secret, timestamp, body))
+	if !hmac.Equal(signature, expected) {
+		return ErrInvalidWebhookSignature
+	}
+	return nil
+}
+
+// parseSignatureHeader extracts the timestamp and signature from a WebhookSignatureHeader value.
+func parseSignatureHeader(header string) (timestamp int64, signature []byte) {
+	for _, field := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch key {
+		case "t":
+			timestamp, _ = strconv.ParseInt(value, 10, 64)
+		case "v1":
+			signature, _ = hex.DecodeString(value)
+		}
+	}
+	return timestamp, signature
+}
+
+// send POSTs notification to w, retrying on failure. The description identifies the notification
+// in log messages.
+func (w *Webhook) send(notification interface{}, description string, logger *log.Logger) {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		logger.Error("Failed to encode %s for webhook: %s", description, err)
+		return
+	}
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if err = w.post(client, body); err == nil {
+			return
+		}
+		logger.Warning("Webhook for %s failed (attempt %d of %d): %s", description, attempt, webhookAttempts, err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+func (w *Webhook) post(client *http.Client, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.Secret) > 0 {
+		now := time.Now().Unix()
+		req.Header.Set(WebhookSignatureHeader, fmt.Sprintf("t=%d,v1=%s", now, signWebhook(w.Secret, now, body)))
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(rsp.Body, MaxResponseLength))
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", rsp.Status)
+	}
+	return nil
+}
+
+// JobManager tracks asynchronous commands.
+type JobManager struct {
+	// Retention controls how long completed jobs are kept.
+	Retention time.Duration
+
+	// Webhook, if not nil, is notified when jobs complete.
+	Webhook *Webhook
+
+	store JobStore
+	lock  sync.Mutex
+}
+
+// NewJobManager creates a JobManager backed by store.
+//
+// Jobs that were in progress when the proxy last stopped can't be resumed, since the proxy does not
+// persist OAuth tokens. They are marked ambiguous if the command may have reached the vehicle, and
+// failed otherwise. Expired jobs are deleted.
+func NewJobManager(store JobStore) (*JobManager, error) {
+	m := &JobManager{Retention: DefaultJobRetention, store: store}
+	jobs, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range jobs {
+		if job.State.Terminal() {
+			continue
+		}
+		if job.State == JobSent {
+			job.State = JobAmbiguous
+		} else {
+			job.State = JobFailed
+		}
+		job.Error = errProxyRestarted.Error()
+		job.Updated = time.Now().UTC()
+		if err := store.Save(job); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.purge(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// PurgeExpired deletes expired jobs every interval. PurgeExpired blocks until done is closed.
+// Errors are logged to logger, which should normally be the Logger of the Proxy using m. If logger
+// is nil, the global logger is used.
+//
+// Applications should start PurgeExpired in a goroutine after creating m; otherwise, completed jobs
+// are only deleted when NewJobManager runs.
+func (m *JobManager) PurgeExpired(done <-chan struct{}, interval time.Duration, logger *slog.Logger) {
+	l := log.New(logger)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if err := m.purge(); err != nil {
+			l.Warning("Failed to purge expired jobs: %s", err)
+		}
+	}
+}
+
+// purge deletes expired jobs.
+func (m *JobManager) purge() error {
+	jobs, err := m.store.List()
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if job.State.Terminal() && time.Since(job.Updated) > m.Retention {
+			if err := m.store.Delete(job.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *JobManager) create(subject, vin, command string) (*Job, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	job := &Job{
+		ID:      hex.EncodeToString(id[:]),
+		Subject: subject,
+		VIN:     vin,
+		Command: command,
+		State:   JobQueued,
+		Created: now,
+		Updated: now,
+	}
+	if err := m.store.Save(job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Get returns the job with the given ID if it belongs to subject.
+func (m *JobManager) Get(subject, id string) (*Job, error) {
+	job, err := m.store.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Subject != subject {
+		return nil, ErrJobNotFound
+	}
+	return job, nil
+}
+
+func (m *JobManager) setState(job *Job, state JobState) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	job.State = state
+	job.Updated = time.Now().UTC()
+	return m.store.Save(job)
+}
+
+type jobContextKey struct{}
+
+// setJobState updates the progress of the asynchronous job associated with ctx, if any.
+func (p *Proxy) setJobState(ctx context.Context, state JobState) {
+	job, ok := ctx.Value(jobContextKey{}).(*Job)
+	if !ok || p.Jobs == nil {
+		return
+	}
+	if err := p.Jobs.setState(job, state); err != nil {
+		p.logger().Error("Failed to update job %s: %s", job.ID, err)
+	}
+}
+
+// wantsAsync returns true if the client asked for asynchronous execution.
+func wantsAsync(req *http.Request) bool {
+	for _, value := range req.Header.Values("Prefer") {
+		for _, preference := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(preference), PreferAsync) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bufferedResponse is an http.ResponseWriter that stores the response in memory.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	if b.header == nil {
+		b.header = make(http.Header)
+	}
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	if b.status == 0 {
+		b.status = code
+	}
+}
+
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(data)
+}
+
+// jobFunc executes an asynchronous command, writing the response to w and updating the record of
+// the command.
+type jobFunc func(w http.ResponseWriter, req *http.Request, record *AuditRecord) error
+
+// startJob runs execute in the background and responds to the client with 202 Accepted.
+//
+// The execute function receives a request with a buffered body and a context that carries the
+// job, so that it may be used after the client's request completes.
+func (p *Proxy) startJob(w http.ResponseWriter, req *http.Request, record *AuditRecord, execute jobFunc) error {
+	body, err := io.ReadAll(io.LimitReader(req.Body, MaxResponseLength))
+	if err != nil {
+		writeJSONError(w, p.logger(), http.StatusBadRequest, err)
+		return err
+	}
+	job, err := p.Jobs.create(record.Subject, record.VIN, record.Command)
+	if err != nil {
+		writeJSONError(w, p.logger(), http.StatusInternalServerError, err)
+		return err
+	}
+
+	accepted := *job
+
+	ctx := context.WithValue(context.WithoutCancel(req.Context()), jobContextKey{}, job)
+	jobReq := req.Clone(ctx)
+	jobReq.Body = io.NopCloser(bytes.NewReader(body))
+	jobRecord := *record
+	go p.runJob(job, jobReq, &jobRecord, execute)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", JobsPath+accepted.ID)
+	w.WriteHeader(http.StatusAccepted)
+	return json.NewEncoder(w).Encode(map[string]*Job{"response": &accepted})
+}
+
+func (p *Proxy) runJob(job *Job, req *http.Request, record *AuditRecord, execute jobFunc) {
+	var rsp bufferedResponse
+	err := execute(&rsp, req, record)
+
+	// The record of the original request shows the job was accepted. This record shows the result.
+	record.Time = time.Now().UTC()
+	record.Path = JobsPath + job.ID
+	record.finish(rsp.status, err)
+	p.writeAuditRecord(record)
+
+	p.Jobs.lock.Lock()
+	switch {
+	case record.Outcome == OutcomeSuccess:
+		job.State = JobSucceeded
+	case record.MayHaveSucceeded:
+		job.State = JobAmbiguous
+	default:
+		job.State = JobFailed
+	}
+	job.Status = record.Status
+	job.Error = record.Error
+	if json.Valid(rsp.body.Bytes()) {
+		job.Response = json.RawMessage(bytes.TrimSpace(rsp.body.Bytes()))
+	}
+	job.Updated = time.Now().UTC()
+	err = p.Jobs.store.Save(job)
+	completed := *job
+	p.Jobs.lock.Unlock()
+	if err != nil {
+		p.logger().Error("Failed to save job %s: %s", job.ID, err)
+	}
+	p.logger().Info("Job %s %s", job.ID, completed.State)
+
+	if p.Jobs.Webhook != nil {
+		p.Jobs.Webhook.send(&completed, "job "+completed.ID, p.logger())
+	}
+}
+
+// handleJobStatus responds to requests for /jobs/{id}.
+func (p *Proxy) handleJobStatus(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeJSONError(w, p.logger(), http.StatusMethodNotAllowed, nil)
+		return
+	}
+	acct, err := getAccount(req)
+	if err != nil {
+		writeJSONError(w, p.logger(), http.StatusForbidden, err)
+		return
+	}
+	job, err := p.Jobs.Get(acct.Subject, strings.TrimPrefix(req.URL.Path, JobsPath))
+	if errors.Is(err, ErrJobNotFound) {
+		writeJSONError(w, p.logger(), http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeJSONError(w, p.logger(), http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]*Job{"response": job})
+}
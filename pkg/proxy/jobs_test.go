@@ -0,0 +1,180 @@
+package proxy_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/teslamotors/vehicle-command/pkg/proxy"
+)
+
+var webhookSecret = []byte("webhook secret")
+
+func decodeJob(t *testing.T, body io.Reader) *proxy.Job {
+	t.Helper()
+	var reply struct {
+		Response proxy.Job `json:"response"`
+	}
+	if err := json.NewDecoder(body).Decode(&reply); err != nil {
+		t.Fatalf("Invalid job response: %s", err)
+	}
+	return &reply.Response
+}
+
+func TestAsyncCommand(t *testing.T) {
+	completed := make(chan *proxy.Job, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if err := proxy.VerifyWebhookSignature(webhookSecret, req.Header.Get(proxy.WebhookSignatureHeader), body, time.Minute); err != nil {
+			t.Errorf("Webhook signature invalid: %s", err)
+		}
+		if err := proxy.VerifyWebhookSignature([]byte("wrong"), req.Header.Get(proxy.WebhookSignatureHeader), body, time.Minute); !errors.Is(err, proxy.ErrInvalidWebhookSignature) {
+			t.Errorf("Expected signature with wrong secret to fail verification, got %v", err)
+		}
+		var job proxy.Job
+		if err := json.Unmarshal(body, &job); err != nil {
+			t.Errorf("Invalid webhook body: %s", err)
+		}
+		completed <- &job
+	}))
+	defer webhook.Close()
+
+	store, err := proxy.NewFileJobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := proxy.New(context.Background(), newTestKey(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Jobs, err = proxy.NewJobManager(store); err != nil {
+		t.Fatal(err)
+	}
+	p.Jobs.Webhook = &proxy.Webhook{URL: webhook.URL, Secret: webhookSecret}
+
+	// The command has invalid parameters, so the job fails without contacting Fleet API.
+	req := httptest.NewRequest(http.MethodPost, "/api/1/vehicles/"+testVIN+"/command/set_charge_limit", strings.NewReader(`{"percent": "lots"}`))
+	req.Header.Set("Authorization", "Bearer "+testToken("subject-1"))
+	req.Header.Set("Prefer", proxy.PreferAsync)
+	rsp := httptest.NewRecorder()
+	p.ServeHTTP(rsp, req)
+	if rsp.Code != http.StatusAccepted {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusAccepted, rsp.Code, rsp.Body)
+	}
+	accepted := decodeJob(t, rsp.Body)
+	if accepted.State != proxy.JobQueued || accepted.VIN != testVIN || accepted.Command != "set_charge_limit" {
+		t.Errorf("Unexpected job %+v", accepted)
+	}
+	if location := rsp.Header().Get("Location"); location != proxy.JobsPath+accepted.ID {
+		t.Errorf("Unexpected Location header %s", location)
+	}
+
+	select {
+	case job := <-completed:
+		if job.ID != accepted.ID || job.State != proxy.JobFailed || job.Status != http.StatusBadRequest {
+			t.Errorf("Unexpected completed job %+v", job)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for webhook")
+	}
+
+	poll := func(subject string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, proxy.JobsPath+accepted.ID, nil)
+		req.Header.Set("Authorization", "Bearer "+testToken(subject))
+		rsp := httptest.NewRecorder()
+		p.ServeHTTP(rsp, req)
+		return rsp
+	}
+	rsp = poll("subject-1")
+	if rsp.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rsp.Code)
+	}
+	if job := decodeJob(t, rsp.Body); job.State != proxy.JobFailed || len(job.Response) == 0 {
+		t.Errorf("Unexpected polled job %+v", job)
+	}
+	if rsp = poll("subject-2"); rsp.Code != http.StatusNotFound {
+		t.Errorf("Expected other client to get status %d, got %d", http.StatusNotFound, rsp.Code)
+	}
+}
+
+func TestJobRecoveryAfterRestart(t *testing.T) {
+	store, err := proxy.NewFileJobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	jobs := []*proxy.Job{
+		{ID: strings.Repeat("01", 16), State: proxy.JobSent, Updated: now},
+		{ID: strings.Repeat("02", 16), State: proxy.JobQueued, Updated: now},
+		{ID: strings.Repeat("03", 16), State: proxy.JobSucceeded, Updated: now},
+		{ID: strings.Repeat("04", 16), State: proxy.JobSucceeded, Updated: now.Add(-2 * proxy.DefaultJobRetention)},
+	}
+	for _, job := range jobs {
+		job.Subject = "subject-1"
+		if err := store.Save(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manager, err := proxy.NewJobManager(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []proxy.JobState{proxy.JobAmbiguous, proxy.JobFailed, proxy.JobSucceeded}
+	for i, state := range expected {
+		job, err := manager.Get("subject-1", jobs[i].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.State != state {
+			t.Errorf("Expected job %d to be %s after restart, got %s", i, state, job.State)
+		}
+	}
+	if _, err := manager.Get("subject-1", jobs[3].ID); !errors.Is(err, proxy.ErrJobNotFound) {
+		t.Errorf("Expected expired job to be deleted, got %v", err)
+	}
+}
+
+func TestJobPurgeExpired(t *testing.T) {
+	store := proxy.NewMemoryJobStore()
+	manager, err := proxy.NewJobManager(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.Retention = time.Minute
+	now := time.Now().UTC()
+	expired := &proxy.Job{ID: strings.Repeat("01", 16), Subject: "subject-1", State: proxy.JobSucceeded, Updated: now.Add(-time.Hour)}
+	running := &proxy.Job{ID: strings.Repeat("02", 16), Subject: "subject-1", State: proxy.JobSent, Updated: now.Add(-time.Hour)}
+	for _, job := range []*proxy.Job{expired, running} {
+		if err := store.Save(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		manager.PurgeExpired(done, time.Millisecond, nil)
+		close(stopped)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := manager.Get("subject-1", expired.ID); errors.Is(err, proxy.ErrJobNotFound) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expired job wasn't purged")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(done)
+	<-stopped
+	if _, err := manager.Get("subject-1", running.ID); err != nil {
+		t.Errorf("Job in progress was purged: %s", err)
+	}
+}
@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Proxy phases measured by the tesla_proxy_phase_duration_seconds histogram.
+const (
+	PhaseWake      = "wake"      // Waking a sleeping vehicle and waiting for it to come online
+	PhaseHandshake = "handshake" // Establishing or resuming an authenticated vehicle session
+	PhaseCommand   = "command"   // Sending a command and waiting for the vehicle's response
+	PhaseForward   = "forward"   // Forwarding a request to Fleet API
+)
+
+// defaultBuckets are histogram bucket upper bounds, in seconds.
+var defaultBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type metricKind string
+
+const (
+	kindCounter   metricKind = "counter"
+	kindGauge     metricKind = "gauge"
+	kindHistogram metricKind = "histogram"
+)
+
+type metricSeries struct {
+	labels  []string
+	value   float64
+	buckets []uint64
+	count   uint64
+}
+
+type metricFamily struct {
+	name   string
+	help   string
+	kind   metricKind
+	labels []string
+	series map[string]*metricSeries
+}
+
+func (f *metricFamily) get(labels []string) *metricSeries {
+	key := strings.Join(labels, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{labels: labels}
+		if f.kind == kindHistogram {
+			s.buckets = make([]uint64, len(defaultBuckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Metrics collects statistics about the proxy and exposes them in the Prometheus text format.
+//
+// A nil *Metrics is valid and discards all measurements.
+type Metrics struct {
+	lock     sync.Mutex
+	families map[string]*metricFamily
+}
+
+// Metric names.
+const (
+	metricRequests          = "tesla_proxy_requests_total"
+	metricPhaseDuration     = "tesla_proxy_phase_duration_seconds"
+	metricLockWait          = "tesla_proxy_vin_lock_wait_seconds"
+	metricQueueDepth        = "tesla_proxy_vin_queue_depth"
+	metricSessionCache      = "tesla_proxy_session_cache_lookups_total"
+	metricUnsupportedVINs   = "tesla_proxy_unsupported_vins"
+	metricUpstreamResponses = "tesla_proxy_upstream_responses_total"
+	metricRateLimited       = "tesla_proxy_rate_limited_total"
+)
+
+// NewMetrics returns an empty set of proxy metrics.
+func NewMetrics() *Metrics {
+	m := &Metrics{families: make(map[string]*metricFamily)}
+	m.register(metricRequests, kindCounter, "Requests handled by the proxy, by command and outcome.", "command", "outcome")
+	m.register(metricPhaseDuration, kindHistogram, "Time spent in each phase of handling a request.", "phase")
+	m.register(metricLockWait, kindHistogram, "Time spent waiting for exclusive access to a vehicle.", "vin")
+	m.register(metricQueueDepth, kindGauge, "Requests waiting for exclusive access to a vehicle.", "vin")
+	m.register(metricSessionCache, kindCounter, "Vehicle session cache lookups, by result.", "result")
+	m.register(metricUnsupportedVINs, kindGauge, "Vehicles that do not support end-to-end command authentication.")
+	m.register(metricUpstreamResponses, kindCounter, "Fleet API responses, by HTTP status code.", "code")
+	m.register(metricRateLimited, kindCounter, "Commands rejected by rate limits, by exceeded scope and command category.", "scope", "category")
+	return m
+}
+
+func (m *Metrics) register(name string, kind metricKind, help string, labels ...string) {
+	m.families[name] = &metricFamily{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: make(map[string]*metricSeries),
+	}
+}
+
+func (m *Metrics) add(name string, delta float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.families[name].get(labels).value += delta
+}
+
+// forgetVehicle deletes vin's lock wait and queue depth series. It's called when the command queue
+// drops vin, which bounds the number of series by the number of vehicles with commands in
+// progress. A queue depth series is kept if requests are still on their way into the queue.
+func (m *Metrics) forgetVehicle(vin string) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.families[metricLockWait].series, vin)
+	if s, ok := m.families[metricQueueDepth].series[vin]; ok && s.value == 0 {
+		delete(m.families[metricQueueDepth].series, vin)
+	}
+}
+
+func (m *Metrics) observe(name string, value float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	s := m.families[name].get(labels)
+	for i, bound := range defaultBuckets {
+		if value <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+func (m *Metrics) observeDuration(name string, start time.Time, labels ...string) {
+	m.observe(name, time.Since(start).Seconds(), labels...)
+}
+
+// countRequest counts a request by command and outcome. Commands that the proxy doesn't recognize
+// are counted as CategoryOther so that clients can't create arbitrarily many series.
+func (m *Metrics) countRequest(command, outcome string) {
+	if command == "" {
+		command = "none"
+	} else if !isKnownCommand(command) {
+		command = CategoryOther
+	}
+	m.add(metricRequests, 1, command, outcome)
+}
+
+func (m *Metrics) countUpstreamResponse(code int) {
+	m.add(metricUpstreamResponses, 1, strconv.Itoa(code))
+}
+
+func (m *Metrics) countSessionCacheLookup(hit bool) {
+	if hit {
+		m.add(metricSessionCache, 1, "hit")
+	} else {
+		m.add(metricSessionCache, 1, "miss")
+	}
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// WriteTo writes all metrics to w in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var b strings.Builder
+	var names []string
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		family := m.families[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n", name, family.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, family.kind)
+		if len(family.labels) == 0 && len(family.series) == 0 && family.kind != kindHistogram {
+			fmt.Fprintf(&b, "%s 0\n", name)
+			continue
+		}
+		var keys []string
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := family.series[key]
+			if family.kind != kindHistogram {
+				fmt.Fprintf(&b, "%s%s %s\n", name, formatLabels(family.labels, s.labels, "", ""), formatFloat(s.value))
+				continue
+			}
+			for i, bound := range defaultBuckets {
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", name, formatLabels(family.labels, s.labels, "le", formatFloat(bound)), s.buckets[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", name, formatLabels(family.labels, s.labels, "le", "+Inf"), s.count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", name, formatLabels(family.labels, s.labels, "", ""), formatFloat(s.value))
+			fmt.Fprintf(&b, "%s_count%s %d\n", name, formatLabels(family.labels, s.labels, "", ""), s.count)
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP exposes metrics to a Prometheus scraper.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeJSONError(w, nil, http.StatusMethodNotAllowed, nil)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = m.WriteTo(w)
+}
@@ -0,0 +1,101 @@
+package proxy_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/teslamotors/vehicle-command/pkg/proxy"
+)
+
+func TestNilMetrics(t *testing.T) {
+	p, err := proxy.New(context.Background(), newTestKey(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/1/vehicles/"+testVIN+"/command/honk_horn", nil)
+	rsp := httptest.NewRecorder()
+	p.ServeHTTP(rsp, req)
+	if rsp.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, got %d", http.StatusForbidden, rsp.Code)
+	}
+}
+
+func TestProxyMetrics(t *testing.T) {
+	p, err := proxy.New(context.Background(), newTestKey(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Metrics = proxy.NewMetrics()
+	p.Policy = newTestPolicyStore(t, `{"rules": [{"effect": "deny", "commands": ["door_unlock", "not_a_command*"]}]}`)
+
+	for _, command := range []string{"door_unlock", "door_unlock", "not_a_command1", "not_a_command2"} {
+		req := httptest.NewRequest(http.MethodPost, "/api/1/vehicles/"+testVIN+"/command/"+command, nil)
+		req.Header.Set("Authorization", "Bearer "+testToken("subject-1"))
+		p.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	rsp := httptest.NewRecorder()
+	p.Metrics.ServeHTTP(rsp, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rsp.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rsp.Code)
+	}
+	body := rsp.Body.String()
+	expected := []string{
+		"# TYPE tesla_proxy_requests_total counter\n",
+		`tesla_proxy_requests_total{command="door_unlock",outcome="denied"} 2` + "\n",
+		`tesla_proxy_requests_total{command="other",outcome="denied"} 2` + "\n",
+		"# TYPE tesla_proxy_phase_duration_seconds histogram\n",
+		"tesla_proxy_unsupported_vins 0\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", line, body)
+		}
+	}
+
+	var buffer bytes.Buffer
+	if _, err := p.Metrics.WriteTo(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	if buffer.String() != body {
+		t.Error("WriteTo and ServeHTTP produced different output")
+	}
+}
+
+func TestVehicleMetricsExpire(t *testing.T) {
+	p, err := proxy.New(context.Background(), newTestKey(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Metrics = proxy.NewMetrics()
+	scrape := func() string {
+		var buffer bytes.Buffer
+		if _, err := p.Metrics.WriteTo(&buffer); err != nil {
+			t.Fatal(err)
+		}
+		return buffer.String()
+	}
+
+	release, err := p.Enqueue(context.Background(), testVIN, "subject-1", "honk_horn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := scrape()
+	for _, line := range []string{
+		`tesla_proxy_vin_queue_depth{vin="` + testVIN + `"} 0` + "\n",
+		`tesla_proxy_vin_lock_wait_seconds_count{vin="` + testVIN + `"} 1` + "\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", line, body)
+		}
+	}
+
+	release()
+	if body := scrape(); strings.Contains(body, testVIN) {
+		t.Errorf("Expected series for %s to be removed, got:\n%s", testVIN, body)
+	}
+}
@@ -0,0 +1,386 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teslamotors/vehicle-command/internal/log"
+)
+
+// APIKeyHeader is the HTTP header clients can use to present an API key to the proxy. API keys
+// identify internal services that share an OAuth token, and are matched against the api_keys field
+// of policy rules.
+const APIKeyHeader = "X-Api-Key"
+
+// Effect is the outcome of a policy rule.
+type Effect string
+
+const (
+	EffectAllow Effect = "allow"
+	EffectDeny  Effect = "deny"
+)
+
+// Pseudo-commands that policy rules use to match requests to per-vehicle endpoints that aren't
+// commands. Other endpoints, such as /api/1/vehicles/{id}/vehicle_data, are matched by their name.
+const (
+	// PolicyCommandVehicle matches requests for /api/1/vehicles/{id}.
+	PolicyCommandVehicle = "vehicle"
+	// PolicyCommandFleetTelemetryConfig matches requests that configure Fleet Telemetry. The policy
+	// is evaluated for each VIN in the request.
+	PolicyCommandFleetTelemetryConfig = "fleet_telemetry_config"
+)
+
+var (
+	// ErrPolicyDenied indicates the proxy's authorization policy did not allow a request.
+	ErrPolicyDenied = errors.New("request denied by proxy authorization policy")
+)
+
+// TimeWindow restricts a rule to certain days and times.
+type TimeWindow struct {
+	// Days is a comma-separated list of day names (e.g., "MON,TUES" or "WEEKDAYS"). Defaults to
+	// all days.
+	Days string `json:"days,omitempty"`
+	// Start and End are formatted as HH:MM. If End is before Start, the window wraps past
+	// midnight.
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// Timezone is an IANA time zone name. Defaults to UTC.
+	Timezone string `json:"timezone,omitempty"`
+
+	days     int32
+	start    time.Duration
+	end      time.Duration
+	location *time.Location
+}
+
+// PolicyRule grants or denies a set of principals access to commands on a set of vehicles.
+//
+// Commands match the command name in /api/1/vehicles/{id}/command/{name}. Requests to other
+// per-vehicle endpoints are matched by endpoint name (e.g., "vehicle_data" or "wake_up"), or by
+// [PolicyCommandVehicle] or [PolicyCommandFleetTelemetryConfig].
+//
+// Subjects, VINs, and Commands support shell-style patterns (see [path.Match]), so "*" matches any
+// value and "media_*" matches all media commands. A rule with no Subjects and no APIKeys applies to
+// every principal.
+type PolicyRule struct {
+	Name     string   `json:"name,omitempty"`
+	Effect   Effect   `json:"effect"`
+	Subjects []string `json:"subjects,omitempty"`
+	// APIKeys contains hex-encoded SHA-256 digests of API keys, so that the policy file does not
+	// contain secrets.
+	APIKeys  []string     `json:"api_keys,omitempty"`
+	VINs     []string     `json:"vins,omitempty"`
+	Commands []string     `json:"commands,omitempty"`
+	Windows  []TimeWindow `json:"time_windows,omitempty"`
+}
+
+// Policy maps principals to the vehicles and commands they may access.
+//
+// Rules are evaluated as a set rather than in order: a matching deny rule always takes precedence
+// over a matching allow rule. Requests that don't match any rule receive the Default effect, which
+// is deny unless the policy explicitly sets it to allow.
+type Policy struct {
+	Default Effect       `json:"default,omitempty"`
+	Rules   []PolicyRule `json:"rules"`
+}
+
+// PolicyRequest describes a request for the purpose of evaluating a [Policy].
+type PolicyRequest struct {
+	Subject string    `json:"subject"`
+	APIKey  string    `json:"api_key,omitempty"`
+	VIN     string    `json:"vin"`
+	Command string    `json:"command"`
+	Time    time.Time `json:"time,omitempty"`
+}
+
+// Decision is the result of evaluating a [PolicyRequest].
+type Decision struct {
+	Allowed bool   `json:"allowed"`
+	Rule    string `json:"rule,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+// LoadPolicy parses a JSON policy from r.
+func LoadPolicy(r io.Reader) (*Policy, error) {
+	var policy Policy
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&policy); err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+	if err := policy.compile(); err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+	return &policy, nil
+}
+
+// LoadPolicyFile reads a JSON policy from disk.
+func LoadPolicyFile(filename string) (*Policy, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return LoadPolicy(file)
+}
+
+func parseTimeOfDay(hoursAndMinutes string) (time.Duration, error) {
+	components := strings.Split(hoursAndMinutes, ":")
+	if len(components) != 2 {
+		return 0, fmt.Errorf("invalid time '%s': expected HH:MM", hoursAndMinutes)
+	}
+	hours, err := strconv.Atoi(components[0])
+	if err != nil || hours < 0 || hours > 24 {
+		return 0, fmt.Errorf("invalid hour in '%s'", hoursAndMinutes)
+	}
+	minutes, err := strconv.Atoi(components[1])
+	if err != nil || minutes < 0 || minutes > 59 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("invalid minutes in '%s'", hoursAndMinutes)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+func (w *TimeWindow) compile() error {
+	var err error
+	w.days = dayNamesBitMask["ALL"]
+	if w.Days != "" {
+		params := RequestParameters{"days": w.Days}
+		if w.days, err = params.getDays("days", true); err != nil {
+			return err
+		}
+	}
+	if w.start, err = parseTimeOfDay(w.Start); err != nil {
+		return err
+	}
+	if w.end, err = parseTimeOfDay(w.End); err != nil {
+		return err
+	}
+	w.location = time.UTC
+	if w.Timezone != "" {
+		if w.location, err = time.LoadLocation(w.Timezone); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *TimeWindow) contains(t time.Time) bool {
+	t = t.In(w.location)
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	day := t.Weekday()
+	if w.end <= w.start && offset < w.end {
+		// The window wrapped past midnight, so it started the previous day.
+		day = (day + 6) % 7
+	}
+	if w.days&(1<<day) == 0 {
+		return false
+	}
+	if w.start < w.end {
+		return offset >= w.start && offset < w.end
+	}
+	return offset >= w.start || offset < w.end
+}
+
+func (p *Policy) compile() error {
+	switch p.Default {
+	case "":
+		p.Default = EffectDeny
+	case EffectAllow, EffectDeny:
+	default:
+		return fmt.Errorf("default effect must be '%s' or '%s'", EffectAllow, EffectDeny)
+	}
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+		if rule.Effect != EffectAllow && rule.Effect != EffectDeny {
+			return fmt.Errorf("%s: effect must be '%s' or '%s'", rule.Name, EffectAllow, EffectDeny)
+		}
+		for _, patterns := range [][]string{rule.Subjects, rule.VINs, rule.Commands} {
+			for _, pattern := range patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("%s: invalid pattern '%s'", rule.Name, pattern)
+				}
+			}
+		}
+		for j, digest := range rule.APIKeys {
+			if decoded, err := hex.DecodeString(digest); err != nil || len(decoded) != sha256.Size {
+				return fmt.Errorf("%s: api_keys must contain hex-encoded SHA-256 digests", rule.Name)
+			}
+			rule.APIKeys[j] = strings.ToLower(digest)
+		}
+		for j := range rule.Windows {
+			if err := rule.Windows[j].compile(); err != nil {
+				return fmt.Errorf("%s: %w", rule.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func matchesAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *PolicyRule) matchesPrincipal(subject, apiKey string) bool {
+	if len(r.Subjects) == 0 && len(r.APIKeys) == 0 {
+		return true
+	}
+	if subject != "" && len(r.Subjects) > 0 && matchesAny(r.Subjects, subject) {
+		return true
+	}
+	if apiKey != "" {
+		digest := sha256.Sum256([]byte(apiKey))
+		encoded := []byte(hex.EncodeToString(digest[:]))
+		for _, expected := range r.APIKeys {
+			if subtle.ConstantTimeCompare(encoded, []byte(expected)) == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *PolicyRule) matches(req *PolicyRequest) bool {
+	if !r.matchesPrincipal(req.Subject, req.APIKey) {
+		return false
+	}
+	if !matchesAny(r.VINs, req.VIN) || !matchesAny(r.Commands, req.Command) {
+		return false
+	}
+	if len(r.Windows) == 0 {
+		return true
+	}
+	for i := range r.Windows {
+		if r.Windows[i].contains(req.Time) {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate decides whether req is permitted. It does not have side effects, so it can be used to
+// test a policy without sending commands.
+func (p *Policy) Evaluate(req *PolicyRequest) Decision {
+	if req.Time.IsZero() {
+		req.Time = time.Now()
+	}
+	var allowedBy *PolicyRule
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if !rule.matches(req) {
+			continue
+		}
+		if rule.Effect == EffectDeny {
+			return Decision{Allowed: false, Rule: rule.Name, Reason: "matched deny rule"}
+		}
+		if allowedBy == nil {
+			allowedBy = rule
+		}
+	}
+	if allowedBy != nil {
+		return Decision{Allowed: true, Rule: allowedBy.Name, Reason: "matched allow rule"}
+	}
+	return Decision{Allowed: p.Default == EffectAllow, Reason: "no matching rule; applied default"}
+}
+
+// PolicyStore holds a Policy loaded from a file and reloads it when the file changes.
+type PolicyStore struct {
+	filename string
+
+	lock    sync.RWMutex
+	policy  *Policy
+	modTime time.Time
+}
+
+// NewPolicyStore loads a policy from filename.
+func NewPolicyStore(filename string) (*PolicyStore, error) {
+	s := &PolicyStore{filename: filename}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Policy returns the current policy.
+func (s *PolicyStore) Policy() *Policy {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.policy
+}
+
+// Reload re-reads the policy file. If the file cannot be parsed, the previous policy remains in
+// effect.
+func (s *PolicyStore) Reload() error {
+	info, err := os.Stat(s.filename)
+	if err != nil {
+		return err
+	}
+	policy, err := LoadPolicyFile(s.filename)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.policy = policy
+	s.modTime = info.ModTime()
+	s.lock.Unlock()
+	return nil
+}
+
+// Watch polls the policy file every interval and reloads it when its modification time changes.
+// Watch blocks until done is closed. Reloads and errors are logged to logger, which should
+// normally be the Logger of the Proxy using s. If logger is nil, the global logger is used.
+func (s *PolicyStore) Watch(done <-chan struct{}, interval time.Duration, logger *slog.Logger) {
+	l := log.New(logger)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(s.filename)
+		if err != nil {
+			l.Warning("Could not check policy file: %s", err)
+			continue
+		}
+		s.lock.RLock()
+		changed := !info.ModTime().Equal(s.modTime)
+		s.lock.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := s.Reload(); err != nil {
+			l.Error("Failed to reload policy; keeping previous policy: %s", err)
+		} else {
+			l.Info("Reloaded policy from %s", s.filename)
+		}
+	}
+}
+
+// Evaluate evaluates req against the current policy.
+func (s *PolicyStore) Evaluate(req *PolicyRequest) Decision {
+	return s.Policy().Evaluate(req)
+}
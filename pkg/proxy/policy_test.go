@@ -0,0 +1,266 @@
+package proxy_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/teslamotors/vehicle-command/pkg/proxy"
+)
+
+const (
+	testVIN      = "5YJ3E1EA1JF000001"
+	otherTestVIN = "5YJ3E1EA1JF000002"
+)
+
+func loadTestPolicy(t *testing.T, policyJSON string) *proxy.Policy {
+	t.Helper()
+	policy, err := proxy.LoadPolicy(strings.NewReader(policyJSON))
+	if err != nil {
+		t.Fatalf("Failed to load policy: %s", err)
+	}
+	return policy
+}
+
+func newTestPolicyStore(t *testing.T, policyJSON string) *proxy.PolicyStore {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(filename, []byte(policyJSON), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := proxy.NewPolicyStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestPolicyEvaluate(t *testing.T) {
+	apiKeyDigest := sha256.Sum256([]byte("hunter2"))
+	policy := loadTestPolicy(t, fmt.Sprintf(`{
+		"rules": [
+			{"name": "dispatch", "effect": "allow", "subjects": ["dispatch-*"], "vins": ["%s"], "commands": ["*"]},
+			{"name": "media-service", "effect": "allow", "api_keys": ["%s"], "commands": ["media_*", "adjust_volume"]},
+			{"name": "high-risk", "effect": "deny", "commands": ["door_unlock", "remote_start_drive", "erase_user_data", "set_valet_mode"]}
+		]
+	}`, testVIN, hex.EncodeToString(apiKeyDigest[:])))
+
+	tests := []struct {
+		request proxy.PolicyRequest
+		allowed bool
+		rule    string
+	}{
+		{proxy.PolicyRequest{Subject: "dispatch-1", VIN: testVIN, Command: "door_lock"}, true, "dispatch"},
+		{proxy.PolicyRequest{Subject: "dispatch-1", VIN: otherTestVIN, Command: "door_lock"}, false, ""},
+		{proxy.PolicyRequest{Subject: "dispatch-1", VIN: testVIN, Command: "door_unlock"}, false, "high-risk"},
+		{proxy.PolicyRequest{Subject: "someone-else", VIN: testVIN, Command: "door_lock"}, false, ""},
+		{proxy.PolicyRequest{Subject: "someone-else", APIKey: "hunter2", VIN: otherTestVIN, Command: "media_next_track"}, true, "media-service"},
+		{proxy.PolicyRequest{Subject: "someone-else", APIKey: "hunter3", VIN: otherTestVIN, Command: "media_next_track"}, false, ""},
+		{proxy.PolicyRequest{Subject: "someone-else", APIKey: "hunter2", VIN: otherTestVIN, Command: "honk_horn"}, false, ""},
+	}
+	for _, test := range tests {
+		decision := policy.Evaluate(&test.request)
+		if decision.Allowed != test.allowed || decision.Rule != test.rule {
+			t.Errorf("%+v: expected allowed=%v by rule '%s', got %+v", test.request, test.allowed, test.rule, decision)
+		}
+	}
+}
+
+func TestPolicyDefaultAllow(t *testing.T) {
+	policy := loadTestPolicy(t, `{"default": "allow", "rules": [{"effect": "deny", "commands": ["erase_user_data"]}]}`)
+	if !policy.Evaluate(&proxy.PolicyRequest{Subject: "x", VIN: testVIN, Command: "honk_horn"}).Allowed {
+		t.Error("Expected default allow")
+	}
+	if policy.Evaluate(&proxy.PolicyRequest{Subject: "x", VIN: testVIN, Command: "erase_user_data"}).Allowed {
+		t.Error("Expected deny rule to override default allow")
+	}
+}
+
+func TestPolicyTimeWindows(t *testing.T) {
+	policy := loadTestPolicy(t, `{
+		"rules": [
+			{"name": "business-hours", "effect": "allow", "time_windows": [{"days": "WEEKDAYS", "start": "08:00", "end": "18:00"}]},
+			{"name": "overnight", "effect": "allow", "commands": ["charge_*"], "time_windows": [{"days": "FRI", "start": "22:00", "end": "06:00"}]}
+		]
+	}`)
+	// 2024-01-05 was a Friday.
+	friday := time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		when    time.Time
+		command string
+		allowed bool
+	}{
+		{friday.Add(9 * time.Hour), "honk_horn", true},
+		{friday.Add(19 * time.Hour), "honk_horn", false},
+		{friday.Add(24*time.Hour + 9*time.Hour), "honk_horn", false}, // Saturday
+		{friday.Add(23 * time.Hour), "charge_start", true},
+		{friday.Add(24*time.Hour + 5*time.Hour), "charge_start", true}, // Saturday morning, window started Friday
+		{friday.Add(5 * time.Hour), "charge_start", false},             // Friday morning, window started Thursday
+	}
+	for _, test := range tests {
+		request := proxy.PolicyRequest{Subject: "x", VIN: testVIN, Command: test.command, Time: test.when}
+		if decision := policy.Evaluate(&request); decision.Allowed != test.allowed {
+			t.Errorf("%s at %s: expected allowed=%v, got %+v", test.command, test.when, test.allowed, decision)
+		}
+	}
+}
+
+func TestInvalidPolicy(t *testing.T) {
+	invalid := []string{
+		`{"rules": [{"effect": "maybe"}]}`,
+		`{"default": "sometimes", "rules": []}`,
+		`{"rules": [{"effect": "allow", "api_keys": ["hunter2"]}]}`,
+		`{"rules": [{"effect": "allow", "vins": ["["]}]}`,
+		`{"rules": [{"effect": "allow", "time_windows": [{"start": "25:00", "end": "01:00"}]}]}`,
+		`{"rules": [{"effect": "allow", "unknown_field": true}]}`,
+	}
+	for _, policyJSON := range invalid {
+		if _, err := proxy.LoadPolicy(strings.NewReader(policyJSON)); err == nil {
+			t.Errorf("Expected error loading %s", policyJSON)
+		}
+	}
+}
+
+func TestPolicyStoreReload(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(filename, []byte(`{"default": "allow", "rules": []}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := proxy.NewPolicyStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := proxy.PolicyRequest{Subject: "x", VIN: testVIN, Command: "honk_horn"}
+	if !store.Evaluate(&request).Allowed {
+		t.Fatal("Expected initial policy to allow request")
+	}
+
+	if err := os.WriteFile(filename, []byte(`{"rules": []}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if store.Evaluate(&request).Allowed {
+		t.Fatal("Expected reloaded policy to deny request")
+	}
+
+	// A broken file should not replace a working policy.
+	if err := os.WriteFile(filename, []byte(`{"rules": [`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reload(); err == nil {
+		t.Fatal("Expected error reloading invalid policy")
+	}
+	if store.Policy() == nil {
+		t.Fatal("Lost previous policy after failed reload")
+	}
+}
+
+func TestPolicyForwardedRequests(t *testing.T) {
+	var forwarded atomic.Int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		forwarded.Add(1)
+		w.Write([]byte(`{"response":{}}`))
+	}))
+	defer server.Close()
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = server.Client().Transport
+	defer func() { http.DefaultTransport = defaultTransport }()
+
+	p, err := proxy.New(context.Background(), newTestKey(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetSubjectHost("subject-1", strings.TrimPrefix(server.URL, "https://"))
+	p.Policy = newTestPolicyStore(t, `{"rules": [
+		{"effect": "allow", "vins": ["`+testVIN+`"], "commands": ["vehicle", "vehicle_data", "fleet_telemetry_config"]},
+		{"effect": "allow", "vins": ["`+otherTestVIN+`"], "commands": ["wake_up"]}
+	]}`)
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{http.MethodGet, "/api/1/vehicles/" + testVIN, "", http.StatusOK},
+		{http.MethodGet, "/api/1/vehicles/" + testVIN + "/vehicle_data", "", http.StatusOK},
+		{http.MethodPost, "/api/1/vehicles/" + testVIN + "/wake_up", "", http.StatusForbidden},
+		{http.MethodGet, "/api/1/vehicles/" + otherTestVIN + "/vehicle_data", "", http.StatusForbidden},
+		{http.MethodPost, "/api/1/vehicles/" + otherTestVIN + "/wake_up", "", http.StatusOK},
+		{http.MethodGet, "/api/1/vehicles/" + otherTestVIN + "/fleet_telemetry_config", "", http.StatusForbidden},
+		{http.MethodDelete, "/api/1/vehicles/" + testVIN + "/fleet_telemetry_config", "", http.StatusOK},
+		{http.MethodGet, "/api/1/vehicles/not-a-vehicle/vehicle_data", "", http.StatusNotFound},
+		{http.MethodPost, "/api/1/vehicles/fleet_telemetry_config", `{"vins": ["` + testVIN + `", "` + otherTestVIN + `"], "config": {}}`, http.StatusForbidden},
+		// Account-level endpoints aren't resolved as vehicle IDs, but VINs in the body are checked.
+		{http.MethodPost, "/api/1/vehicles/fleet_status", `{"vins": ["` + testVIN + `"]}`, http.StatusOK},
+		{http.MethodPost, "/api/1/vehicles/fleet_status", `{"vins": ["` + otherTestVIN + `"]}`, http.StatusForbidden},
+		{http.MethodPost, "/api/1/vehicles/fleet_telemetry_config_jws", `{"vins": ["` + testVIN + `"], "token": "x"}`, http.StatusOK},
+		{http.MethodPost, "/api/1/vehicles/fleet_telemetry_config_jws", `{"vins": ["` + otherTestVIN + `"], "token": "x"}`, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		before := forwarded.Load()
+		req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		req.Header.Set("Authorization", "Bearer "+testToken("subject-1"))
+		rsp := httptest.NewRecorder()
+		p.ServeHTTP(rsp, req)
+		if rsp.Code != test.status {
+			t.Errorf("%s %s: expected status %d, got %d", test.method, test.path, test.status, rsp.Code)
+		}
+		if sent := forwarded.Load() != before; sent != (test.status == http.StatusOK) {
+			t.Errorf("%s %s: forwarded = %v", test.method, test.path, sent)
+		}
+	}
+}
+
+func TestPolicyCommandPathVariants(t *testing.T) {
+	var forwarded atomic.Int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		forwarded.Add(1)
+		w.Write([]byte(`{"response":{}}`))
+	}))
+	defer server.Close()
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = server.Client().Transport
+	defer func() { http.DefaultTransport = defaultTransport }()
+
+	p, err := proxy.New(context.Background(), newTestKey(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetSubjectHost("subject-1", strings.TrimPrefix(server.URL, "https://"))
+	p.Policy = newTestPolicyStore(t, `{"default": "allow", "rules": [{"effect": "deny", "commands": ["door_unlock"]}]}`)
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/api/1/vehicles/" + testVIN + "/command/door_unlock/", http.StatusForbidden},
+		{"/api/1/vehicles/" + testVIN + "//command/door_unlock", http.StatusForbidden},
+		{"/api/1/vehicles/" + testVIN + "/command/./door_unlock", http.StatusForbidden},
+		{"/api/1/vehicles/" + testVIN + "/command/door_unlock/extra", http.StatusBadRequest},
+		{"/api/1/vehicles/" + testVIN + "/command", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, test.path, nil)
+		req.Header.Set("Authorization", "Bearer "+testToken("subject-1"))
+		rsp := httptest.NewRecorder()
+		p.ServeHTTP(rsp, req)
+		if rsp.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.path, test.status, rsp.Code)
+		}
+	}
+	if n := forwarded.Load(); n != 0 {
+		t.Errorf("%d requests were forwarded to Fleet API", n)
+	}
+}
@@ -7,9 +7,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
+	"path"
 	"slices"
 	"strings"
 	"sync"
@@ -22,7 +24,9 @@ import (
 	"github.com/teslamotors/vehicle-command/pkg/cache"
 	"github.com/teslamotors/vehicle-command/pkg/connector/inet"
 	"github.com/teslamotors/vehicle-command/pkg/protocol"
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/keys"
 	"github.com/teslamotors/vehicle-command/pkg/sign"
+	"github.com/teslamotors/vehicle-command/pkg/trace"
 	"github.com/teslamotors/vehicle-command/pkg/vehicle"
 )
 
@@ -35,6 +39,9 @@ const (
 	MaxAttempts          = 2
 )
 
+// DefaultUnsupportedVINExpiry is the default value of Proxy.UnsupportedVINExpiry.
+const DefaultUnsupportedVINExpiry = 24 * time.Hour
+
 var h2Prefix = "h2=https://"
 
 func getAccount(req *http.Request) (*account.Account, error) {
@@ -49,11 +56,74 @@ func getAccount(req *http.Request) (*account.Account, error) {
 type Proxy struct {
 	Timeout time.Duration
 
-	commandKey       protocol.ECDHPrivateKey
-	sessions         *cache.SessionCache
-	vinLock          sync.Map
+	// Policy restricts which vehicles and commands each client may access. If nil, any client with
+	// a valid OAuth token may send any command to any vehicle on the token's account.
+	Policy *PolicyStore
+
+	// AuditLog, if not nil, receives a record of every command and forwarded request.
+	AuditLog *AuditLog
+
+	// Logger, if not nil, receives log messages from the proxy and the vehicles it connects to.
+	// Otherwise, messages are written to the global logger.
+	Logger *slog.Logger
+
+	// Jobs, if not nil, allows clients to send commands asynchronously by including a
+	// "Prefer: respond-async" header. The proxy responds with 202 Accepted and a job that the
+	// client can poll at /jobs/{id}.
+	Jobs *JobManager
+
+	// Idempotency, if not nil, prevents commands sent with the same Idempotency-Key header from
+	// being executed more than once.
+	Idempotency *IdempotencyCache
+
+	// Metrics, if not nil, collects statistics about requests handled by the proxy.
+	Metrics *Metrics
+
+	// UnsupportedVINExpiry is how long the proxy forwards commands for a vehicle to Fleet API's
+	// REST API after learning that the vehicle doesn't support end-to-end authentication. After it
+	// expires, the proxy tries end-to-end authentication again, in case the vehicle's firmware was
+	// updated. If zero, vehicles are never retried.
+	UnsupportedVINExpiry time.Duration
+
+	// StepUp, if not nil, requires a second factor before the proxy sends high-risk commands.
+	StepUp *StepUp
+
+	// RateLimiter, if not nil, rejects commands and wake_up requests that exceed per-subject,
+	// per-vehicle, or per-category rate limits with 429 Too Many Requests.
+	RateLimiter *RateLimiter
+
+	// AutoWake, if true, causes the proxy to wake sleeping vehicles and retry commands that fail
+	// because the vehicle is asleep. Clients can override it for a request using WakeHeader.
+	AutoWake bool
+
+	// WakeTimeout replaces Timeout as the deadline for commands that may wake the vehicle. The
+	// deadline covers waiting in the queue, waking the vehicle, establishing a session, and
+	// executing the command.
+	WakeTimeout time.Duration
+
+	// RoleChecks, if true, causes the proxy to reject commands that the role of its
+	// command-authentication key doesn't allow with 403 Forbidden, without sending them to the
+	// vehicle. See [vehicle.RolePermissions]. The role is looked up once per vehicle and cached.
+	RoleChecks bool
+
+	// Queue orders commands sent to each vehicle. New initializes it to an unbounded queue, which
+	// also removes a vehicle's lock wait and queue depth metrics when its queue empties. Adjust
+	// its fields rather than replacing it. It must not be nil.
+	Queue *CommandQueue
+
+	cacheSize        int
+	defaultTenant    *tenant
+	tenants          []*tenant
 	unsupported      sync.Map
 	domainForSubject sync.Map
+	vehicleLists     sync.Map
+	keyRoles         sync.Map // Maps keyRoleEntry to keys.Role
+}
+
+// keyRoleEntry identifies the command-authentication key of a tenant on a particular vehicle.
+type keyRoleEntry struct {
+	tenant *tenant
+	vin    string
 }
 
 func (p *Proxy) updateDomainForSubject(subject, domain string) {
@@ -69,41 +139,46 @@ func (p *Proxy) fetchDomainForSubject(subject string) string {
 }
 
 func (p *Proxy) markUnsupportedVIN(vin string) {
-	p.unsupported.Store(vin, true)
+	if _, loaded := p.unsupported.Swap(vin, time.Now()); !loaded {
+		p.Metrics.add(metricUnsupportedVINs, 1)
+	}
 }
 
-func (p *Proxy) isNotSupported(vin string) bool {
-	_, ok := p.unsupported.Load(vin)
-	return ok
+// unsupportedVINExpired returns true if a VIN marked as unsupported at markedAt should be retried.
+func (p *Proxy) unsupportedVINExpired(markedAt time.Time) bool {
+	return p.UnsupportedVINExpiry > 0 && time.Since(markedAt) > p.UnsupportedVINExpiry
 }
 
-// lockVIN locks a VIN-specific mutex, blocking until the operation succeeds or ctx expires.
-func (p *Proxy) lockVIN(ctx context.Context, vin string) error {
-	lock := make(chan bool, 1)
-	for {
-		if obj, loaded := p.vinLock.LoadOrStore(vin, lock); loaded {
-			select {
-			case <-obj.(chan bool):
-				// The goroutine that reads from the channel doesn't necessarily own the mutex. This
-				// allows the mutex owner to delete the entry from the map, limiting the size of the
-				// map to the number of concurrent vehicle commands.
-			case <-ctx.Done():
-				return ctx.Err()
-			}
-		} else {
-			return nil
-		}
+func (p *Proxy) isNotSupported(vin string) bool {
+	markedAt, ok := p.unsupported.Load(vin)
+	if !ok {
+		return false
+	}
+	if p.unsupportedVINExpired(markedAt.(time.Time)) {
+		p.clearUnsupportedVIN(vin, markedAt)
+		return false
 	}
+	return true
 }
 
-// unlockVIN releases a VIN-specific mutex.
-func (p *Proxy) unlockVIN(vin string) {
-	obj, ok := p.vinLock.Load(vin)
-	if !ok {
-		panic("called unlock without owning mutex")
+// clearUnsupportedVIN removes vin from the list of unsupported VINs if it was marked at markedAt.
+func (p *Proxy) clearUnsupportedVIN(vin string, markedAt any) bool {
+	if p.unsupported.CompareAndDelete(vin, markedAt) {
+		p.Metrics.add(metricUnsupportedVINs, -1)
+		return true
 	}
-	p.vinLock.Delete(vin)  // Allow someone else to claim the mutex
-	close(obj.(chan bool)) // Unblock goroutines
+	return false
+}
+
+// enqueue waits for command to reach the front of vin's queue. If it returns nil, the caller must
+// call the returned function when it's done communicating with the vehicle.
+func (p *Proxy) enqueue(ctx context.Context, vin, subject, command string) (release func(), err error) {
+	start := time.Now()
+	p.Metrics.add(metricQueueDepth, 1, vin)
+	defer p.Metrics.add(metricQueueDepth, -1, vin)
+	defer p.Metrics.observeDuration(metricLockWait, start, vin)
+
+	return p.Queue.Acquire(ctx, vin, subject, command)
 }
 
 // New creates an http proxy.
@@ -111,18 +186,27 @@ func (p *Proxy) unlockVIN(vin string) {
 // Vehicles must have the public part of skey enrolled on their keychains. (This is a
 // command-authentication key, not a TLS key.)
 func New(_ context.Context, skey protocol.ECDHPrivateKey, cacheSize int) (*Proxy, error) {
-	return &Proxy{
-		Timeout:    DefaultTimeout,
-		commandKey: skey,
-		sessions:   cache.New(cacheSize),
-	}, nil
+	p := &Proxy{
+		Timeout:              DefaultTimeout,
+		UnsupportedVINExpiry: DefaultUnsupportedVINExpiry,
+		WakeTimeout:          DefaultWakeTimeout,
+		Queue:                NewCommandQueue(0),
+		cacheSize:            cacheSize,
+		defaultTenant: &tenant{
+			TenantConfig: TenantConfig{CommandKey: skey},
+			sessions:     cache.New(cacheSize),
+		},
+	}
+	p.Queue.idle = func(vin string) { p.Metrics.forgetVehicle(vin) }
+	return p, nil
 }
 
 // Response contains a server's response to a client request.
 type Response struct {
-	Response   interface{} `json:"response"`
-	Error      string      `json:"error"`
-	ErrDetails string      `json:"error_description"`
+	Response   interface{}   `json:"response"`
+	Error      string        `json:"error"`
+	ErrDetails string        `json:"error_description"`
+	Details    *ErrorDetails `json:"error_details,omitempty"`
 }
 
 type carResponse struct {
@@ -130,15 +214,37 @@ type carResponse struct {
 	Reason string `json:"reason"`
 }
 
-func writeJSONError(w http.ResponseWriter, code int, err error) {
+// addErrorDetails adds an "error_details" field to body if body is a JSON object. Otherwise it
+// returns body unmodified.
+func addErrorDetails(body []byte, details *ErrorDetails) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil || fields == nil {
+		return body
+	}
+	encodedDetails, err := json.Marshal(details)
+	if err != nil {
+		return body
+	}
+	fields["error_details"] = encodedDetails
+	if updated, err := json.Marshal(fields); err == nil {
+		return updated
+	}
+	return body
+}
+
+// writeJSONError writes an error response to w. Errors are logged to logger, or to the global
+// logger if logger is nil.
+func writeJSONError(w http.ResponseWriter, logger *log.Logger, code int, err error) {
 	reply := Response{}
 
 	var httpErr *inet.HTTPError
 	var jsonBytes []byte
 	if errors.As(err, &httpErr) {
 		code = httpErr.Code
-		jsonBytes = []byte(err.Error())
+		reply.Details = describeError(code, err)
+		jsonBytes = addErrorDetails([]byte(httpErr.Error()), reply.Details)
 	} else {
+		reply.Details = describeError(code, err)
 		if err == nil {
 			reply.Error = http.StatusText(code)
 		} else if protocol.IsNominalError(err) {
@@ -149,15 +255,16 @@ func writeJSONError(w http.ResponseWriter, code int, err error) {
 		}
 		jsonBytes, err = json.Marshal(&reply)
 		if err != nil {
-			log.Error("Error serializing reply %+v: %s", &reply, err)
+			logger.Error("Error serializing reply %+v: %s", &reply, err)
 			code = http.StatusInternalServerError
 			jsonBytes = []byte("{\"error\": \"internal server error\"}")
 		}
 	}
 	if code != http.StatusOK {
-		log.Error("Returning error %s", http.StatusText(code))
+		logger.Error("Returning error %s", http.StatusText(code))
 	}
 	w.Header().Set("Content-Type", "application/json")
+	setRetryAfter(w, reply.Details)
 	w.WriteHeader(code)
 	jsonBytes = append(jsonBytes, '\n')
 	w.Write(jsonBytes)
@@ -174,12 +281,14 @@ var connectionHeaders = []string{
 // forwardRequest is the fallback handler for "/api/1/*".
 // It forwards GET and POST requests to Tesla using the proxy's OAuth token.
 func (p *Proxy) forwardRequest(acct *account.Account, w http.ResponseWriter, req *http.Request) {
-	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), p.Timeout)
 	defer cancel()
+	defer p.Metrics.observeDuration(metricPhaseDuration, time.Now(), PhaseForward)
+	p.setJobState(ctx, JobSent)
 
 	proxyReq, err := http.NewRequestWithContext(ctx, req.Method, req.URL.String(), req.Body)
 	if err != nil {
-		writeJSONError(w, http.StatusBadRequest, err)
+		writeJSONError(w, p.logger(), http.StatusBadRequest, err)
 		return
 	}
 	proxyReq.Header = req.Header.Clone()
@@ -187,10 +296,11 @@ func (p *Proxy) forwardRequest(acct *account.Account, w http.ResponseWriter, req
 	for _, hdr := range connectionHeaders {
 		proxyReq.Header.Del(hdr)
 	}
+	trace.Inject(ctx, proxyReq.Header)
 
 	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
 	if err != nil {
-		writeJSONError(w, http.StatusBadRequest, err)
+		writeJSONError(w, p.logger(), http.StatusBadRequest, err)
 		return
 	}
 
@@ -210,7 +320,7 @@ func (p *Proxy) forwardRequest(acct *account.Account, w http.ResponseWriter, req
 	if req.Body != nil {
 		requestBody, err = io.ReadAll(req.Body)
 		if err != nil {
-			writeJSONError(w, http.StatusBadGateway, err)
+			writeJSONError(w, p.logger(), http.StatusBadGateway, err)
 			return
 		}
 		proxyReq.Body = io.NopCloser(bytes.NewBuffer(requestBody))
@@ -218,15 +328,15 @@ func (p *Proxy) forwardRequest(acct *account.Account, w http.ResponseWriter, req
 
 	for {
 		proxyReq.URL.Host = acct.Host
-		log.Debug("Forwarding request to %s", proxyReq.URL.String())
+		p.logger().Debug("Forwarding request to %s", proxyReq.URL.String())
 		client := http.Client{}
 		result, err := client.Do(proxyReq)
 
 		if err != nil {
 			if urlErr, ok := err.(*url.Error); ok && urlErr.Timeout() {
-				writeJSONError(w, http.StatusGatewayTimeout, urlErr)
+				writeJSONError(w, p.logger(), http.StatusGatewayTimeout, urlErr)
 			} else {
-				writeJSONError(w, http.StatusBadGateway, err)
+				writeJSONError(w, p.logger(), http.StatusBadGateway, err)
 			}
 			return
 		}
@@ -236,12 +346,13 @@ func (p *Proxy) forwardRequest(acct *account.Account, w http.ResponseWriter, req
 		_ = result.Body.Close()
 
 		if err != nil {
-			writeJSONError(w, http.StatusBadGateway, err)
+			writeJSONError(w, p.logger(), http.StatusBadGateway, err)
 			return
 		}
+		p.Metrics.countUpstreamResponse(result.StatusCode)
 
 		if len(body) == MaxResponseLength+1 {
-			writeJSONError(w, http.StatusBadGateway, protocol.NewError("response exceeds maximum length", true, true))
+			writeJSONError(w, p.logger(), http.StatusBadGateway, protocol.NewError("response exceeds maximum length", true, true))
 			return
 		}
 
@@ -249,12 +360,12 @@ func (p *Proxy) forwardRequest(acct *account.Account, w http.ResponseWriter, req
 			altSvc := result.Header.Values("Alt-Svc")
 			idx := slices.IndexFunc(altSvc, func(str string) bool { return strings.HasPrefix(str, h2Prefix) })
 			if idx == -1 {
-				writeJSONError(w, result.StatusCode, err)
+				writeJSONError(w, p.logger(), result.StatusCode, err)
 				return
 			}
 
 			altHost := altSvc[idx][len(h2Prefix):]
-			log.Debug("Received HTTP Status 421. Updating server URL to %s", altHost)
+			p.logger().Debug("Received HTTP Status 421. Updating server URL to %s", altHost)
 			acct.Host = altHost
 			p.updateDomainForSubject(acct.Subject, acct.Host)
 			if proxyReq.Body != nil {
@@ -276,13 +387,13 @@ func (p *Proxy) forwardRequest(acct *account.Account, w http.ResponseWriter, req
 
 		attempts++
 		if attempts == MaxAttempts {
-			writeJSONError(w, http.StatusBadGateway, protocol.NewError("max retry exhausted", false, false))
+			writeJSONError(w, p.logger(), http.StatusBadGateway, protocol.NewError("max retry exhausted", false, false))
 		}
 
-		log.Debug("Retrying transmission after error...")
+		p.logger().Debug("Retrying transmission after error...")
 		select {
 		case <-ctx.Done():
-			writeJSONError(w, http.StatusGatewayTimeout, ctx.Err())
+			writeJSONError(w, p.logger(), http.StatusGatewayTimeout, ctx.Err())
 			return
 		case <-time.After(1 * time.Second):
 			continue
@@ -291,90 +402,287 @@ func (p *Proxy) forwardRequest(acct *account.Account, w http.ResponseWriter, req
 }
 
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	log.Info("Received %s request for %s", req.Method, req.URL.Path)
+	p.logger().Info("Received %s request for %s", req.Method, req.URL.Path)
 
 	if req.URL.Path == "/health" {
 		p.handleHealthCheck(w, req)
 		return
 	}
 
+	if p.Jobs != nil && strings.HasPrefix(req.URL.Path, JobsPath) {
+		p.handleJobStatus(w, req)
+		return
+	}
+
+	ctx, span := trace.Start(trace.Extract(req.Context(), req.Header), "Proxy.ServeHTTP")
+	req = req.WithContext(ctx)
+	defer span.End()
+
+	record := newAuditRecord(req)
+	recorder := &statusRecorder{ResponseWriter: w}
+	err := p.serveAPI(recorder, req, record)
+	record.finish(recorder.status, err)
+	span.SetAttribute(trace.AttrVIN, record.VIN)
+	span.SetAttribute(trace.AttrCommand, record.Command)
+	span.SetAttribute(trace.AttrHTTPStatus, record.Status)
+	span.RecordError(err)
+	p.writeAuditRecord(record)
+	p.Metrics.countRequest(record.Command, record.Outcome)
+}
+
+// serveAPI handles requests that require an OAuth token. It fills in record as it learns more
+// about the request, and returns an error if the request failed before it could be forwarded to
+// Fleet API.
+func (p *Proxy) serveAPI(w http.ResponseWriter, req *http.Request, record *AuditRecord) error {
 	acct, err := getAccount(req)
 	if err != nil {
-		writeJSONError(w, http.StatusForbidden, err)
-		return
+		writeJSONError(w, p.logger(), http.StatusForbidden, err)
+		return err
 	}
+	record.Subject = acct.Subject
 	if host := p.fetchDomainForSubject(acct.Subject); host != "" {
 		acct.Host = host
 	}
+	tenant, err := p.selectTenant(req)
+	if errors.Is(err, ErrUnknownTenant) {
+		writeJSONError(w, p.logger(), http.StatusBadRequest, err)
+		return err
+	} else if err != nil {
+		writeJSONError(w, p.logger(), http.StatusForbidden, err)
+		return err
+	}
+	record.Tenant = tenant.Name
 
 	if strings.HasPrefix(req.URL.Path, "/api/1/vehicles/") {
-		path := strings.Split(req.URL.Path, "/")
-		if len(path) == 7 && path[5] == "command" {
-			command := path[6]
-			vin := path[4]
-			if len(vin) != vinLength {
-				writeJSONError(w, http.StatusNotFound, errors.New("expected 17-character VIN in path (do not user Fleet API ID)"))
-				return
+		// Clean the path so that variants such as a trailing slash can't be used to send a command
+		// through the forwarding branch below.
+		segments := strings.Split(path.Clean(req.URL.Path), "/")
+		if len(segments) > 5 && segments[5] == "command" {
+			if len(segments) != 7 {
+				writeJSONError(w, p.logger(), http.StatusBadRequest, errInvalidCommand)
+				return errInvalidCommand
 			}
-			if p.isNotSupported(vin) {
-				p.forwardRequest(acct, w, req)
-				if acct.Host != p.fetchDomainForSubject(acct.Subject) {
-					p.updateDomainForSubject(acct.Subject, acct.Host)
+			command := segments[6]
+			record.Command = command
+			if err := p.requireKey(w, tenant); err != nil {
+				return err
+			}
+			vin, err := p.resolveVehicle(w, req, acct, segments[4])
+			if err != nil {
+				return err
+			}
+			record.VIN = vin
+			if p.AuditLog != nil {
+				record.Parameters = sanitizeParameters(peekParameters(req))
+			}
+			if err := p.authorize(acct, req, vin, command); err != nil {
+				writeJSONError(w, p.logger(), http.StatusForbidden, err)
+				return err
+			}
+			run := func(w http.ResponseWriter, req *http.Request) error {
+				if err := p.checkRateLimit(w, acct.Subject, vin, command); err != nil {
+					return err
 				}
-			} else {
-				if err := p.handleVehicleCommand(acct, w, req, command, vin); err == ErrCommandUseRESTAPI {
-					p.forwardRequest(acct, w, req)
+				if err := p.checkStepUp(w, req, record, command, vin); err != nil {
+					return err
+				}
+				if p.Jobs != nil && wantsAsync(req) {
+					return p.startJob(w, req, record, func(w http.ResponseWriter, req *http.Request, record *AuditRecord) error {
+						return p.executeCommand(acct, tenant, w, req, record, command, vin)
+					})
 				}
+				return p.executeCommand(acct, tenant, w, req, record, command, vin)
 			}
-			return
+			if key := req.Header.Get(IdempotencyKeyHeader); key != "" && p.Idempotency != nil {
+				return p.runIdempotent(w, req, record, key, run)
+			}
+			return run(w, req)
 		}
-		if len(path) == 5 && path[4] == "fleet_telemetry_config" {
-			p.handleFleetTelemetryConfig(acct, w, req)
-			return
+		if len(segments) == 5 && segments[4] == "fleet_telemetry_config" {
+			if err := p.requireKey(w, tenant); err != nil {
+				return err
+			}
+			return p.handleFleetTelemetryConfig(acct, tenant, w, req)
+		}
+		if len(segments) == 5 {
+			if command, ok := accountVehicleEndpoints[segments[4]]; ok {
+				if err := p.authorizeBodyVINs(acct, req, command); err != nil {
+					writeJSONError(w, p.logger(), http.StatusForbidden, err)
+					return err
+				}
+				p.forwardRequest(acct, w, req)
+				return nil
+			}
+		}
+		if len(segments) >= 5 {
+			record.VIN = segments[4]
+			endpoint := vehicleEndpoint(segments)
+			rateLimited := p.RateLimiter != nil && rateLimitedEndpoints[endpoint]
+			if p.Policy != nil || rateLimited {
+				vin, err := p.resolveVehicle(w, req, acct, segments[4])
+				if err != nil {
+					return err
+				}
+				record.VIN = vin
+				if err := p.authorize(acct, req, vin, endpoint); err != nil {
+					writeJSONError(w, p.logger(), http.StatusForbidden, err)
+					return err
+				}
+				if rateLimited {
+					if err := p.checkRateLimit(w, acct.Subject, vin, endpoint); err != nil {
+						return err
+					}
+				}
+			}
 		}
 	}
 	p.forwardRequest(acct, w, req)
+	return nil
+}
+
+// accountVehicleEndpoints maps Fleet API endpoints of the form /api/1/vehicles/{endpoint}, which
+// apply to the VINs listed in the request body instead of a vehicle in the path, to the name that
+// policy rules use to match them.
+var accountVehicleEndpoints = map[string]string{
+	"fleet_status":               PolicyCommandVehicle,
+	"fleet_telemetry_config_jws": PolicyCommandFleetTelemetryConfig,
+}
+
+// rateLimitedEndpoints lists per-vehicle endpoints, other than commands, that count against
+// RateLimiter limits.
+var rateLimitedEndpoints = map[string]bool{
+	"wake_up": true,
+}
+
+// vehicleEndpoint returns the name that policy rules use to match a request to a per-vehicle
+// endpoint other than a command. For /api/1/vehicles/{id}/{endpoint}/... this is the endpoint name
+// (e.g., "vehicle_data" or "wake_up"); for /api/1/vehicles/{id} it's [PolicyCommandVehicle].
+func vehicleEndpoint(segments []string) string {
+	if len(segments) > 5 {
+		return segments[5]
+	}
+	return PolicyCommandVehicle
+}
+
+// authorizeBodyVINs checks the policy, if any, for each VIN in the "vins" field of req's JSON body.
+func (p *Proxy) authorizeBodyVINs(acct *account.Account, req *http.Request, command string) error {
+	if p.Policy == nil {
+		return nil
+	}
+	vins, _ := peekParameters(req)["vins"].([]interface{})
+	for _, vin := range vins {
+		vin, ok := vin.(string)
+		if !ok {
+			continue
+		}
+		if err := p.authorize(acct, req, vin, command); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveVehicle returns the VIN of vehicle, which may be a VIN or a Fleet API vehicle ID. If the
+// VIN can't be resolved, resolveVehicle writes an error response to w.
+func (p *Proxy) resolveVehicle(w http.ResponseWriter, req *http.Request, acct *account.Account, vehicle string) (string, error) {
+	vin, err := p.resolveVIN(req.Context(), acct, vehicle)
+	if errors.Is(err, errInvalidVehicle) || errors.Is(err, ErrUnknownVehicleID) {
+		writeJSONError(w, p.logger(), http.StatusNotFound, err)
+		return "", err
+	} else if err != nil {
+		err = fmt.Errorf("could not resolve vehicle ID: %w", err)
+		writeJSONError(w, p.logger(), http.StatusBadGateway, err)
+		return "", err
+	}
+	return vin, nil
+}
+
+// peekParameters parses the JSON body of req without consuming it.
+func peekParameters(req *http.Request) RequestParameters {
+	if req.Body == nil {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, MaxResponseLength))
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return nil
+	}
+	var params RequestParameters
+	if err := json.Unmarshal(body, &params); err != nil {
+		return nil
+	}
+	return params
+}
+
+// authorize checks the proxy's policy, if any, before a request is sent to a vehicle. The command is
+// either a vehicle command or a pseudo-command naming another per-vehicle endpoint.
+func (p *Proxy) authorize(acct *account.Account, req *http.Request, vin, command string) error {
+	if p.Policy == nil {
+		return nil
+	}
+	decision := p.Policy.Evaluate(&PolicyRequest{
+		Subject: acct.Subject,
+		APIKey:  req.Header.Get(APIKeyHeader),
+		VIN:     vin,
+		Command: command,
+	})
+	if !decision.Allowed {
+		p.logger().Warning("Policy denied %s on %s for subject %s (%s %s)", command, vin, acct.Subject, decision.Rule, decision.Reason)
+		return ErrPolicyDenied
+	}
+	p.logger().Debug("Policy allowed %s on %s for subject %s (%s)", command, vin, acct.Subject, decision.Rule)
+	return nil
 }
 
 func (p *Proxy) handleHealthCheck(w http.ResponseWriter, req *http.Request) {
 	if req.Method != http.MethodGet {
-		writeJSONError(w, http.StatusMethodNotAllowed, nil)
+		writeJSONError(w, p.logger(), http.StatusMethodNotAllowed, nil)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
 }
 
-func (p *Proxy) handleFleetTelemetryConfig(acct *account.Account, w http.ResponseWriter, req *http.Request) {
-	log.Info("Processing fleet telemetry configuration...")
+func (p *Proxy) handleFleetTelemetryConfig(acct *account.Account, tenant *tenant, w http.ResponseWriter, req *http.Request) error {
+	p.logger().Info("Processing fleet telemetry configuration...")
 	defer func() {
 		_ = req.Body.Close()
 	}()
 	body, err := io.ReadAll(req.Body)
 	if err != nil {
-		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("could not read request body: %s", err))
-		return
+		err = fmt.Errorf("could not read request body: %s", err)
+		writeJSONError(w, p.logger(), http.StatusBadRequest, err)
+		return err
 	}
 	var params struct {
 		VINs   []string      `json:"vins"`
 		Config jwt.MapClaims `json:"config"`
 	}
 	if err := json.Unmarshal(body, &params); err != nil {
-		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("could not parse JSON body: %s", err))
-		return
+		err = fmt.Errorf("could not parse JSON body: %s", err)
+		writeJSONError(w, p.logger(), http.StatusBadRequest, err)
+		return err
+	}
+	for _, vin := range params.VINs {
+		if err := p.authorize(acct, req, vin, PolicyCommandFleetTelemetryConfig); err != nil {
+			writeJSONError(w, p.logger(), http.StatusForbidden, err)
+			return err
+		}
 	}
 
 	// Let the server validate the VINs and config, the proxy just needs to sign
 	if _, ok := params.Config["aud"]; ok {
-		log.Warning("Configuration 'aud' field will be overwritten")
+		p.logger().Warning("Configuration 'aud' field will be overwritten")
 	}
 	if _, ok := params.Config["iss"]; ok {
-		log.Warning("Configuration 'iss' field will be overwritten")
+		p.logger().Warning("Configuration 'iss' field will be overwritten")
 	}
-	token, err := sign.SignMessageForFleet(p.commandKey, "TelemetryClient", params.Config)
+	token, err := sign.SignMessageForFleet(tenant.telemetryKey(), "TelemetryClient", params.Config)
 	if err != nil {
-		writeJSONError(w, http.StatusInternalServerError, fmt.Errorf("error signing configuration: %s", err))
-		return
+		err = fmt.Errorf("error signing configuration: %s", err)
+		writeJSONError(w, p.logger(), http.StatusInternalServerError, err)
+		return err
 	}
 
 	// Forward the new request to Tesla's servers
@@ -383,63 +691,138 @@ func (p *Proxy) handleFleetTelemetryConfig(acct *account.Account, w http.Respons
 	jwtRequest["token"] = token
 	bodyJSON, err := json.Marshal(jwtRequest)
 	if err != nil {
-		writeJSONError(w, http.StatusInternalServerError, fmt.Errorf("error while serializing a request: %s", err))
-		return
+		err = fmt.Errorf("error while serializing a request: %s", err)
+		writeJSONError(w, p.logger(), http.StatusInternalServerError, err)
+		return err
 	}
 	req.Body = io.NopCloser(bytes.NewReader(bodyJSON))
 	req.URL, err = req.URL.Parse("/api/1/vehicles/fleet_telemetry_config_jws")
 	if err != nil {
-		writeJSONError(w, http.StatusInternalServerError, fmt.Errorf("error creating proxied URL: %s", err))
-		return
+		err = fmt.Errorf("error creating proxied URL: %s", err)
+		writeJSONError(w, p.logger(), http.StatusInternalServerError, err)
+		return err
 	}
-	log.Debug("Posting data to %s: %s", req.URL.String(), bodyJSON)
+	p.logger().Debug("Posting data to %s: %s", req.URL.String(), bodyJSON)
 	p.forwardRequest(acct, w, req)
+	return nil
+}
+
+// executeCommand sends a command to a vehicle, falling back to Fleet API's REST interface if the
+// vehicle or command does not support end-to-end authentication.
+func (p *Proxy) executeCommand(acct *account.Account, tenant *tenant, w http.ResponseWriter, req *http.Request, record *AuditRecord, command, vin string) error {
+	if p.isNotSupported(vin) {
+		p.forwardRequest(acct, w, req)
+		if acct.Host != p.fetchDomainForSubject(acct.Subject) {
+			p.updateDomainForSubject(acct.Subject, acct.Host)
+		}
+		return nil
+	}
+	err := p.handleVehicleCommand(acct, tenant, w, req, command, vin)
+	if err == ErrCommandUseRESTAPI {
+		p.forwardRequest(acct, w, req)
+		return nil
+	}
+	if errors.Is(err, protocol.ErrProtocolNotSupported) {
+		// The request was forwarded to Fleet API.
+		return nil
+	}
+	record.Transport = TransportSignedCommand
+	return err
 }
 
-func (p *Proxy) handleVehicleCommand(acct *account.Account, w http.ResponseWriter, req *http.Request, command, vin string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+func (p *Proxy) handleVehicleCommand(acct *account.Account, tenant *tenant, w http.ResponseWriter, req *http.Request, command, vin string) error {
+	wake, err := p.wakeEnabled(req)
+	if err != nil {
+		writeJSONError(w, p.logger(), http.StatusBadRequest, err)
+		return err
+	}
+
+	// Commands continue if the client disconnects, but the context retains trace information.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), p.commandTimeout(wake))
 	defer cancel()
 
 	// Serialize commands sent to a specific VIN to avoid some complexities associated with sharing
-	// the vehicle.Vehicle object. VCSEC commands fail if they arrive out of order, anyway.
-	if err := p.lockVIN(ctx, vin); err != nil {
-		writeJSONError(w, http.StatusServiceUnavailable, err)
+	// the vehicle.Vehicle object. VCSEC commands fail if they arrive out of order, anyway. Unlike
+	// the command itself, waiting in the queue stops if the client disconnects.
+	queueCtx, stopWaiting := context.WithCancel(ctx)
+	defer context.AfterFunc(req.Context(), stopWaiting)()
+	release, err := p.enqueue(queueCtx, vin, acct.Subject, command)
+	stopWaiting()
+	if errors.Is(err, ErrQueueFull) {
+		writeJSONError(w, p.logger(), http.StatusTooManyRequests, err)
+		return err
+	} else if err != nil {
+		writeJSONError(w, p.logger(), http.StatusServiceUnavailable, err)
 		return err
 	}
-	defer p.unlockVIN(vin)
+	defer release()
 
-	car, commandToExecuteFunc, err := p.loadVehicleAndCommandFromRequest(ctx, acct, w, req, command, vin)
+	car, commandToExecuteFunc, err := p.loadVehicleAndCommandFromRequest(ctx, acct, tenant, w, req, command, vin)
 	if err != nil {
 		return err
 	}
 
+	p.setJobState(ctx, JobWaking)
 	if err := car.Connect(ctx); err != nil {
-		writeJSONError(w, http.StatusInternalServerError, err)
+		writeJSONError(w, p.logger(), http.StatusInternalServerError, err)
 		return err
 	}
 	defer car.Disconnect()
 
-	if err := car.StartSession(ctx, nil); errors.Is(err, protocol.ErrProtocolNotSupported) {
+	_, cached := tenant.sessions.GetEntry(vin)
+	p.Metrics.countSessionCacheLookup(cached)
+	retrier := &wakeRetrier{proxy: p, car: car, w: w, enabled: wake}
+	err = retrier.do(ctx, func() error {
+		p.setJobState(ctx, JobHandshaking)
+		handshakeStart := time.Now()
+		err := car.StartSession(ctx, nil)
+		p.Metrics.observeDuration(metricPhaseDuration, handshakeStart, PhaseHandshake)
+		addServerTiming(w, PhaseHandshake, handshakeStart)
+		p.countUpstreamError(err)
+		return err
+	})
+	if errors.Is(err, protocol.ErrProtocolNotSupported) {
 		p.markUnsupportedVIN(vin)
 		p.forwardRequest(acct, w, req)
 		return err
 	} else if err != nil {
-		writeJSONError(w, http.StatusInternalServerError, err)
+		writeJSONError(w, p.logger(), http.StatusInternalServerError, err)
 		return err
 	}
 	defer func() {
-		_ = car.UpdateCachedSessions(p.sessions)
+		_ = car.UpdateCachedSessions(tenant.sessions)
 	}()
 
-	if err = commandToExecuteFunc(car); err == ErrCommandUseRESTAPI {
+	err = retrier.do(ctx, func() error {
+		p.setJobState(ctx, JobSent)
+		commandStart := time.Now()
+		err := commandToExecuteFunc(car)
+		p.Metrics.observeDuration(metricPhaseDuration, commandStart, PhaseCommand)
+		addServerTiming(w, PhaseCommand, commandStart)
+		p.countUpstreamError(err)
+		return err
+	})
+	if err == ErrCommandUseRESTAPI {
+		return err
+	}
+	var permissionErr *vehicle.PermissionError
+	if errors.As(err, &permissionErr) {
+		// The key's role may have changed since it was cached.
+		p.keyRoles.Delete(keyRoleEntry{tenant, vin})
+		writeJSONError(w, p.logger(), http.StatusForbidden, err)
 		return err
 	}
+	if p.RoleChecks && err == nil {
+		if role, roleErr := car.KeyRole(ctx); roleErr == nil {
+			p.keyRoles.Store(keyRoleEntry{tenant, vin}, role)
+		}
+	}
 	if protocol.IsNominalError(err) {
-		writeJSONError(w, http.StatusOK, err)
+		writeJSONError(w, p.logger(), http.StatusOK, err)
 		return err
 	}
 	if err != nil {
-		writeJSONError(w, http.StatusInternalServerError, err)
+		writeJSONError(w, p.logger(), http.StatusInternalServerError, err)
 		return err
 	}
 
@@ -449,30 +832,54 @@ func (p *Proxy) handleVehicleCommand(acct *account.Account, w http.ResponseWrite
 	return nil
 }
 
-func (p *Proxy) loadVehicleAndCommandFromRequest(ctx context.Context, acct *account.Account, w http.ResponseWriter, req *http.Request,
+// countUpstreamError records the Fleet API status code that caused err, if any.
+func (p *Proxy) countUpstreamError(err error) {
+	var httpErr *inet.HTTPError
+	if errors.As(err, &httpErr) {
+		p.Metrics.countUpstreamResponse(httpErr.Code)
+	} else if errors.Is(err, protocol.ErrProtocolNotSupported) {
+		p.Metrics.countUpstreamResponse(http.StatusUnprocessableEntity)
+	}
+}
+
+func (p *Proxy) loadVehicleAndCommandFromRequest(ctx context.Context, acct *account.Account, tenant *tenant, w http.ResponseWriter, req *http.Request,
 	command, vin string) (*vehicle.Vehicle, func(*vehicle.Vehicle) error, error) {
 
-	log.Debug("Executing %s on %s", command, vin)
+	p.logger().Debug("Executing %s on %s", command, vin)
 	if req.Method != http.MethodPost {
-		writeJSONError(w, http.StatusMethodNotAllowed, nil)
+		writeJSONError(w, p.logger(), http.StatusMethodNotAllowed, nil)
 		return nil, nil, fmt.Errorf("wrong http method")
 	}
 
 	commandToExecuteFunc, err := extractCommandAction(ctx, req, command)
 	if err != nil {
-		writeJSONError(w, http.StatusBadRequest, err)
+		writeJSONError(w, p.logger(), http.StatusBadRequest, err)
 		return nil, nil, err
 	}
 
-	car, err := acct.GetVehicle(ctx, vin, p.commandKey, p.sessions)
+	car, err := acct.GetVehicle(ctx, vin, tenant.CommandKey, tenant.sessions)
 	if err != nil || car == nil {
-		writeJSONError(w, http.StatusInternalServerError, err)
+		writeJSONError(w, p.logger(), http.StatusInternalServerError, err)
 		return nil, nil, err
 	}
+	if p.Logger != nil {
+		car.SetLogger(p.Logger)
+	}
+	if p.RoleChecks {
+		car.SetRoleChecks(true)
+		if role, ok := p.keyRoles.Load(keyRoleEntry{tenant, vin}); ok {
+			car.SetKeyRole(role.(keys.Role))
+		}
+	}
 
 	return car, commandToExecuteFunc, err
 }
 
+// logger returns the Logger used for messages about requests handled by p.
+func (p *Proxy) logger() *log.Logger {
+	return log.New(p.Logger)
+}
+
 func extractCommandAction(ctx context.Context, req *http.Request, command string) (func(*vehicle.Vehicle) error, error) {
 	var params RequestParameters
 	body, err := io.ReadAll(req.Body)
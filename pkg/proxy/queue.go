@@ -0,0 +1,298 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrQueueFull indicates that too many commands are waiting to be sent to a vehicle.
+var ErrQueueFull = errors.New("too many commands are queued for this vehicle")
+
+// Priority determines the order in which queued commands are sent to a vehicle. Commands with
+// higher priority are sent first; commands with the same priority are sent in the order they
+// arrived.
+type Priority int
+
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+var priorityNames = map[Priority]string{
+	PriorityLow:    "low",
+	PriorityNormal: "normal",
+	PriorityHigh:   "high",
+}
+
+func (p Priority) String() string {
+	if name, ok := priorityNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+// MarshalText encodes p as "low", "normal", or "high".
+func (p Priority) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText decodes "low", "normal", or "high".
+func (p *Priority) UnmarshalText(text []byte) error {
+	for priority, name := range priorityNames {
+		if name == string(text) {
+			*p = priority
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown priority %q", text)
+}
+
+// DefaultPriorities moves security-related commands ahead of, and media commands behind, other
+// commands. Commands that aren't listed have PriorityNormal.
+var DefaultPriorities = map[string]Priority{
+	"door_lock":              PriorityHigh,
+	"door_unlock":            PriorityHigh,
+	"set_sentry_mode":        PriorityHigh,
+	"remote_start_drive":     PriorityHigh,
+	"set_pin_to_drive":       PriorityHigh,
+	"set_valet_mode":         PriorityHigh,
+	"guest_mode":             PriorityHigh,
+	"speed_limit_activate":   PriorityHigh,
+	"speed_limit_deactivate": PriorityHigh,
+	"erase_user_data":        PriorityHigh,
+
+	"adjust_volume":         PriorityLow,
+	"remote_boombox":        PriorityLow,
+	"media_next_fav":        PriorityLow,
+	"media_prev_fav":        PriorityLow,
+	"media_next_track":      PriorityLow,
+	"media_prev_track":      PriorityLow,
+	"media_volume_down":     PriorityLow,
+	"media_volume_up":       PriorityLow,
+	"media_toggle_playback": PriorityLow,
+}
+
+// ParsePriorities parses a comma-separated list of command=priority pairs, such as
+// "door_lock=high,honk_horn=low".
+func ParsePriorities(s string) (map[string]Priority, error) {
+	priorities := make(map[string]Priority)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		command, name, ok := strings.Cut(pair, "=")
+		if !ok || command == "" {
+			return nil, fmt.Errorf("expected command=priority, got %q", pair)
+		}
+		var priority Priority
+		if err := priority.UnmarshalText([]byte(name)); err != nil {
+			return nil, err
+		}
+		priorities[command] = priority
+	}
+	return priorities, nil
+}
+
+// QueueEntry describes a command that is being sent to a vehicle or waiting to be sent.
+type QueueEntry struct {
+	Subject  string    `json:"subject"`
+	Command  string    `json:"command"`
+	Priority Priority  `json:"priority"`
+	Enqueued time.Time `json:"enqueued_at"`
+}
+
+// QueueStatus describes the commands queued for a vehicle.
+type QueueStatus struct {
+	VIN     string       `json:"vin"`
+	Active  *QueueEntry  `json:"active"`
+	Waiting []QueueEntry `json:"waiting"`
+}
+
+type queueTicket struct {
+	QueueEntry
+	// ready is closed when the ticket reaches the front of the queue.
+	ready chan struct{}
+}
+
+type vinQueue struct {
+	active  *queueTicket
+	waiting []*queueTicket // Ordered by priority, then arrival.
+}
+
+// CommandQueue serializes commands sent to each vehicle. The proxy only sends one command at a
+// time to a given VIN; other commands for that VIN wait in the queue.
+type CommandQueue struct {
+	// MaxDepth is the maximum number of commands that may wait for a vehicle, not counting the
+	// command in progress. If MaxDepth is zero, the queue is unbounded. Commands that arrive when
+	// the queue is full are rejected with ErrQueueFull.
+	MaxDepth int
+
+	// Priorities maps command names to priorities. If nil, DefaultPriorities is used.
+	Priorities map[string]Priority
+
+	lock sync.Mutex
+	vins map[string]*vinQueue
+	// idle, if not nil, is called after the last command for a vehicle is released.
+	idle func(vin string)
+}
+
+// NewCommandQueue returns a CommandQueue that allows at most maxDepth commands to wait for each
+// vehicle. If maxDepth is zero, the queue is unbounded.
+func NewCommandQueue(maxDepth int) *CommandQueue {
+	return &CommandQueue{
+		MaxDepth: maxDepth,
+		vins:     make(map[string]*vinQueue),
+	}
+}
+
+func (q *CommandQueue) priority(command string) Priority {
+	priorities := q.Priorities
+	if priorities == nil {
+		priorities = DefaultPriorities
+	}
+	return priorities[command]
+}
+
+// Acquire blocks until command reaches the front of vin's queue or ctx expires. On success, the
+// caller must call release when it's done communicating with the vehicle.
+func (q *CommandQueue) Acquire(ctx context.Context, vin, subject, command string) (release func(), err error) {
+	ticket, err := q.acquire(ctx, vin, subject, command)
+	if err != nil {
+		return nil, err
+	}
+	return func() { q.release(vin, ticket) }, nil
+}
+
+func (q *CommandQueue) acquire(ctx context.Context, vin, subject, command string) (*queueTicket, error) {
+	ticket := &queueTicket{
+		QueueEntry: QueueEntry{
+			Subject:  subject,
+			Command:  command,
+			Priority: q.priority(command),
+			Enqueued: time.Now(),
+		},
+		ready: make(chan struct{}),
+	}
+
+	q.lock.Lock()
+	if q.vins == nil {
+		q.vins = make(map[string]*vinQueue)
+	}
+	vq, ok := q.vins[vin]
+	if !ok {
+		vq = &vinQueue{}
+		q.vins[vin] = vq
+	}
+	if vq.active == nil {
+		vq.active = ticket
+		q.lock.Unlock()
+		return ticket, nil
+	}
+	if q.MaxDepth > 0 && len(vq.waiting) >= q.MaxDepth {
+		q.lock.Unlock()
+		return nil, ErrQueueFull
+	}
+	// Insert after all commands with the same or higher priority.
+	i := sort.Search(len(vq.waiting), func(i int) bool {
+		return vq.waiting[i].Priority < ticket.Priority
+	})
+	vq.waiting = append(vq.waiting, nil)
+	copy(vq.waiting[i+1:], vq.waiting[i:])
+	vq.waiting[i] = ticket
+	q.lock.Unlock()
+
+	select {
+	case <-ticket.ready:
+		return ticket, nil
+	case <-ctx.Done():
+	}
+
+	q.lock.Lock()
+	for i, t := range vq.waiting {
+		if t == ticket {
+			vq.waiting = append(vq.waiting[:i], vq.waiting[i+1:]...)
+			q.lock.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+	q.lock.Unlock()
+	// The ticket reached the front of the queue after ctx expired, so pass the vehicle on to the
+	// next command.
+	q.release(vin, ticket)
+	return nil, ctx.Err()
+}
+
+// release removes ticket from the front of vin's queue and wakes the next command.
+func (q *CommandQueue) release(vin string, ticket *queueTicket) {
+	q.lock.Lock()
+	vq, ok := q.vins[vin]
+	if !ok || vq.active != ticket {
+		q.lock.Unlock()
+		panic("called release without owning the vehicle")
+	}
+	if len(vq.waiting) == 0 {
+		// Limit the size of the map to the number of vehicles with active commands.
+		delete(q.vins, vin)
+		q.lock.Unlock()
+		if q.idle != nil {
+			q.idle(vin)
+		}
+		return
+	}
+	vq.active = vq.waiting[0]
+	vq.waiting = vq.waiting[1:]
+	close(vq.active.ready)
+	q.lock.Unlock()
+}
+
+// Status returns the commands queued for each vehicle with at least one command in progress.
+func (q *CommandQueue) Status() []QueueStatus {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	status := make([]QueueStatus, 0, len(q.vins))
+	for vin, vq := range q.vins {
+		s := QueueStatus{VIN: vin, Waiting: make([]QueueEntry, len(vq.waiting))}
+		if vq.active != nil {
+			active := vq.active.QueueEntry
+			s.Active = &active
+		}
+		for i, t := range vq.waiting {
+			s.Waiting[i] = t.QueueEntry
+		}
+		status = append(status, s)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].VIN < status[j].VIN })
+	return status
+}
+
+// ServeHTTP responds to GET requests with the output of Status, encoded as JSON. The optional vin
+// query parameter restricts the response to a single vehicle.
+//
+// The response includes OAuth subjects and VINs, so q should not be exposed to proxy clients.
+func (q *CommandQueue) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeJSONError(w, nil, http.StatusMethodNotAllowed, nil)
+		return
+	}
+	status := q.Status()
+	if vin := req.URL.Query().Get("vin"); vin != "" {
+		filtered := []QueueStatus{}
+		for _, s := range status {
+			if s.VIN == vin {
+				filtered = append(filtered, s)
+			}
+		}
+		status = filtered
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string][]QueueStatus{"response": status})
+}
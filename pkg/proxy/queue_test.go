@@ -0,0 +1,154 @@
+package proxy_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/teslamotors/vehicle-command/pkg/proxy"
+)
+
+// waitForQueueDepth blocks until depth commands are waiting for testVIN.
+func waitForQueueDepth(t *testing.T, q *proxy.CommandQueue, depth int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, status := range q.Status() {
+			if status.VIN == testVIN && len(status.Waiting) == depth {
+				return
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for queue depth %d", depth)
+}
+
+func TestCommandQueueOrder(t *testing.T) {
+	q := proxy.NewCommandQueue(0)
+	release, err := q.Acquire(context.Background(), testVIN, "subject-1", "set_temps")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commands := []string{"honk_horn", "media_next_track", "door_lock", "flash_lights"}
+	order := make(chan string, len(commands))
+	for i, command := range commands {
+		go func(command string) {
+			release, err := q.Acquire(context.Background(), testVIN, "subject-1", command)
+			if err != nil {
+				t.Error(err)
+				order <- ""
+				return
+			}
+			order <- command
+			release()
+		}(command)
+		waitForQueueDepth(t, q, i+1)
+	}
+
+	status := q.Status()
+	if len(status) != 1 || status[0].Active == nil || status[0].Active.Command != "set_temps" {
+		t.Fatalf("Unexpected queue status: %+v", status)
+	}
+	if status[0].Waiting[0].Priority != proxy.PriorityHigh {
+		t.Errorf("Expected high priority command at front of queue, got %+v", status[0].Waiting[0])
+	}
+
+	release()
+	expected := []string{"door_lock", "honk_horn", "flash_lights", "media_next_track"}
+	for _, command := range expected {
+		if actual := <-order; actual != command {
+			t.Errorf("Expected %s, got %s", command, actual)
+		}
+	}
+	if status := q.Status(); len(status) != 0 {
+		t.Errorf("Expected empty queue, got %+v", status)
+	}
+}
+
+func TestCommandQueueLimits(t *testing.T) {
+	q := proxy.NewCommandQueue(1)
+	release, err := q.Acquire(context.Background(), testVIN, "subject-1", "honk_horn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waiting := make(chan error, 1)
+	go func() {
+		_, err := q.Acquire(ctx, testVIN, "subject-1", "flash_lights")
+		waiting <- err
+	}()
+	waitForQueueDepth(t, q, 1)
+
+	if _, err := q.Acquire(context.Background(), testVIN, "subject-2", "flash_lights"); !errors.Is(err, proxy.ErrQueueFull) {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+	if _, err := q.Acquire(context.Background(), otherTestVIN, "subject-2", "flash_lights"); err != nil {
+		t.Errorf("Queue limit should not apply to other vehicles: %s", err)
+	}
+
+	cancel()
+	if err := <-waiting; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected cancellation, got %v", err)
+	}
+	waitForQueueDepth(t, q, 0)
+}
+
+func TestProxyQueueFull(t *testing.T) {
+	p, err := proxy.New(context.Background(), newTestKey(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Queue.MaxDepth = 1
+	release, err := p.Queue.Acquire(context.Background(), testVIN, "subject-1", "honk_horn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Queue.Acquire(ctx, testVIN, "subject-1", "honk_horn")
+	waitForQueueDepth(t, p.Queue, 1)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/1/vehicles/"+testVIN+"/command/door_lock", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken("subject-2"))
+	rsp := httptest.NewRecorder()
+	p.ServeHTTP(rsp, req)
+	if rsp.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status %d, got %d", http.StatusTooManyRequests, rsp.Code)
+	}
+	if rsp.Header().Get("Retry-After") == "" {
+		t.Error("Expected Retry-After header")
+	}
+
+	rsp = httptest.NewRecorder()
+	p.Queue.ServeHTTP(rsp, httptest.NewRequest(http.MethodGet, "/queue?vin="+testVIN, nil))
+	var reply struct {
+		Response []proxy.QueueStatus `json:"response"`
+	}
+	if err := json.Unmarshal(rsp.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Response) != 1 || len(reply.Response[0].Waiting) != 1 || reply.Response[0].Active.Subject != "subject-1" {
+		t.Errorf("Unexpected queue status: %s", rsp.Body.String())
+	}
+}
+
+func TestParsePriorities(t *testing.T) {
+	priorities, err := proxy.ParsePriorities("door_lock=low, honk_horn=high")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if priorities["door_lock"] != proxy.PriorityLow || priorities["honk_horn"] != proxy.PriorityHigh {
+		t.Errorf("Unexpected priorities: %v", priorities)
+	}
+	if _, err := proxy.ParsePriorities("door_lock=urgent"); err == nil {
+		t.Error("Expected error for unknown priority")
+	}
+}
@@ -0,0 +1,351 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited indicates a client sent commands faster than the proxy's rate limits allow.
+// Errors returned by [RateLimiter.Allow] are *RateLimitError values that match ErrRateLimited.
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// Rate-limit scopes reported in RateLimitError.Scope.
+const (
+	ScopeSubject  = "subject"  // All commands sent by an OAuth subject
+	ScopeVIN      = "vin"      // All commands sent to a vehicle
+	ScopeCategory = "category" // Commands in one category sent to a vehicle
+)
+
+// CategoryOther is the category of commands that aren't listed in RateLimits.CommandCategories.
+const CategoryOther = "other"
+
+// rateLimitSweepInterval is how often a RateLimiter discards buckets that have refilled.
+const rateLimitSweepInterval = time.Minute
+
+// DefaultCommandCategories groups commands for the purpose of rate limiting. Commands that aren't
+// listed belong to CategoryOther.
+var DefaultCommandCategories = map[string]string{
+	"honk_horn":      "alerts",
+	"flash_lights":   "alerts",
+	"remote_boombox": "alerts",
+
+	"adjust_volume":         "media",
+	"media_next_fav":        "media",
+	"media_prev_fav":        "media",
+	"media_next_track":      "media",
+	"media_prev_track":      "media",
+	"media_volume_down":     "media",
+	"media_volume_up":       "media",
+	"media_toggle_playback": "media",
+
+	"auto_conditioning_start":              "climate",
+	"auto_conditioning_stop":               "climate",
+	"remote_seat_cooler_request":           "climate",
+	"remote_seat_heater_request":           "climate",
+	"remote_auto_seat_climate_request":     "climate",
+	"remote_steering_wheel_heater_request": "climate",
+	"set_bioweapon_mode":                   "climate",
+	"set_cabin_overheat_protection":        "climate",
+	"set_climate_keeper_mode":              "climate",
+	"set_cop_temp":                         "climate",
+	"set_preconditioning_max":              "climate",
+	"set_temps":                            "climate",
+
+	"charge_max_range":       "charging",
+	"charge_standard":        "charging",
+	"charge_start":           "charging",
+	"charge_stop":            "charging",
+	"charge_port_door_open":  "charging",
+	"charge_port_door_close": "charging",
+	"set_charging_amps":      "charging",
+	"set_charge_limit":       "charging",
+
+	"actuate_trunk":  "closures",
+	"open_tonneau":   "closures",
+	"close_tonneau":  "closures",
+	"stop_tonneau":   "closures",
+	"window_control": "closures",
+
+	"door_lock":          "security",
+	"door_unlock":        "security",
+	"remote_start_drive": "security",
+	"set_sentry_mode":    "security",
+	"set_valet_mode":     "security",
+	"guest_mode":         "security",
+	"erase_user_data":    "security",
+
+	"wake_up": "wake",
+}
+
+// Limit allows bursts of up to Count requests, and refills at a rate of Count requests per Per.
+// The zero value imposes no limit.
+type Limit struct {
+	Count int
+	Per   time.Duration
+}
+
+func (l Limit) enabled() bool {
+	return l.Count > 0 && l.Per > 0
+}
+
+func (l Limit) String() string {
+	return fmt.Sprintf("%d/%s", l.Count, l.Per)
+}
+
+// ParseLimit parses a limit of the form "<count>/<duration>", such as "10/1m". The duration may
+// also be one of the units "s", "m", or "h", as in "10/m".
+func ParseLimit(s string) (Limit, error) {
+	countString, perString, ok := strings.Cut(s, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("expected <count>/<duration>, got %q", s)
+	}
+	count, err := strconv.Atoi(countString)
+	if err != nil || count < 0 {
+		return Limit{}, fmt.Errorf("invalid count in rate limit %q", s)
+	}
+	switch perString {
+	case "s", "m", "h":
+		perString = "1" + perString
+	}
+	per, err := time.ParseDuration(perString)
+	if err != nil || per <= 0 {
+		return Limit{}, fmt.Errorf("invalid duration in rate limit %q", s)
+	}
+	return Limit{Count: count, Per: per}, nil
+}
+
+// RateLimits configures a RateLimiter. A request must satisfy every applicable limit.
+type RateLimits struct {
+	// Subject limits the commands each OAuth subject may send, across all vehicles.
+	Subject Limit
+
+	// VIN limits the commands sent to each vehicle, across all clients.
+	VIN Limit
+
+	// Categories limits the commands in each category sent to each vehicle, across all clients.
+	Categories map[string]Limit
+
+	// CommandCategories maps commands to categories. If nil, DefaultCommandCategories is used.
+	CommandCategories map[string]string
+}
+
+// ParseRateLimits parses a comma-separated list of scope=limit pairs, such as
+// "subject=60/m,vin=20/m,alerts=3/m". The scope is "subject", "vin", or a category from
+// DefaultCommandCategories. See ParseLimit for the format of limits.
+func ParseRateLimits(s string) (*RateLimits, error) {
+	categories := map[string]bool{CategoryOther: true}
+	for _, category := range DefaultCommandCategories {
+		categories[category] = true
+	}
+	limits := &RateLimits{Categories: make(map[string]Limit)}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		scope, limitString, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected scope=limit, got %q", pair)
+		}
+		limit, err := ParseLimit(limitString)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case scope == ScopeSubject:
+			limits.Subject = limit
+		case scope == ScopeVIN:
+			limits.VIN = limit
+		case categories[scope]:
+			limits.Categories[scope] = limit
+		default:
+			return nil, fmt.Errorf("unknown rate-limit scope %q", scope)
+		}
+	}
+	return limits, nil
+}
+
+// RateLimitError indicates which limit a request exceeded.
+type RateLimitError struct {
+	// Scope is ScopeSubject, ScopeVIN, or ScopeCategory.
+	Scope string
+	// Category is the command category, if Scope is ScopeCategory.
+	Category string
+	// RetryAfter is how long the client should wait before sending the request again.
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	scope := e.Scope
+	if e.Scope == ScopeCategory {
+		scope = e.Category + " commands"
+	}
+	return fmt.Sprintf("%s for %s; retry in %s", ErrRateLimited, scope, e.RetryAfter.Round(time.Second))
+}
+
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// retryAfterSeconds returns e.RetryAfter rounded up to a whole number of seconds.
+func (e *RateLimitError) retryAfterSeconds() int {
+	return int(math.Ceil(e.RetryAfter.Seconds()))
+}
+
+type tokenBucket struct {
+	limit   Limit
+	tokens  float64
+	updated time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed > 0 {
+		rate := float64(b.limit.Count) / b.limit.Per.Seconds()
+		b.tokens = math.Min(float64(b.limit.Count), b.tokens+elapsed*rate)
+		b.updated = now
+	}
+}
+
+// wait returns how long until b contains a token.
+func (b *tokenBucket) wait() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	perToken := b.limit.Per / time.Duration(b.limit.Count)
+	return time.Duration((1 - b.tokens) * float64(perToken))
+}
+
+// RateLimiter enforces RateLimits using token buckets. It protects vehicles from clients that
+// send commands in a loop, and is independent of Fleet API's own rate limits.
+type RateLimiter struct {
+	limits    RateLimits
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewRateLimiter returns a RateLimiter that enforces limits.
+func NewRateLimiter(limits RateLimits) *RateLimiter {
+	if limits.CommandCategories == nil {
+		limits.CommandCategories = DefaultCommandCategories
+	}
+	return &RateLimiter{
+		limits:  limits,
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// Category returns the category that command belongs to.
+func (r *RateLimiter) Category(command string) string {
+	if category, ok := r.limits.CommandCategories[command]; ok {
+		return category
+	}
+	return CategoryOther
+}
+
+// Allow consumes a token from each limit that applies to a command sent by subject to vin. If any
+// limit is exhausted, Allow returns a *RateLimitError and doesn't consume any tokens.
+func (r *RateLimiter) Allow(subject, vin, command string) error {
+	type check struct {
+		key      string
+		limit    Limit
+		scope    string
+		category string
+	}
+	category := r.Category(command)
+	checks := []check{
+		{"s/" + subject, r.limits.Subject, ScopeSubject, ""},
+		{"v/" + vin, r.limits.VIN, ScopeVIN, ""},
+		{"c/" + vin + "/" + category, r.limits.Categories[category], ScopeCategory, category},
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := r.now()
+	r.sweep(now)
+
+	var buckets []*tokenBucket
+	var exceeded *RateLimitError
+	for _, c := range checks {
+		if !c.limit.enabled() {
+			continue
+		}
+		b, ok := r.buckets[c.key]
+		if !ok || b.limit != c.limit {
+			b = &tokenBucket{limit: c.limit, tokens: float64(c.limit.Count), updated: now}
+			r.buckets[c.key] = b
+		}
+		b.refill(now)
+		if wait := b.wait(); wait > 0 && (exceeded == nil || wait > exceeded.RetryAfter) {
+			exceeded = &RateLimitError{Scope: c.scope, Category: c.category, RetryAfter: wait}
+		}
+		buckets = append(buckets, b)
+	}
+	if exceeded != nil {
+		return exceeded
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return nil
+}
+
+// sweep discards full buckets, which behave the same as missing buckets. The caller must hold
+// r.lock.
+func (r *RateLimiter) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	r.lastSweep = now
+	for key, b := range r.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Count) {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// Limits returns the limits enforced by r, formatted for logging.
+func (r *RateLimiter) Limits() []string {
+	var limits []string
+	if r.limits.Subject.enabled() {
+		limits = append(limits, ScopeSubject+"="+r.limits.Subject.String())
+	}
+	if r.limits.VIN.enabled() {
+		limits = append(limits, ScopeVIN+"="+r.limits.VIN.String())
+	}
+	var categories []string
+	for category, limit := range r.limits.Categories {
+		if limit.enabled() {
+			categories = append(categories, category+"="+limit.String())
+		}
+	}
+	sort.Strings(categories)
+	return append(limits, categories...)
+}
+
+// checkRateLimit writes an error response and returns an error if p.RateLimiter doesn't allow
+// subject to send command to vin.
+func (p *Proxy) checkRateLimit(w http.ResponseWriter, subject, vin, command string) error {
+	if p.RateLimiter == nil {
+		return nil
+	}
+	err := p.RateLimiter.Allow(subject, vin, command)
+	var rateErr *RateLimitError
+	if errors.As(err, &rateErr) {
+		p.Metrics.add(metricRateLimited, 1, rateErr.Scope, p.RateLimiter.Category(command))
+		p.logger().Warning("Rate limited %s on %s for subject %s: %s", command, vin, subject, err)
+		writeJSONError(w, p.logger(), http.StatusTooManyRequests, err)
+	}
+	return err
+}
@@ -0,0 +1,170 @@
+package proxy_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/teslamotors/vehicle-command/pkg/proxy"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := proxy.ParseRateLimits("subject=60/m, vin=20/10m,alerts=3/h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits.Subject != (proxy.Limit{Count: 60, Per: time.Minute}) {
+		t.Errorf("Unexpected subject limit %s", limits.Subject)
+	}
+	if limits.VIN != (proxy.Limit{Count: 20, Per: 10 * time.Minute}) {
+		t.Errorf("Unexpected VIN limit %s", limits.VIN)
+	}
+	if limits.Categories["alerts"] != (proxy.Limit{Count: 3, Per: time.Hour}) {
+		t.Errorf("Unexpected alerts limit %s", limits.Categories["alerts"])
+	}
+	for _, s := range []string{"alert=3/m", "vin=3", "vin=x/m", "vin=3/x", "vin=3/0s"} {
+		if _, err := proxy.ParseRateLimits(s); err == nil {
+			t.Errorf("Expected error parsing %q", s)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := proxy.NewRateLimiter(proxy.RateLimits{
+		Subject:    proxy.Limit{Count: 4, Per: time.Minute},
+		Categories: map[string]proxy.Limit{"alerts": {Count: 2, Per: time.Minute}},
+	})
+	limiter.SetClock(func() time.Time { return now })
+
+	expectLimited := func(description string, err error, scope string, retryAfter time.Duration) {
+		t.Helper()
+		var rateErr *proxy.RateLimitError
+		if !errors.As(err, &rateErr) || !errors.Is(err, proxy.ErrRateLimited) {
+			t.Fatalf("%s: expected rate-limit error, got %v", description, err)
+		}
+		if rateErr.Scope != scope || rateErr.RetryAfter != retryAfter {
+			t.Errorf("%s: expected %s limit with retry after %s, got %+v", description, scope, retryAfter, rateErr)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := limiter.Allow("subject-1", testVIN, "honk_horn"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectLimited("third alert", limiter.Allow("subject-1", testVIN, "flash_lights"), proxy.ScopeCategory, 30*time.Second)
+	// Category limits apply to each vehicle separately.
+	if err := limiter.Allow("subject-1", otherTestVIN, "honk_horn"); err != nil {
+		t.Fatal(err)
+	}
+	// Rejected requests don't consume tokens from other limits.
+	if err := limiter.Allow("subject-1", testVIN, "door_lock"); err != nil {
+		t.Fatal(err)
+	}
+	expectLimited("subject", limiter.Allow("subject-1", testVIN, "door_lock"), proxy.ScopeSubject, 15*time.Second)
+	if err := limiter.Allow("subject-2", testVIN, "door_lock"); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(30 * time.Second)
+	if err := limiter.Allow("subject-1", testVIN, "honk_horn"); err != nil {
+		t.Errorf("Expected tokens to refill: %s", err)
+	}
+}
+
+func TestProxyRateLimit(t *testing.T) {
+	p, err := proxy.New(context.Background(), newTestKey(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Metrics = proxy.NewMetrics()
+	p.RateLimiter = proxy.NewRateLimiter(proxy.RateLimits{VIN: proxy.Limit{Count: 1, Per: time.Hour}})
+
+	send := func() *httptest.ResponseRecorder {
+		// GET requests for commands are rejected with 405 after rate limits are checked but before
+		// the proxy contacts Fleet API.
+		req := httptest.NewRequest(http.MethodGet, "/api/1/vehicles/"+testVIN+"/command/honk_horn", nil)
+		req.Header.Set("Authorization", "Bearer "+testToken("subject-1"))
+		rsp := httptest.NewRecorder()
+		p.ServeHTTP(rsp, req)
+		return rsp
+	}
+	if rsp := send(); rsp.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected status %d, got %d", http.StatusMethodNotAllowed, rsp.Code)
+	}
+	rsp := send()
+	if rsp.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status %d, got %d", http.StatusTooManyRequests, rsp.Code)
+	}
+	if retryAfter := rsp.Header().Get("Retry-After"); retryAfter != "3600" {
+		t.Errorf("Expected Retry-After: 3600, got %q", retryAfter)
+	}
+	var reply struct {
+		Details proxy.ErrorDetails `json:"error_details"`
+	}
+	if err := json.Unmarshal(rsp.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Details.Code != proxy.CodeRateLimited || reply.Details.RetryAfter != 3600 {
+		t.Errorf("Unexpected error details: %+v", reply.Details)
+	}
+
+	var metrics bytes.Buffer
+	if _, err := p.Metrics.WriteTo(&metrics); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(metrics.String(), `tesla_proxy_rate_limited_total{scope="vin",category="alerts"} 1`) {
+		t.Errorf("Expected rate-limit counter in metrics:\n%s", metrics.String())
+	}
+}
+
+func TestRateLimitWakeUp(t *testing.T) {
+	var forwarded atomic.Int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		forwarded.Add(1)
+		w.Write([]byte(`{"response":{}}`))
+	}))
+	defer server.Close()
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = server.Client().Transport
+	defer func() { http.DefaultTransport = defaultTransport }()
+
+	p, err := proxy.New(context.Background(), newTestKey(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetSubjectHost("subject-1", strings.TrimPrefix(server.URL, "https://"))
+	p.RateLimiter = proxy.NewRateLimiter(proxy.RateLimits{
+		Categories: map[string]proxy.Limit{"wake": {Count: 1, Per: time.Hour}},
+	})
+
+	for i, status := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest(http.MethodPost, "/api/1/vehicles/"+testVIN+"/wake_up", nil)
+		req.Header.Set("Authorization", "Bearer "+testToken("subject-1"))
+		rsp := httptest.NewRecorder()
+		p.ServeHTTP(rsp, req)
+		if rsp.Code != status {
+			t.Errorf("Request %d: expected status %d, got %d", i, status, rsp.Code)
+		}
+	}
+	if n := forwarded.Load(); n != 1 {
+		t.Errorf("Expected one forwarded request, got %d", n)
+	}
+
+	// Other forwarded endpoints aren't rate limited.
+	req := httptest.NewRequest(http.MethodGet, "/api/1/vehicles/"+testVIN+"/vehicle_data", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken("subject-1"))
+	rsp := httptest.NewRecorder()
+	p.ServeHTTP(rsp, req)
+	if rsp.Code != http.StatusOK {
+		t.Errorf("Expected vehicle_data to succeed, got %d", rsp.Code)
+	}
+}
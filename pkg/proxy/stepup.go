@@ -0,0 +1,385 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TOTPHeader contains a time-based one-time password (RFC 6238) for the request's OAuth
+	// subject.
+	TOTPHeader = "X-Tesla-Proxy-TOTP"
+
+	// ApprovalHeader contains a signature from an approval service. See SignApproval.
+	ApprovalHeader = "X-Tesla-Proxy-Approval"
+
+	// ConfirmationHeader contains a token issued by the proxy in response to an unconfirmed
+	// request.
+	ConfirmationHeader = "X-Tesla-Proxy-Confirmation"
+
+	// DefaultConfirmationTTL is a suggested value for StepUp.ConfirmationTTL.
+	DefaultConfirmationTTL = 2 * time.Minute
+
+	// ApprovalMaxAge is how long a signature in an ApprovalHeader remains valid.
+	ApprovalMaxAge = time.Minute
+
+	totpPeriod = 30 // seconds
+)
+
+// Second factors recorded in AuditRecord.StepUp.
+const (
+	StepUpTOTP         = "totp"
+	StepUpApproval     = "approval"
+	StepUpConfirmation = "confirmation"
+)
+
+var (
+	// ErrStepUpRequired indicates a command requires a second factor that the request did not
+	// include.
+	ErrStepUpRequired = errors.New("command requires step-up confirmation")
+
+	// ErrStepUpFailed indicates a request included an invalid, expired, or previously used second
+	// factor.
+	ErrStepUpFailed = errors.New("step-up confirmation failed")
+)
+
+// DefaultStepUpCommands are the commands that require a second factor if StepUp.Commands is nil.
+var DefaultStepUpCommands = []string{
+	"door_unlock",
+	"remote_start_drive",
+	"erase_user_data",
+	"reset_valet_pin",
+	"reset_pin_to_drive_pin",
+	"clear_pin_to_drive_admin",
+}
+
+// StepUp requires a second factor, in addition to an OAuth token, before the proxy sends
+// high-risk commands. A request for such a command must include one of:
+//
+//   - A TOTPHeader with a current code for the OAuth subject's secret in TOTPSecrets.
+//   - An ApprovalHeader signed with ApprovalSecret.
+//   - A ConfirmationHeader with a token issued by the proxy. If ConfirmationTTL is not zero, the
+//     proxy responds to requests that don't include a second factor with 428 Precondition
+//     Required and issues a token that confirms the same command, with the same parameters, for
+//     ConfirmationTTL.
+//
+// Each code, signature, and token is accepted once. At most one confirmation is pending for each
+// subject, VIN, and command: repeating an unconfirmed request returns the pending confirmation
+// again, and a request with different parameters replaces it.
+type StepUp struct {
+	// Commands lists the commands that require a second factor. If nil, DefaultStepUpCommands is
+	// used.
+	Commands []string
+
+	// TOTPSecrets maps OAuth subjects to their TOTP secrets.
+	TOTPSecrets map[string][]byte
+
+	// ApprovalSecret is the HMAC key shared with an approval service.
+	ApprovalSecret []byte
+
+	// ConfirmationTTL is how long confirmation tokens remain valid. If zero, the proxy doesn't
+	// issue confirmation tokens.
+	ConfirmationTTL time.Duration
+
+	// ConfirmationWebhook, if not nil, receives a PendingConfirmation for each new token the proxy
+	// issues, and the token is not returned to the client. This lets an out-of-band channel, such
+	// as a push notification to the vehicle owner, deliver the token. If nil, the token is
+	// returned to the client, which protects against accidental commands but not against stolen
+	// OAuth tokens.
+	ConfirmationWebhook *Webhook
+
+	lock      sync.Mutex
+	pending   map[string]*PendingConfirmation
+	tokens    map[string]string    // Pending token for each subject, VIN, and command.
+	usedTOTP  map[string]int64     // Most recent time step accepted for each subject.
+	usedMACs  map[string]time.Time // Approvals that have been accepted, and when they expire.
+	lastPurge time.Time
+}
+
+// PendingConfirmation describes a command that the proxy will send once the client presents
+// Token in a ConfirmationHeader.
+type PendingConfirmation struct {
+	Token     string    `json:"token,omitempty"`
+	Subject   string    `json:"subject"`
+	VIN       string    `json:"vin"`
+	Command   string    `json:"command"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	bodyHash [sha256.Size]byte
+	repeated bool // Set on copies returned for a request that matched an existing confirmation.
+}
+
+// pendingKey identifies the command confirmed by a PendingConfirmation.
+func pendingKey(subject, vin, command string) string {
+	return subject + "\n" + vin + "\n" + command
+}
+
+// TOTPCode returns the RFC 6238 code (HMAC-SHA1, 30-second period, 6 digits) for secret at time
+// t.
+func TOTPCode(secret []byte, t time.Time) string {
+	return totpCodeForStep(secret, t.Unix()/totpPeriod)
+}
+
+func totpCodeForStep(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// approvalMessage returns the data covered by an ApprovalHeader signature.
+func approvalMessage(subject, vin, command string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	return []byte(strings.Join([]string{subject, vin, command, hex.EncodeToString(bodyHash[:])}, "\n"))
+}
+
+// SignApproval returns an ApprovalHeader value that authorizes subject to send command, with
+// the JSON-encoded parameters in body, to vin. The header has the same format as a
+// WebhookSignatureHeader: "t=<unix timestamp>,v1=<hex HMAC-SHA256>", where the HMAC covers the
+// timestamp, a period, and the subject, VIN, command, and hex SHA-256 hash of body, separated by
+// newlines.
+func SignApproval(secret []byte, subject, vin, command string, body []byte, t time.Time) string {
+	timestamp := t.Unix()
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, signWebhook(secret, timestamp, approvalMessage(subject, vin, command, body)))
+}
+
+func (s *StepUp) requires(command string) bool {
+	commands := s.Commands
+	if commands == nil {
+		commands = DefaultStepUpCommands
+	}
+	return slices.Contains(commands, command)
+}
+
+// remove deletes a pending confirmation. The caller must hold s.lock.
+func (s *StepUp) remove(token string, pending *PendingConfirmation) {
+	delete(s.pending, token)
+	key := pendingKey(pending.Subject, pending.VIN, pending.Command)
+	if s.tokens[key] == token {
+		delete(s.tokens, key)
+	}
+}
+
+// purge removes expired state. The caller must hold s.lock.
+func (s *StepUp) purge(now time.Time) {
+	if now.Sub(s.lastPurge) < time.Minute {
+		return
+	}
+	s.lastPurge = now
+	for token, pending := range s.pending {
+		if now.After(pending.ExpiresAt) {
+			s.remove(token, pending)
+		}
+	}
+	for signature, expires := range s.usedMACs {
+		if now.After(expires) {
+			delete(s.usedMACs, signature)
+		}
+	}
+}
+
+func (s *StepUp) checkTOTP(subject, code string, now time.Time) bool {
+	secret, ok := s.TOTPSecrets[subject]
+	if !ok || len(secret) == 0 {
+		return false
+	}
+	current := now.Unix() / totpPeriod
+	// Allow one period of clock skew in either direction.
+	for step := current - 1; step <= current+1; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCodeForStep(secret, step)), []byte(code)) != 1 {
+			continue
+		}
+		if s.usedTOTP == nil {
+			s.usedTOTP = make(map[string]int64)
+		}
+		if last, ok := s.usedTOTP[subject]; ok && step <= last {
+			return false
+		}
+		s.usedTOTP[subject] = step
+		return true
+	}
+	return false
+}
+
+func (s *StepUp) checkApproval(header string, message []byte, now time.Time) bool {
+	if len(s.ApprovalSecret) == 0 {
+		return false
+	}
+	if err := VerifyWebhookSignature(s.ApprovalSecret, header, message, ApprovalMaxAge); err != nil {
+		return false
+	}
+	// The header can be encoded in several equivalent ways, so identify the approval by what was
+	// signed instead.
+	timestamp, _ := parseSignatureHeader(header)
+	digest := sha256.Sum256(message)
+	approvalID := fmt.Sprintf("%d.%x", timestamp, digest)
+	if s.usedMACs == nil {
+		s.usedMACs = make(map[string]time.Time)
+	}
+	if _, ok := s.usedMACs[approvalID]; ok {
+		return false
+	}
+	s.usedMACs[approvalID] = now.Add(2 * ApprovalMaxAge)
+	return true
+}
+
+func (s *StepUp) checkConfirmation(token, subject, vin, command string, body []byte, now time.Time) bool {
+	pending, ok := s.pending[token]
+	if !ok {
+		return false
+	}
+	s.remove(token, pending)
+	return now.Before(pending.ExpiresAt) &&
+		pending.Subject == subject && pending.VIN == vin && pending.Command == command &&
+		pending.bodyHash == sha256.Sum256(body)
+}
+
+// prepare returns a copy of the confirmation pending for subject, vin, and command. If there isn't
+// one, or it confirms different parameters, prepare replaces it with a new confirmation.
+func (s *StepUp) prepare(subject, vin, command string, body []byte, now time.Time) (*PendingConfirmation, error) {
+	key := pendingKey(subject, vin, command)
+	bodyHash := sha256.Sum256(body)
+	if token, ok := s.tokens[key]; ok {
+		existing := s.pending[token]
+		if now.Before(existing.ExpiresAt) && existing.bodyHash == bodyHash {
+			issued := *existing
+			issued.repeated = true
+			return &issued, nil
+		}
+		s.remove(token, existing)
+	}
+	var tokenBytes [16]byte
+	if _, err := rand.Read(tokenBytes[:]); err != nil {
+		return nil, err
+	}
+	pending := &PendingConfirmation{
+		Token:     hex.EncodeToString(tokenBytes[:]),
+		Subject:   subject,
+		VIN:       vin,
+		Command:   command,
+		ExpiresAt: now.Add(s.ConfirmationTTL),
+		bodyHash:  bodyHash,
+	}
+	if s.pending == nil {
+		s.pending = make(map[string]*PendingConfirmation)
+		s.tokens = make(map[string]string)
+	}
+	s.pending[pending.Token] = pending
+	s.tokens[key] = pending.Token
+	issued := *pending
+	return &issued, nil
+}
+
+// verify checks the second factor in req, if command requires one. It returns the type of
+// factor used, or an empty string if none was required. If no factor was provided and
+// confirmation tokens are enabled, it returns the PendingConfirmation for the request along with
+// ErrStepUpRequired.
+func (s *StepUp) verify(req *http.Request, subject, vin, command string, body []byte) (string, *PendingConfirmation, error) {
+	if !s.requires(command) {
+		return "", nil, nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	s.purge(now)
+
+	totp := req.Header.Get(TOTPHeader)
+	approval := req.Header.Get(ApprovalHeader)
+	confirmation := req.Header.Get(ConfirmationHeader)
+	switch {
+	case totp != "":
+		if s.checkTOTP(subject, totp, now) {
+			return StepUpTOTP, nil, nil
+		}
+	case approval != "":
+		if s.checkApproval(approval, approvalMessage(subject, vin, command, body), now) {
+			return StepUpApproval, nil, nil
+		}
+	case confirmation != "":
+		if s.checkConfirmation(confirmation, subject, vin, command, body, now) {
+			return StepUpConfirmation, nil, nil
+		}
+	default:
+		if s.ConfirmationTTL <= 0 {
+			return "", nil, ErrStepUpRequired
+		}
+		pending, err := s.prepare(subject, vin, command, body, now)
+		if err != nil {
+			return "", nil, err
+		}
+		return "", pending, ErrStepUpRequired
+	}
+	return "", nil, ErrStepUpFailed
+}
+
+// checkStepUp enforces p.StepUp before a command is sent. If it returns an error, it has already
+// written a response to w.
+func (p *Proxy) checkStepUp(w http.ResponseWriter, req *http.Request, record *AuditRecord, command, vin string) error {
+	if p.StepUp == nil {
+		return nil
+	}
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(req.Body, MaxResponseLength))
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			writeJSONError(w, p.logger(), http.StatusBadRequest, err)
+			return err
+		}
+	}
+	factor, pending, err := p.StepUp.verify(req, record.Subject, vin, command, body)
+	record.StepUp = factor
+	if errors.Is(err, ErrStepUpFailed) {
+		p.logger().Warning("Step-up confirmation of %s on %s failed for subject %s", command, vin, record.Subject)
+		writeJSONError(w, p.logger(), http.StatusForbidden, err)
+		return err
+	}
+	if errors.Is(err, ErrStepUpRequired) {
+		reply := Response{Error: err.Error(), Details: describeError(http.StatusPreconditionRequired, err)}
+		if pending != nil {
+			issued := *pending
+			if p.StepUp.ConfirmationWebhook != nil {
+				// Repeated requests don't notify the owner again.
+				if !pending.repeated {
+					notification := *pending
+					go p.StepUp.ConfirmationWebhook.send(&notification, "confirmation of "+command, p.logger())
+				}
+				issued.Token = ""
+			}
+			reply.Response = map[string]*PendingConfirmation{"confirmation": &issued}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusPreconditionRequired)
+		_ = json.NewEncoder(w).Encode(&reply)
+		return err
+	}
+	if err != nil {
+		writeJSONError(w, p.logger(), http.StatusInternalServerError, err)
+		return err
+	}
+	if factor != "" {
+		p.logger().Info("Subject %s confirmed %s on %s using %s", record.Subject, command, vin, factor)
+	}
+	return nil
+}
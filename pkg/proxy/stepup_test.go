@@ -0,0 +1,162 @@
+package proxy_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/teslamotors/vehicle-command/pkg/proxy"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// Test vector from RFC 6238, truncated to six digits.
+	secret := []byte("12345678901234567890")
+	if code := proxy.TOTPCode(secret, time.Unix(59, 0)); code != "287082" {
+		t.Errorf("Expected 287082, got %s", code)
+	}
+	if code := proxy.TOTPCode(secret, time.Unix(1111111109, 0)); code != "081804" {
+		t.Errorf("Expected 081804, got %s", code)
+	}
+}
+
+func TestStepUp(t *testing.T) {
+	totpSecret := []byte("totp-secret")
+	approvalSecret := []byte("approval-secret")
+	p, err := proxy.New(context.Background(), newTestKey(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.StepUp = &proxy.StepUp{
+		TOTPSecrets:     map[string][]byte{"subject-1": totpSecret},
+		ApprovalSecret:  approvalSecret,
+		ConfirmationTTL: time.Minute,
+	}
+
+	// GET requests for commands are rejected with 405 after step-up checks pass but before the
+	// proxy contacts Fleet API.
+	send := func(command, header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/1/vehicles/"+testVIN+"/command/"+command, nil)
+		req.Header.Set("Authorization", "Bearer "+testToken("subject-1"))
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		rsp := httptest.NewRecorder()
+		p.ServeHTTP(rsp, req)
+		return rsp
+	}
+	expect := func(description string, rsp *httptest.ResponseRecorder, status int) {
+		t.Helper()
+		if rsp.Code != status {
+			t.Errorf("%s: expected status %d, got %d (%s)", description, status, rsp.Code, rsp.Body.String())
+		}
+	}
+
+	expect("command without step-up", send("honk_horn", "", ""), http.StatusMethodNotAllowed)
+
+	rsp := send("door_unlock", "", "")
+	expect("missing second factor", rsp, http.StatusPreconditionRequired)
+	var reply struct {
+		Response struct {
+			Confirmation proxy.PendingConfirmation `json:"confirmation"`
+		} `json:"response"`
+		Details proxy.ErrorDetails `json:"error_details"`
+	}
+	if err := json.Unmarshal(rsp.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	token := reply.Response.Confirmation.Token
+	if token == "" || reply.Details.Code != proxy.CodeStepUpRequired {
+		t.Fatalf("Expected confirmation token, got %s", rsp.Body.String())
+	}
+	expect("confirmation for other command", send("remote_start_drive", proxy.ConfirmationHeader, token), http.StatusForbidden)
+	// Failed attempts consume the token.
+	expect("consumed confirmation", send("door_unlock", proxy.ConfirmationHeader, token), http.StatusForbidden)
+
+	rsp = send("door_unlock", "", "")
+	if err := json.Unmarshal(rsp.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	expect("confirmation", send("door_unlock", proxy.ConfirmationHeader, reply.Response.Confirmation.Token), http.StatusMethodNotAllowed)
+
+	code := proxy.TOTPCode(totpSecret, time.Now())
+	expect("wrong TOTP", send("door_unlock", proxy.TOTPHeader, "000000"+code), http.StatusForbidden)
+	expect("TOTP", send("door_unlock", proxy.TOTPHeader, code), http.StatusMethodNotAllowed)
+	expect("replayed TOTP", send("door_unlock", proxy.TOTPHeader, code), http.StatusForbidden)
+
+	approval := proxy.SignApproval(approvalSecret, "subject-1", testVIN, "erase_user_data", nil, time.Now())
+	expect("approval for other command", send("door_unlock", proxy.ApprovalHeader, approval), http.StatusForbidden)
+	expect("approval", send("erase_user_data", proxy.ApprovalHeader, approval), http.StatusMethodNotAllowed)
+	expect("replayed approval", send("erase_user_data", proxy.ApprovalHeader, " "+approval), http.StatusForbidden)
+	expired := proxy.SignApproval(approvalSecret, "subject-1", testVIN, "erase_user_data", nil, time.Now().Add(-2*proxy.ApprovalMaxAge))
+	expect("expired approval", send("erase_user_data", proxy.ApprovalHeader, expired), http.StatusForbidden)
+}
+
+func TestStepUpPendingConfirmations(t *testing.T) {
+	notifications := make(chan proxy.PendingConfirmation, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var pending proxy.PendingConfirmation
+		if err := json.NewDecoder(req.Body).Decode(&pending); err != nil {
+			t.Error(err)
+		}
+		notifications <- pending
+	}))
+	defer webhook.Close()
+
+	p, err := proxy.New(context.Background(), newTestKey(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.StepUp = &proxy.StepUp{
+		ConfirmationTTL:     time.Minute,
+		ConfirmationWebhook: &proxy.Webhook{URL: webhook.URL},
+	}
+	send := func(body, token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/1/vehicles/"+testVIN+"/command/door_unlock", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+testToken("subject-1"))
+		if token != "" {
+			req.Header.Set(proxy.ConfirmationHeader, token)
+		}
+		rsp := httptest.NewRecorder()
+		p.ServeHTTP(rsp, req)
+		return rsp.Code
+	}
+	notification := func() string {
+		t.Helper()
+		select {
+		case pending := <-notifications:
+			return pending.Token
+		case <-time.After(5 * time.Second):
+			t.Fatal("Webhook wasn't notified")
+		}
+		return ""
+	}
+
+	for i := 0; i < 3; i++ {
+		if status := send("{}", ""); status != http.StatusPreconditionRequired {
+			t.Fatalf("Expected status %d, got %d", http.StatusPreconditionRequired, status)
+		}
+	}
+	first := notification()
+	// Different parameters replace the pending confirmation.
+	send(`{"a":1}`, "")
+	second := notification()
+	select {
+	case <-notifications:
+		t.Error("Repeated requests sent more than one notification each")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if first == second {
+		t.Fatal("Replacement confirmation reused token")
+	}
+	if status := send("{}", first); status != http.StatusForbidden {
+		t.Errorf("Expected replaced token to be rejected, got %d", status)
+	}
+	if status := send(`{"a":1}`, second); status != http.StatusMethodNotAllowed {
+		t.Errorf("Expected current token to be accepted, got %d", status)
+	}
+}
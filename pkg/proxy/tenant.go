@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/teslamotors/vehicle-command/pkg/account"
+	"github.com/teslamotors/vehicle-command/pkg/cache"
+	"github.com/teslamotors/vehicle-command/pkg/protocol"
+)
+
+// TenantHeader selects the tenant whose keys are used to process a request. If absent, the
+// tenant is selected using the OAuth token's client_id and aud claims.
+const TenantHeader = "X-Tesla-Proxy-Tenant"
+
+var (
+	// ErrUnknownTenant indicates a request's TenantHeader doesn't match a tenant.
+	ErrUnknownTenant = errors.New("unknown tenant")
+
+	// ErrTenantNotAllowed indicates a request's TenantHeader selected a tenant that doesn't accept
+	// the request's OAuth client ID.
+	ErrTenantNotAllowed = errors.New("OAuth client is not allowed to use this tenant")
+
+	// ErrNoTenant indicates a request that must be signed doesn't match a tenant and the proxy
+	// doesn't have a default key to sign it with.
+	ErrNoTenant = errors.New("request does not match a tenant")
+)
+
+// TenantConfig describes an application that shares the proxy with other applications but has its
+// own command-authentication key enrolled on vehicles.
+type TenantConfig struct {
+	// Name identifies the tenant in TenantHeader values, logs, and audit records.
+	Name string
+
+	// CommandKey signs commands sent to vehicles on behalf of the tenant.
+	CommandKey protocol.ECDHPrivateKey
+
+	// TelemetryKey signs fleet telemetry configurations. If nil, CommandKey is used.
+	TelemetryKey protocol.ECDHPrivateKey
+
+	// ClientIDs are the OAuth client IDs (the token's client_id claim) that belong to the tenant.
+	// If not empty, requests that select the tenant using TenantHeader must use one of these
+	// client IDs.
+	ClientIDs []string
+
+	// Audiences selects the tenant for OAuth tokens that contain one of these values in their aud
+	// claim.
+	Audiences []string
+}
+
+// tenant holds the keys and session cache used for a request. The zero-value name is the proxy's
+// default tenant, which uses the key passed to New.
+type tenant struct {
+	TenantConfig
+	sessions *cache.SessionCache
+}
+
+func (t *tenant) telemetryKey() protocol.ECDHPrivateKey {
+	if t.TelemetryKey != nil {
+		return t.TelemetryKey
+	}
+	return t.CommandKey
+}
+
+// SetTelemetryKey sets the key used to sign fleet telemetry configurations for requests that
+// aren't routed to a tenant. By default, the key passed to New is used. A separate key is required
+// if that key can't create Schnorr signatures, as is the case for keys stored in PKCS#11 tokens.
+func (p *Proxy) SetTelemetryKey(key protocol.ECDHPrivateKey) {
+	p.defaultTenant.TelemetryKey = key
+}
+
+// AddTenant registers a tenant. Each tenant has a separate session cache, with the same capacity
+// as the cache of the proxy's default key. AddTenant should be called before p starts serving
+// requests.
+func (p *Proxy) AddTenant(config TenantConfig) error {
+	if config.Name == "" {
+		return errors.New("tenant name is required")
+	}
+	if config.CommandKey == nil {
+		return fmt.Errorf("tenant %s: %w", config.Name, protocol.ErrRequiresKey)
+	}
+	for _, t := range p.tenants {
+		if t.Name == config.Name {
+			return fmt.Errorf("tenant %s already exists", config.Name)
+		}
+	}
+	p.tenants = append(p.tenants, &tenant{
+		TenantConfig: config,
+		sessions:     cache.New(p.cacheSize),
+	})
+	return nil
+}
+
+// Tenants returns the names of tenants registered with AddTenant.
+func (p *Proxy) Tenants() []string {
+	names := make([]string, len(p.tenants))
+	for i, t := range p.tenants {
+		names[i] = t.Name
+	}
+	return names
+}
+
+// allTenants returns the default tenant followed by registered tenants.
+func (p *Proxy) allTenants() []*tenant {
+	return append([]*tenant{p.defaultTenant}, p.tenants...)
+}
+
+// selectTenant returns the tenant that should process req. Requests that don't match a registered
+// tenant use the default tenant, which has no keys if the proxy was created without a key; see
+// requireKey.
+func (p *Proxy) selectTenant(req *http.Request) (*tenant, error) {
+	var clientID string
+	var audiences []string
+	token, _ := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	// Invalid tokens are rejected by getAccount.
+	if claims, err := account.ParseClaims(token); err == nil {
+		clientID, audiences = claims.ClientID, claims.Audiences
+	}
+	if name := req.Header.Get(TenantHeader); name != "" {
+		for _, t := range p.tenants {
+			if t.Name != name {
+				continue
+			}
+			if len(t.ClientIDs) > 0 && !slices.Contains(t.ClientIDs, clientID) {
+				return nil, ErrTenantNotAllowed
+			}
+			return t, nil
+		}
+		return nil, ErrUnknownTenant
+	}
+	if clientID != "" {
+		for _, t := range p.tenants {
+			if slices.Contains(t.ClientIDs, clientID) {
+				return t, nil
+			}
+		}
+	}
+	for _, t := range p.tenants {
+		for _, aud := range audiences {
+			if slices.Contains(t.Audiences, aud) {
+				return t, nil
+			}
+		}
+	}
+	return p.defaultTenant, nil
+}
+
+// requireKey writes an error response and returns ErrNoTenant if t doesn't have a key for signing
+// commands. Requests that Fleet API processes without a signature don't need a key.
+func (p *Proxy) requireKey(w http.ResponseWriter, t *tenant) error {
+	if t.CommandKey == nil {
+		writeJSONError(w, p.logger(), http.StatusForbidden, ErrNoTenant)
+		return ErrNoTenant
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package proxy_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/teslamotors/vehicle-command/internal/authentication"
+	"github.com/teslamotors/vehicle-command/pkg/protocol"
+	"github.com/teslamotors/vehicle-command/pkg/proxy"
+)
+
+// testClientToken returns an unsigned OAuth token with a client_id claim.
+func testClientToken(subject, clientID string, audiences ...string) string {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"sub":       subject,
+		"client_id": clientID,
+		"aud":       audiences,
+	})
+	return "header." + base64.RawStdEncoding.EncodeToString(payload) + ".signature"
+}
+
+func newTestKey(t *testing.T) protocol.ECDHPrivateKey {
+	t.Helper()
+	key, err := authentication.NewECDHPrivateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestTenantSelection(t *testing.T) {
+	p, err := proxy.New(context.Background(), newTestKey(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	p.AuditLog = proxy.NewAuditLog(proxy.NewWriterAuditSink(&buffer), nil)
+
+	for _, config := range []proxy.TenantConfig{
+		{Name: "partner-a", ClientIDs: []string{"client-a"}},
+		{Name: "partner-b", Audiences: []string{"https://partner-b.example.com"}},
+	} {
+		if config.CommandKey, err = authentication.NewECDHPrivateKey(rand.Reader); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.AddTenant(config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.AddTenant(proxy.TenantConfig{Name: "partner-c"}); err == nil {
+		t.Error("Expected error when adding tenant without a key")
+	}
+	key, err := authentication.NewECDHPrivateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddTenant(proxy.TenantConfig{Name: "partner-a", CommandKey: key}); err == nil {
+		t.Error("Expected error when adding duplicate tenant")
+	}
+	if names := p.Tenants(); len(names) != 2 {
+		t.Errorf("Expected two tenants, got %v", names)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		status int
+		tenant string
+	}{
+		{"default", testToken("subject-1"), "", http.StatusMethodNotAllowed, ""},
+		{"client ID", testClientToken("subject-1", "client-a"), "", http.StatusMethodNotAllowed, "partner-a"},
+		{"audience", testClientToken("subject-1", "client-c", "https://partner-b.example.com"), "", http.StatusMethodNotAllowed, "partner-b"},
+		{"header", testToken("subject-1"), "partner-b", http.StatusMethodNotAllowed, "partner-b"},
+		{"header with client ID", testClientToken("subject-1", "client-a"), "partner-a", http.StatusMethodNotAllowed, "partner-a"},
+		{"header with wrong client ID", testClientToken("subject-1", "client-b"), "partner-a", http.StatusForbidden, ""},
+		{"unknown tenant", testToken("subject-1"), "partner-c", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		buffer.Reset()
+		// GET requests for commands are rejected after the tenant is selected but before the
+		// proxy contacts Fleet API.
+		req := httptest.NewRequest(http.MethodGet, "/api/1/vehicles/"+testVIN+"/command/honk_horn", nil)
+		req.Header.Set("Authorization", "Bearer "+test.token)
+		if test.header != "" {
+			req.Header.Set(proxy.TenantHeader, test.header)
+		}
+		rsp := httptest.NewRecorder()
+		p.ServeHTTP(rsp, req)
+		if rsp.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, rsp.Code)
+			continue
+		}
+		records := readAuditRecords(t, buffer.Bytes())
+		if len(records) != 1 || records[0].Tenant != test.tenant {
+			t.Errorf("%s: expected tenant %q, got %+v", test.name, test.tenant, records)
+		}
+	}
+}
+
+func TestTenantsWithoutDefaultKey(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"response":{}}`))
+	}))
+	defer server.Close()
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = server.Client().Transport
+	defer func() { http.DefaultTransport = defaultTransport }()
+
+	p, err := proxy.New(context.Background(), nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetSubjectHost("subject-1", strings.TrimPrefix(server.URL, "https://"))
+	if err := p.AddTenant(proxy.TenantConfig{Name: "partner-a", ClientIDs: []string{"client-a"}, CommandKey: newTestKey(t)}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"tenant", testClientToken("subject-1", "client-a"), http.MethodGet, "/api/1/vehicles/" + testVIN + "/command/honk_horn", "", http.StatusMethodNotAllowed},
+		{"command", testClientToken("subject-1", "client-b"), http.MethodPost, "/api/1/vehicles/" + testVIN + "/command/honk_horn", "", http.StatusForbidden},
+		// Requests that aren't signed are forwarded without a key.
+		{"vehicle data", testClientToken("subject-1", "client-b"), http.MethodGet, "/api/1/vehicles/" + testVIN + "/vehicle_data", "", http.StatusOK},
+		{"telemetry", testToken("subject-1"), http.MethodPost, "/api/1/vehicles/fleet_telemetry_config", `{"vins": ["` + testVIN + `"], "config": {}}`, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		req.Header.Set("Authorization", "Bearer "+test.token)
+		rsp := httptest.NewRecorder()
+		p.ServeHTTP(rsp, req)
+		if rsp.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, rsp.Code)
+		}
+		if test.status == http.StatusForbidden && !strings.Contains(rsp.Body.String(), proxy.ErrNoTenant.Error()) {
+			t.Errorf("%s: expected ErrNoTenant, got %s", test.name, rsp.Body.String())
+		}
+	}
+}
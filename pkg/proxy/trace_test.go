@@ -0,0 +1,40 @@
+package proxy_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/teslamotors/vehicle-command/pkg/proxy"
+	"github.com/teslamotors/vehicle-command/pkg/trace"
+)
+
+func TestProxyPropagatesTraceContext(t *testing.T) {
+	exporter := trace.NewInMemoryExporter()
+	trace.SetExporter(exporter)
+	defer trace.SetExporter(nil)
+
+	p, err := proxy.New(context.Background(), newTestKey(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Policy = newTestPolicyStore(t, `{"rules": []}`)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/1/vehicles/"+testVIN+"/command/honk_horn", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken("subject-1"))
+	req.Header.Set(trace.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	p.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := exporter.Spans()
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.SpanContext.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || span.Parent.SpanID.String() != "00f067aa0ba902b7" {
+		t.Errorf("Span did not continue incoming trace: %+v", span)
+	}
+	if span.Attributes[trace.AttrVIN] != testVIN || span.Attributes[trace.AttrCommand] != "honk_horn" || span.Attributes[trace.AttrHTTPStatus] != http.StatusForbidden {
+		t.Errorf("Unexpected span attributes: %+v", span.Attributes)
+	}
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/teslamotors/vehicle-command/pkg/account"
+)
+
+const (
+	// vehicleListTTL is how long the proxy uses a subject's vehicle list to resolve vehicle IDs.
+	vehicleListTTL = time.Hour
+	// vehicleListRefreshInterval limits how often an unknown vehicle ID causes the proxy to fetch
+	// a subject's vehicle list again.
+	vehicleListRefreshInterval = time.Minute
+)
+
+var (
+	// ErrUnknownVehicleID indicates a request path contained a Fleet API vehicle ID that isn't on
+	// the OAuth token's account.
+	ErrUnknownVehicleID = errors.New("vehicle ID not found on account")
+
+	errInvalidVehicle = errors.New("expected 17-character VIN or numeric vehicle ID in path")
+)
+
+// vehicleList maps the Fleet API vehicle IDs on a subject's account to VINs. It's not modified
+// after it's stored in Proxy.vehicleLists.
+type vehicleList struct {
+	vins    map[string]string
+	fetched time.Time
+}
+
+// isVehicleID returns true if s has the format of a Fleet API vehicle ID.
+func isVehicleID(s string) bool {
+	_, err := strconv.ParseUint(s, 10, 64)
+	return err == nil
+}
+
+// resolveVIN returns the VIN identified by vehicle, which is either a VIN or a numeric Fleet API
+// vehicle ID. Vehicle IDs are resolved using the vehicle list of acct, which is cached for each
+// OAuth subject.
+func (p *Proxy) resolveVIN(ctx context.Context, acct *account.Account, vehicle string) (string, error) {
+	if len(vehicle) == vinLength {
+		return vehicle, nil
+	}
+	if !isVehicleID(vehicle) {
+		return "", errInvalidVehicle
+	}
+
+	now := time.Now()
+	if value, ok := p.vehicleLists.Load(acct.Subject); ok {
+		list := value.(*vehicleList)
+		age := now.Sub(list.fetched)
+		if vin, ok := list.vins[vehicle]; ok && age < vehicleListTTL {
+			return vin, nil
+		}
+		if age < vehicleListRefreshInterval {
+			return "", ErrUnknownVehicleID
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+	vehicles, err := acct.Vehicles(ctx)
+	if err != nil {
+		return "", err
+	}
+	list := &vehicleList{vins: make(map[string]string), fetched: now}
+	for _, v := range vehicles {
+		list.vins[strconv.FormatInt(v.ID, 10)] = v.VIN
+	}
+	p.storeVehicleList(acct.Subject, list)
+	p.logger().Debug("Fetched %d vehicles for subject %s", len(vehicles), acct.Subject)
+
+	if vin, ok := list.vins[vehicle]; ok {
+		return vin, nil
+	}
+	return "", ErrUnknownVehicleID
+}
+
+// storeVehicleList caches list for subject and discards expired lists.
+func (p *Proxy) storeVehicleList(subject string, list *vehicleList) {
+	p.vehicleLists.Range(func(key, value any) bool {
+		if list.fetched.Sub(value.(*vehicleList).fetched) >= vehicleListTTL {
+			p.vehicleLists.CompareAndDelete(key, value)
+		}
+		return true
+	})
+	p.vehicleLists.Store(subject, list)
+}
@@ -0,0 +1,78 @@
+package proxy_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/teslamotors/vehicle-command/pkg/proxy"
+)
+
+func TestVehicleIDs(t *testing.T) {
+	var listRequests atomic.Int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/1/vehicles" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		listRequests.Add(1)
+		w.Write([]byte(`{"response":[{"id":1234567890123,"id_s":"1234567890123","vin":"` + testVIN + `"}],"pagination":{"next":null}}`))
+	}))
+	defer server.Close()
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = server.Client().Transport
+	defer func() { http.DefaultTransport = defaultTransport }()
+
+	p, err := proxy.New(context.Background(), newTestKey(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	p.AuditLog = proxy.NewAuditLog(proxy.NewWriterAuditSink(&buffer), nil)
+	host := strings.TrimPrefix(server.URL, "https://")
+	p.SetSubjectHost("subject-1", host)
+	p.SetSubjectHost("subject-2", host)
+
+	send := func(subject, vehicle string) int {
+		buffer.Reset()
+		// GET requests for commands are rejected with 405 after the VIN is resolved but before
+		// the proxy contacts the vehicle.
+		req := httptest.NewRequest(http.MethodGet, "/api/1/vehicles/"+vehicle+"/command/honk_horn", nil)
+		req.Header.Set("Authorization", "Bearer "+testToken(subject))
+		rsp := httptest.NewRecorder()
+		p.ServeHTTP(rsp, req)
+		return rsp.Code
+	}
+
+	if status := send("subject-1", "1234567890123"); status != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected status %d, got %d", http.StatusMethodNotAllowed, status)
+	}
+	if records := readAuditRecords(t, buffer.Bytes()); len(records) != 1 || records[0].VIN != testVIN {
+		t.Errorf("Expected audit record for %s, got %+v", testVIN, records)
+	}
+	if status := send("subject-1", "1234567890123"); status != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status %d, got %d", http.StatusMethodNotAllowed, status)
+	}
+	if status := send("subject-1", "999"); status != http.StatusNotFound {
+		t.Errorf("Expected status %d for unknown vehicle ID, got %d", http.StatusNotFound, status)
+	}
+	if n := listRequests.Load(); n != 1 {
+		t.Errorf("Expected vehicle list to be cached, but it was fetched %d times", n)
+	}
+
+	// Vehicle lists are cached per subject.
+	if status := send("subject-2", "1234567890123"); status != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status %d, got %d", http.StatusMethodNotAllowed, status)
+	}
+	if n := listRequests.Load(); n != 2 {
+		t.Errorf("Expected vehicle list to be fetched for second subject, got %d fetches", n)
+	}
+
+	if status := send("subject-1", "not-a-vin"); status != http.StatusNotFound {
+		t.Errorf("Expected status %d for invalid vehicle, got %d", http.StatusNotFound, status)
+	}
+}
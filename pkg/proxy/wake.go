@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/teslamotors/vehicle-command/pkg/connector/inet"
+	"github.com/teslamotors/vehicle-command/pkg/vehicle"
+)
+
+const (
+	// WakeHeader enables ("true") or disables ("false") automatic wake-up for a request,
+	// overriding Proxy.AutoWake.
+	WakeHeader = "X-Tesla-Proxy-Wake"
+
+	// WakeStatusHeader is included in responses to commands for which the proxy tried to wake the
+	// vehicle. Its value is WakeStatusWoke or WakeStatusFailed.
+	WakeStatusHeader = "X-Tesla-Proxy-Wake-Status"
+
+	// ServerTimingHeader reports how long the proxy spent waking the vehicle, establishing a
+	// session, and waiting for the vehicle to execute a command, using the standard Server-Timing
+	// format. For example: "wake;dur=12034, handshake;dur=412, command;dur=530".
+	ServerTimingHeader = "Server-Timing"
+
+	// DefaultWakeTimeout is the default value of Proxy.WakeTimeout. Fleet API typically reports
+	// a vehicle online within 30 seconds of being woken.
+	DefaultWakeTimeout = 90 * time.Second
+)
+
+// WakeStatusHeader values.
+const (
+	WakeStatusWoke   = "woke"
+	WakeStatusFailed = "failed"
+)
+
+// wakeRetrier sends vehicle operations, waking the vehicle at most once if an operation fails
+// because the vehicle is asleep.
+type wakeRetrier struct {
+	proxy     *Proxy
+	car       *vehicle.Vehicle
+	w         http.ResponseWriter
+	enabled   bool
+	attempted bool
+}
+
+// wakeEnabled returns true if the proxy should wake the vehicle before executing the command in
+// req.
+func (p *Proxy) wakeEnabled(req *http.Request) (bool, error) {
+	value := req.Header.Get(WakeHeader)
+	if value == "" {
+		return p.AutoWake, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s header: %q", WakeHeader, value)
+	}
+	return enabled, nil
+}
+
+// commandTimeout returns the deadline for queuing, waking, handshaking, and executing a command.
+func (p *Proxy) commandTimeout(wake bool) time.Duration {
+	if wake && p.WakeTimeout > p.Timeout {
+		return p.WakeTimeout
+	}
+	return p.Timeout
+}
+
+// addServerTiming adds the time elapsed since start to the response's ServerTimingHeader.
+func addServerTiming(w http.ResponseWriter, phase string, start time.Time) {
+	w.Header().Add(ServerTimingHeader, fmt.Sprintf("%s;dur=%d", phase, time.Since(start).Milliseconds()))
+}
+
+// do calls op. If op fails because the vehicle is asleep, and automatic wake-up is enabled and
+// hasn't been attempted yet, do wakes the vehicle and calls op again. Fleet API rejects requests
+// for sleeping vehicles before delivering them, so repeating op doesn't execute a command twice.
+func (r *wakeRetrier) do(ctx context.Context, op func() error) error {
+	err := op()
+	if !r.enabled || r.attempted || !errors.Is(err, inet.ErrVehicleNotAwake) {
+		return err
+	}
+	r.attempted = true
+	vin := r.car.VIN()
+	r.proxy.logger().Info("Waking %s", vin)
+	r.proxy.setJobState(ctx, JobWaking)
+	start := time.Now()
+	err = r.car.Wakeup(ctx)
+	r.proxy.Metrics.observeDuration(metricPhaseDuration, start, PhaseWake)
+	addServerTiming(r.w, PhaseWake, start)
+	if err != nil {
+		r.w.Header().Set(WakeStatusHeader, WakeStatusFailed)
+		r.proxy.countUpstreamError(err)
+		return fmt.Errorf("could not wake vehicle: %w", err)
+	}
+	r.w.Header().Set(WakeStatusHeader, WakeStatusWoke)
+	r.proxy.logger().Info("%s is online after %s", vin, time.Since(start).Round(time.Millisecond))
+	return op()
+}
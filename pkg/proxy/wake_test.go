@@ -0,0 +1,92 @@
+package proxy_test
+
+import (
+	"context"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/teslamotors/vehicle-command/internal/authentication"
+	"github.com/teslamotors/vehicle-command/pkg/proxy"
+)
+
+func TestAutoWake(t *testing.T) {
+	var wakeRequests, commandRequests, commandsAfterWake atomic.Int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/wake_up"):
+			wakeRequests.Add(1)
+			w.Write([]byte(`{"response":{"state":"online"}}`))
+		case strings.HasSuffix(req.URL.Path, "/signed_command"):
+			// The vehicle never comes online from the perspective of signed commands, so the
+			// proxy should give up after one wake attempt.
+			commandRequests.Add(1)
+			if wakeRequests.Load() > 0 {
+				commandsAfterWake.Add(1)
+			}
+			w.WriteHeader(http.StatusRequestTimeout)
+			w.Write([]byte(`{"error":"vehicle unavailable: vehicle is offline or asleep"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = server.Client().Transport
+	defer func() { http.DefaultTransport = defaultTransport }()
+
+	key, err := authentication.NewECDHPrivateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := proxy.New(context.Background(), key, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetSubjectHost("subject-1", strings.TrimPrefix(server.URL, "https://"))
+	p.WakeTimeout = 10 * time.Second
+
+	send := func(wake string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/1/vehicles/"+testVIN+"/command/honk_horn", nil)
+		req.Header.Set("Authorization", "Bearer "+testToken("subject-1"))
+		if wake != "" {
+			req.Header.Set(proxy.WakeHeader, wake)
+		}
+		rsp := httptest.NewRecorder()
+		p.ServeHTTP(rsp, req)
+		return rsp
+	}
+
+	rsp := send("")
+	if rsp.Header().Get(proxy.WakeStatusHeader) != "" || wakeRequests.Load() != 0 {
+		t.Errorf("Proxy woke vehicle without being asked to")
+	}
+	if commandRequests.Load() == 0 {
+		t.Fatal("Proxy did not contact the vehicle")
+	}
+
+	rsp = send("true")
+	if status := rsp.Header().Get(proxy.WakeStatusHeader); status != proxy.WakeStatusWoke {
+		t.Errorf("Expected wake status %q, got %q", proxy.WakeStatusWoke, status)
+	}
+	if wakeRequests.Load() != 1 {
+		t.Errorf("Expected one wake request, got %d", wakeRequests.Load())
+	}
+	if commandsAfterWake.Load() == 0 {
+		t.Error("Proxy did not retry after waking the vehicle")
+	}
+	if timing := strings.Join(rsp.Header().Values(proxy.ServerTimingHeader), ", "); !strings.Contains(timing, "wake;dur=") {
+		t.Errorf("Expected wake phase in %s header, got %q", proxy.ServerTimingHeader, timing)
+	}
+	if !strings.Contains(rsp.Body.String(), `"vehicle_offline"`) {
+		t.Errorf("Expected vehicle_offline error, got %s", rsp.Body.String())
+	}
+
+	if rsp := send("maybe"); rsp.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for invalid %s header, got %d", http.StatusBadRequest, proxy.WakeHeader, rsp.Code)
+	}
+}
@@ -0,0 +1,18 @@
+// Package trace provides lightweight, optional tracing of vehicle commands.
+//
+// Tracing is disabled until a client calls [SetTracerProvider] or [SetExporter]. When tracing is
+// disabled, [Start] returns a nil [*Span], and all Span methods are no-ops on a nil receiver, so
+// instrumented code incurs negligible overhead.
+//
+// Applications that use OpenTelemetry pass their TracerProvider to [SetTracerProvider]. Each span
+// is then backed by an OpenTelemetry span, so spans from this module appear in the application's
+// traces, nested under any OpenTelemetry span in the context passed to Start. Applications that
+// don't use OpenTelemetry can receive finished spans by implementing [Exporter]. The
+// [InMemoryExporter] is intended for tests.
+//
+// Trace context is propagated over HTTP using the W3C traceparent header.
+//
+// Instrumented operations include Vehicle.Send, session handshakes, transmission of
+// individual messages, Fleet API requests, and BLE writes. Spans carry the attributes defined in
+// this package, such as the vehicle domain, request UUID, retry count, and vehicle fault codes.
+package trace
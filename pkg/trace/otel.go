@@ -0,0 +1,101 @@
+package trace
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentationName identifies this package as the instrumentation scope of spans sent to an
+// OpenTelemetry TracerProvider.
+const InstrumentationName = "github.com/teslamotors/vehicle-command/pkg/trace"
+
+var (
+	tracerLock sync.RWMutex
+	tracer     oteltrace.Tracer
+)
+
+// SetTracerProvider enables tracing and sends spans to provider, which is typically the
+// TracerProvider of an OpenTelemetry SDK. Passing nil stops sending spans to OpenTelemetry.
+//
+// When a TracerProvider is set, each span created by [Start] is backed by an OpenTelemetry span
+// and uses its trace and span IDs. Attributes, errors, and the end of the span are forwarded to
+// the OpenTelemetry span, and spans continue OpenTelemetry spans found in the context passed to
+// Start. A TracerProvider can be used alone or together with an [Exporter].
+func SetTracerProvider(provider oteltrace.TracerProvider) {
+	tracerLock.Lock()
+	defer tracerLock.Unlock()
+	if provider == nil {
+		tracer = nil
+	} else {
+		tracer = provider.Tracer(InstrumentationName)
+	}
+}
+
+func currentTracer() oteltrace.Tracer {
+	tracerLock.RLock()
+	defer tracerLock.RUnlock()
+	return tracer
+}
+
+// startOTel starts an OpenTelemetry span named name. If ctx doesn't contain an OpenTelemetry span
+// but parent is valid (for example, because it was extracted from an incoming request), the new
+// span is a child of parent.
+func startOTel(ctx context.Context, t oteltrace.Tracer, name string, parent SpanContext) (context.Context, oteltrace.Span) {
+	if !oteltrace.SpanContextFromContext(ctx).IsValid() && parent.IsValid() {
+		ctx = oteltrace.ContextWithRemoteSpanContext(ctx, toOTel(parent))
+	}
+	return t.Start(ctx, name)
+}
+
+func toOTel(sc SpanContext) oteltrace.SpanContext {
+	var flags oteltrace.TraceFlags
+	if sc.Sampled {
+		flags = oteltrace.FlagsSampled
+	}
+	return oteltrace.NewSpanContext(oteltrace.SpanContextConfig{
+		TraceID:    oteltrace.TraceID(sc.TraceID),
+		SpanID:     oteltrace.SpanID(sc.SpanID),
+		TraceFlags: flags,
+		Remote:     true,
+	})
+}
+
+func fromOTel(sc oteltrace.SpanContext) SpanContext {
+	return SpanContext{
+		TraceID: TraceID(sc.TraceID()),
+		SpanID:  SpanID(sc.SpanID()),
+		Sampled: sc.IsSampled(),
+	}
+}
+
+// otelAttribute converts an attribute value set by SetAttribute. Types without an OpenTelemetry
+// equivalent are recorded as strings.
+func otelAttribute(key string, value interface{}) attribute.KeyValue {
+	switch v := value.(type) {
+	case string:
+		return attribute.String(key, v)
+	case bool:
+		return attribute.Bool(key, v)
+	case int:
+		return attribute.Int(key, v)
+	case int32:
+		return attribute.Int64(key, int64(v))
+	case int64:
+		return attribute.Int64(key, v)
+	case uint32:
+		return attribute.Int64(key, int64(v))
+	case float64:
+		return attribute.Float64(key, v)
+	}
+	return attribute.String(key, fmt.Sprint(value))
+}
+
+func otelRecordError(span oteltrace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,137 @@
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// recordingProvider is a minimal OpenTelemetry TracerProvider that records spans in memory.
+type recordingProvider struct {
+	noop.TracerProvider
+	lock  sync.Mutex
+	spans []*recordingSpan
+}
+
+type recordingTracer struct {
+	noop.Tracer
+	provider *recordingProvider
+}
+
+type recordingSpan struct {
+	noop.Span
+	name       string
+	sc         oteltrace.SpanContext
+	parent     oteltrace.SpanContext
+	attributes map[attribute.Key]attribute.Value
+	status     codes.Code
+	ended      bool
+}
+
+func (p *recordingProvider) Tracer(string, ...oteltrace.TracerOption) oteltrace.Tracer {
+	return recordingTracer{provider: p}
+}
+
+func (t recordingTracer) Start(ctx context.Context, name string, _ ...oteltrace.SpanStartOption) (context.Context, oteltrace.Span) {
+	parent := oteltrace.SpanContextFromContext(ctx)
+	config := oteltrace.SpanContextConfig{TraceID: parent.TraceID(), TraceFlags: oteltrace.FlagsSampled}
+	if !parent.IsValid() {
+		_, _ = rand.Read(config.TraceID[:])
+	}
+	_, _ = rand.Read(config.SpanID[:])
+	span := &recordingSpan{
+		name:       name,
+		sc:         oteltrace.NewSpanContext(config),
+		parent:     parent,
+		attributes: make(map[attribute.Key]attribute.Value),
+	}
+	t.provider.lock.Lock()
+	t.provider.spans = append(t.provider.spans, span)
+	t.provider.lock.Unlock()
+	return oteltrace.ContextWithSpan(ctx, span), span
+}
+
+func (s *recordingSpan) SpanContext() oteltrace.SpanContext { return s.sc }
+func (s *recordingSpan) IsRecording() bool                  { return !s.ended }
+func (s *recordingSpan) End(...oteltrace.SpanEndOption)     { s.ended = true }
+func (s *recordingSpan) SetStatus(code codes.Code, _ string) {
+	s.status = code
+}
+func (s *recordingSpan) SetAttributes(kv ...attribute.KeyValue) {
+	for _, attr := range kv {
+		s.attributes[attr.Key] = attr.Value
+	}
+}
+
+func TestTracerProvider(t *testing.T) {
+	provider := &recordingProvider{}
+	exporter := NewInMemoryExporter()
+	SetTracerProvider(provider)
+	SetExporter(exporter)
+	defer SetTracerProvider(nil)
+	defer SetExporter(nil)
+
+	incoming := http.Header{}
+	incoming.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, parent := Start(Extract(context.Background(), incoming), "parent")
+	_, child := Start(ctx, "child")
+	child.SetAttribute(AttrRetryCount, 2)
+	child.RecordError(errors.New("busy"))
+	child.End()
+	parent.End()
+
+	if len(provider.spans) != 2 {
+		t.Fatalf("Expected 2 OpenTelemetry spans, got %d", len(provider.spans))
+	}
+	otelParent, otelChild := provider.spans[0], provider.spans[1]
+	if otelParent.parent.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || otelParent.parent.SpanID().String() != "00f067aa0ba902b7" || !otelParent.parent.IsRemote() {
+		t.Errorf("Remote parent not propagated: %+v", otelParent.parent)
+	}
+	if otelChild.parent.SpanID() != otelParent.sc.SpanID() {
+		t.Error("Child isn't a child of parent")
+	}
+	if !otelParent.ended || !otelChild.ended {
+		t.Error("Spans weren't ended")
+	}
+	if otelChild.attributes[AttrRetryCount].AsInt64() != 2 || otelChild.attributes[AttrError].AsString() != "busy" {
+		t.Errorf("Unexpected attributes %v", otelChild.attributes)
+	}
+	if otelChild.status != codes.Error {
+		t.Error("Error status not set")
+	}
+
+	// Spans use the OpenTelemetry IDs, so exported spans and outgoing headers match.
+	if fromOTel(otelChild.sc) != child.SpanContext() {
+		t.Error("Span doesn't use OpenTelemetry IDs")
+	}
+	if spans := exporter.Spans(); len(spans) != 2 || spans[0].Parent != parent.SpanContext() {
+		t.Errorf("Unexpected exported spans %+v", spans)
+	}
+	outgoing := http.Header{}
+	Inject(ctx, outgoing)
+	if expected := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + otelParent.sc.SpanID().String() + "-01"; outgoing.Get(TraceparentHeader) != expected {
+		t.Errorf("Expected traceparent %s, got %s", expected, outgoing.Get(TraceparentHeader))
+	}
+}
+
+func TestOTelParentContext(t *testing.T) {
+	provider := &recordingProvider{}
+	SetTracerProvider(provider)
+	defer SetTracerProvider(nil)
+
+	// Spans started by the application with OpenTelemetry are parents of spans started by Start.
+	ctx, appSpan := provider.Tracer("app").Start(context.Background(), "app")
+	_, span := Start(ctx, "Vehicle.Send")
+	span.End()
+	if len(provider.spans) != 2 || provider.spans[1].parent.SpanID() != appSpan.SpanContext().SpanID() {
+		t.Error("Span isn't a child of the application's OpenTelemetry span")
+	}
+}
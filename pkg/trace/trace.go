@@ -0,0 +1,304 @@
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	oteltrace "go.opentelemetry.io/otel/trace"
+
+	"github.com/teslamotors/vehicle-command/pkg/protocol"
+)
+
+// Span attributes set by this module.
+const (
+	AttrVIN           = "tesla.vin"
+	AttrDomain        = "tesla.domain"          // Vehicle subsystem that receives a message
+	AttrRequestUUID   = "tesla.request_uuid"    // Hex-encoded UUID of the RoutableMessage
+	AttrRetryCount    = "tesla.retry_count"     // Number of times an operation was retried
+	AttrFaultCode     = "tesla.fault_code"      // Fault reported by the vehicle, if any
+	AttrSessionCached = "tesla.session_cached"  // Whether a handshake was skipped because session state was cached
+	AttrCommand       = "tesla.command"         // Fleet API command name
+	AttrHTTPStatus    = "http.status_code"      // Status code returned by Fleet API
+	AttrError         = "error"                 // Error message
+	AttrBLEBlocks     = "tesla.ble.block_count" // Number of BLE characteristic writes
+)
+
+// TraceparentHeader is the W3C Trace Context header used to propagate spans over HTTP.
+const TraceparentHeader = "Traceparent"
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// SpanContext identifies a span and the trace it belongs to.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid returns true if s has non-zero trace and span IDs.
+func (s SpanContext) IsValid() bool {
+	return s.TraceID != TraceID{} && s.SpanID != SpanID{}
+}
+
+// SpanData is an immutable record of a completed span.
+type SpanData struct {
+	Name        string
+	SpanContext SpanContext
+	Parent      SpanContext
+	Start       time.Time
+	End         time.Time
+	Attributes  map[string]interface{}
+	Err         error
+}
+
+// Exporter receives completed spans. Implementations must be safe for concurrent use.
+type Exporter interface {
+	ExportSpan(span SpanData)
+}
+
+var (
+	exporterLock sync.RWMutex
+	exporter     Exporter
+)
+
+// SetExporter enables tracing and sends completed spans to e. Passing nil disables tracing.
+func SetExporter(e Exporter) {
+	exporterLock.Lock()
+	defer exporterLock.Unlock()
+	exporter = e
+}
+
+func currentExporter() Exporter {
+	exporterLock.RLock()
+	defer exporterLock.RUnlock()
+	return exporter
+}
+
+// Span represents an operation in progress. A nil *Span is valid and ignores all method calls.
+type Span struct {
+	exporter Exporter
+	otel     oteltrace.Span // Set if a TracerProvider was configured
+
+	lock sync.Mutex
+	data SpanData
+	done bool
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// Start creates a span named name. If ctx contains a span, the new span is its child. The returned
+// context contains the new span.
+//
+// If tracing is disabled (neither an Exporter nor a TracerProvider is set), Start returns ctx and a
+// nil *Span.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	e := currentExporter()
+	t := currentTracer()
+	if e == nil && t == nil {
+		return ctx, nil
+	}
+	span := &Span{exporter: e}
+	span.data.Name = name
+	span.data.Start = time.Now()
+	span.data.Parent = SpanContextFromContext(ctx)
+	if t != nil {
+		ctx, span.otel = startOTel(ctx, t, name, span.data.Parent)
+		// Non-recording OpenTelemetry spans may reuse the parent's IDs.
+		if sc := fromOTel(span.otel.SpanContext()); sc.IsValid() && sc.SpanID != span.data.Parent.SpanID {
+			span.data.SpanContext = sc
+		}
+	}
+	if !span.data.SpanContext.IsValid() {
+		if span.data.Parent.IsValid() {
+			span.data.SpanContext.TraceID = span.data.Parent.TraceID
+		} else {
+			_, _ = rand.Read(span.data.SpanContext.TraceID[:])
+		}
+		_, _ = rand.Read(span.data.SpanContext.SpanID[:])
+		span.data.SpanContext.Sampled = true
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SpanFromContext returns the span stored in ctx, or nil if there isn't one.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// SpanContextFromContext returns the SpanContext of the current span in ctx. If ctx does not
+// contain a local span, the method returns the remote SpanContext (if any) added by [Extract], or
+// else the context of the current OpenTelemetry span (if any).
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.SpanContext()
+	}
+	if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		return remote
+	}
+	return fromOTel(oteltrace.SpanContextFromContext(ctx))
+}
+
+// SpanContext returns the identifiers of s.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.SpanContext
+}
+
+// SetAttribute records a key-value pair on s. Setting the same key again overwrites the previous
+// value.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	if s.otel != nil {
+		s.otel.SetAttributes(otelAttribute(key, value))
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]interface{})
+	}
+	s.data.Attributes[key] = value
+}
+
+// RecordError marks s as failed. If the vehicle reported a fault, the fault code is recorded as
+// the AttrFaultCode attribute. RecordError does nothing if err is nil.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.SetAttribute(AttrError, err.Error())
+	if fault, _, ok := protocol.VehicleFault(err); ok {
+		s.SetAttribute(AttrFaultCode, fault)
+	}
+	if s.otel != nil {
+		otelRecordError(s.otel, err)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.data.Err = err
+}
+
+// End completes s and sends it to the exporter and TracerProvider. Calls after the first have no
+// effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if s.done {
+		s.lock.Unlock()
+		return
+	}
+	s.done = true
+	s.data.End = time.Now()
+	data := s.data
+	data.Attributes = make(map[string]interface{}, len(s.data.Attributes))
+	for key, value := range s.data.Attributes {
+		data.Attributes[key] = value
+	}
+	s.lock.Unlock()
+	if s.otel != nil {
+		s.otel.End()
+	}
+	if s.exporter != nil {
+		s.exporter.ExportSpan(data)
+	}
+}
+
+// Inject adds the span context from ctx to header as a W3C traceparent header. If ctx does not
+// contain a valid span context, header is not modified.
+func Inject(ctx context.Context, header http.Header) {
+	sc := SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	header.Set(TraceparentHeader, fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags))
+}
+
+// Extract returns a copy of ctx that contains the remote span context from header's W3C
+// traceparent header. Spans started from the returned context are children of the remote span.
+// If header doesn't contain a valid traceparent, Extract returns ctx.
+func Extract(ctx context.Context, header http.Header) context.Context {
+	sc, ok := parseTraceparent(header.Get(TraceparentHeader))
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+func parseTraceparent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	fields := strings.Split(strings.TrimSpace(value), "-")
+	if len(fields) < 4 || len(fields[0]) != 2 || fields[0] == "ff" || len(fields[3]) != 2 {
+		return sc, false
+	}
+	if fields[0] == "00" && len(fields) != 4 {
+		return sc, false
+	}
+	if n, err := hex.Decode(sc.TraceID[:], []byte(fields[1])); err != nil || n != len(sc.TraceID) || len(fields[1]) != 2*len(sc.TraceID) {
+		return sc, false
+	}
+	if n, err := hex.Decode(sc.SpanID[:], []byte(fields[2])); err != nil || n != len(sc.SpanID) || len(fields[2]) != 2*len(sc.SpanID) {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(fields[3])
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+// InMemoryExporter stores completed spans in memory. It's intended for tests.
+type InMemoryExporter struct {
+	lock  sync.Mutex
+	spans []SpanData
+}
+
+// NewInMemoryExporter returns an empty InMemoryExporter.
+func NewInMemoryExporter() *InMemoryExporter {
+	return &InMemoryExporter{}
+}
+
+// ExportSpan implements the Exporter interface.
+func (e *InMemoryExporter) ExportSpan(span SpanData) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+// Spans returns the spans exported so far, in the order they ended.
+func (e *InMemoryExporter) Spans() []SpanData {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]SpanData(nil), e.spans...)
+}
+
+// Reset discards all exported spans.
+func (e *InMemoryExporter) Reset() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.spans = nil
+}
@@ -0,0 +1,75 @@
+package trace
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestDisabled(t *testing.T) {
+	SetExporter(nil)
+	ctx, span := Start(context.Background(), "noop")
+	if span != nil {
+		t.Fatal("Expected nil span when tracing is disabled")
+	}
+	span.SetAttribute(AttrVIN, "x")
+	span.RecordError(context.Canceled)
+	span.End()
+	if SpanFromContext(ctx) != nil {
+		t.Error("Context should not contain a span")
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	exporter := NewInMemoryExporter()
+	SetExporter(exporter)
+	defer SetExporter(nil)
+
+	incoming := http.Header{}
+	incoming.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, parent := Start(Extract(context.Background(), incoming), "parent")
+	if parent.SpanContext().TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Remote trace ID not propagated: %s", parent.SpanContext().TraceID)
+	}
+	_, child := Start(ctx, "child")
+	child.SetAttribute(AttrRetryCount, 2)
+	child.End()
+	child.End()
+	parent.End()
+
+	spans := exporter.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(spans))
+	}
+	if spans[0].Name != "child" || spans[0].Parent != parent.SpanContext() || spans[0].Attributes[AttrRetryCount] != 2 {
+		t.Errorf("Unexpected child span %+v", spans[0])
+	}
+	if spans[1].Parent.SpanID.String() != "00f067aa0ba902b7" {
+		t.Errorf("Unexpected parent span %+v", spans[1])
+	}
+
+	outgoing := http.Header{}
+	Inject(ctx, outgoing)
+	expected := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + parent.SpanContext().SpanID.String() + "-01"
+	if got := outgoing.Get(TraceparentHeader); got != expected {
+		t.Errorf("Expected traceparent %s, got %s", expected, got)
+	}
+}
+
+func TestInvalidTraceparent(t *testing.T) {
+	invalid := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-zzf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	}
+	for _, value := range invalid {
+		if _, ok := parseTraceparent(value); ok {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package vehicle
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/teslamotors/vehicle-command/pkg/protocol"
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/keys"
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/vcsec"
+)
+
+// maxSlotRequests limits the number of whitelist slots KeyInventory fetches at the same time.
+const maxSlotRequests = 8
+
+// KeyNameResolver provides human-readable names for public keys, for example from an application's
+// own records of the keys it has enrolled.
+type KeyNameResolver interface {
+	// KeyNames returns a map from hex-encoded, uncompressed public keys to key names.
+	KeyNames(ctx context.Context) (map[string]string, error)
+}
+
+// KeyInventoryEntry describes a key in a vehicle's whitelist.
+type KeyInventoryEntry struct {
+	Slot        uint32
+	PublicKey   []byte // Uncompressed public key
+	Fingerprint string // See protocol.KeyFingerprint
+	Role        keys.Role
+	FormFactor  vcsec.KeyFormFactor
+	Name        string // Name registered with Tesla's servers, if known
+	Self        bool   // True if the key is the one v uses to authorize commands
+	Err         error  // Set if the slot couldn't be fetched, in which case other fields are empty
+}
+
+// roleName returns role as used on the tesla-control command line (e.g., "owner").
+func roleName(role keys.Role) string {
+	return strings.ToLower(strings.TrimPrefix(role.String(), "ROLE_"))
+}
+
+// formFactorName returns formFactor as used on the tesla-control command line (e.g., "cloud_key").
+func formFactorName(formFactor vcsec.KeyFormFactor) string {
+	return strings.ToLower(strings.TrimPrefix(formFactor.String(), "KEY_FORM_FACTOR_"))
+}
+
+// MarshalJSON encodes the entry using lowercase role and form factor names and a hex-encoded public
+// key.
+func (e KeyInventoryEntry) MarshalJSON() ([]byte, error) {
+	type entryJSON struct {
+		Slot        uint32 `json:"slot"`
+		PublicKey   string `json:"public_key,omitempty"`
+		Fingerprint string `json:"fingerprint,omitempty"`
+		Role        string `json:"role,omitempty"`
+		FormFactor  string `json:"form_factor,omitempty"`
+		Name        string `json:"name,omitempty"`
+		Self        bool   `json:"self,omitempty"`
+		Error       string `json:"error,omitempty"`
+	}
+	encoded := entryJSON{Slot: e.Slot, Name: e.Name, Self: e.Self}
+	if e.Err != nil {
+		encoded.Error = e.Err.Error()
+	} else {
+		encoded.PublicKey = hex.EncodeToString(e.PublicKey)
+		encoded.Fingerprint = e.Fingerprint
+		encoded.Role = roleName(e.Role)
+		encoded.FormFactor = formFactorName(e.FormFactor)
+	}
+	return json.Marshal(&encoded)
+}
+
+// KeyInventory lists the keys in a vehicle's whitelist, ordered by slot.
+type KeyInventory struct {
+	VIN     string              `json:"vin"`
+	Entries []KeyInventoryEntry `json:"keys"`
+	// NamesErr is set if key names were requested but couldn't be fetched, in which case entries
+	// are unnamed.
+	NamesErr error `json:"-"`
+}
+
+// Find returns the entry with the given public key, or nil if there isn't one.
+func (inv *KeyInventory) Find(publicBytes []byte) *KeyInventoryEntry {
+	for i := range inv.Entries {
+		if bytes.Equal(inv.Entries[i].PublicKey, publicBytes) {
+			return &inv.Entries[i]
+		}
+	}
+	return nil
+}
+
+// Err returns the first error encountered fetching a slot, if any.
+func (inv *KeyInventory) Err() error {
+	for _, entry := range inv.Entries {
+		if entry.Err != nil {
+			return fmt.Errorf("slot %d: %w", entry.Slot, entry.Err)
+		}
+	}
+	return nil
+}
+
+// WriteTable writes inv to w as a human-readable table. The key v uses to authorize commands is
+// marked with an asterisk.
+func (inv *KeyInventory) WriteTable(w io.Writer) error {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "SLOT\tROLE\tFORM FACTOR\tNAME\tFINGERPRINT")
+	for _, entry := range inv.Entries {
+		slot := fmt.Sprintf("%d", entry.Slot)
+		if entry.Self {
+			slot += "*"
+		}
+		if entry.Err != nil {
+			fmt.Fprintf(table, "%s\t\t\t\terror: %s\n", slot, entry.Err)
+			continue
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", slot, roleName(entry.Role), formFactorName(entry.FormFactor), entry.Name, entry.Fingerprint)
+	}
+	return table.Flush()
+}
+
+// KeyInventory fetches every entry in the vehicle's whitelist. Slots are fetched concurrently.
+//
+// If a slot can't be fetched, its Err field is set and the remaining slots are still returned; use
+// [KeyInventory.Err] to check for such errors. KeyInventory only returns an error if the list of
+// slots can't be fetched or ctx expires.
+//
+// If names is not nil, it's used to fill in the Name field of each entry. If names fails, the
+// entries are returned without names and the error is recorded in [KeyInventory.NamesErr].
+func (v *Vehicle) KeyInventory(ctx context.Context, names KeyNameResolver) (*KeyInventory, error) {
+	summary, err := v.KeySummary(ctx)
+	if err != nil {
+		return nil, err
+	}
+	inv := &KeyInventory{VIN: v.vin}
+	for slot, mask := uint32(0), summary.GetSlotMask(); mask > 0; slot, mask = slot+1, mask>>1 {
+		if mask&1 == 1 {
+			inv.Entries = append(inv.Entries, KeyInventoryEntry{Slot: slot})
+		}
+	}
+
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, maxSlotRequests)
+	for i := range inv.Entries {
+		wg.Add(1)
+		go func(entry *KeyInventoryEntry) {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+			info, err := v.KeyInfoBySlot(ctx, entry.Slot)
+			if err != nil {
+				entry.Err = err
+				return
+			}
+			entry.PublicKey = info.GetPublicKey().GetPublicKeyRaw()
+			entry.Fingerprint = protocol.KeyFingerprint(entry.PublicKey)
+			entry.Role = info.GetKeyRole()
+			entry.FormFactor = info.GetMetadataForKey().GetKeyFormFactor()
+			entry.Self = v.publicKey != nil && bytes.Equal(entry.PublicKey, v.publicKey)
+		}(&inv.Entries[i])
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if names != nil {
+		keyNames, err := names.KeyNames(ctx)
+		if err != nil {
+			inv.NamesErr = fmt.Errorf("couldn't fetch key names: %w", err)
+		}
+		for i := range inv.Entries {
+			if inv.Entries[i].Err != nil {
+				continue
+			}
+			if name, ok := keyNames[hex.EncodeToString(inv.Entries[i].PublicKey)]; ok {
+				inv.Entries[i].Name = name
+			}
+		}
+	}
+	return inv, nil
+}
@@ -0,0 +1,109 @@
+package vehicle
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/teslamotors/vehicle-command/pkg/protocol"
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/keys"
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/vcsec"
+)
+
+func testInventory() *KeyInventory {
+	publicKey := testPublicKey().Bytes()
+	return &KeyInventory{
+		VIN: "5YJ3E1EA0JF000000",
+		Entries: []KeyInventoryEntry{
+			{
+				Slot:        0,
+				PublicKey:   publicKey,
+				Fingerprint: protocol.KeyFingerprint(publicKey),
+				Role:        keys.Role_ROLE_OWNER,
+				FormFactor:  vcsec.KeyFormFactor_KEY_FORM_FACTOR_CLOUD_KEY,
+				Name:        "Fleet Server",
+				Self:        true,
+			},
+			{Slot: 3, Err: protocol.ErrBusy},
+		},
+	}
+}
+
+func TestKeyInventoryJSON(t *testing.T) {
+	encoded, err := json.Marshal(testInventory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		VIN  string                   `json:"vin"`
+		Keys []map[string]interface{} `json:"keys"`
+	}
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.VIN != "5YJ3E1EA0JF000000" || len(decoded.Keys) != 2 {
+		t.Fatalf("Unexpected JSON: %s", encoded)
+	}
+	first := decoded.Keys[0]
+	if first["role"] != "owner" || first["form_factor"] != "cloud_key" || first["self"] != true || first["name"] != "Fleet Server" {
+		t.Errorf("Unexpected entry: %v", first)
+	}
+	if !strings.HasPrefix(first["public_key"].(string), "04") {
+		t.Errorf("Expected hex-encoded public key: %v", first)
+	}
+	if decoded.Keys[1]["error"] == nil || decoded.Keys[1]["public_key"] != nil {
+		t.Errorf("Unexpected failed entry: %v", decoded.Keys[1])
+	}
+}
+
+func TestKeyInventoryTable(t *testing.T) {
+	inv := testInventory()
+	var out bytes.Buffer
+	if err := inv.WriteTable(&out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Unexpected table:\n%s", out.String())
+	}
+	if !strings.HasPrefix(lines[1], "0*") || !strings.Contains(lines[1], "Fleet Server") || !strings.Contains(lines[1], inv.Entries[0].Fingerprint) {
+		t.Errorf("Unexpected row: %s", lines[1])
+	}
+	if !strings.Contains(lines[2], "error:") {
+		t.Errorf("Expected error in row: %s", lines[2])
+	}
+
+	if entry := inv.Find(testPublicKey().Bytes()); entry == nil || entry.Slot != 0 {
+		t.Errorf("Didn't find key: %v", entry)
+	}
+	if err := inv.Err(); !errors.Is(err, protocol.ErrBusy) {
+		t.Errorf("Expected ErrBusy but got %v", err)
+	}
+}
+
+type failingKeyNames struct{}
+
+func (failingKeyNames) KeyNames(context.Context) (map[string]string, error) {
+	return nil, errors.New("not found")
+}
+
+func TestKeyInventoryNamesUnavailable(t *testing.T) {
+	v, _, _ := newPairingTest(t, -1, false)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	inv, err := v.KeyInventory(ctx, failingKeyNames{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if inv.NamesErr == nil {
+		t.Error("Expected NamesErr to be set")
+	}
+	if len(inv.Entries) != 1 || !bytes.Equal(inv.Entries[0].PublicKey, testPublicKey().Bytes()) {
+		t.Errorf("Unexpected entries %+v", inv.Entries)
+	}
+}
@@ -0,0 +1,150 @@
+package vehicle
+
+import (
+	"context"
+	"crypto/ecdh"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/teslamotors/vehicle-command/internal/authentication"
+	"github.com/teslamotors/vehicle-command/pkg/protocol"
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/keys"
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/vcsec"
+)
+
+// ErrPairingTimeout indicates an add-key request wasn't approved before the context expired.
+var ErrPairingTimeout = errors.New("timed out waiting for add-key request to be approved")
+
+// pairingPollInterval is the time between whitelist checks while waiting for the user to approve an
+// add-key request.
+var pairingPollInterval = 2 * time.Second
+
+// PairingStep identifies the progress of [Vehicle.PairKey].
+type PairingStep int
+
+const (
+	// PairingRequestSent indicates the add-key request was sent to the vehicle.
+	PairingRequestSent PairingStep = iota
+	// PairingWaiting indicates the key hasn't been enrolled yet. It's reported each time the
+	// whitelist is checked.
+	PairingWaiting
+	// PairingKeyEnrolled indicates the key has been added to the whitelist.
+	PairingKeyEnrolled
+	// PairingSessionStarted indicates the vehicle accepted an authenticated session using the key.
+	PairingSessionStarted
+)
+
+var pairingStepNames = map[PairingStep]string{
+	PairingRequestSent:    "request-sent",
+	PairingWaiting:        "waiting",
+	PairingKeyEnrolled:    "key-enrolled",
+	PairingSessionStarted: "session-started",
+}
+
+func (s PairingStep) String() string {
+	if name, ok := pairingStepNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("PairingStep(%d)", int(s))
+}
+
+// PairKey enrolls privateKey's public key with the given role and form factor, and then switches v
+// to using privateKey.
+//
+// If the key isn't already in the vehicle's whitelist, PairKey sends an add-key request (see
+// [Vehicle.SendAddKeyRequestWithRole]) and waits for the user to approve it by tapping their NFC
+// card on the center console. The whitelist is polled until the key appears or ctx expires, in
+// which case PairKey returns [ErrPairingTimeout]. Finally, PairKey starts an authenticated session
+// with the vehicle security controller to confirm the vehicle accepts the key. Existing sessions
+// are discarded.
+//
+// Pairing requires a BLE connection. If progress is not nil, it's called after each step.
+func (v *Vehicle) PairKey(ctx context.Context, privateKey authentication.ECDHPrivateKey, role keys.Role, formFactor vcsec.KeyFormFactor, progress func(PairingStep)) error {
+	report := func(step PairingStep) {
+		if progress != nil {
+			progress(step)
+		}
+	}
+	publicBytes := privateKey.PublicBytes()
+	publicKey, err := ecdh.P256().NewPublicKey(publicBytes)
+	if err != nil {
+		return protocol.ErrInvalidPublicKey
+	}
+
+	summary, err := v.KeySummary(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := v.findKey(ctx, publicBytes); errors.Is(err, ErrKeyNotFound) {
+		if err := v.SendAddKeyRequestWithRole(ctx, publicKey, role, formFactor); err != nil {
+			return err
+		}
+		report(PairingRequestSent)
+		if err := v.waitForKey(ctx, publicBytes, summary.GetSlotMask(), report); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	report(PairingKeyEnrolled)
+
+	if err := v.useKey(ctx, privateKey); err != nil {
+		return fmt.Errorf("vehicle didn't accept key: %w", err)
+	}
+	report(PairingSessionStarted)
+	return nil
+}
+
+// waitForKey polls the whitelist until it contains publicBytes. The whitelist entries are only
+// fetched when the slot mask differs from mask, which is the slot mask before the add-key request
+// was sent.
+func (v *Vehicle) waitForKey(ctx context.Context, publicBytes []byte, mask uint32, report func(PairingStep)) error {
+	return pollUntil(ctx, pairingPollInterval, func(ctx context.Context) (bool, error) {
+		report(PairingWaiting)
+		summary, err := v.KeySummary(ctx)
+		if err != nil {
+			return false, err
+		}
+		if summary.GetSlotMask() == mask {
+			return false, nil
+		}
+		mask = summary.GetSlotMask()
+		if _, err := v.findKey(ctx, publicBytes); err != nil {
+			if errors.Is(err, ErrKeyNotFound) {
+				// Some other key was added or removed.
+				return false, nil
+			}
+			// Retry the slot lookup on the next poll.
+			mask = 0
+			return false, err
+		}
+		return true, nil
+	})
+}
+
+// pollUntil calls check every interval until it returns true or ctx expires. Errors returned by
+// check don't stop polling, since the vehicle may be temporarily busy while the user approves a
+// request, but the last error is included in the error returned if ctx expires.
+func pollUntil(ctx context.Context, interval time.Duration, check func(context.Context) (bool, error)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var lastErr error
+	for {
+		done, err := check(ctx)
+		if done {
+			return nil
+		}
+		if err != nil {
+			lastErr = err
+		}
+		select {
+		case <-ctx.Done():
+			if lastErr != nil {
+				return fmt.Errorf("%w (last error: %s)", ErrPairingTimeout, lastErr)
+			}
+			return ErrPairingTimeout
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package vehicle
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/teslamotors/vehicle-command/internal/authentication"
+	"github.com/teslamotors/vehicle-command/pkg/connector"
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/keys"
+	universal "github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/universalmessage"
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/vcsec"
+)
+
+func TestPollUntil(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	calls := 0
+	errBusy := errors.New("busy")
+	err := pollUntil(ctx, time.Millisecond, func(context.Context) (bool, error) {
+		calls++
+		if calls == 1 {
+			return false, errBusy
+		}
+		return calls == 3, nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if calls != 3 {
+		t.Errorf("Expected 3 checks but got %d", calls)
+	}
+}
+
+func TestPollUntilTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err := pollUntil(ctx, time.Millisecond, func(context.Context) (bool, error) {
+		return false, nil
+	})
+	if err != ErrPairingTimeout {
+		t.Errorf("Expected ErrPairingTimeout but got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = pollUntil(ctx, time.Millisecond, func(context.Context) (bool, error) {
+		return false, errors.New("busy")
+	})
+	if !errors.Is(err, ErrPairingTimeout) {
+		t.Errorf("Expected ErrPairingTimeout but got %v", err)
+	} else if !strings.Contains(err.Error(), "busy") {
+		t.Errorf("Expected last error in %q", err)
+	}
+}
+
+func TestPairingStepString(t *testing.T) {
+	if s := PairingKeyEnrolled.String(); s != "key-enrolled" {
+		t.Errorf("Unexpected name %q", s)
+	}
+	if s := PairingStep(42).String(); s != "PairingStep(42)" {
+		t.Errorf("Unexpected name %q", s)
+	}
+}
+
+// pairingConnector simulates a vehicle's security controller. It answers whitelist queries and
+// session-info requests, and enrolls the key from an add-key request once the whitelist has been
+// polled approveAfter times. If approveAfter is negative, add-key requests are never approved.
+type pairingConnector struct {
+	lock         sync.Mutex
+	inbox        chan []byte
+	closed       bool
+	vcsecKey     authentication.ECDHPrivateKey
+	whitelist    [][]byte
+	pending      []byte
+	approveAfter int
+	addRequests  int
+}
+
+func newPairingConnector(t *testing.T, approveAfter int, whitelist ...[]byte) *pairingConnector {
+	t.Helper()
+	vcsecKey, err := authentication.NewECDHPrivateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &pairingConnector{
+		inbox:        make(chan []byte, 10),
+		vcsecKey:     vcsecKey,
+		whitelist:    whitelist,
+		approveAfter: approveAfter,
+	}
+}
+
+func (c *pairingConnector) VIN() string {
+	return "0123456789ABCDEFG"
+}
+
+func (c *pairingConnector) Receive() <-chan []byte {
+	return c.inbox
+}
+
+func (c *pairingConnector) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.inbox)
+	}
+}
+
+func (c *pairingConnector) PreferredAuthMethod() connector.AuthMethod {
+	return connector.AuthMethodGCM
+}
+
+func (c *pairingConnector) RetryInterval() time.Duration {
+	return time.Millisecond
+}
+
+func (c *pairingConnector) AllowedLatency() time.Duration {
+	return time.Second
+}
+
+func (c *pairingConnector) Send(_ context.Context, buffer []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var message universal.RoutableMessage
+	if err := proto.Unmarshal(buffer, &message); err != nil || message.GetToDestination() == nil {
+		// Add-key requests are sent as bare VCSEC messages.
+		return c.handleAddKeyRequest(buffer)
+	}
+
+	reply := &universal.RoutableMessage{
+		ToDestination:   message.GetFromDestination(),
+		FromDestination: message.GetToDestination(),
+		RequestUuid:     message.GetUuid(),
+	}
+	if request := message.GetSessionInfoRequest(); request != nil {
+		verifier, err := authentication.NewVerifier(c.vcsecKey, []byte(c.VIN()), message.GetToDestination().GetDomain(), request.GetPublicKey())
+		if err != nil {
+			return err
+		}
+		if err := verifier.SetSessionInfo(message.GetUuid(), reply); err != nil {
+			return err
+		}
+	} else {
+		var payload vcsec.UnsignedMessage
+		if err := proto.Unmarshal(message.GetProtobufMessageAsBytes(), &payload); err != nil {
+			return err
+		}
+		fromVCSEC, err := c.answerInformationRequest(payload.GetInformationRequest())
+		if err != nil {
+			return err
+		}
+		encoded, err := proto.Marshal(fromVCSEC)
+		if err != nil {
+			return err
+		}
+		reply.Payload = &universal.RoutableMessage_ProtobufMessageAsBytes{ProtobufMessageAsBytes: encoded}
+	}
+	encoded, err := proto.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	if !c.closed {
+		c.inbox <- encoded
+	}
+	return nil
+}
+
+func (c *pairingConnector) handleAddKeyRequest(buffer []byte) error {
+	var envelope vcsec.ToVCSECMessage
+	if err := proto.Unmarshal(buffer, &envelope); err != nil {
+		return err
+	}
+	var payload vcsec.UnsignedMessage
+	if err := proto.Unmarshal(envelope.GetSignedMessage().GetProtobufMessageAsBytes(), &payload); err != nil {
+		return err
+	}
+	change := payload.GetWhitelistOperation().GetAddKeyToWhitelistAndAddPermissions()
+	if change == nil {
+		return errors.New("expected add-key request")
+	}
+	c.addRequests++
+	c.pending = change.GetKey().GetPublicKeyRaw()
+	return nil
+}
+
+func (c *pairingConnector) answerInformationRequest(request *vcsec.InformationRequest) (*vcsec.FromVCSECMessage, error) {
+	switch request.GetInformationRequestType() {
+	case vcsec.InformationRequestType_INFORMATION_REQUEST_TYPE_GET_WHITELIST_INFO:
+		if c.pending != nil && c.approveAfter >= 0 {
+			if c.approveAfter == 0 {
+				c.whitelist = append(c.whitelist, c.pending)
+				c.pending = nil
+			}
+			c.approveAfter--
+		}
+		return &vcsec.FromVCSECMessage{
+			SubMessage: &vcsec.FromVCSECMessage_WhitelistInfo{
+				WhitelistInfo: &vcsec.WhitelistInfo{
+					NumberOfEntries: uint32(len(c.whitelist)),
+					SlotMask:        1<<len(c.whitelist) - 1,
+				},
+			},
+		}, nil
+	case vcsec.InformationRequestType_INFORMATION_REQUEST_TYPE_GET_WHITELIST_ENTRY_INFO:
+		slot := request.GetSlot()
+		if slot >= uint32(len(c.whitelist)) {
+			return nil, fmt.Errorf("no key in slot %d", slot)
+		}
+		return &vcsec.FromVCSECMessage{
+			SubMessage: &vcsec.FromVCSECMessage_WhitelistEntryInfo{
+				WhitelistEntryInfo: &vcsec.WhitelistEntryInfo{
+					PublicKey: &vcsec.PublicKey{PublicKeyRaw: c.whitelist[slot]},
+					KeyRole:   keys.Role_ROLE_OWNER,
+					Slot:      slot,
+				},
+			},
+		}, nil
+	}
+	return nil, errors.New("unexpected information request")
+}
+
+func newPairingTest(t *testing.T, approveAfter int, enrolled bool) (*Vehicle, *pairingConnector, authentication.ECDHPrivateKey) {
+	t.Helper()
+	oldInterval := pairingPollInterval
+	pairingPollInterval = time.Millisecond
+	t.Cleanup(func() { pairingPollInterval = oldInterval })
+
+	privateKey, err := authentication.NewECDHPrivateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey := testPublicKey().Bytes()
+	whitelist := [][]byte{otherKey}
+	if enrolled {
+		whitelist = append(whitelist, privateKey.PublicBytes())
+	}
+	conn := newPairingConnector(t, approveAfter, whitelist...)
+	v, err := NewVehicle(conn, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := v.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(v.Disconnect)
+	return v, conn, privateKey
+}
+
+func TestPairKeyAlreadyEnrolled(t *testing.T) {
+	v, conn, privateKey := newPairingTest(t, -1, true)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var steps []PairingStep
+	if err := v.PairKey(ctx, privateKey, keys.Role_ROLE_OWNER, vcsec.KeyFormFactor_KEY_FORM_FACTOR_CLOUD_KEY, func(step PairingStep) {
+		steps = append(steps, step)
+	}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if conn.addRequests != 0 {
+		t.Errorf("Sent %d add-key requests for an enrolled key", conn.addRequests)
+	}
+	if !slices.Equal(steps, []PairingStep{PairingKeyEnrolled, PairingSessionStarted}) {
+		t.Errorf("Unexpected steps %v", steps)
+	}
+	if !v.PrivateKeyAvailable() {
+		t.Error("Vehicle isn't using the paired key")
+	}
+}
+
+func TestPairKeyAfterPolls(t *testing.T) {
+	const polls = 3
+	v, conn, privateKey := newPairingTest(t, polls, false)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	waiting := 0
+	var steps []PairingStep
+	if err := v.PairKey(ctx, privateKey, keys.Role_ROLE_OWNER, vcsec.KeyFormFactor_KEY_FORM_FACTOR_CLOUD_KEY, func(step PairingStep) {
+		if step == PairingWaiting {
+			waiting++
+			return
+		}
+		steps = append(steps, step)
+	}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if conn.addRequests != 1 {
+		t.Errorf("Expected one add-key request but sent %d", conn.addRequests)
+	}
+	if waiting != polls+1 {
+		t.Errorf("Expected %d polls but got %d", polls+1, waiting)
+	}
+	if !slices.Equal(steps, []PairingStep{PairingRequestSent, PairingKeyEnrolled, PairingSessionStarted}) {
+		t.Errorf("Unexpected steps %v", steps)
+	}
+}
+
+func TestPairKeyTimeout(t *testing.T) {
+	v, conn, privateKey := newPairingTest(t, -1, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := v.PairKey(ctx, privateKey, keys.Role_ROLE_OWNER, vcsec.KeyFormFactor_KEY_FORM_FACTOR_CLOUD_KEY, nil)
+	if !errors.Is(err, ErrPairingTimeout) {
+		t.Fatalf("Expected ErrPairingTimeout but got %v", err)
+	}
+	if conn.addRequests != 1 {
+		t.Errorf("Expected one add-key request but sent %d", conn.addRequests)
+	}
+}
@@ -0,0 +1,209 @@
+package vehicle
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/teslamotors/vehicle-command/pkg/connector"
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/carserver"
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/keys"
+	universal "github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/universalmessage"
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/vcsec"
+)
+
+// Permission identifies a class of commands that a key role may be allowed to authorize.
+type Permission int
+
+const (
+	// PermissionReadData covers commands that fetch vehicle data without changing vehicle state.
+	PermissionReadData Permission = iota
+	// PermissionCharging covers commands that control charging and the charge port.
+	PermissionCharging
+	// PermissionVehicleControl covers commands that change vehicle state and aren't covered by a
+	// more specific permission.
+	PermissionVehicleControl
+	// PermissionManagePINs covers commands that set or override vehicle PINs.
+	PermissionManagePINs
+	// PermissionManageKeys covers changes to the vehicle's whitelist, such as adding or removing
+	// keys.
+	PermissionManageKeys
+)
+
+var permissionNames = map[Permission]string{
+	PermissionReadData:       "read-data",
+	PermissionCharging:       "charging",
+	PermissionVehicleControl: "vehicle-control",
+	PermissionManagePINs:     "manage-pins",
+	PermissionManageKeys:     "manage-keys",
+}
+
+func (p Permission) String() string {
+	if name, ok := permissionNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("Permission(%d)", int(p))
+}
+
+// RolePermissions lists the permissions of each role, as documented in the [Protocol
+// Specification]. Roles that aren't listed, such as [keys.Role_ROLE_SERVICE], aren't restricted by
+// client-side checks; the vehicle remains the final authority on what each role can do.
+//
+// [Protocol Specification]: https://github.com/teslamotors/vehicle-command/blob/main/pkg/protocol/protocol.md#roles
+var RolePermissions = map[keys.Role][]Permission{
+	keys.Role_ROLE_OWNER:            {PermissionReadData, PermissionCharging, PermissionVehicleControl, PermissionManagePINs, PermissionManageKeys},
+	keys.Role_ROLE_FM:               {PermissionReadData, PermissionCharging, PermissionVehicleControl, PermissionManagePINs},
+	keys.Role_ROLE_DRIVER:           {PermissionReadData, PermissionCharging, PermissionVehicleControl},
+	keys.Role_ROLE_GUEST:            {PermissionReadData, PermissionCharging, PermissionVehicleControl},
+	keys.Role_ROLE_CHARGING_MANAGER: {PermissionReadData, PermissionCharging},
+	keys.Role_ROLE_VEHICLE_MONITOR:  {PermissionReadData},
+}
+
+// ActionPermissions maps infotainment actions, identified by their field name in the
+// VehicleAction message of car_server.proto, to the permission they require. Actions that aren't
+// listed require [PermissionVehicleControl].
+var ActionPermissions = map[string]Permission{
+	"getVehicleData":         PermissionReadData,
+	"getNearbyChargingSites": PermissionReadData,
+	"ping":                   PermissionReadData,
+
+	"chargingSetLimitAction":           PermissionCharging,
+	"chargingStartStopAction":          PermissionCharging,
+	"scheduledChargingAction":          PermissionCharging,
+	"scheduledDepartureAction":         PermissionCharging,
+	"setChargingAmpsAction":            PermissionCharging,
+	"chargePortDoorClose":              PermissionCharging,
+	"chargePortDoorOpen":               PermissionCharging,
+	"addChargeScheduleAction":          PermissionCharging,
+	"removeChargeScheduleAction":       PermissionCharging,
+	"batchRemoveChargeSchedulesAction": PermissionCharging,
+
+	"vehicleControlSetPinToDriveAction":        PermissionManagePINs,
+	"vehicleControlResetPinToDriveAction":      PermissionManagePINs,
+	"vehicleControlResetPinToDriveAdminAction": PermissionManagePINs,
+	"drivingClearSpeedLimitPinAdminAction":     PermissionManagePINs,
+	"parentalControlsClearPinAdminAction":      PermissionManagePINs,
+}
+
+// RoleAllows returns true if role has permission. Roles that aren't in [RolePermissions] are
+// allowed everything.
+func RoleAllows(role keys.Role, permission Permission) bool {
+	permissions, ok := RolePermissions[role]
+	return !ok || slices.Contains(permissions, permission)
+}
+
+// PermissionError indicates a command was rejected before it was sent because the role of the
+// client's key doesn't allow it.
+type PermissionError struct {
+	Role       keys.Role
+	Permission Permission
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("key role %s does not have %s permission", roleName(e.Role), e.Permission)
+}
+
+// CommandPermission returns the permission required to authorize payload, an encoded message for
+// the given domain. Payloads that can't be classified require [PermissionVehicleControl].
+func CommandPermission(domain universal.Domain, payload []byte) Permission {
+	switch domain {
+	case universal.Domain_DOMAIN_INFOTAINMENT:
+		var action carserver.Action
+		if err := proto.Unmarshal(payload, &action); err != nil {
+			break
+		}
+		msg := action.GetVehicleAction().ProtoReflect()
+		oneof := msg.Descriptor().Oneofs().ByName("vehicle_action_msg")
+		if oneof == nil {
+			break
+		}
+		if field := msg.WhichOneof(oneof); field != nil {
+			if permission, ok := ActionPermissions[string(field.Name())]; ok {
+				return permission
+			}
+		}
+	case universal.Domain_DOMAIN_VEHICLE_SECURITY:
+		var message vcsec.UnsignedMessage
+		if err := proto.Unmarshal(payload, &message); err != nil {
+			break
+		}
+		switch msg := message.GetSubMessage().(type) {
+		case *vcsec.UnsignedMessage_InformationRequest:
+			return PermissionReadData
+		case *vcsec.UnsignedMessage_WhitelistOperation:
+			return PermissionManageKeys
+		case *vcsec.UnsignedMessage_RKEAction:
+			// Waking the vehicle is a prerequisite for reading data.
+			if msg.RKEAction == vcsec.RKEAction_E_RKE_ACTION_WAKE_VEHICLE {
+				return PermissionReadData
+			}
+		}
+	}
+	return PermissionVehicleControl
+}
+
+// SetRoleChecks controls whether v checks the role of its key before sending authenticated
+// commands. When enabled, commands that the role doesn't allow (see [RolePermissions]) fail with a
+// [*PermissionError] instead of being rejected by the vehicle.
+//
+// The role is looked up the first time it's needed (see [Vehicle.KeyRole]) unless it has been
+// provided using [Vehicle.SetKeyRole]. Role checks are disabled by default because the lookup
+// requires additional round trips to the vehicle.
+func (v *Vehicle) SetRoleChecks(enabled bool) {
+	v.roleChecks = enabled
+}
+
+// SetKeyRole records the role of v's key, for example from a previous call to [Vehicle.KeyRole],
+// so that role checks don't need to look it up.
+func (v *Vehicle) SetKeyRole(role keys.Role) {
+	v.keyRole = role
+}
+
+// KeyRole returns the role of the key v uses to authorize commands. The role is looked up in the
+// vehicle's whitelist the first time KeyRole is called and cached afterwards. KeyRole returns
+// [ErrKeyNotFound] if the key isn't enrolled.
+func (v *Vehicle) KeyRole(ctx context.Context) (keys.Role, error) {
+	if v.keyRole != keys.Role_ROLE_NONE {
+		return v.keyRole, nil
+	}
+	if v.publicKey == nil {
+		return keys.Role_ROLE_NONE, ErrKeyNotFound
+	}
+	summary, err := v.KeySummary(ctx)
+	if err != nil {
+		return keys.Role_ROLE_NONE, err
+	}
+	for slot, mask := uint32(0), summary.GetSlotMask(); mask > 0; slot, mask = slot+1, mask>>1 {
+		if mask&1 == 0 {
+			continue
+		}
+		info, err := v.KeyInfoBySlot(ctx, slot)
+		if err != nil {
+			return keys.Role_ROLE_NONE, err
+		}
+		if bytes.Equal(info.GetPublicKey().GetPublicKeyRaw(), v.publicKey) {
+			v.keyRole = info.GetKeyRole()
+			return v.keyRole, nil
+		}
+	}
+	return keys.Role_ROLE_NONE, ErrKeyNotFound
+}
+
+// checkPermission returns a [*PermissionError] if role checks are enabled and v's key isn't allowed
+// to authorize payload.
+func (v *Vehicle) checkPermission(ctx context.Context, domain universal.Domain, payload []byte, auth connector.AuthMethod) error {
+	if !v.roleChecks || auth == connector.AuthMethodNone {
+		return nil
+	}
+	role, err := v.KeyRole(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't determine key role: %w", err)
+	}
+	if permission := CommandPermission(domain, payload); !RoleAllows(role, permission) {
+		return &PermissionError{Role: role, Permission: permission}
+	}
+	return nil
+}
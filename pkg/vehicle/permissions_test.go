@@ -0,0 +1,134 @@
+package vehicle
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/teslamotors/vehicle-command/pkg/connector"
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/carserver"
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/keys"
+	universal "github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/universalmessage"
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/vcsec"
+)
+
+func encodeVehicleAction(t *testing.T, action *carserver.VehicleAction) []byte {
+	encoded, err := proto.Marshal(&carserver.Action{
+		ActionMsg: &carserver.Action_VehicleAction{VehicleAction: action},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+func encodeVCSECMessage(t *testing.T, message *vcsec.UnsignedMessage) []byte {
+	encoded, err := proto.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+func TestCommandPermission(t *testing.T) {
+	tests := []struct {
+		name     string
+		domain   universal.Domain
+		payload  []byte
+		expected Permission
+	}{
+		{
+			"vehicle data", universal.Domain_DOMAIN_INFOTAINMENT,
+			encodeVehicleAction(t, &carserver.VehicleAction{VehicleActionMsg: &carserver.VehicleAction_GetVehicleData{GetVehicleData: &carserver.GetVehicleData{}}}),
+			PermissionReadData,
+		},
+		{
+			"charge start", universal.Domain_DOMAIN_INFOTAINMENT,
+			encodeVehicleAction(t, &carserver.VehicleAction{VehicleActionMsg: &carserver.VehicleAction_ChargingStartStopAction{ChargingStartStopAction: &carserver.ChargingStartStopAction{}}}),
+			PermissionCharging,
+		},
+		{
+			"honk", universal.Domain_DOMAIN_INFOTAINMENT,
+			encodeVehicleAction(t, &carserver.VehicleAction{VehicleActionMsg: &carserver.VehicleAction_VehicleControlHonkHornAction{VehicleControlHonkHornAction: &carserver.VehicleControlHonkHornAction{}}}),
+			PermissionVehicleControl,
+		},
+		{
+			"clear PIN", universal.Domain_DOMAIN_INFOTAINMENT,
+			encodeVehicleAction(t, &carserver.VehicleAction{VehicleActionMsg: &carserver.VehicleAction_VehicleControlResetPinToDriveAdminAction{VehicleControlResetPinToDriveAdminAction: &carserver.VehicleControlResetPinToDriveAdminAction{}}}),
+			PermissionManagePINs,
+		},
+		{
+			"unlock", universal.Domain_DOMAIN_VEHICLE_SECURITY,
+			encodeVCSECMessage(t, &vcsec.UnsignedMessage{SubMessage: &vcsec.UnsignedMessage_RKEAction{RKEAction: vcsec.RKEAction_E_RKE_ACTION_UNLOCK}}),
+			PermissionVehicleControl,
+		},
+		{
+			"wake", universal.Domain_DOMAIN_VEHICLE_SECURITY,
+			encodeVCSECMessage(t, &vcsec.UnsignedMessage{SubMessage: &vcsec.UnsignedMessage_RKEAction{RKEAction: vcsec.RKEAction_E_RKE_ACTION_WAKE_VEHICLE}}),
+			PermissionReadData,
+		},
+		{
+			"add key", universal.Domain_DOMAIN_VEHICLE_SECURITY,
+			encodeVCSECMessage(t, addKeyPayload(testPublicKey(), keys.Role_ROLE_DRIVER, vcsec.KeyFormFactor_KEY_FORM_FACTOR_CLOUD_KEY)),
+			PermissionManageKeys,
+		},
+		{"garbage", universal.Domain_DOMAIN_INFOTAINMENT, []byte{0xff, 0xff}, PermissionVehicleControl},
+	}
+	for _, test := range tests {
+		if permission := CommandPermission(test.domain, test.payload); permission != test.expected {
+			t.Errorf("%s: expected %s but got %s", test.name, test.expected, permission)
+		}
+	}
+}
+
+func TestRoleAllows(t *testing.T) {
+	if !RoleAllows(keys.Role_ROLE_OWNER, PermissionManageKeys) {
+		t.Error("Owner should be able to manage keys")
+	}
+	if RoleAllows(keys.Role_ROLE_DRIVER, PermissionManageKeys) {
+		t.Error("Driver shouldn't be able to manage keys")
+	}
+	if !RoleAllows(keys.Role_ROLE_CHARGING_MANAGER, PermissionCharging) || RoleAllows(keys.Role_ROLE_CHARGING_MANAGER, PermissionVehicleControl) {
+		t.Error("Charging manager should only be able to control charging")
+	}
+	if RoleAllows(keys.Role_ROLE_VEHICLE_MONITOR, PermissionCharging) {
+		t.Error("Vehicle monitor shouldn't be able to control charging")
+	}
+	if !RoleAllows(keys.Role_ROLE_SERVICE, PermissionVehicleControl) {
+		t.Error("Roles missing from RolePermissions shouldn't be restricted")
+	}
+}
+
+func TestRoleChecks(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	vehicle, _ := newTestVehicle()
+	vehicle.authMethod = connector.AuthMethodGCM
+	vehicle.SetRoleChecks(true)
+	vehicle.SetKeyRole(keys.Role_ROLE_VEHICLE_MONITOR)
+
+	var permissionErr *PermissionError
+	if err := vehicle.ChargeStart(ctx); !errors.As(err, &permissionErr) {
+		t.Fatalf("Expected PermissionError but got %v", err)
+	}
+	if permissionErr.Role != keys.Role_ROLE_VEHICLE_MONITOR || permissionErr.Permission != PermissionCharging {
+		t.Errorf("Unexpected error: %s", permissionErr)
+	}
+	if err := vehicle.Lock(ctx); !errors.As(err, &permissionErr) {
+		t.Errorf("Expected PermissionError but got %v", err)
+	}
+
+	// Unauthenticated messages aren't checked.
+	if err := vehicle.checkPermission(ctx, universal.Domain_DOMAIN_VEHICLE_SECURITY, nil, connector.AuthMethodNone); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	vehicle.SetKeyRole(keys.Role_ROLE_CHARGING_MANAGER)
+	payload := encodeVehicleAction(t, &carserver.VehicleAction{VehicleActionMsg: &carserver.VehicleAction_ChargingStartStopAction{ChargingStartStopAction: &carserver.ChargingStartStopAction{}}})
+	if err := vehicle.checkPermission(ctx, universal.Domain_DOMAIN_INFOTAINMENT, payload, connector.AuthMethodGCM); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
@@ -0,0 +1,211 @@
+package vehicle
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"errors"
+	"fmt"
+
+	"github.com/teslamotors/vehicle-command/internal/authentication"
+	"github.com/teslamotors/vehicle-command/internal/dispatcher"
+	"github.com/teslamotors/vehicle-command/pkg/protocol"
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/keys"
+	universal "github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/universalmessage"
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/vcsec"
+)
+
+var (
+	// ErrKeyNotFound indicates a public key is not in the vehicle's whitelist.
+	ErrKeyNotFound = errors.New("public key not found in vehicle whitelist")
+
+	// ErrRotationMismatch indicates a KeyRotation was resumed with a different vehicle or key than
+	// the one it was started with.
+	ErrRotationMismatch = errors.New("key rotation does not match vehicle or key")
+)
+
+// RotationStep identifies the last completed step of a [KeyRotation].
+type RotationStep int
+
+const (
+	// RotationStarted indicates the caller has generated and saved the new key.
+	RotationStarted RotationStep = iota
+	// RotationKeyAdded indicates the new key has been added to the whitelist.
+	RotationKeyAdded
+	// RotationKeyVerified indicates the vehicle accepted a session with the new key.
+	RotationKeyVerified
+	// RotationOldKeyRemoved indicates the old key has been removed from the whitelist. This is the
+	// last step performed by [Vehicle.RotateKey].
+	RotationOldKeyRemoved
+	// RotationComplete indicates the caller has finished updating its own state (keyring, session
+	// cache, etc.) to use the new key.
+	RotationComplete
+)
+
+var rotationStepNames = map[RotationStep]string{
+	RotationStarted:       "started",
+	RotationKeyAdded:      "key-added",
+	RotationKeyVerified:   "key-verified",
+	RotationOldKeyRemoved: "old-key-removed",
+	RotationComplete:      "complete",
+}
+
+func (s RotationStep) String() string {
+	if name, ok := rotationStepNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("RotationStep(%d)", int(s))
+}
+
+// KeyRotation records the progress of replacing one whitelisted key with another. It's designed
+// to be serialized (e.g., as JSON) after each step so that a rotation that is interrupted can be
+// resumed by passing the same KeyRotation to [Vehicle.RotateKey].
+type KeyRotation struct {
+	VIN          string              `json:"vin"`
+	OldPublicKey []byte              `json:"old_public_key"`
+	NewPublicKey []byte              `json:"new_public_key"`
+	Role         keys.Role           `json:"role"`
+	FormFactor   vcsec.KeyFormFactor `json:"form_factor"`
+	Step         RotationStep        `json:"step"`
+}
+
+// NewKeyRotation returns a KeyRotation that replaces oldPublicKey with the public key of newKey on
+// the vehicle with the given VIN. The role and form factor of the old key are looked up by
+// [Vehicle.RotateKey].
+//
+// Callers must save newKey before passing the KeyRotation to RotateKey; otherwise, an interrupted
+// rotation may leave the vehicle without a usable key.
+func NewKeyRotation(vin string, oldPublicKey []byte, newKey authentication.ECDHPrivateKey) *KeyRotation {
+	return &KeyRotation{
+		VIN:          vin,
+		OldPublicKey: bytes.Clone(oldPublicKey),
+		NewPublicKey: newKey.PublicBytes(),
+		Step:         RotationStarted,
+	}
+}
+
+// findKey returns the whitelist entry that matches publicBytes, or ErrKeyNotFound.
+func (v *Vehicle) findKey(ctx context.Context, publicBytes []byte) (*KeyInventoryEntry, error) {
+	inv, err := v.KeyInventory(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if entry := inv.Find(publicBytes); entry != nil {
+		return entry, nil
+	}
+	// The key might be in a slot that couldn't be fetched.
+	if err := inv.Err(); err != nil {
+		return nil, err
+	}
+	return nil, ErrKeyNotFound
+}
+
+// useKey replaces v's dispatcher with one that authenticates using privateKey, and then starts a
+// session with the vehicle security controller. Existing sessions are discarded.
+func (v *Vehicle) useKey(ctx context.Context, privateKey authentication.ECDHPrivateKey) error {
+	dispatch, err := dispatcher.New(v.conn, privateKey)
+	if err != nil {
+		return err
+	}
+	if v.logger != nil {
+		dispatch.SetLogger(v.logger)
+	}
+	dispatch.SetMaxLatency(v.maxLatency)
+	v.dispatcher.Stop()
+	v.dispatcher = dispatch
+	v.keyAvailable = true
+	v.publicKey = privateKey.PublicBytes()
+	v.keyRole = keys.Role_ROLE_NONE
+	if err := v.Connect(ctx); err != nil {
+		return err
+	}
+	return v.StartSession(ctx, []universal.Domain{universal.Domain_DOMAIN_VEHICLE_SECURITY})
+}
+
+// RotateKey replaces rotation.OldPublicKey with newKey in the vehicle's whitelist. The new key is
+// given the same role and form factor as the old key.
+//
+// The method performs the following steps, skipping any that rotation.Step indicates have already
+// been completed:
+//
+//  1. Add the new key using v's current session, which must be authorized by the old key (or
+//     another key with permission to add keys).
+//  2. Switch v to the new key and start a fresh session, proving the vehicle accepts it.
+//  3. Remove the old key using the new key's session.
+//
+// After each step, rotation.Step is updated and checkpoint (if not nil) is called. If checkpoint
+// returns an error, RotateKey stops and returns that error. When RotateKey returns successfully, v
+// uses newKey, but only has a session with the vehicle security controller. The caller is
+// responsible for replacing the old key in its own storage and then setting rotation.Step to
+// [RotationComplete]. RotateKey does nothing if rotation is already complete.
+func (v *Vehicle) RotateKey(ctx context.Context, rotation *KeyRotation, newKey authentication.ECDHPrivateKey, checkpoint func(*KeyRotation) error) error {
+	if rotation.VIN != v.vin || !bytes.Equal(rotation.NewPublicKey, newKey.PublicBytes()) {
+		return ErrRotationMismatch
+	}
+	if bytes.Equal(rotation.OldPublicKey, rotation.NewPublicKey) {
+		return fmt.Errorf("%w: new key is the same as old key", ErrRotationMismatch)
+	}
+	oldPublicKey, err := ecdh.P256().NewPublicKey(rotation.OldPublicKey)
+	if err != nil {
+		return protocol.ErrInvalidPublicKey
+	}
+	newPublicKey, err := ecdh.P256().NewPublicKey(rotation.NewPublicKey)
+	if err != nil {
+		return protocol.ErrInvalidPublicKey
+	}
+	advance := func(step RotationStep) error {
+		rotation.Step = step
+		if checkpoint == nil {
+			return nil
+		}
+		return checkpoint(rotation)
+	}
+
+	if rotation.Step < RotationKeyAdded {
+		if rotation.Role == keys.Role_ROLE_NONE {
+			info, err := v.findKey(ctx, rotation.OldPublicKey)
+			if err != nil {
+				return fmt.Errorf("couldn't determine role of old key: %w", err)
+			}
+			rotation.Role = info.Role
+			rotation.FormFactor = info.FormFactor
+		}
+		// A previous attempt may have added the key without recording it.
+		if _, err := v.findKey(ctx, rotation.NewPublicKey); errors.Is(err, ErrKeyNotFound) {
+			if err := v.AddKeyWithRole(ctx, newPublicKey, rotation.Role, rotation.FormFactor); err != nil {
+				return fmt.Errorf("couldn't add new key: %w", err)
+			}
+		} else if err != nil {
+			return err
+		}
+		if err := advance(RotationKeyAdded); err != nil {
+			return err
+		}
+	}
+
+	if rotation.Step >= RotationComplete {
+		return nil
+	}
+	if err := v.useKey(ctx, newKey); err != nil {
+		return fmt.Errorf("vehicle didn't accept new key: %w", err)
+	}
+	if rotation.Step < RotationKeyVerified {
+		if err := advance(RotationKeyVerified); err != nil {
+			return err
+		}
+	}
+
+	if rotation.Step < RotationOldKeyRemoved {
+		if _, err := v.findKey(ctx, rotation.OldPublicKey); err == nil {
+			if err := v.RemoveKey(ctx, oldPublicKey); err != nil {
+				return fmt.Errorf("couldn't remove old key: %w", err)
+			}
+		} else if !errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+		if err := advance(RotationOldKeyRemoved); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package vehicle
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/teslamotors/vehicle-command/internal/authentication"
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/keys"
+)
+
+func TestRotateKeyMismatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	vehicle, _ := newTestVehicle()
+	vehicle.vin = "5YJ3E1EA0JF000000"
+	newKey, err := authentication.NewECDHPrivateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := authentication.NewECDHPrivateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotation := NewKeyRotation("5YJ3E1EA0JF000001", testPublicKey().Bytes(), newKey)
+	if err := vehicle.RotateKey(ctx, rotation, newKey, nil); !errors.Is(err, ErrRotationMismatch) {
+		t.Errorf("Expected ErrRotationMismatch for wrong VIN but got %v", err)
+	}
+	rotation = NewKeyRotation(vehicle.VIN(), testPublicKey().Bytes(), newKey)
+	if err := vehicle.RotateKey(ctx, rotation, otherKey, nil); !errors.Is(err, ErrRotationMismatch) {
+		t.Errorf("Expected ErrRotationMismatch for wrong key but got %v", err)
+	}
+	rotation = NewKeyRotation(vehicle.VIN(), newKey.PublicBytes(), newKey)
+	if err := vehicle.RotateKey(ctx, rotation, newKey, nil); !errors.Is(err, ErrRotationMismatch) {
+		t.Errorf("Expected ErrRotationMismatch for unchanged key but got %v", err)
+	}
+
+	// A completed rotation shouldn't contact the vehicle.
+	rotation = NewKeyRotation(vehicle.VIN(), testPublicKey().Bytes(), newKey)
+	rotation.Step = RotationComplete
+	if err := vehicle.RotateKey(ctx, rotation, newKey, nil); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestKeyRotationEncoding(t *testing.T) {
+	newKey, err := authentication.NewECDHPrivateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotation := NewKeyRotation("5YJ3E1EA0JF000000", testPublicKey().Bytes(), newKey)
+	rotation.Role = keys.Role_ROLE_FM
+	rotation.Step = RotationKeyVerified
+	encoded, err := json.Marshal(rotation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded KeyRotation
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Step != RotationKeyVerified || decoded.Role != keys.Role_ROLE_FM || string(decoded.NewPublicKey) != string(newKey.PublicBytes()) {
+		t.Errorf("Rotation changed after encoding: %+v", decoded)
+	}
+	if RotationKeyVerified.String() != "key-verified" {
+		t.Errorf("Unexpected step name %s", RotationKeyVerified)
+	}
+}
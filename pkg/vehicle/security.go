@@ -1,10 +1,13 @@
 package vehicle
 
 import (
+	"bytes"
 	"context"
 	"crypto/ecdh"
 	"errors"
+	"math"
 	"strings"
+	"time"
 
 	"google.golang.org/protobuf/proto"
 
@@ -287,6 +290,166 @@ func (v *Vehicle) RemoveKey(ctx context.Context, publicKey *ecdh.PublicKey) erro
 	return v.executeWhitelistOperation(ctx, encodedPayload)
 }
 
+// whitelistPublicKey converts publicKey to the format used in whitelist operations.
+func whitelistPublicKey(publicKey *ecdh.PublicKey) (*vcsec.PublicKey, error) {
+	if publicKey.Curve() != ecdh.P256() {
+		return nil, protocol.ErrInvalidPublicKey
+	}
+	return &vcsec.PublicKey{PublicKeyRaw: publicKey.Bytes()}, nil
+}
+
+// keyLifetimeSeconds converts lifetime to the units used by [vcsec.PermissionChange]. Partial
+// seconds are rounded up. A lifetime of zero means the key doesn't expire.
+func keyLifetimeSeconds(lifetime time.Duration) (uint32, error) {
+	if lifetime < 0 {
+		return 0, ErrInvalidKeyLifetime
+	}
+	seconds := (lifetime + time.Second - 1) / time.Second
+	if seconds > math.MaxUint32 {
+		return 0, ErrInvalidKeyLifetime
+	}
+	return uint32(seconds), nil
+}
+
+// sendWhitelistOperation sends op to the vehicle security controller and waits for it to complete.
+// If formFactor is not KEY_FORM_FACTOR_UNKNOWN, it's included as metadata for the key.
+func (v *Vehicle) sendWhitelistOperation(ctx context.Context, op *vcsec.WhitelistOperation, formFactor vcsec.KeyFormFactor) error {
+	if formFactor != vcsec.KeyFormFactor_KEY_FORM_FACTOR_UNKNOWN {
+		op.MetadataForKey = &vcsec.KeyMetadata{KeyFormFactor: formFactor}
+	}
+	payload := vcsec.UnsignedMessage{
+		SubMessage: &vcsec.UnsignedMessage_WhitelistOperation{
+			WhitelistOperation: op,
+		},
+	}
+	encodedPayload, err := proto.Marshal(&payload)
+	if err != nil {
+		return err
+	}
+	return v.executeWhitelistOperation(ctx, encodedPayload)
+}
+
+func replaceKeyOperation(oldKey *vcsec.ReplaceKey, newPublicKey *ecdh.PublicKey, role keys.Role) (*vcsec.WhitelistOperation, error) {
+	keyToAdd, err := whitelistPublicKey(newPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	oldKey.KeyToAdd = keyToAdd
+	oldKey.KeyRole = role
+	return &vcsec.WhitelistOperation{
+		SubMessage: &vcsec.WhitelistOperation_ReplaceKey{ReplaceKey: oldKey},
+	}, nil
+}
+
+// ReplaceKey atomically replaces oldPublicKey with newPublicKey in the vehicle's whitelist. The
+// new key is given the specified role, which need not match the role of the old key. Unlike
+// calling [Vehicle.AddKeyWithRole] followed by [Vehicle.RemoveKey], ReplaceKey never leaves both
+// keys enrolled and works even if the whitelist is full.
+func (v *Vehicle) ReplaceKey(ctx context.Context, oldPublicKey, newPublicKey *ecdh.PublicKey, role keys.Role, formFactor vcsec.KeyFormFactor) error {
+	keyToReplace, err := whitelistPublicKey(oldPublicKey)
+	if err != nil {
+		return err
+	}
+	op, err := replaceKeyOperation(&vcsec.ReplaceKey{
+		KeyToReplace: &vcsec.ReplaceKey_PublicKeyToReplace{PublicKeyToReplace: keyToReplace},
+	}, newPublicKey, role)
+	if err != nil {
+		return err
+	}
+	return v.sendWhitelistOperation(ctx, op, formFactor)
+}
+
+// ReplaceKeyInSlot behaves like [Vehicle.ReplaceKey], but identifies the key to replace by its
+// whitelist slot. This allows replacing a key when its public key isn't known (for example, a lost
+// phone key). Use [Vehicle.KeySummary] and [Vehicle.KeyInfoBySlot] to find slot numbers.
+func (v *Vehicle) ReplaceKeyInSlot(ctx context.Context, slot uint32, newPublicKey *ecdh.PublicKey, role keys.Role, formFactor vcsec.KeyFormFactor) error {
+	op, err := replaceKeyOperation(&vcsec.ReplaceKey{
+		KeyToReplace: &vcsec.ReplaceKey_SlotToReplace{SlotToReplace: slot},
+	}, newPublicKey, role)
+	if err != nil {
+		return err
+	}
+	return v.sendWhitelistOperation(ctx, op, formFactor)
+}
+
+// UpdateKeyRole changes the role of a public key that's already in the vehicle's whitelist.
+func (v *Vehicle) UpdateKeyRole(ctx context.Context, publicKey *ecdh.PublicKey, role keys.Role) error {
+	key, err := whitelistPublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	op := &vcsec.WhitelistOperation{
+		SubMessage: &vcsec.WhitelistOperation_UpdateKeyAndPermissions{
+			UpdateKeyAndPermissions: &vcsec.PermissionChange{
+				Key:     key,
+				KeyRole: role,
+			},
+		},
+	}
+	if err := v.sendWhitelistOperation(ctx, op, vcsec.KeyFormFactor_KEY_FORM_FACTOR_UNKNOWN); err != nil {
+		return err
+	}
+	if bytes.Equal(key.GetPublicKeyRaw(), v.publicKey) {
+		v.keyRole = role
+	}
+	return nil
+}
+
+func impermanentKeyChange(publicKey *ecdh.PublicKey, role keys.Role, lifetime time.Duration) (*vcsec.PermissionChange, error) {
+	key, err := whitelistPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	seconds, err := keyLifetimeSeconds(lifetime)
+	if err != nil {
+		return nil, err
+	}
+	return &vcsec.PermissionChange{
+		Key:               key,
+		KeyRole:           role,
+		SecondsToBeActive: seconds,
+	}, nil
+}
+
+// AddImpermanentKey adds a public key to the vehicle's whitelist with the specified role. The
+// vehicle removes the key automatically once lifetime has elapsed. If lifetime is zero, the key
+// remains enrolled until it's removed using [Vehicle.RemoveKey] or
+// [Vehicle.RemoveAllImpermanentKeys].
+//
+// Impermanent keys are useful for granting temporary access, such as to a valet or detailer.
+func (v *Vehicle) AddImpermanentKey(ctx context.Context, publicKey *ecdh.PublicKey, role keys.Role, formFactor vcsec.KeyFormFactor, lifetime time.Duration) error {
+	change, err := impermanentKeyChange(publicKey, role, lifetime)
+	if err != nil {
+		return err
+	}
+	op := &vcsec.WhitelistOperation{
+		SubMessage: &vcsec.WhitelistOperation_AddImpermanentKey{AddImpermanentKey: change},
+	}
+	return v.sendWhitelistOperation(ctx, op, formFactor)
+}
+
+// AddImpermanentKeyAndRemoveExisting behaves like [Vehicle.AddImpermanentKey], but first removes
+// all impermanent keys that are already enrolled.
+func (v *Vehicle) AddImpermanentKeyAndRemoveExisting(ctx context.Context, publicKey *ecdh.PublicKey, role keys.Role, formFactor vcsec.KeyFormFactor, lifetime time.Duration) error {
+	change, err := impermanentKeyChange(publicKey, role, lifetime)
+	if err != nil {
+		return err
+	}
+	op := &vcsec.WhitelistOperation{
+		SubMessage: &vcsec.WhitelistOperation_AddImpermanentKeyAndRemoveExisting{AddImpermanentKeyAndRemoveExisting: change},
+	}
+	return v.sendWhitelistOperation(ctx, op, formFactor)
+}
+
+// RemoveAllImpermanentKeys removes all impermanent keys from the vehicle's whitelist, including
+// those that haven't expired yet.
+func (v *Vehicle) RemoveAllImpermanentKeys(ctx context.Context) error {
+	op := &vcsec.WhitelistOperation{
+		SubMessage: &vcsec.WhitelistOperation_RemoveAllImpermanentKeys{RemoveAllImpermanentKeys: true},
+	}
+	return v.sendWhitelistOperation(ctx, op, vcsec.KeyFormFactor_KEY_FORM_FACTOR_UNKNOWN)
+}
+
 func (v *Vehicle) KeySummary(ctx context.Context) (*vcsec.WhitelistInfo, error) {
 	reply, err := v.getVCSECInfo(ctx, vcsec.InformationRequestType_INFORMATION_REQUEST_TYPE_GET_WHITELIST_INFO, slotNone)
 	if err != nil {
@@ -1,7 +1,13 @@
 package vehicle
 
 import (
+	"errors"
+	"math"
 	"testing"
+	"time"
+
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/keys"
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/vcsec"
 )
 
 func TestValidPIN(t *testing.T) {
@@ -28,3 +34,42 @@ func TestValidPIN(t *testing.T) {
 		}
 	}
 }
+
+func TestKeyLifetimeSeconds(t *testing.T) {
+	valid := map[time.Duration]uint32{
+		0:                            0,
+		time.Millisecond:             1,
+		time.Second:                  1,
+		90 * time.Minute:             5400,
+		math.MaxUint32 * time.Second: math.MaxUint32,
+	}
+	for lifetime, expected := range valid {
+		seconds, err := keyLifetimeSeconds(lifetime)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %s", lifetime, err)
+		} else if seconds != expected {
+			t.Errorf("Expected %d seconds for %s but got %d", expected, lifetime, seconds)
+		}
+	}
+	for _, lifetime := range []time.Duration{-time.Second, (math.MaxUint32 + 1) * time.Second} {
+		if _, err := keyLifetimeSeconds(lifetime); !errors.Is(err, ErrInvalidKeyLifetime) {
+			t.Errorf("Expected ErrInvalidKeyLifetime for %s but got %v", lifetime, err)
+		}
+	}
+}
+
+func TestReplaceKeyOperation(t *testing.T) {
+	op, err := replaceKeyOperation(&vcsec.ReplaceKey{
+		KeyToReplace: &vcsec.ReplaceKey_SlotToReplace{SlotToReplace: 4},
+	}, testPublicKey(), keys.Role_ROLE_GUEST)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replace := op.GetReplaceKey()
+	if replace.GetSlotToReplace() != 4 || replace.GetKeyRole() != keys.Role_ROLE_GUEST {
+		t.Errorf("Unexpected operation: %v", op)
+	}
+	if string(replace.GetKeyToAdd().GetPublicKeyRaw()) != string(testPublicKey().Bytes()) {
+		t.Errorf("Wrong public key in operation: %v", op)
+	}
+}
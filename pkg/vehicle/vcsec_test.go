@@ -12,6 +12,7 @@ import (
 	"github.com/teslamotors/vehicle-command/pkg/protocol"
 
 	verror "github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/errors"
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/keys"
 	universal "github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/universalmessage"
 	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/vcsec"
 )
@@ -108,6 +109,12 @@ func TestNominalVSCECError(t *testing.T) {
 
 	checkNominalError(t, vehicle.AddKey(ctx, testPublicKey(), true, 0), errCode)
 	checkNominalError(t, vehicle.RemoveKey(ctx, testPublicKey()), errCode)
+	checkNominalError(t, vehicle.ReplaceKey(ctx, testPublicKey(), testPublicKey(), keys.Role_ROLE_DRIVER, 0), errCode)
+	checkNominalError(t, vehicle.ReplaceKeyInSlot(ctx, 3, testPublicKey(), keys.Role_ROLE_DRIVER, 0), errCode)
+	checkNominalError(t, vehicle.UpdateKeyRole(ctx, testPublicKey(), keys.Role_ROLE_DRIVER), errCode)
+	checkNominalError(t, vehicle.AddImpermanentKey(ctx, testPublicKey(), keys.Role_ROLE_DRIVER, 0, time.Hour), errCode)
+	checkNominalError(t, vehicle.AddImpermanentKeyAndRemoveExisting(ctx, testPublicKey(), keys.Role_ROLE_DRIVER, 0, time.Hour), errCode)
+	checkNominalError(t, vehicle.RemoveAllImpermanentKeys(ctx), errCode)
 	checkNominalError(t, vehicle.Lock(ctx), errCode)
 }
 
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/ecdh"
 	"errors"
+	"log/slog"
 	"time"
 
 	"google.golang.org/protobuf/proto"
@@ -13,7 +14,9 @@ import (
 	"github.com/teslamotors/vehicle-command/pkg/cache"
 	"github.com/teslamotors/vehicle-command/pkg/connector"
 	"github.com/teslamotors/vehicle-command/pkg/protocol"
+	"github.com/teslamotors/vehicle-command/pkg/trace"
 
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/keys"
 	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/signatures"
 	universal "github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/universalmessage"
 )
@@ -29,6 +32,10 @@ var (
 	// ErrVehicleStateUnknown indicates the client attempt to determine if a vehicle supported a
 	// feature before calling vehicle.GetState.
 	ErrVehicleStateUnknown = errors.New("could not determine vehicle state")
+
+	// ErrInvalidKeyLifetime indicates the client provided a negative or excessively long lifetime
+	// for an impermanent key.
+	ErrInvalidKeyLifetime = errors.New("invalid key lifetime")
 )
 
 // sender provides an interface that handles the RoutableMessage protocol layer.
@@ -71,6 +78,14 @@ type Vehicle struct {
 	authMethod connector.AuthMethod
 
 	keyAvailable bool
+	publicKey    []byte // Public key corresponding to the private key, if any
+
+	roleChecks bool      // See SetRoleChecks
+	keyRole    keys.Role // Role of publicKey, or ROLE_NONE if it hasn't been looked up
+
+	// Settings applied to the dispatcher, which are retained in case it's replaced.
+	logger     *slog.Logger
+	maxLatency time.Duration
 }
 
 // NewVehicle creates a new Vehicle. The privateKey and sessionCache may be nil.
@@ -88,6 +103,9 @@ func NewVehicle(conn connector.Connector, privateKey authentication.ECDHPrivateK
 		authMethod:   conn.PreferredAuthMethod(),
 		keyAvailable: privateKey != nil,
 	}
+	if privateKey != nil {
+		vehicle.publicKey = privateKey.PublicBytes()
+	}
 	if sessionCache != nil {
 		if sessions, ok := sessionCache.GetEntry(vin); ok {
 			if err := dispatch.LoadCache(sessions); err != nil {
@@ -98,9 +116,30 @@ func NewVehicle(conn connector.Connector, privateKey authentication.ECDHPrivateK
 	return vehicle, nil
 }
 
+// loggerSetter is implemented by components that accept an injected logger.
+type loggerSetter interface {
+	SetLogger(logger *slog.Logger)
+}
+
+// SetLogger directs log messages about v to logger. The logger is also passed to v's connector, if
+// the connector has a SetLogger method. Log records are tagged with the VIN and, where applicable,
+// the vehicle domain and request UUID. Tokens, PINs, and other secrets are redacted.
+//
+// If logger is nil, messages are written to the global logger. Must be called before Connect.
+func (v *Vehicle) SetLogger(logger *slog.Logger) {
+	v.logger = logger
+	if d, ok := v.dispatcher.(loggerSetter); ok {
+		d.SetLogger(logger)
+	}
+	if c, ok := v.conn.(loggerSetter); ok {
+		c.SetLogger(logger)
+	}
+}
+
 // SetMaxLatency sets the threshold used by the client to discard clock-synchronization messages
 // from the vehicle that take too long to arrive.
 func (v *Vehicle) SetMaxLatency(latency time.Duration) {
+	v.maxLatency = latency
 	v.dispatcher.SetMaxLatency(latency)
 }
 
@@ -179,6 +218,9 @@ func (v *Vehicle) Disconnect() {
 }
 
 func (v *Vehicle) getReceiver(ctx context.Context, domain universal.Domain, payload []byte, auth connector.AuthMethod) (protocol.Receiver, error) {
+	if err := v.checkPermission(ctx, domain, payload, auth); err != nil {
+		return nil, err
+	}
 	message := universal.RoutableMessage{
 		ToDestination: &universal.Destination{
 			SubDestination: &universal.Destination_Domain{
@@ -233,11 +275,20 @@ func (v *Vehicle) SendMessage(ctx context.Context, message *universal.RoutableMe
 //
 // The domain controls what vehicle subsystem receives the message, and auth controls how the
 // message is authenticated (if it all).
-func (v *Vehicle) Send(ctx context.Context, domain universal.Domain, payload []byte, auth connector.AuthMethod) ([]byte, error) {
+func (v *Vehicle) Send(ctx context.Context, domain universal.Domain, payload []byte, auth connector.AuthMethod) (response []byte, err error) {
+	ctx, span := trace.Start(ctx, "Vehicle.Send")
+	span.SetAttribute(trace.AttrVIN, v.vin)
+	span.SetAttribute(trace.AttrDomain, domain.String())
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
 	payloadCopy := make([]byte, len(payload))
 	copy(payloadCopy, payload)
-	for {
-		response, err := v.trySend(ctx, domain, payloadCopy, auth)
+	for retries := 0; ; retries++ {
+		span.SetAttribute(trace.AttrRetryCount, retries)
+		response, err = v.trySend(ctx, domain, payloadCopy, auth)
 
 		if err == nil {
 			return response, nil